@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/golang/glog"
+	influxClient "github.com/influxdata/influxdb1-client/v2"
+
+	"github.com/lorahome/server/db/influxdb"
+	"github.com/lorahome/server/transport"
+)
+
+const airtimeReportInterval = time.Minute
+
+// reportAirtime periodically writes duty cycle budget usage into InfluxDB
+func reportAirtime(ctx context.Context, reporter transport.AirtimeReporter, db *influxdb.InfluxDB) {
+	ticker := time.NewTicker(airtimeReportInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case now := <-ticker.C:
+			err := writeAirtime(db, reporter.Airtime(now), now)
+			if err != nil {
+				glog.Errorf("Unable to report airtime: %v", err)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func writeAirtime(db *influxdb.InfluxDB, budgets []transport.AirtimeBudget, now time.Time) error {
+	if len(budgets) == 0 {
+		return nil
+	}
+
+	batchPoints, err := influxClient.NewBatchPoints(influxClient.BatchPointsConfig{
+		Precision: "s",
+		Database:  db.DefaultDatabase,
+	})
+	if err != nil {
+		return err
+	}
+	for _, budget := range budgets {
+		point, err := influxClient.NewPoint(
+			"airtime",
+			map[string]string{
+				"gateway": budget.Gateway,
+				"band":    budget.Band,
+			},
+			influxdb.KV{
+				"used_ms":      budget.Used.Seconds() * 1000,
+				"remaining_ms": budget.Remaining.Seconds() * 1000,
+			},
+			now,
+		)
+		if err != nil {
+			return err
+		}
+		batchPoints.AddPoint(point)
+		glog.V(1).Infof("Airtime of %s (%s): used %v, remaining %v",
+			budget.Gateway, budget.Band, budget.Used, budget.Remaining)
+	}
+
+	return db.Write(batchPoints)
+}
@@ -0,0 +1,417 @@
+// Package alerts evaluates device readings against alert rules (thresholds,
+// rate of change, missing readings), publishes alert state to MQTT and
+// delivers notifications when alerts fire or resolve.
+package alerts
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+
+	"github.com/lorahome/server/config"
+	"github.com/lorahome/server/mqtt"
+	"github.com/lorahome/server/state"
+)
+
+// How often stale alerts are checked
+const staleInterval = 10 * time.Second
+
+// Notifications waiting for delivery, new ones are dropped when full
+const notificationsQueueSize = 64
+
+const (
+	StateFiring   = "firing"
+	StateResolved = "resolved"
+)
+
+// Rule defines alert condition for device (or all devices) quantity
+type Rule struct {
+	Name string
+	// Device name, empty for all devices reporting quantity
+	Device   string
+	Quantity string
+	// Thresholds
+	Above *float64
+	Below *float64
+	// Rate of change (absolute), units per hour
+	Rate *float64
+	// No readings for this long
+	Stale time.Duration
+	// Value has to move this far back to resolve alert
+	Hysteresis float64
+	// Notifiers to deliver notifications to, all if empty
+	Notify []string
+}
+
+// Alert is state of rule for particular device
+type Alert struct {
+	Rule     string    `json:"rule"`
+	Device   string    `json:"device"`
+	Quantity string    `json:"quantity"`
+	State    string    `json:"state"`
+	Value    float64   `json:"value"`
+	Message  string    `json:"message"`
+	Since    time.Time `json:"since"`
+
+	last state.Reading
+}
+
+type alertKey struct {
+	rule   string
+	device string
+}
+
+type notification struct {
+	notifier string
+	alert    Alert
+}
+
+// Manager evaluates alert rules on every reading of state store
+type Manager struct {
+	// MQTT topic for alert state, "{device}" and "{rule}" are replaced
+	StateTopic string
+	Notifiers  []*NotifierConfig
+	Rules      []*Rule
+
+	store         *state.Store
+	mqttClient    *mqtt.MqttClient
+	notifiers     map[string]Notifier
+	notifications chan notification
+	alerts        map[alertKey]*Alert
+	devices       []string
+	lock          sync.Mutex
+}
+
+func NewManager(cfg interface{}, store *state.Store, mqttClient *mqtt.MqttClient) (*Manager, error) {
+	m := &Manager{
+		StateTopic:    "lorahome/alerts/{device}/{rule}",
+		store:         store,
+		mqttClient:    mqttClient,
+		notifiers:     map[string]Notifier{},
+		notifications: make(chan notification, notificationsQueueSize),
+		alerts:        map[alertKey]*Alert{},
+	}
+	if cfg == nil {
+		// No alerts
+		return m, nil
+	}
+
+	// Map configuration into structure
+	err := config.Decode(cfg, m)
+	if err != nil {
+		return nil, err
+	}
+	for _, nc := range m.Notifiers {
+		notifier, err := newNotifier(nc)
+		if err != nil {
+			return nil, fmt.Errorf("notifier '%s': %v", nc.Name, err)
+		}
+		m.notifiers[nc.Name] = notifier
+	}
+	for i, rule := range m.Rules {
+		if rule.Name == "" {
+			rule.Name = fmt.Sprintf("alert%d", i+1)
+		}
+		err := m.validate(rule)
+		if err != nil {
+			return nil, fmt.Errorf("alert '%s': %v", rule.Name, err)
+		}
+	}
+
+	return m, nil
+}
+
+// Expect sets devices expected to report (e.g. all configured ones), so
+// stale rules of all devices fire for devices not reporting since start
+func (m *Manager) Expect(devices []string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.devices = devices
+}
+
+// Run evaluates alert rules until context canceled
+func (m *Manager) Run(ctx context.Context) error {
+	if len(m.Rules) == 0 {
+		glog.Info("No alert rules defined")
+		<-ctx.Done()
+		return nil
+	}
+	glog.Infof("Alerts started, %d rule(s)", len(m.Rules))
+
+	// Notifiers are slow (SMTP, HTTP), so deliver aside of evaluation
+	delivered := make(chan struct{})
+	go func() {
+		defer close(delivered)
+		m.deliverNotifications(ctx)
+	}()
+	defer func() { <-delivered }()
+
+	readings := m.store.Subscribe()
+	m.startStale(time.Now())
+	ticker := time.NewTicker(staleInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case reading := <-readings:
+			m.process(reading, time.Now())
+		case now := <-ticker.C:
+			m.checkStale(now)
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// Active returns all firing alerts
+func (m *Manager) Active() []Alert {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	res := []Alert{}
+	for _, alert := range m.alerts {
+		if alert.State == StateFiring {
+			res = append(res, *alert)
+		}
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].Since.Before(res[j].Since)
+	})
+
+	return res
+}
+
+func (m *Manager) validate(rule *Rule) error {
+	conditions := 0
+	for _, set := range []bool{rule.Above != nil, rule.Below != nil, rule.Rate != nil, rule.Stale != 0} {
+		if set {
+			conditions++
+		}
+	}
+	if conditions != 1 {
+		return errors.New("exactly one of above, below, rate or stale is required")
+	}
+	if rule.Quantity == "" && rule.Stale == 0 {
+		return errors.New("quantity is required")
+	}
+	for _, name := range rule.Notify {
+		if _, ok := m.notifiers[name]; !ok {
+			return fmt.Errorf("unknown notifier '%s'", name)
+		}
+	}
+
+	return nil
+}
+
+// process evaluates reading against all matching rules
+func (m *Manager) process(reading state.Reading, now time.Time) {
+	for _, rule := range m.Rules {
+		if rule.Device != "" && rule.Device != reading.Device {
+			continue
+		}
+		if rule.Quantity != "" && rule.Quantity != reading.Quantity {
+			continue
+		}
+
+		m.lock.Lock()
+		key := alertKey{rule.Name, reading.Device}
+		alert, ok := m.alerts[key]
+		if !ok {
+			alert = &Alert{
+				Rule:     rule.Name,
+				Device:   reading.Device,
+				Quantity: reading.Quantity,
+				State:    StateResolved,
+			}
+			m.alerts[key] = alert
+		}
+		previous := alert.last
+		alert.last = reading
+		alert.Value = reading.Value
+		m.lock.Unlock()
+
+		if rule.Stale != 0 {
+			// Any reading resolves stale alert
+			m.transition(rule, alert, false, now, "reporting again")
+			continue
+		}
+
+		value := reading.Value
+		var firing, resolved bool
+		var message string
+		switch {
+		case rule.Above != nil:
+			firing = value > *rule.Above
+			resolved = value <= *rule.Above-rule.Hysteresis
+			message = fmt.Sprintf("%s is %v, above %v", reading.Quantity, value, *rule.Above)
+		case rule.Below != nil:
+			firing = value < *rule.Below
+			resolved = value >= *rule.Below+rule.Hysteresis
+			message = fmt.Sprintf("%s is %v, below %v", reading.Quantity, value, *rule.Below)
+		case rule.Rate != nil:
+			if previous.Time.IsZero() || !reading.Time.After(previous.Time) {
+				continue
+			}
+			rate := (value - previous.Value) / reading.Time.Sub(previous.Time).Hours()
+			firing = math.Abs(rate) > *rule.Rate
+			resolved = math.Abs(rate) <= *rule.Rate-rule.Hysteresis
+			message = fmt.Sprintf("%s changes %.2f per hour, limit %v", reading.Quantity, rate, *rule.Rate)
+		}
+		switch {
+		case firing:
+			m.transition(rule, alert, true, now, message)
+		case resolved:
+			m.transition(rule, alert, false, now, fmt.Sprintf("%s is %v", reading.Quantity, value))
+		}
+	}
+}
+
+// startStale starts stale timers of devices, so devices not reporting
+// since start are detected too: last seen is the latest reading of state
+// store, start time for devices which have not reported yet
+func (m *Manager) startStale(now time.Time) {
+	latest := map[alertKey]state.Reading{}
+	for _, reading := range m.store.All() {
+		for _, rule := range m.Rules {
+			if rule.Stale == 0 || (rule.Device != "" && rule.Device != reading.Device) ||
+				(rule.Quantity != "" && rule.Quantity != reading.Quantity) {
+				continue
+			}
+			key := alertKey{rule.Name, reading.Device}
+			if last, ok := latest[key]; !ok || reading.Time.After(last.Time) {
+				latest[key] = reading
+			}
+		}
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	for _, rule := range m.Rules {
+		if rule.Stale == 0 {
+			continue
+		}
+		devices := m.devices
+		if rule.Device != "" {
+			devices = []string{rule.Device}
+		}
+		for _, device := range devices {
+			key := alertKey{rule.Name, device}
+			if _, ok := latest[key]; !ok {
+				latest[key] = state.Reading{Device: device, Quantity: rule.Quantity, Time: now}
+			}
+		}
+	}
+	for key, last := range latest {
+		if _, ok := m.alerts[key]; ok {
+			continue
+		}
+		m.alerts[key] = &Alert{
+			Rule:     key.rule,
+			Device:   key.device,
+			Quantity: last.Quantity,
+			State:    StateResolved,
+			Value:    last.Value,
+			last:     last,
+		}
+	}
+}
+
+// checkStale fires alerts of devices not reporting for too long
+func (m *Manager) checkStale(now time.Time) {
+	m.lock.Lock()
+	stale := []*Alert{}
+	rules := []*Rule{}
+	for _, rule := range m.Rules {
+		if rule.Stale == 0 {
+			continue
+		}
+		for key, alert := range m.alerts {
+			if key.rule == rule.Name && alert.State != StateFiring && now.Sub(alert.last.Time) > rule.Stale {
+				stale = append(stale, alert)
+				rules = append(rules, rule)
+			}
+		}
+	}
+	m.lock.Unlock()
+
+	for i, alert := range stale {
+		message := fmt.Sprintf("no readings since %s", alert.last.Time.Format(time.RFC3339))
+		m.transition(rules[i], alert, true, now, message)
+	}
+}
+
+// transition changes alert state, publishes and notifies about change
+func (m *Manager) transition(rule *Rule, alert *Alert, firing bool, now time.Time, message string) {
+	newState := StateResolved
+	if firing {
+		newState = StateFiring
+	}
+	m.lock.Lock()
+	if alert.State == newState {
+		m.lock.Unlock()
+		return
+	}
+	alert.State = newState
+	alert.Message = message
+	alert.Since = now
+	snapshot := *alert
+	m.lock.Unlock()
+
+	glog.Infof("Alert '%s' of %s %s: %s", rule.Name, alert.Device, newState, message)
+	m.publish(&snapshot)
+	m.notify(rule, &snapshot)
+}
+
+func (m *Manager) publish(alert *Alert) {
+	if m.StateTopic == "" || m.mqttClient == nil {
+		return
+	}
+	topic := strings.NewReplacer("{device}", alert.Device, "{rule}", alert.Rule).Replace(m.StateTopic)
+	payload, _ := json.Marshal(alert)
+	err := m.mqttClient.PublishRetain(topic, string(payload))
+	if err != nil {
+		glog.Errorf("MQTT Publish failed: %v", err)
+	}
+}
+
+func (m *Manager) notify(rule *Rule, alert *Alert) {
+	names := rule.Notify
+	if len(names) == 0 {
+		for name := range m.notifiers {
+			names = append(names, name)
+		}
+	}
+	for _, name := range names {
+		select {
+		case m.notifications <- notification{notifier: name, alert: *alert}:
+		default:
+			glog.Errorf("Notifier '%s' queue is full, notification dropped: %s", name, alert.Message)
+		}
+	}
+}
+
+// deliverNotifications delivers queued notifications until context canceled
+func (m *Manager) deliverNotifications(ctx context.Context) {
+	for {
+		select {
+		case n := <-m.notifications:
+			m.deliver(n)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (m *Manager) deliver(n notification) {
+	err := m.notifiers[n.notifier].Notify(&n.alert)
+	if err != nil {
+		glog.Errorf("Notifier '%s' failed: %v", n.notifier, err)
+	}
+}
@@ -0,0 +1,312 @@
+package alerts
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v2"
+
+	"github.com/lorahome/server/mqtt"
+	"github.com/lorahome/server/state"
+)
+
+type notifierMock struct {
+	manager *Manager
+	alerts  []Alert
+}
+
+func (n *notifierMock) Notify(alert *Alert) error {
+	n.alerts = append(n.alerts, *alert)
+	return nil
+}
+
+// states delivers queued notifications, returns states of all notified alerts
+func (n *notifierMock) states() []string {
+	for len(n.manager.notifications) > 0 {
+		n.manager.deliver(<-n.manager.notifications)
+	}
+	res := []string{}
+	for _, alert := range n.alerts {
+		res = append(res, alert.Device+" "+alert.State)
+	}
+	return res
+}
+
+func newTestManager(t *testing.T, alertsYaml string) (*Manager, *notifierMock) {
+	cfg := map[string]interface{}{}
+	require.NoError(t, yaml.Unmarshal([]byte(alertsYaml), &cfg))
+	mqttClient, err := mqtt.NewMqttClient(nil)
+	require.NoError(t, err)
+	m, err := NewManager(cfg, state.NewStore(), mqttClient)
+	require.NoError(t, err)
+	notifier := &notifierMock{manager: m}
+	m.notifiers["mock"] = notifier
+
+	return m, notifier
+}
+
+func reading(device, quantity string, value float64, ts time.Time) state.Reading {
+	return state.Reading{Device: device, Quantity: quantity, Value: value, Time: ts}
+}
+
+func TestAlertThresholdHysteresis(t *testing.T) {
+	m, notifier := newTestManager(t, `
+rules:
+- name: freezer warm
+  device: freezer
+  quantity: temperature
+  above: -12
+  hysteresis: 2
+`)
+	now := time.Now()
+	for _, value := range []float64{-18, -11, -10, -13, -11.5, -15, -14} {
+		m.process(reading("freezer", "temperature", value, now), now)
+		// Other devices / quantities are ignored
+		m.process(reading("fridge", "temperature", value, now), now)
+		m.process(reading("freezer", "humidity", value, now), now)
+	}
+	assert.Equal(t, []string{"freezer firing", "freezer resolved"}, notifier.states())
+	assert.Equal(t, -15.0, notifier.alerts[1].Value)
+	assert.Equal(t, "temperature is -11, above -12", notifier.alerts[0].Message)
+	assert.Empty(t, m.Active())
+
+	m.process(reading("freezer", "temperature", -5, now), now)
+	active := m.Active()
+	require.Len(t, active, 1)
+	assert.Equal(t, "freezer warm", active[0].Rule)
+}
+
+func TestAlertBelowAllDevices(t *testing.T) {
+	m, notifier := newTestManager(t, `
+rules:
+- quantity: battery_voltage
+  below: 2.4
+  hysteresis: 0.2
+`)
+	now := time.Now()
+	m.process(reading("hallway", "battery_voltage", 2.3, now), now)
+	m.process(reading("kitchen", "battery_voltage", 2.5, now), now)
+	m.process(reading("hallway", "battery_voltage", 2.5, now), now)
+	m.process(reading("hallway", "battery_voltage", 2.7, now), now)
+	assert.Equal(t, []string{"hallway firing", "hallway resolved"}, notifier.states())
+	assert.Equal(t, "alert1", notifier.alerts[0].Rule)
+}
+
+func TestAlertRate(t *testing.T) {
+	m, notifier := newTestManager(t, `
+rules:
+- name: jump
+  quantity: temperature
+  rate: 10
+  hysteresis: 2
+`)
+	now := time.Now()
+	m.process(reading("room", "temperature", 20, now), now)
+	// +2 in 6 minutes is 20 per hour
+	now = now.Add(6 * time.Minute)
+	m.process(reading("room", "temperature", 22, now), now)
+	// 0.5 in 6 minutes is 5 per hour
+	now = now.Add(6 * time.Minute)
+	m.process(reading("room", "temperature", 22.5, now), now)
+	assert.Equal(t, []string{"room firing", "room resolved"}, notifier.states())
+}
+
+func TestAlertStale(t *testing.T) {
+	m, notifier := newTestManager(t, `
+rules:
+- name: silent
+  device: hallway
+  stale: 1h
+`)
+	now := time.Now()
+	m.process(reading("hallway", "temperature", 20, now), now)
+	m.checkStale(now.Add(30 * time.Minute))
+	assert.Empty(t, notifier.states())
+	m.checkStale(now.Add(61 * time.Minute))
+	m.checkStale(now.Add(62 * time.Minute))
+	assert.Equal(t, []string{"hallway firing"}, notifier.states())
+
+	now = now.Add(63 * time.Minute)
+	m.process(reading("hallway", "humidity", 40, now), now)
+	assert.Equal(t, []string{"hallway firing", "hallway resolved"}, notifier.states())
+}
+
+func TestAlertStaleSinceStart(t *testing.T) {
+	m, notifier := newTestManager(t, `
+rules:
+- name: silent
+  device: hallway
+  stale: 1h
+- name: any
+  quantity: temperature
+  stale: 1h
+`)
+	now := time.Now()
+	// Reported before start, but neither since
+	m.store.Update(reading("kitchen", "temperature", 20, now.Add(-50*time.Minute)))
+	m.Expect([]string{"kitchen", "garage"})
+	m.startStale(now)
+	m.checkStale(now.Add(30 * time.Minute))
+	assert.Equal(t, []string{"kitchen firing"}, notifier.states())
+	m.checkStale(now.Add(61 * time.Minute))
+	assert.ElementsMatch(t, []string{"kitchen firing", "hallway firing", "garage firing"}, notifier.states())
+}
+
+func TestAlertConfigErrors(t *testing.T) {
+	for _, alertsYaml := range []string{
+		"rules: [{quantity: temperature}]",
+		"rules: [{quantity: temperature, above: 1, below: 0}]",
+		"rules: [{above: 1}]",
+		"rules: [{quantity: temperature, above: 1, notify: [missing]}]",
+		"notifiers: [{name: x}]",
+		"notifiers: [{webhook: {url: http://localhost}}]",
+		"notifiers: [{name: x, smtp: {addr: localhost:25}}]",
+	} {
+		cfg := map[string]interface{}{}
+		require.NoError(t, yaml.Unmarshal([]byte(alertsYaml), &cfg))
+		_, err := NewManager(cfg, state.NewStore(), nil)
+		assert.Error(t, err, alertsYaml)
+	}
+}
+
+func TestHttpNotifiers(t *testing.T) {
+	requests := make(chan *http.Request, 2)
+	bodies := make(chan string, 2)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/missing" {
+			http.NotFound(w, r)
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		requests <- r
+		bodies <- string(body)
+	}))
+	defer srv.Close()
+
+	alert := &Alert{Rule: "freezer warm", Device: "freezer", State: StateFiring, Message: "too warm"}
+
+	webhook := &WebhookNotifier{Url: srv.URL + "/hook", Headers: map[string]string{"X-Key": "k"}}
+	require.NoError(t, webhook.Notify(alert))
+	r := <-requests
+	assert.Equal(t, "/hook", r.URL.Path)
+	assert.Equal(t, "k", r.Header.Get("X-Key"))
+	decoded := &Alert{}
+	require.NoError(t, json.Unmarshal([]byte(<-bodies), decoded))
+	assert.Equal(t, "freezer", decoded.Device)
+
+	ntfy := &NtfyNotifier{Url: srv.URL + "/topic", Priority: "high", Token: "secret"}
+	require.NoError(t, ntfy.init())
+	require.NoError(t, ntfy.Notify(alert))
+	r = <-requests
+	assert.Equal(t, "[FIRING] freezer: freezer warm", r.Header.Get("Title"))
+	assert.Equal(t, "high", r.Header.Get("Priority"))
+	assert.Equal(t, "Bearer secret", r.Header.Get("Authorization"))
+	assert.Equal(t, "freezer: too warm", <-bodies)
+
+	failing := &WebhookNotifier{Url: srv.URL + "/missing"}
+	assert.Error(t, failing.Notify(alert))
+}
+
+// fakeSmtp accepts one message and returns its data
+func fakeSmtp(t *testing.T) (string, chan string) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	data := make(chan string, 1)
+	go func() {
+		defer l.Close()
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		reader := bufio.NewReader(conn)
+		conn.Write([]byte("220 localhost\r\n"))
+		for {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				return
+			}
+			switch cmd := strings.ToUpper(strings.TrimSpace(line)); {
+			case cmd == "DATA":
+				conn.Write([]byte("354 go ahead\r\n"))
+				msg := ""
+				for {
+					line, _ = reader.ReadString('\n')
+					if line == ".\r\n" || line == "" {
+						break
+					}
+					msg += line
+				}
+				data <- msg
+				conn.Write([]byte("250 ok\r\n"))
+			case cmd == "QUIT":
+				conn.Write([]byte("221 bye\r\n"))
+				return
+			default:
+				conn.Write([]byte("250 ok\r\n"))
+			}
+		}
+	}()
+
+	return l.Addr().String(), data
+}
+
+func TestSmtpNotifier(t *testing.T) {
+	addr, data := fakeSmtp(t)
+	notifier := &SmtpNotifier{Addr: addr, From: "lorahome@localhost", To: []string{"admin@localhost"}}
+	require.NoError(t, notifier.init())
+
+	alert := &Alert{Rule: "battery low", Device: "hallway", State: StateResolved, Message: "battery_voltage is 2.7"}
+	require.NoError(t, notifier.Notify(alert))
+	msg := <-data
+	assert.Contains(t, msg, "Subject: [RESOLVED] hallway: battery low\r\n")
+	assert.Contains(t, msg, "hallway: battery_voltage is 2.7")
+}
+
+func TestAlertNotificationsAsync(t *testing.T) {
+	m, err := NewManager(map[string]interface{}{
+		"rules": []interface{}{map[string]interface{}{"quantity": "temperature", "above": 30}},
+	}, state.NewStore(), nil)
+	require.NoError(t, err)
+	notifier := &blockingNotifier{release: make(chan struct{}), notified: make(chan *Alert, 1)}
+	m.notifiers["slow"] = notifier
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go m.Run(ctx)
+
+	// Evaluation goes on while notifier is busy
+	now := time.Now()
+	m.process(reading("attic", "temperature", 35, now), now)
+	m.process(reading("attic", "temperature", 20, now), now)
+	assert.Empty(t, m.Active())
+	close(notifier.release)
+	for _, expected := range []string{StateFiring, StateResolved} {
+		select {
+		case alert := <-notifier.notified:
+			assert.Equal(t, expected, alert.State)
+		case <-time.After(5 * time.Second):
+			t.Fatal("no notification delivered")
+		}
+	}
+}
+
+type blockingNotifier struct {
+	release  chan struct{}
+	notified chan *Alert
+}
+
+func (n *blockingNotifier) Notify(alert *Alert) error {
+	<-n.release
+	n.notified <- alert
+	return nil
+}
@@ -0,0 +1,20 @@
+package alerts
+
+import (
+	"net/http"
+
+	"github.com/lorahome/server/api"
+)
+
+// Handler serves alerts API:
+//
+//	GET /api/alerts - list firing alerts
+func (m *Manager) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		api.WriteJSON(w, http.StatusOK, m.Active())
+	})
+}
@@ -0,0 +1,163 @@
+package alerts
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/smtp"
+	"strings"
+	"time"
+
+	"github.com/lorahome/server/secrets"
+)
+
+// Notifier delivers alert state change notification
+type Notifier interface {
+	Notify(alert *Alert) error
+}
+
+// NotifierConfig defines one notifier, exactly one kind must be set
+type NotifierConfig struct {
+	Name    string
+	Webhook *WebhookNotifier
+	Smtp    *SmtpNotifier
+	Ntfy    *NtfyNotifier
+}
+
+func newNotifier(cfg *NotifierConfig) (Notifier, error) {
+	if cfg.Name == "" {
+		return nil, errors.New("name is required")
+	}
+	switch {
+	case cfg.Webhook != nil:
+		if cfg.Webhook.Url == "" {
+			return nil, errors.New("webhook url is required")
+		}
+		return cfg.Webhook, nil
+	case cfg.Smtp != nil:
+		return cfg.Smtp, cfg.Smtp.init()
+	case cfg.Ntfy != nil:
+		return cfg.Ntfy, cfg.Ntfy.init()
+	}
+
+	return nil, errors.New("one of webhook, smtp or ntfy is required")
+}
+
+var httpClient = &http.Client{Timeout: 10 * time.Second}
+
+func subject(alert *Alert) string {
+	return fmt.Sprintf("[%s] %s: %s", strings.ToUpper(alert.State), alert.Device, alert.Rule)
+}
+
+// WebhookNotifier posts alert as JSON
+type WebhookNotifier struct {
+	Url     string
+	Headers map[string]string
+}
+
+func (w *WebhookNotifier) Notify(alert *Alert) error {
+	body, _ := json.Marshal(alert)
+	req, err := http.NewRequest(http.MethodPost, w.Url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for name, value := range w.Headers {
+		req.Header.Set(name, value)
+	}
+
+	return do(req)
+}
+
+// SmtpNotifier sends mail, intended for local relay
+type SmtpNotifier struct {
+	// host:port
+	Addr string
+	From string
+	To   []string
+	// Optional authentication, password may be secret reference
+	User     string
+	Password string
+
+	auth smtp.Auth
+}
+
+func (s *SmtpNotifier) init() error {
+	if s.Addr == "" || s.From == "" || len(s.To) == 0 {
+		return errors.New("smtp addr, from and to are required")
+	}
+	if s.User != "" {
+		password, err := secrets.Resolve(s.Password)
+		if err != nil {
+			return err
+		}
+		host := strings.Split(s.Addr, ":")[0]
+		s.auth = smtp.PlainAuth("", s.User, password, host)
+	}
+
+	return nil
+}
+
+func (s *SmtpNotifier) Notify(alert *Alert) error {
+	msg := fmt.Sprintf("From: %s\r\nTo: %s\r\nSubject: %s\r\n\r\n%s: %s\r\n",
+		s.From, strings.Join(s.To, ", "), subject(alert), alert.Device, alert.Message)
+
+	return smtp.SendMail(s.Addr, s.auth, s.From, s.To, []byte(msg))
+}
+
+// NtfyNotifier publishes plain text message to ntfy style topic URL
+type NtfyNotifier struct {
+	Url string
+	// Priority of firing alerts (e.g. "high"), resolved ones use default
+	Priority string
+	// Optional access token, may be secret reference
+	Token string
+
+	token string
+}
+
+func (n *NtfyNotifier) init() error {
+	if n.Url == "" {
+		return errors.New("ntfy url is required")
+	}
+	var err error
+	n.token, err = secrets.Resolve(n.Token)
+
+	return err
+}
+
+func (n *NtfyNotifier) Notify(alert *Alert) error {
+	req, err := http.NewRequest(http.MethodPost, n.Url, strings.NewReader(alert.Device+": "+alert.Message))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Title", subject(alert))
+	if alert.State == StateFiring {
+		req.Header.Set("Tags", "warning")
+		if n.Priority != "" {
+			req.Header.Set("Priority", n.Priority)
+		}
+	} else {
+		req.Header.Set("Tags", "white_check_mark")
+	}
+	if n.token != "" {
+		req.Header.Set("Authorization", "Bearer "+n.token)
+	}
+
+	return do(req)
+}
+
+func do(req *http.Request) error {
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("%s: %s", req.URL, resp.Status)
+	}
+
+	return nil
+}
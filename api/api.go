@@ -0,0 +1,210 @@
+// Package api is HTTP server of REST API (and UI), features register
+// their handlers on it.
+package api
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/mitchellh/mapstructure"
+
+	"github.com/lorahome/server/secrets"
+)
+
+// Content types browsers send cross-site without preflight request
+var simpleContentTypes = map[string]bool{
+	"application/x-www-form-urlencoded": true,
+	"multipart/form-data":               true,
+	"text/plain":                        true,
+}
+
+type Server struct {
+	Listen string
+	// Origins (e.g. https://home.example.com) allowed to use API from
+	// browser, besides origin of API itself
+	AllowedOrigins []string
+	// Optional: HTTP basic authentication of all requests (API and UI).
+	// Password may be secret reference, e.g. keystore:api
+	Username string
+	Password string
+
+	enabled  bool
+	mux      *http.ServeMux
+	listener net.Listener
+	ready    chan struct{}
+}
+
+func NewServer(cfg interface{}) (*Server, error) {
+	s := &Server{
+		mux:   http.NewServeMux(),
+		ready: make(chan struct{}),
+	}
+	if cfg == nil {
+		// Bypass mode - API disabled
+		return s, nil
+	}
+
+	// Map configuration into structure
+	err := mapstructure.Decode(cfg, s)
+	if err != nil {
+		return nil, err
+	}
+	s.Password, err = secrets.Resolve(s.Password)
+	if err != nil {
+		return nil, err
+	}
+	if (s.Username == "") != (s.Password == "") {
+		return nil, errors.New("both api.username and api.password are required for authentication")
+	}
+	s.enabled = s.Listen != ""
+
+	return s, nil
+}
+
+// Handle registers handler for pattern (see http.ServeMux),
+// requests changing state are checked by protect
+func (s *Server) Handle(pattern string, handler http.Handler) {
+	s.mux.Handle(pattern, s.protect(handler))
+}
+
+// Run serves HTTP requests until context canceled
+func (s *Server) Run(ctx context.Context) error {
+	if !s.enabled {
+		glog.Info("API is not enabled")
+		close(s.ready)
+		<-ctx.Done()
+		return nil
+	}
+
+	var err error
+	s.listener, err = net.Listen("tcp", s.Listen)
+	if err != nil {
+		return err
+	}
+	server := &http.Server{
+		Handler: s.authenticate(s.mux),
+		// Long running requests (event streams) end with server
+		BaseContext: func(net.Listener) context.Context {
+			return ctx
+		},
+	}
+	glog.Infof("API server started at %s", s.listener.Addr())
+	close(s.ready)
+	go server.Serve(s.listener)
+
+	// Wait until context canceled, let running requests finish
+	<-ctx.Done()
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	return server.Shutdown(shutdownCtx)
+}
+
+// Ready is closed once server accepts connections
+func (s *Server) Ready() <-chan struct{} {
+	return s.ready
+}
+
+// Addr returns address server listens on, nil until ready
+func (s *Server) Addr() net.Addr {
+	if s.listener == nil {
+		return nil
+	}
+	return s.listener.Addr()
+}
+
+// CheckOrigin reports whether request is allowed by its origin: requests of
+// non browser clients (no Origin header), same origin requests and requests
+// from AllowedOrigins are
+func (s *Server) CheckOrigin(r *http.Request) bool {
+	return CheckOrigin(r, s.AllowedOrigins)
+}
+
+// CheckOrigin is origin check of Server, for other HTTP listeners
+// (e.g. WebSocket of MQTT broker)
+func CheckOrigin(r *http.Request, allowedOrigins []string) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+	if strings.EqualFold(u.Host, r.Host) {
+		return true
+	}
+	for _, allowed := range allowedOrigins {
+		if strings.EqualFold(strings.TrimSuffix(allowed, "/"), origin) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// protect rejects cross-site requests changing state (methods other than
+// GET / HEAD): origin must be allowed, POST requests must have content type
+// which makes browser check origin with preflight request first
+func (s *Server) protect(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet || r.Method == http.MethodHead {
+			handler.ServeHTTP(w, r)
+			return
+		}
+		if !s.CheckOrigin(r) {
+			WriteError(w, http.StatusForbidden, errors.New("origin is not allowed"))
+			return
+		}
+		if r.Method == http.MethodPost {
+			contentType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+			if contentType == "" || simpleContentTypes[contentType] {
+				WriteError(w, http.StatusUnsupportedMediaType, errors.New("content type application/json is required"))
+				return
+			}
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// authenticate requires HTTP basic authentication, when configured
+func (s *Server) authenticate(handler http.Handler) http.Handler {
+	if s.Username == "" {
+		return handler
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		username, password, ok := r.BasicAuth()
+		if !ok ||
+			subtle.ConstantTimeCompare([]byte(username), []byte(s.Username)) != 1 ||
+			subtle.ConstantTimeCompare([]byte(password), []byte(s.Password)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Basic realm="LoRa Home", charset="UTF-8"`)
+			WriteError(w, http.StatusUnauthorized, errors.New("authentication required"))
+			return
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// WriteJSON writes value as JSON response
+func WriteJSON(w http.ResponseWriter, status int, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	err := json.NewEncoder(w).Encode(value)
+	if err != nil {
+		glog.Errorf("API response failed: %v", err)
+	}
+}
+
+// WriteError writes error as JSON response
+func WriteError(w http.ResponseWriter, status int, err error) {
+	WriteJSON(w, status, map[string]string{"error": err.Error()})
+}
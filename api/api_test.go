@@ -0,0 +1,93 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProtect(t *testing.T) {
+	s, err := NewServer(map[string]interface{}{"allowedOrigins": []string{"https://home.example.com"}})
+	require.NoError(t, err)
+	handler := s.protect(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+
+	for _, tc := range []struct {
+		method      string
+		origin      string
+		contentType string
+		status      int
+	}{
+		{http.MethodGet, "https://evil.example.com", "", http.StatusNoContent},
+		{http.MethodPost, "", "application/json", http.StatusNoContent},
+		{http.MethodPost, "http://lorahome:8080", "application/json; charset=utf-8", http.StatusNoContent},
+		{http.MethodPost, "https://home.example.com", "application/json", http.StatusNoContent},
+		{http.MethodPost, "https://evil.example.com", "application/json", http.StatusForbidden},
+		{http.MethodPost, "", "text/plain", http.StatusUnsupportedMediaType},
+		{http.MethodPost, "", "application/x-www-form-urlencoded", http.StatusUnsupportedMediaType},
+		{http.MethodPost, "", "", http.StatusUnsupportedMediaType},
+		{http.MethodDelete, "", "", http.StatusNoContent},
+		{http.MethodDelete, "https://evil.example.com", "", http.StatusForbidden},
+	} {
+		r := httptest.NewRequest(tc.method, "http://lorahome:8080/api/test", strings.NewReader("{}"))
+		if tc.origin != "" {
+			r.Header.Set("Origin", tc.origin)
+		}
+		if tc.contentType != "" {
+			r.Header.Set("Content-Type", tc.contentType)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		assert.Equal(t, tc.status, w.Code, "%+v", tc)
+	}
+}
+
+func TestAuthentication(t *testing.T) {
+	// Both username and password are required
+	_, err := NewServer(map[string]interface{}{"username": "admin"})
+	assert.Error(t, err)
+
+	s, err := NewServer(map[string]interface{}{
+		"listen":   "127.0.0.1:0",
+		"username": "admin",
+		"password": "secret",
+	})
+	require.NoError(t, err)
+	s.Handle("/api/test", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go s.Run(ctx)
+	<-s.Ready()
+	url := "http://" + s.Addr().String() + "/api/test"
+
+	for _, tc := range []struct {
+		username string
+		password string
+		status   int
+	}{
+		{"", "", http.StatusUnauthorized},
+		{"admin", "wrong", http.StatusUnauthorized},
+		{"admin", "secret", http.StatusNoContent},
+	} {
+		req, err := http.NewRequest(http.MethodGet, url, nil)
+		require.NoError(t, err)
+		if tc.username != "" {
+			req.SetBasicAuth(tc.username, tc.password)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+		assert.Equal(t, tc.status, resp.StatusCode, tc.username+":"+tc.password)
+		if tc.status == http.StatusUnauthorized {
+			assert.Contains(t, resp.Header.Get("WWW-Authenticate"), "Basic")
+		}
+	}
+}
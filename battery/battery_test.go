@@ -0,0 +1,177 @@
+package battery
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/mitchellh/mapstructure"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v2"
+
+	"github.com/lorahome/server/db/influxdb"
+	"github.com/lorahome/server/devices"
+	"github.com/lorahome/server/mqtt"
+	"github.com/lorahome/server/state"
+)
+
+const influxDeviceUrl = "testInfluxUrl"
+
+// influxDevice writes battery voltage into InfluxDB
+type influxDevice struct {
+	devices.MockDevice `mapstructure:",squash"`
+}
+
+func (d *influxDevice) InfluxSeries(quantity string) (string, string, string, bool) {
+	return "home", "battery_voltage", "voltage", quantity == state.BatteryVoltage
+}
+
+func init() {
+	devices.RegisterDeviceClass(influxDeviceUrl, "InfluxDevice", func(cfg interface{}, caps *devices.Capabilities) (devices.Device, error) {
+		dev := &influxDevice{}
+		err := mapstructure.Decode(cfg, dev)
+		return dev, err
+	})
+}
+
+func TestProfilePercent(t *testing.T) {
+	p := &Profile{Chemistry: "alkaline", Cells: 2}
+	require.NoError(t, p.init(nil))
+	assert.Equal(t, 100.0, p.Percent(3.3))
+	assert.Equal(t, 0.0, p.Percent(1.5))
+	assert.InDelta(t, 50.0, p.Percent(2.6), 0.001)
+	assert.InDelta(t, 12.5, p.Percent(2.2), 0.001)
+
+	custom := &Profile{Chemistry: "custom"}
+	require.NoError(t, custom.init(map[string][]Point{"custom": {{3, 100}, {2, 0}}}))
+	assert.Equal(t, 1, custom.Cells)
+	assert.InDelta(t, 25.0, custom.Percent(2.25), 0.001)
+
+	assert.Error(t, (&Profile{Chemistry: "unobtainium"}).init(nil))
+}
+
+func TestMonitorLevelAndEvents(t *testing.T) {
+	cfg := map[string]interface{}{}
+	require.NoError(t, yaml.Unmarshal([]byte(`
+classes:
+  MultiSensor: {chemistry: liion}
+devices:
+  garage: {chemistry: cr2032}
+thresholds: [10, 20]
+`), &cfg))
+	store := state.NewStore()
+	mqttClient, err := mqtt.NewMqttClient(nil)
+	require.NoError(t, err)
+	m, err := NewMonitor(cfg, store, mqttClient, nil)
+	require.NoError(t, err)
+	readings := store.Subscribe()
+	now := time.Now()
+	voltage := func(device, class string, v float64) state.Reading {
+		m.process(state.Reading{Device: device, Class: class, Quantity: state.BatteryVoltage, Value: v, Time: now})
+		return <-readings
+	}
+
+	level := voltage("hallway", "MultiSensor", 3.75)
+	assert.Equal(t, state.BatteryLevel, level.Quantity)
+	assert.Equal(t, 45.0, level.Value)
+	assert.Equal(t, 80.0, voltage("garage", "MultiSensor", 2.9).Value)
+	// No profile for class
+	m.process(state.Reading{Device: "strip", Class: "LedStrip", Quantity: state.BatteryVoltage, Value: 3})
+	assert.Len(t, m.List(), 2)
+
+	b := m.batteries["hallway"]
+	assert.Equal(t, []float64{}, b.checkThresholds(m.Thresholds))
+	b.status.Percent = 15
+	assert.Equal(t, []float64{20}, b.checkThresholds(m.Thresholds))
+	b.status.Percent = 14
+	assert.Equal(t, []float64{}, b.checkThresholds(m.Thresholds))
+	b.status.Percent = 5
+	assert.Equal(t, []float64{10}, b.checkThresholds(m.Thresholds))
+	// Battery replaced
+	b.status.Percent = 100
+	assert.Equal(t, []float64{}, b.checkThresholds(m.Thresholds))
+	b.status.Percent = 19
+	assert.Equal(t, []float64{20}, b.checkThresholds(m.Thresholds))
+}
+
+func TestEstimate(t *testing.T) {
+	b := &deviceBattery{}
+	start := time.Now()
+	keep := 30 * 24 * time.Hour
+
+	b.addSample(start, 90, keep)
+	b.addSample(start.Add(time.Minute), 89, keep)
+	assert.Len(t, b.history, 1)
+	assert.Nil(t, b.estimate())
+
+	// 1% a day
+	for day := 1; day <= 10; day++ {
+		b.addSample(start.Add(time.Duration(day)*24*time.Hour), 90-float64(day), keep)
+	}
+	b.status.Percent = 80
+	days := b.estimate()
+	require.NotNil(t, days)
+	assert.Equal(t, 80.0, *days)
+
+	// Recharged: history restarts
+	b.addSample(start.Add(11*24*time.Hour), 100, keep)
+	assert.Len(t, b.history, 1)
+
+	// Old samples dropped
+	b.addSample(start.Add(50*24*time.Hour), 99, keep)
+	assert.Len(t, b.history, 1)
+}
+
+func TestMonitorInfluxDb(t *testing.T) {
+	queries := make(chan string, 1)
+	writes := make(chan string, 1)
+	influx := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/ping":
+			w.WriteHeader(http.StatusNoContent)
+		case "/query":
+			w.Header().Set("Content-Type", "application/json")
+			queries <- r.FormValue("db") + ": " + r.FormValue("q")
+			fmt.Fprint(w, `{"results": [{"statement_id": 0, "series": [{"name": "battery_level", "columns": ["time", "percent", "voltage"],
+				"values": [["2020-01-01T10:00:00Z", 30, 3.7], ["2020-01-02T10:00:00Z", 25, 3.68], ["2020-01-03T10:00:00Z", 15, 3.6]]}]}]}`)
+		case "/write":
+			body, _ := ioutil.ReadAll(r.Body)
+			writes <- r.FormValue("db") + ": " + string(body)
+			w.WriteHeader(http.StatusNoContent)
+		}
+	}))
+	defer influx.Close()
+	db, err := influxdb.NewInfluxDB(map[string]interface{}{"addr": influx.URL})
+	require.NoError(t, err)
+	_, err = devices.RegisterDevice(influxDeviceUrl, map[string]interface{}{"id": 3, "name": "attic"}, nil)
+	require.NoError(t, err)
+	store := state.NewStore()
+	m, err := NewMonitor(map[string]interface{}{
+		"devices":    map[string]interface{}{"attic": map[string]interface{}{"chemistry": "liion"}},
+		"thresholds": []float64{10, 20},
+	}, store, nil, db)
+	require.NoError(t, err)
+
+	// State is restored from battery level written before restart
+	now := time.Date(2020, 1, 3, 12, 0, 0, 0, time.UTC)
+	m.rebuild(now)
+	assert.Contains(t, <-queries, `home: SELECT "percent", "voltage" FROM "battery_level" WHERE "device_id" = '3' AND time >= '2019-12-04T12:00:00Z'`)
+	list := m.List()
+	require.Len(t, list, 1)
+	assert.Equal(t, "attic", list[0].Device)
+	assert.Equal(t, 15.0, list[0].Percent)
+	assert.Equal(t, 3.6, list[0].Voltage)
+	require.NotNil(t, list[0].RemainingDays)
+	assert.Equal(t, 2.0, *list[0].RemainingDays)
+	// Low battery event was emitted before restart
+	assert.Equal(t, map[float64]bool{20: true}, m.batteries["attic"].crossed)
+	assert.Len(t, m.batteries["attic"].history, 3)
+
+	// Level is written next to voltage
+	m.process(state.Reading{DeviceId: 3, Device: "attic", Class: "InfluxDevice", Quantity: state.BatteryVoltage, Value: 3.75, Time: now})
+	assert.Equal(t, "home: battery_level,class_name=InfluxDevice,device_id=3,name=attic percent=45,voltage=3.75 1578052800\n", <-writes)
+}
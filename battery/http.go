@@ -0,0 +1,20 @@
+package battery
+
+import (
+	"net/http"
+
+	"github.com/lorahome/server/api"
+)
+
+// Handler serves battery API:
+//
+//	GET /api/battery - battery status of all devices
+func (m *Monitor) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		api.WriteJSON(w, http.StatusOK, m.List())
+	})
+}
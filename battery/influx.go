@@ -0,0 +1,150 @@
+package battery
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+	influxClient "github.com/influxdata/influxdb1-client/v2"
+
+	"github.com/lorahome/server/devices"
+	"github.com/lorahome/server/state"
+)
+
+// database returns InfluxDB database battery voltage of device is written into
+func (m *Monitor) database(device string) (string, bool) {
+	if m.influx == nil || !m.influx.Enabled() || m.Measurement == "" {
+		return "", false
+	}
+	source, ok := devices.GetDeviceByName(device).(devices.InfluxSeries)
+	if !ok {
+		return "", false
+	}
+	database, _, _, ok := source.InfluxSeries(state.BatteryVoltage)
+
+	return database, ok
+}
+
+// write writes battery level point next to battery voltage of device
+func (m *Monitor) write(reading state.Reading, percent float64) error {
+	database, ok := m.database(reading.Device)
+	if !ok {
+		return nil
+	}
+	batchPoints, err := influxClient.NewBatchPoints(influxClient.BatchPointsConfig{
+		Precision: "s",
+		Database:  database,
+	})
+	if err != nil {
+		return err
+	}
+	point, err := influxClient.NewPoint(
+		m.Measurement,
+		map[string]string{
+			"device_id":  fmt.Sprintf("%d", reading.DeviceId),
+			"class_name": reading.Class,
+			"name":       reading.Device,
+		},
+		map[string]interface{}{
+			"percent": percent,
+			"voltage": reading.Value,
+		},
+		reading.Time,
+	)
+	if err != nil {
+		return err
+	}
+	batchPoints.AddPoint(point)
+
+	return m.influx.Write(batchPoints)
+}
+
+// rebuild restores discharge history, status and crossed thresholds of
+// all devices from battery level points written before restart
+func (m *Monitor) rebuild(now time.Time) {
+	for _, device := range devices.GetAllDevices() {
+		profile := m.profile(device.GetName(), device.GetClassName())
+		if profile == nil {
+			continue
+		}
+		database, ok := m.database(device.GetName())
+		if !ok {
+			continue
+		}
+		battery, err := m.query(database, device.GetId(), profile, now)
+		if err != nil {
+			glog.Errorf("Unable to restore battery state of '%s': %v", device.GetName(), err)
+			continue
+		}
+		if battery == nil {
+			continue
+		}
+		battery.status.Device = device.GetName()
+		m.lock.Lock()
+		m.batteries[device.GetName()] = battery
+		m.lock.Unlock()
+	}
+}
+
+// query reads battery level points of device within history window,
+// nil if there are none
+func (m *Monitor) query(database string, id uint64, profile *Profile, now time.Time) (*deviceBattery, error) {
+	query := fmt.Sprintf(`SELECT "percent", "voltage" FROM "%s" WHERE "device_id" = '%d' AND time >= '%s' ORDER BY time ASC`,
+		strings.Replace(m.Measurement, `"`, `\"`, -1), id, now.Add(-m.History).UTC().Format(time.RFC3339Nano))
+	rows, err := m.influx.Query(database, query)
+	if err != nil {
+		return nil, err
+	}
+
+	var battery *deviceBattery
+	for _, row := range rows {
+		for _, values := range row.Values {
+			if len(values) < 3 || values[1] == nil || values[2] == nil {
+				continue
+			}
+			ts, err := time.Parse(time.RFC3339Nano, fmt.Sprint(values[0]))
+			if err != nil {
+				return nil, fmt.Errorf("unexpected time '%v': %v", values[0], err)
+			}
+			percent, err := toFloat(values[1])
+			if err != nil {
+				return nil, err
+			}
+			voltage, err := toFloat(values[2])
+			if err != nil {
+				return nil, err
+			}
+			if battery == nil {
+				battery = &deviceBattery{crossed: map[float64]bool{}}
+			}
+			battery.status = Status{
+				Chemistry: profile.Chemistry,
+				Voltage:   voltage,
+				Percent:   percent,
+				Time:      ts,
+			}
+			battery.addSample(ts, percent, m.History)
+		}
+	}
+	if battery == nil {
+		return nil, nil
+	}
+	battery.status.RemainingDays = battery.estimate()
+	// Events of thresholds level is already below were emitted before restart
+	battery.checkThresholds(m.Thresholds)
+
+	return battery, nil
+}
+
+func toFloat(value interface{}) (float64, error) {
+	switch v := value.(type) {
+	case json.Number:
+		return v.Float64()
+	case float64:
+		return v, nil
+	}
+
+	return 0, fmt.Errorf("unexpected value '%v'", value)
+}
@@ -0,0 +1,310 @@
+// Package battery converts battery voltage reported by devices into
+// remaining capacity (using chemistry discharge curves), estimates battery
+// life from discharge trend and emits low battery events.
+package battery
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+
+	"github.com/lorahome/server/config"
+	"github.com/lorahome/server/db/influxdb"
+	"github.com/lorahome/server/mqtt"
+	"github.com/lorahome/server/state"
+)
+
+const (
+	// At most one history sample per interval is kept
+	sampleInterval = 15 * time.Minute
+	// Low battery threshold re-arms once level is this far above it (battery replaced)
+	rearmMargin = 5
+)
+
+// Status is battery state of device
+type Status struct {
+	Device    string    `json:"device"`
+	Chemistry string    `json:"chemistry"`
+	Voltage   float64   `json:"voltage"`
+	Percent   float64   `json:"percent"`
+	Time      time.Time `json:"time"`
+	// Estimated from discharge trend, not available until enough history collected
+	RemainingDays *float64 `json:"remaining_days,omitempty"`
+}
+
+// Event is emitted once battery level drops below threshold
+type Event struct {
+	Device    string    `json:"device"`
+	Threshold float64   `json:"threshold"`
+	Percent   float64   `json:"percent"`
+	Voltage   float64   `json:"voltage"`
+	Time      time.Time `json:"time"`
+}
+
+type sample struct {
+	time    time.Time
+	percent float64
+}
+
+type deviceBattery struct {
+	status  Status
+	history []sample
+	// Thresholds already crossed (event emitted)
+	crossed map[float64]bool
+}
+
+// Monitor tracks battery of all devices with known battery profile
+type Monitor struct {
+	// Profiles by device class name and by device name (takes precedence)
+	Classes map[string]*Profile
+	Devices map[string]*Profile
+	// Custom chemistries (discharge curves), may override built-in ones
+	Chemistries map[string][]Point
+	// Low battery thresholds, percent
+	Thresholds []float64
+	// How long discharge history is kept for estimation
+	History time.Duration
+	// MQTT topics of battery level and low battery events, "{device}" is replaced.
+	// Level is published by device classes alongside voltage as well
+	// (e.g. MultiSensor state document), so its own topic is optional.
+	Topic      string
+	EventTopic string
+	// InfluxDB measurement of battery level, written into database of battery voltage.
+	// History and thresholds state is rebuilt from it on start.
+	Measurement string
+
+	store      *state.Store
+	mqttClient *mqtt.MqttClient
+	influx     *influxdb.InfluxDB
+	batteries  map[string]*deviceBattery
+	lock       sync.Mutex
+}
+
+func NewMonitor(cfg interface{}, store *state.Store, mqttClient *mqtt.MqttClient, influx *influxdb.InfluxDB) (*Monitor, error) {
+	m := &Monitor{
+		Thresholds:  []float64{20, 10},
+		History:     30 * 24 * time.Hour,
+		EventTopic:  "lorahome/events/battery/{device}",
+		Measurement: "battery_level",
+		store:       store,
+		mqttClient:  mqttClient,
+		influx:      influx,
+		batteries:   map[string]*deviceBattery{},
+	}
+	if cfg == nil {
+		// Battery monitoring disabled
+		return m, nil
+	}
+
+	// Map configuration into structure
+	err := config.Decode(cfg, m)
+	if err != nil {
+		return nil, err
+	}
+	for name, profile := range m.Classes {
+		if err := profile.init(m.Chemistries); err != nil {
+			return nil, fmt.Errorf("class '%s': %v", name, err)
+		}
+	}
+	for name, profile := range m.Devices {
+		if err := profile.init(m.Chemistries); err != nil {
+			return nil, fmt.Errorf("device '%s': %v", name, err)
+		}
+	}
+	// Emit the highest threshold first
+	sort.Sort(sort.Reverse(sort.Float64Slice(m.Thresholds)))
+
+	return m, nil
+}
+
+// Run tracks battery voltage readings until context canceled
+func (m *Monitor) Run(ctx context.Context) error {
+	if len(m.Classes) == 0 && len(m.Devices) == 0 {
+		glog.Info("No battery profiles defined")
+		<-ctx.Done()
+		return nil
+	}
+
+	readings := m.store.Subscribe()
+	m.rebuild(time.Now())
+	for {
+		select {
+		case reading := <-readings:
+			if reading.Quantity == state.BatteryVoltage {
+				m.process(reading)
+			}
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// List returns battery status of all devices, sorted by name
+func (m *Monitor) List() []Status {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	res := []Status{}
+	for _, battery := range m.batteries {
+		res = append(res, battery.status)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].Device < res[j].Device
+	})
+
+	return res
+}
+
+func (m *Monitor) profile(device, class string) *Profile {
+	if profile, ok := m.Devices[device]; ok {
+		return profile
+	}
+
+	return m.Classes[class]
+}
+
+// Level converts battery voltage of device into level, if battery profile
+// of device is known (devices.BatteryLevels)
+func (m *Monitor) Level(device, class string, voltage float64) (float64, bool) {
+	profile := m.profile(device, class)
+	if profile == nil {
+		return 0, false
+	}
+
+	return math.Round(profile.Percent(voltage)*10) / 10, true
+}
+
+// process converts battery voltage into level, updates history and checks thresholds
+func (m *Monitor) process(reading state.Reading) {
+	percent, ok := m.Level(reading.Device, reading.Class, reading.Value)
+	if !ok {
+		return
+	}
+	profile := m.profile(reading.Device, reading.Class)
+
+	m.lock.Lock()
+	battery, ok := m.batteries[reading.Device]
+	if !ok {
+		battery = &deviceBattery{crossed: map[float64]bool{}}
+		m.batteries[reading.Device] = battery
+	}
+	battery.status = Status{
+		Device:    reading.Device,
+		Chemistry: profile.Chemistry,
+		Voltage:   reading.Value,
+		Percent:   percent,
+		Time:      reading.Time,
+	}
+	battery.addSample(reading.Time, percent, m.History)
+	battery.status.RemainingDays = battery.estimate()
+	events := battery.checkThresholds(m.Thresholds)
+	m.lock.Unlock()
+
+	m.store.Update(state.Reading{
+		DeviceId: reading.DeviceId,
+		Device:   reading.Device,
+		Class:    reading.Class,
+		Quantity: state.BatteryLevel,
+		Value:    percent,
+		Time:     reading.Time,
+	})
+	m.publish(m.Topic, reading.Device, fmt.Sprintf("%.0f", percent), true)
+	err := m.write(reading, percent)
+	if err != nil {
+		glog.Errorf("Unable to write battery level of '%s': %v", reading.Device, err)
+	}
+
+	for _, threshold := range events {
+		event := &Event{
+			Device:    reading.Device,
+			Threshold: threshold,
+			Percent:   percent,
+			Voltage:   reading.Value,
+			Time:      reading.Time,
+		}
+		glog.Infof("Battery of '%s' is low: %v%% (below %v%%)", event.Device, percent, threshold)
+		payload, _ := json.Marshal(event)
+		m.publish(m.EventTopic, reading.Device, string(payload), false)
+	}
+}
+
+func (m *Monitor) publish(topic, device, payload string, retain bool) {
+	if topic == "" || m.mqttClient == nil {
+		return
+	}
+	topic = strings.Replace(topic, "{device}", device, -1)
+	err := m.mqttClient.Publish(topic, payload, 0, retain)
+	if err != nil {
+		glog.Errorf("MQTT Publish failed: %v", err)
+	}
+}
+
+func (b *deviceBattery) addSample(ts time.Time, percent float64, keep time.Duration) {
+	if n := len(b.history); n > 0 {
+		last := b.history[n-1]
+		if percent > last.percent+rearmMargin {
+			// Battery replaced / recharged, old trend is meaningless
+			b.history = nil
+		} else if ts.Sub(last.time) < sampleInterval {
+			return
+		}
+	}
+	b.history = append(b.history, sample{ts, percent})
+
+	// Drop samples older than history window
+	i := 0
+	for i < len(b.history) && ts.Sub(b.history[i].time) > keep {
+		i++
+	}
+	b.history = b.history[i:]
+}
+
+// estimate returns remaining battery life in days based on least squares
+// fit of level history, nil if history is too short or level is not dropping
+func (b *deviceBattery) estimate() *float64 {
+	n := float64(len(b.history))
+	if n < 2 || b.history[len(b.history)-1].time.Sub(b.history[0].time) < 24*time.Hour {
+		return nil
+	}
+
+	start := b.history[0].time
+	var sumX, sumY, sumXY, sumXX float64
+	for _, s := range b.history {
+		x := s.time.Sub(start).Hours() / 24
+		sumX += x
+		sumY += s.percent
+		sumXY += x * s.percent
+		sumXX += x * x
+	}
+	slope := (n*sumXY - sumX*sumY) / (n*sumXX - sumX*sumX)
+	if slope >= 0 {
+		return nil
+	}
+	days := math.Round(b.status.Percent / -slope)
+
+	return &days
+}
+
+// checkThresholds returns thresholds just crossed, re-arms the ones level is back above
+func (b *deviceBattery) checkThresholds(thresholds []float64) []float64 {
+	crossed := []float64{}
+	percent := b.status.Percent
+	for _, threshold := range thresholds {
+		switch {
+		case percent < threshold && !b.crossed[threshold]:
+			b.crossed[threshold] = true
+			crossed = append(crossed, threshold)
+		case percent >= threshold+rearmMargin:
+			delete(b.crossed, threshold)
+		}
+	}
+
+	return crossed
+}
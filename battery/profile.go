@@ -0,0 +1,79 @@
+package battery
+
+import (
+	"fmt"
+	"sort"
+)
+
+// Point of discharge curve: cell voltage and remaining capacity (percent)
+type Point struct {
+	Voltage float64
+	Percent float64
+}
+
+// Discharge curves (single cell, light load) of well known chemistries
+var chemistries = map[string][]Point{
+	"alkaline": {
+		{0.90, 0}, {1.05, 5}, {1.15, 20}, {1.25, 40}, {1.35, 60}, {1.45, 80}, {1.55, 100},
+	},
+	"nimh": {
+		{1.00, 0}, {1.10, 10}, {1.15, 30}, {1.20, 50}, {1.25, 70}, {1.30, 90}, {1.40, 100},
+	},
+	"lithium": {
+		{1.00, 0}, {1.30, 5}, {1.45, 20}, {1.55, 50}, {1.70, 80}, {1.80, 100},
+	},
+	"liion": {
+		{3.30, 0}, {3.50, 10}, {3.65, 25}, {3.75, 45}, {3.85, 65}, {4.00, 85}, {4.20, 100},
+	},
+	"cr2032": {
+		{2.00, 0}, {2.50, 10}, {2.60, 20}, {2.70, 40}, {2.80, 60}, {2.90, 80}, {3.00, 100},
+	},
+}
+
+// Profile describes battery of device: chemistry and cells in series
+type Profile struct {
+	Chemistry string
+	// Number of cells in series, 1 if not set
+	Cells int
+
+	curve []Point
+}
+
+func (p *Profile) init(custom map[string][]Point) error {
+	curve, ok := custom[p.Chemistry]
+	if !ok {
+		curve, ok = chemistries[p.Chemistry]
+	}
+	if !ok {
+		return fmt.Errorf("unknown chemistry '%s'", p.Chemistry)
+	}
+	if len(curve) < 2 {
+		return fmt.Errorf("chemistry '%s': at least 2 curve points required", p.Chemistry)
+	}
+	if p.Cells == 0 {
+		p.Cells = 1
+	}
+	p.curve = append([]Point{}, curve...)
+	sort.Slice(p.curve, func(i, j int) bool {
+		return p.curve[i].Voltage < p.curve[j].Voltage
+	})
+
+	return nil
+}
+
+// Percent converts battery (pack) voltage into remaining capacity, 0..100
+func (p *Profile) Percent(voltage float64) float64 {
+	v := voltage / float64(p.Cells)
+	curve := p.curve
+	if v <= curve[0].Voltage {
+		return curve[0].Percent
+	}
+	for i := 1; i < len(curve); i++ {
+		if v <= curve[i].Voltage {
+			lo, hi := curve[i-1], curve[i]
+			return lo.Percent + (v-lo.Voltage)/(hi.Voltage-lo.Voltage)*(hi.Percent-lo.Percent)
+		}
+	}
+
+	return curve[len(curve)-1].Percent
+}
@@ -0,0 +1,98 @@
+package capture
+
+import (
+	"bufio"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+)
+
+// Packet directions
+const (
+	Uplink   = "uplink"
+	Downlink = "downlink"
+)
+
+// Record is one captured raw packet
+type Record struct {
+	Time      time.Time         `json:"time"`
+	Transport string            `json:"transport"`
+	Direction string            `json:"direction"`
+	Data      string            `json:"data"`
+	Metadata  map[string]string `json:"metadata,omitempty"`
+}
+
+// Writer appends records into capture file, one JSON per line
+type Writer struct {
+	file *os.File
+	lock sync.Mutex
+}
+
+func NewWriter(filename string) (*Writer, error) {
+	f, err := os.OpenFile(filename, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Writer{file: f}, nil
+}
+
+// Write records packet
+func (w *Writer) Write(transport, direction string, packet []byte, metadata map[string]string) error {
+	data, err := json.Marshal(&Record{
+		Time:      time.Now(),
+		Transport: transport,
+		Direction: direction,
+		Data:      hex.EncodeToString(packet),
+		Metadata:  metadata,
+	})
+	if err != nil {
+		return err
+	}
+
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	_, err = w.file.Write(append(data, '\n'))
+
+	return err
+}
+
+// Close closes capture file, records written afterwards fail
+func (w *Writer) Close() error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	return w.file.Close()
+}
+
+// ReadFile reads all records from capture file
+func ReadFile(filename string) ([]*Record, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	records := []*Record{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		record := &Record{}
+		err := json.Unmarshal(scanner.Bytes(), record)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, record)
+	}
+
+	return records, scanner.Err()
+}
+
+// Packet returns raw bytes of captured packet
+func (r *Record) Packet() ([]byte, error) {
+	return hex.DecodeString(r.Data)
+}
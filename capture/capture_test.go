@@ -0,0 +1,91 @@
+package capture
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/lorahome/server/transport"
+)
+
+func TestCapture(t *testing.T) {
+	dir, err := ioutil.TempDir("", "capture")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "capture.jsonl")
+
+	writer, err := NewWriter(filename)
+	require.NoError(t, err)
+	mock := transport.NewMockLoRaTransport()
+	wrapped := Wrap(mock, "mock", writer)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go wrapped.Run(ctx)
+
+	// Uplink is forwarded and recorded
+	mock.Ch <- []byte{1, 2, 3}
+	assert.Equal(t, []byte{1, 2, 3}, <-wrapped.Receive())
+	// Downlink is sent and recorded
+	require.NoError(t, wrapped.Send([]byte{4, 5}))
+	assert.Equal(t, [][]byte{{4, 5}}, mock.History)
+	require.NoError(t, writer.Close())
+
+	records, err := ReadFile(filename)
+	require.NoError(t, err)
+	require.Len(t, records, 2)
+	assert.Equal(t, Uplink, records[0].Direction)
+	assert.Equal(t, "mock", records[0].Transport)
+	packet, err := records[0].Packet()
+	assert.NoError(t, err)
+	assert.Equal(t, []byte{1, 2, 3}, packet)
+	assert.Equal(t, Downlink, records[1].Direction)
+	assert.Equal(t, "0405", records[1].Data)
+
+	// Packets sent after capture is closed are not recorded
+	assert.NoError(t, wrapped.Send([]byte{6}))
+	records, err = ReadFile(filename)
+	require.NoError(t, err)
+	assert.Len(t, records, 2)
+}
+
+type observedMock struct {
+	*transport.MockLoRaTransport
+	observer func([]byte, map[string]string)
+}
+
+func (m *observedMock) ObserveUplinks(f func([]byte, map[string]string)) {
+	m.observer = f
+}
+
+func TestCaptureMetadata(t *testing.T) {
+	dir, err := ioutil.TempDir("", "capture")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "capture.jsonl")
+
+	writer, err := NewWriter(filename)
+	require.NoError(t, err)
+	mock := &observedMock{MockLoRaTransport: transport.NewMockLoRaTransport()}
+	wrapped := Wrap(mock, "udp", writer)
+	require.NotNil(t, mock.observer)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go wrapped.Run(ctx)
+
+	// Uplink is recorded once, by observer
+	mock.observer([]byte{1}, map[string]string{"source": "10.0.0.2:1700", "gateway": "10.0.0.2:1680"})
+	mock.Ch <- []byte{1}
+	assert.Equal(t, []byte{1}, <-wrapped.Receive())
+	require.NoError(t, writer.Close())
+
+	records, err := ReadFile(filename)
+	require.NoError(t, err)
+	require.Len(t, records, 1)
+	assert.Equal(t, Uplink, records[0].Direction)
+	assert.Equal(t, map[string]string{"source": "10.0.0.2:1700", "gateway": "10.0.0.2:1680"}, records[0].Metadata)
+}
@@ -0,0 +1,85 @@
+package capture
+
+import (
+	"context"
+
+	"github.com/golang/glog"
+
+	"github.com/lorahome/server/transport"
+)
+
+// Transport records all packets going through wrapped transport
+type Transport struct {
+	transport.LoRaTransport
+
+	name   string
+	writer *Writer
+	ch     chan []byte
+	// Uplinks are recorded by observer, along with their metadata
+	observed bool
+}
+
+// Wrap returns transport which captures all packets of t into w
+func Wrap(t transport.LoRaTransport, name string, w *Writer) *Transport {
+	c := &Transport{
+		LoRaTransport: t,
+		name:          name,
+		writer:        w,
+		ch:            make(chan []byte, 1),
+	}
+	if observer, ok := t.(transport.UplinkObserver); ok {
+		observer.ObserveUplinks(c.recordUplink)
+		c.observed = true
+	}
+
+	return c
+}
+
+func (t *Transport) Run(ctx context.Context) error {
+	go t.forward(ctx)
+
+	return t.LoRaTransport.Run(ctx)
+}
+
+func (t *Transport) Receive() <-chan []byte {
+	return t.ch
+}
+
+func (t *Transport) Send(packet []byte) error {
+	err := t.LoRaTransport.Send(packet)
+
+	var metadata map[string]string
+	if err != nil {
+		metadata = map[string]string{"error": err.Error()}
+	}
+	if err := t.writer.Write(t.name, Downlink, packet, metadata); err != nil {
+		glog.Errorf("Capture failed: %v", err)
+	}
+
+	return err
+}
+
+// forward records uplinks of wrapped transport
+func (t *Transport) forward(ctx context.Context) {
+	for {
+		select {
+		case packet := <-t.LoRaTransport.Receive():
+			if !t.observed {
+				t.recordUplink(packet, nil)
+			}
+			select {
+			case t.ch <- packet:
+			case <-ctx.Done():
+				return
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (t *Transport) recordUplink(packet []byte, metadata map[string]string) {
+	if err := t.writer.Write(t.name, Uplink, packet, metadata); err != nil {
+		glog.Errorf("Capture failed: %v", err)
+	}
+}
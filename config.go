@@ -8,10 +8,20 @@ import (
 
 // Config is top level configuration for all features
 type Config struct {
-	Devices  []interface{}
-	InfluxDb interface{}
-	Udp      interface{}
-	Mqtt     interface{}
+	Alerts    interface{}
+	Api       interface{}
+	Battery   interface{}
+	Devices   []interface{}
+	Downlink  interface{}
+	Events    interface{}
+	Grpc      interface{}
+	InfluxDb  interface{}
+	Udp       interface{}
+	Mqtt      interface{}
+	Rules     interface{}
+	Scheduler interface{}
+	Secrets   interface{}
+	Webhooks  interface{}
 }
 
 // ConfigLoadFromFile reads and parses YAML configuration from file
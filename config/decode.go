@@ -0,0 +1,20 @@
+package config
+
+import (
+	"github.com/mitchellh/mapstructure"
+)
+
+// Decode maps raw YAML configuration into structure, same as
+// mapstructure.Decode does, but also converts strings like "10m"
+// into time.Duration
+func Decode(cfg interface{}, result interface{}) error {
+	decoder, err := mapstructure.NewDecoder(&mapstructure.DecoderConfig{
+		DecodeHook: mapstructure.StringToTimeDurationHookFunc(),
+		Result:     result,
+	})
+	if err != nil {
+		return err
+	}
+
+	return decoder.Decode(cfg)
+}
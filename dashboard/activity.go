@@ -0,0 +1,107 @@
+package dashboard
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/lorahome/server/events"
+)
+
+// Limits of kept history
+const (
+	maxErrors  = 50
+	maxUnknown = 100
+)
+
+// UnknownDevice is device sending packets, but not defined in devices file
+type UnknownDevice struct {
+	Id        uint64    `json:"id"`
+	FirstSeen time.Time `json:"first_seen"`
+	LastSeen  time.Time `json:"last_seen"`
+	Packets   int       `json:"packets"`
+}
+
+// PacketError is failure of packet processing
+type PacketError struct {
+	Time     time.Time `json:"time"`
+	DeviceId uint64    `json:"device_id"`
+	Error    string    `json:"error"`
+}
+
+// Activity records packets processed by server (packet / error events):
+// packets of unknown devices and recent processing errors
+type Activity struct {
+	unknown map[uint64]*UnknownDevice
+	errors  []PacketError
+	lock    sync.Mutex
+}
+
+func NewActivity() *Activity {
+	return &Activity{
+		unknown: map[uint64]*UnknownDevice{},
+	}
+}
+
+// Record records packet or error event
+func (a *Activity) Record(event events.Event) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	switch event.Type {
+	case events.TypeError:
+		message, _ := event.Data.(string)
+		a.errors = append(a.errors, PacketError{Time: event.Time, DeviceId: event.DeviceId, Error: message})
+		if len(a.errors) > maxErrors {
+			a.errors = a.errors[len(a.errors)-maxErrors:]
+		}
+	case events.TypePacket:
+		if data, ok := event.Data.(*events.PacketData); !ok || data.Size < 8 {
+			// Too short to carry device id
+			return
+		}
+		if event.Device != "" {
+			delete(a.unknown, event.DeviceId)
+			return
+		}
+		unknown, ok := a.unknown[event.DeviceId]
+		if !ok {
+			if len(a.unknown) >= maxUnknown {
+				return
+			}
+			unknown = &UnknownDevice{Id: event.DeviceId, FirstSeen: event.Time}
+			a.unknown[event.DeviceId] = unknown
+		}
+		unknown.LastSeen = event.Time
+		unknown.Packets++
+	}
+}
+
+// Unknown returns devices sending packets, but not defined, most recent first
+func (a *Activity) Unknown() []UnknownDevice {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	res := []UnknownDevice{}
+	for _, unknown := range a.unknown {
+		res = append(res, *unknown)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].LastSeen.After(res[j].LastSeen)
+	})
+
+	return res
+}
+
+// Errors returns recent packet processing errors, most recent first
+func (a *Activity) Errors() []PacketError {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	res := make([]PacketError, len(a.errors))
+	for i, e := range a.errors {
+		res[len(res)-1-i] = e
+	}
+
+	return res
+}
@@ -0,0 +1,162 @@
+// Package dashboard is built-in web UI: devices with their latest readings,
+// live updates (event stream, see events package), LED strip controls,
+// unknown devices and recent packet processing errors. UI is embedded
+// into server binary.
+package dashboard
+
+import (
+	"context"
+	"embed"
+	"encoding/json"
+	"io/fs"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/lorahome/server/api"
+	"github.com/lorahome/server/devices"
+	"github.com/lorahome/server/downlink"
+	"github.com/lorahome/server/events"
+	"github.com/lorahome/server/state"
+)
+
+//go:embed static
+var static embed.FS
+
+// Device is device as shown by dashboard
+type Device struct {
+	Id           uint64             `json:"id"`
+	Name         string             `json:"name"`
+	Class        string             `json:"class"`
+	LastSeen     *time.Time         `json:"last_seen,omitempty"`
+	Online       bool               `json:"online"`
+	Controllable bool               `json:"controllable"`
+	Readings     map[string]float64 `json:"readings"`
+}
+
+// Dashboard serves web UI and its API
+type Dashboard struct {
+	store    *state.Store
+	events   *events.Service
+	activity *Activity
+	packets  *events.Subscription
+}
+
+func NewDashboard(store *state.Store, service *events.Service) *Dashboard {
+	return &Dashboard{
+		store:    store,
+		events:   service,
+		activity: NewActivity(),
+		// Subscribe right away, not to miss packets received before Run
+		packets: service.Bus().Subscribe(events.Filter{
+			Types: map[string]bool{events.TypePacket: true, events.TypeError: true},
+		}),
+	}
+}
+
+// Run records packets and errors of event bus until context canceled
+func (d *Dashboard) Run(ctx context.Context) error {
+	defer d.events.Bus().Unsubscribe(d.packets)
+	for {
+		select {
+		case event := <-d.packets.C:
+			d.activity.Record(event)
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// Register registers UI and API handlers:
+//
+//	GET  /dashboard/                     - web UI
+//	GET  /api/devices                    - devices with the latest readings
+//	POST /api/devices/{name}/control     - send command {"value": "..."} to device
+//	GET  /api/devices/{name}/downlinks   - delivery status of recent downlinks
+//	GET  /api/devices/unknown            - devices sending packets, but not defined
+//	GET  /api/errors                     - recent packet processing errors
+//
+// Live updates come from /api/events.
+func (d *Dashboard) Register(server *api.Server) {
+	ui, _ := fs.Sub(static, "static")
+	server.Handle("/dashboard/", http.StripPrefix("/dashboard/", http.FileServer(http.FS(ui))))
+	server.Handle("/api/devices", http.HandlerFunc(d.serveDevices))
+	server.Handle("/api/devices/", http.HandlerFunc(d.serveDevice))
+	server.Handle("/api/errors", http.HandlerFunc(d.serveErrors))
+}
+
+// Devices returns all devices with their latest readings
+func (d *Dashboard) Devices() []Device {
+	res := []Device{}
+	for _, device := range devices.GetAllDevices() {
+		view := Device{
+			Id:       device.GetId(),
+			Name:     device.GetName(),
+			Class:    device.GetClassName(),
+			Readings: map[string]float64{},
+		}
+		lastSeen, online := d.events.Presence(view.Id)
+		if !lastSeen.IsZero() {
+			view.LastSeen = &lastSeen
+		}
+		view.Online = online
+		_, view.Controllable = device.(devices.Controllable)
+		for _, reading := range d.store.Device(view.Name) {
+			view.Readings[reading.Quantity] = reading.Value
+		}
+		res = append(res, view)
+	}
+
+	return res
+}
+
+func (d *Dashboard) serveDevices(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	api.WriteJSON(w, http.StatusOK, d.Devices())
+}
+
+func (d *Dashboard) serveDevice(w http.ResponseWriter, r *http.Request) {
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/devices/"), "/")
+	switch {
+	case r.Method == http.MethodGet && path == "unknown":
+		api.WriteJSON(w, http.StatusOK, d.activity.Unknown())
+	case r.Method == http.MethodGet && strings.HasSuffix(path, "/downlinks"):
+		device := devices.GetDeviceByName(strings.TrimSuffix(path, "/downlinks"))
+		if device == nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		history := device.GetBaseDevice().DownlinkHistory()
+		if history == nil {
+			history = []downlink.Record{}
+		}
+		api.WriteJSON(w, http.StatusOK, history)
+	case r.Method == http.MethodPost && strings.HasSuffix(path, "/control"):
+		name := strings.TrimSuffix(path, "/control")
+		command := struct {
+			Value string `json:"value"`
+		}{}
+		err := json.NewDecoder(r.Body).Decode(&command)
+		if err == nil {
+			err = devices.ControlDevice(name, command.Value)
+		}
+		if err != nil {
+			api.WriteError(w, http.StatusBadRequest, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func (d *Dashboard) serveErrors(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	api.WriteJSON(w, http.StatusOK, d.activity.Errors())
+}
@@ -0,0 +1,193 @@
+package dashboard
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mitchellh/mapstructure"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/lorahome/server/api"
+	"github.com/lorahome/server/devices"
+	"github.com/lorahome/server/downlink"
+	"github.com/lorahome/server/events"
+	"github.com/lorahome/server/state"
+	"github.com/lorahome/server/transport"
+)
+
+const stripUrl = "testStripUrl"
+
+type stripMock struct {
+	devices.MockDevice `mapstructure:",squash"`
+	values             []string
+}
+
+func (s *stripMock) Control(value string) error {
+	if value == "bad" {
+		return errors.New("bad value")
+	}
+	s.values = append(s.values, value)
+	return nil
+}
+
+func init() {
+	devices.RegisterDeviceClass(devices.Url, devices.ClassName, devices.NewMockDevice)
+	devices.RegisterDeviceClass(stripUrl, "Strip", func(cfg interface{}, caps *devices.Capabilities) (devices.Device, error) {
+		dev := &stripMock{}
+		err := mapstructure.Decode(cfg, dev)
+		return dev, err
+	})
+}
+
+func packet(id uint64) []byte {
+	p := make([]byte, 24)
+	binary.LittleEndian.PutUint64(p, id)
+	return p
+}
+
+func getJSON(t *testing.T, url string, value interface{}) {
+	resp, err := http.Get(url)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(value))
+}
+
+func TestActivity(t *testing.T) {
+	a := NewActivity()
+	packet := func(id uint64, device string, size int) events.Event {
+		return events.Event{Type: events.TypePacket, Time: time.Now(), DeviceId: id, Device: device, Data: &events.PacketData{Size: size}}
+	}
+	failure := func(id uint64, message string) events.Event {
+		return events.Event{Type: events.TypeError, Time: time.Now(), DeviceId: id, Data: message}
+	}
+
+	a.Record(packet(1, "kitchen", 24))
+	a.Record(packet(7, "", 24))
+	a.Record(failure(7, "device 0x7 does not exist"))
+	a.Record(packet(7, "", 24))
+	a.Record(failure(7, "device 0x7 does not exist"))
+	a.Record(packet(0, "", 1))
+	a.Record(failure(0, "too short"))
+
+	unknown := a.Unknown()
+	require.Len(t, unknown, 1)
+	assert.Equal(t, uint64(7), unknown[0].Id)
+	assert.Equal(t, 2, unknown[0].Packets)
+
+	errs := a.Errors()
+	require.Len(t, errs, 3)
+	assert.Equal(t, "too short", errs[0].Error)
+	assert.Equal(t, uint64(7), errs[1].DeviceId)
+
+	for i := 0; i < maxErrors*2; i++ {
+		a.Record(failure(1, "failed"))
+	}
+	assert.Len(t, a.Errors(), maxErrors)
+}
+
+func TestDashboard(t *testing.T) {
+	store := state.NewStore()
+	queue, err := downlink.NewQueue(nil, transport.NewMockLoRaTransport(), nil)
+	require.NoError(t, err)
+	caps := &devices.Capabilities{State: store, Downlink: queue}
+	_, err = devices.RegisterDevice(devices.Url, map[string]interface{}{"id": 1, "name": "kitchen"}, caps)
+	require.NoError(t, err)
+	_, err = devices.RegisterDevice(stripUrl, map[string]interface{}{"id": 2, "name": "strip", "key": "22222222222222222222222222222222"}, caps)
+	require.NoError(t, err)
+	service, err := events.NewService(nil, store)
+	require.NoError(t, err)
+	server, err := api.NewServer(map[string]interface{}{"listen": "127.0.0.1:0"})
+	require.NoError(t, err)
+	dashboard := NewDashboard(store, service)
+	dashboard.Register(server)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go server.Run(ctx)
+	go dashboard.Run(ctx)
+	<-server.Ready()
+	url := "http://" + server.Addr().String()
+
+	// Packets come through event bus
+	store.Update(state.Reading{Device: "kitchen", Quantity: state.Temperature, Value: 21.5})
+	store.Update(state.Reading{Device: "kitchen", Quantity: state.BatteryLevel, Value: 80})
+	service.Packet(packet(1), nil)
+	service.Packet(packet(9), errors.New("device 0x9 does not exist"))
+	unknown := []UnknownDevice{}
+	require.Eventually(t, func() bool {
+		getJSON(t, url+"/api/devices/unknown", &unknown)
+		return len(unknown) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, uint64(9), unknown[0].Id)
+
+	list := []Device{}
+	getJSON(t, url+"/api/devices", &list)
+	require.Len(t, list, 2)
+	assert.Equal(t, "kitchen", list[0].Name)
+	assert.NotNil(t, list[0].LastSeen)
+	assert.True(t, list[0].Online)
+	assert.False(t, list[0].Controllable)
+	assert.Equal(t, map[string]float64{state.Temperature: 21.5, state.BatteryLevel: 80}, list[0].Readings)
+	assert.Equal(t, "strip", list[1].Name)
+	assert.Nil(t, list[1].LastSeen)
+	assert.False(t, list[1].Online)
+	assert.True(t, list[1].Controllable)
+
+	errs := []PacketError{}
+	getJSON(t, url+"/api/errors", &errs)
+	require.Len(t, errs, 1)
+	assert.Equal(t, "device 0x9 does not exist", errs[0].Error)
+
+	// Controls
+	resp, err := http.Post(url+"/api/devices/strip/control", "application/json", strings.NewReader(`{"value": "42"}`))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+	assert.Equal(t, []string{"42"}, devices.GetDeviceByName("strip").(*stripMock).values)
+	// Plain text (cross-site form) commands are rejected
+	resp, err = http.Post(url+"/api/devices/strip/control", "text/plain", strings.NewReader(`{"value": "43"}`))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusUnsupportedMediaType, resp.StatusCode)
+	assert.Equal(t, []string{"42"}, devices.GetDeviceByName("strip").(*stripMock).values)
+	for _, path := range []string{"/api/devices/strip/control", "/api/devices/kitchen/control", "/api/devices/missing/control"} {
+		resp, err := http.Post(url+path, "application/json", strings.NewReader(`{"value": "bad"}`))
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode, path)
+	}
+
+	// Downlinks delivery status
+	strip := devices.GetDeviceByName("strip").GetBaseDevice()
+	require.NoError(t, strip.LoadKeys())
+	strip.ConfirmedDownlinks = true
+	require.NoError(t, strip.SendDownlink("test", []byte{1}))
+	queue.Ack(2, 1)
+	history := []downlink.Record{}
+	getJSON(t, url+"/api/devices/strip/downlinks", &history)
+	require.Len(t, history, 1)
+	assert.Equal(t, "test", history[0].Kind)
+	assert.Equal(t, downlink.StatusDelivered, history[0].Status)
+	getJSON(t, url+"/api/devices/kitchen/downlinks", &history)
+	assert.Empty(t, history)
+	resp, err = http.Get(url + "/api/devices/missing/downlinks")
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	// Embedded UI
+	resp, err = http.Get(url + "/dashboard/")
+	require.NoError(t, err)
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Contains(t, string(body), "<title>LoRa Home</title>")
+	resp, err = http.Get(url + "/dashboard/app.js")
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+}
@@ -0,0 +1,181 @@
+'use strict';
+
+// Readings not shown in generic readings column
+const special = ['battery_level', 'battery_voltage'];
+
+let devices = [];
+
+function text(value) {
+  return value === undefined || value === null ? '—' : String(value);
+}
+
+function time(value) {
+  return value ? new Date(value).toLocaleString() : '—';
+}
+
+function round(value) {
+  return Math.round(value * 100) / 100;
+}
+
+function row(cells) {
+  const tr = document.createElement('tr');
+  for (const cell of cells) {
+    const td = document.createElement('td');
+    if (cell instanceof Node) {
+      td.appendChild(cell);
+    } else {
+      td.textContent = text(cell);
+    }
+    tr.appendChild(td);
+  }
+  return tr;
+}
+
+function fill(id, rows, columns) {
+  const body = document.getElementById(id);
+  body.replaceChildren(...rows);
+  if (rows.length === 0) {
+    const tr = row(['none']);
+    tr.firstChild.colSpan = columns;
+    tr.className = 'empty';
+    body.appendChild(tr);
+  }
+}
+
+function battery(readings) {
+  if (readings.battery_level !== undefined) {
+    return readings.battery_level + '%';
+  }
+  if (readings.battery_voltage !== undefined) {
+    return round(readings.battery_voltage) + 'V';
+  }
+  return undefined;
+}
+
+function readingsCell(device) {
+  const span = document.createElement('span');
+  span.className = 'readings';
+  for (const [quantity, value] of Object.entries(device.readings).sort()) {
+    if (!special.includes(quantity)) {
+      const item = document.createElement('span');
+      item.textContent = quantity + ': ' + round(value);
+      span.appendChild(item);
+      span.appendChild(document.createTextNode(' '));
+    }
+  }
+  return span;
+}
+
+function control(device) {
+  if (!device.controllable) {
+    return '';
+  }
+  const form = document.createElement('form');
+  const input = document.createElement('input');
+  input.type = 'range';
+  input.min = 0;
+  input.max = 255;
+  input.value = device.readings.level || 0;
+  const button = document.createElement('button');
+  button.textContent = 'Set';
+  form.append(input, button);
+  form.onsubmit = async (event) => {
+    event.preventDefault();
+    const resp = await fetch('/api/devices/' + encodeURIComponent(device.name) + '/control', {
+      method: 'POST',
+      headers: {'Content-Type': 'application/json'},
+      body: JSON.stringify({value: input.value}),
+    });
+    if (!resp.ok) {
+      alert((await resp.json()).error);
+    }
+  };
+  return form;
+}
+
+function renderDevices() {
+  fill('devices', devices.map((device) => {
+    const tr = row([
+      device.name,
+      '0x' + device.id.toString(16),
+      device.class,
+      time(device.last_seen),
+      battery(device.readings),
+      readingsCell(device),
+      control(device),
+    ]);
+    tr.id = 'device-' + device.name;
+    tr.classList.toggle('stale', !device.online);
+    return tr;
+  }), 7);
+}
+
+async function load(url) {
+  const resp = await fetch(url);
+  return resp.json();
+}
+
+async function refresh() {
+  try {
+    devices = await load('/api/devices');
+    renderDevices();
+    const unknown = await load('/api/devices/unknown');
+    fill('unknown', unknown.map((u) => row([
+      '0x' + u.id.toString(16), time(u.first_seen), time(u.last_seen), u.packets,
+    ])), 4);
+    const errors = await load('/api/errors');
+    fill('errors', errors.map((e) => row([
+      time(e.time), e.device_id ? '0x' + e.device_id.toString(16) : '', e.error,
+    ])), 3);
+  } catch (e) {
+    console.error(e);
+  }
+}
+
+function deviceRow(name) {
+  return [devices.find((d) => d.name === name), document.getElementById('device-' + name)];
+}
+
+function live() {
+  const status = document.getElementById('live');
+  const events = new EventSource('/api/events?type=reading,online,offline');
+  events.onopen = () => {
+    status.textContent = 'live';
+    status.className = 'online';
+  };
+  events.onerror = () => {
+    status.textContent = 'offline';
+    status.className = 'offline';
+  };
+  for (const type of ['online', 'offline']) {
+    events.addEventListener(type, (event) => {
+      const [device, tr] = deviceRow(JSON.parse(event.data).device);
+      if (device && tr) {
+        device.online = type === 'online';
+        tr.classList.toggle('stale', !device.online);
+      }
+    });
+  }
+  events.addEventListener('reading', (event) => {
+    const reading = JSON.parse(event.data).data;
+    const [device, tr] = deviceRow(reading.device);
+    if (!device || !tr) {
+      return;
+    }
+    device.readings[reading.quantity] = reading.value;
+    device.last_seen = reading.time;
+    device.online = true;
+    // Update cells in place, not to reset controls being used
+    const cells = tr.children;
+    cells[3].textContent = time(device.last_seen);
+    cells[4].textContent = text(battery(device.readings));
+    cells[5].replaceChildren(readingsCell(device));
+    tr.classList.remove('updated', 'stale');
+    void tr.offsetWidth;
+    tr.classList.add('updated');
+  });
+}
+
+refresh();
+live();
+setInterval(refresh, 10000);
@@ -0,0 +1,253 @@
+package influxdb
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	influxClient "github.com/influxdata/influxdb1-client/v2"
+)
+
+// Aggregation functions
+const (
+	Mean = "mean"
+	Min  = "min"
+	Max  = "max"
+	Last = "last"
+)
+
+// AggregationConfig reduces points of measurement to one per window
+type AggregationConfig struct {
+	Window time.Duration
+	// Result of the first function is stored under original field name,
+	// the rest get "_<function>" suffix. Mean if not set.
+	Functions []string
+}
+
+type fieldStats struct {
+	min, max, sum, last float64
+	count               int
+	// Integer fields stay integer (InfluxDB field type can't change)
+	integer bool
+	// Non numeric fields keep last value only
+	raw interface{}
+}
+
+type window struct {
+	start  time.Time
+	tags   map[string]string
+	fields map[string]*fieldStats
+}
+
+// Aggregator accumulates points and writes aggregated ones once window passes
+type Aggregator struct {
+	window    time.Duration
+	functions []string
+	database  string
+	writer    func(influxClient.BatchPoints) error
+
+	windows map[string]*window
+	timer   *time.Timer
+	lock    sync.Mutex
+}
+
+func NewAggregator(cfg *AggregationConfig, db *InfluxDB, database string) (*Aggregator, error) {
+	if cfg.Window <= 0 {
+		return nil, errors.New("aggregation window is required")
+	}
+	functions := cfg.Functions
+	if len(functions) == 0 {
+		functions = []string{Mean}
+	}
+	for _, fn := range functions {
+		if fn != Mean && fn != Min && fn != Max && fn != Last {
+			return nil, fmt.Errorf("unknown aggregation function '%s'", fn)
+		}
+	}
+
+	return &Aggregator{
+		window:    cfg.Window,
+		functions: functions,
+		database:  database,
+		writer:    db.Write,
+		windows:   map[string]*window{},
+	}, nil
+}
+
+// Add adds point of measurement. Aggregated point of previous window
+// (if any) is written right away, the current one once window passes.
+func (a *Aggregator) Add(measurement string, tags map[string]string, fields KV, ts time.Time) error {
+	start := ts.Truncate(a.window)
+
+	a.lock.Lock()
+	done := map[string]*window{}
+	w := a.windows[measurement]
+	if w != nil && !w.start.Equal(start) {
+		done[measurement] = w
+		w = nil
+	}
+	if w == nil {
+		w = &window{start: start, fields: map[string]*fieldStats{}}
+		a.windows[measurement] = w
+	}
+	w.tags = tags
+	for name, value := range fields {
+		stats := w.fields[name]
+		if stats == nil {
+			stats = &fieldStats{}
+			w.fields[name] = stats
+		}
+		stats.add(value)
+	}
+	if a.timer == nil {
+		a.timer = time.AfterFunc(time.Until(start.Add(a.window)), a.flushExpired)
+	}
+	a.lock.Unlock()
+
+	return a.writeWindows(done)
+}
+
+// Flush writes all pending aggregated points
+func (a *Aggregator) Flush() error {
+	a.lock.Lock()
+	done := a.windows
+	a.windows = map[string]*window{}
+	if a.timer != nil {
+		a.timer.Stop()
+		a.timer = nil
+	}
+	a.lock.Unlock()
+
+	return a.writeWindows(done)
+}
+
+// flushExpired writes points of passed windows, re-arms timer for the rest
+func (a *Aggregator) flushExpired() {
+	now := time.Now()
+	a.lock.Lock()
+	done := map[string]*window{}
+	next := time.Time{}
+	for measurement, w := range a.windows {
+		end := w.start.Add(a.window)
+		if !end.After(now) {
+			done[measurement] = w
+			delete(a.windows, measurement)
+		} else if next.IsZero() || end.Before(next) {
+			next = end
+		}
+	}
+	a.timer = nil
+	if !next.IsZero() {
+		a.timer = time.AfterFunc(next.Sub(now), a.flushExpired)
+	}
+	a.lock.Unlock()
+
+	err := a.writeWindows(done)
+	if err != nil {
+		glog.Errorf("Unable to write aggregated points: %v", err)
+	}
+}
+
+func (a *Aggregator) writeWindows(windows map[string]*window) error {
+	if len(windows) == 0 {
+		return nil
+	}
+
+	batchPoints, err := influxClient.NewBatchPoints(influxClient.BatchPointsConfig{
+		Precision: "s",
+		Database:  a.database,
+	})
+	if err != nil {
+		return err
+	}
+	measurements := []string{}
+	for measurement := range windows {
+		measurements = append(measurements, measurement)
+	}
+	sort.Strings(measurements)
+	for _, measurement := range measurements {
+		w := windows[measurement]
+		fields := KV{}
+		for name, stats := range w.fields {
+			for i, fn := range a.functions {
+				key := name
+				if i > 0 {
+					key = name + "_" + fn
+				}
+				fields[key] = stats.value(fn)
+			}
+		}
+		point, err := influxClient.NewPoint(measurement, w.tags, fields, w.start)
+		if err != nil {
+			return err
+		}
+		batchPoints.AddPoint(point)
+	}
+
+	return a.writer(batchPoints)
+}
+
+func (f *fieldStats) add(value interface{}) {
+	v, integer, ok := toFloat(value)
+	if !ok {
+		f.raw = value
+		return
+	}
+	if f.count == 0 || v < f.min {
+		f.min = v
+	}
+	if f.count == 0 || v > f.max {
+		f.max = v
+	}
+	f.sum += v
+	f.last = v
+	f.count++
+	f.integer = integer
+}
+
+func (f *fieldStats) value(fn string) interface{} {
+	if f.count == 0 {
+		return f.raw
+	}
+	var v float64
+	switch fn {
+	case Min:
+		v = f.min
+	case Max:
+		v = f.max
+	case Last:
+		v = f.last
+	default:
+		v = f.sum / float64(f.count)
+	}
+	if f.integer {
+		return int64(math.Round(v))
+	}
+
+	return v
+}
+
+func toFloat(value interface{}) (v float64, integer bool, ok bool) {
+	switch n := value.(type) {
+	case float64:
+		return n, false, true
+	case float32:
+		return float64(n), false, true
+	case int:
+		return float64(n), true, true
+	case int32:
+		return float64(n), true, true
+	case int64:
+		return float64(n), true, true
+	case uint32:
+		return float64(n), true, true
+	case uint64:
+		return float64(n), true, true
+	}
+
+	return 0, false, false
+}
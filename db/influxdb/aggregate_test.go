@@ -0,0 +1,80 @@
+package influxdb
+
+import (
+	"testing"
+	"time"
+
+	influxClient "github.com/influxdata/influxdb1-client/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestAggregator(t *testing.T, cfg *AggregationConfig) (*Aggregator, *[]*influxClient.Point) {
+	a, err := NewAggregator(cfg, &InfluxDB{}, "test")
+	require.NoError(t, err)
+	points := &[]*influxClient.Point{}
+	a.writer = func(bp influxClient.BatchPoints) error {
+		assert.Equal(t, "test", bp.Database())
+		*points = append(*points, bp.Points()...)
+		return nil
+	}
+
+	return a, points
+}
+
+func TestAggregator(t *testing.T) {
+	a, points := newTestAggregator(t, &AggregationConfig{
+		Window:    time.Hour,
+		Functions: []string{Mean, Min, Max, Last},
+	})
+	start := time.Now().Truncate(time.Hour).Add(-2 * time.Hour)
+	tags := map[string]string{"name": "kitchen"}
+	for i, value := range []float64{20, 22, 27} {
+		require.NoError(t, a.Add("temperature", tags, KV{"c": value, "als": uint32(i)}, start.Add(time.Duration(i)*time.Minute)))
+	}
+	assert.Empty(t, *points)
+
+	// Point of the next window writes previous one
+	require.NoError(t, a.Add("temperature", tags, KV{"c": 10.0, "als": uint32(5)}, start.Add(time.Hour)))
+	require.Len(t, *points, 1)
+	p := (*points)[0]
+	assert.Equal(t, start, p.Time())
+	assert.Equal(t, tags, p.Tags())
+	fields, err := p.Fields()
+	require.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{
+		"c": 23.0, "c_min": 20.0, "c_max": 27.0, "c_last": 27.0,
+		"als": int64(1), "als_min": int64(0), "als_max": int64(2), "als_last": int64(2),
+	}, fields)
+
+	require.NoError(t, a.Flush())
+	require.Len(t, *points, 2)
+	fields, _ = (*points)[1].Fields()
+	assert.Equal(t, 10.0, fields["c"])
+}
+
+func TestAggregatorTimer(t *testing.T) {
+	a, _ := newTestAggregator(t, &AggregationConfig{Window: 50 * time.Millisecond})
+	written := make(chan int, 1)
+	a.writer = func(bp influxClient.BatchPoints) error {
+		written <- len(bp.Points())
+		return nil
+	}
+	require.NoError(t, a.Add("humidity", nil, KV{"value": 40.0}, time.Now()))
+	require.NoError(t, a.Add("humidity", nil, KV{"value": 42.0}, time.Now()))
+
+	// Window passed without new points
+	select {
+	case n := <-written:
+		assert.Equal(t, 1, n)
+	case <-time.After(time.Second):
+		t.Fatal("aggregated point not written")
+	}
+}
+
+func TestAggregatorConfig(t *testing.T) {
+	_, err := NewAggregator(&AggregationConfig{}, &InfluxDB{}, "test")
+	assert.Error(t, err)
+	_, err = NewAggregator(&AggregationConfig{Window: time.Minute, Functions: []string{"median"}}, &InfluxDB{}, "test")
+	assert.Error(t, err)
+}
@@ -1,11 +1,15 @@
 package influxdb
 
 import (
+	"errors"
 	"time"
 
 	"github.com/golang/glog"
+	"github.com/influxdata/influxdb1-client/models"
 	influxClient "github.com/influxdata/influxdb1-client/v2"
 	"github.com/mitchellh/mapstructure"
+
+	"github.com/lorahome/server/secrets"
 )
 
 type InfluxDB struct {
@@ -32,7 +36,14 @@ func NewInfluxDB(cfg interface{}) (*InfluxDB, error) {
 		return nil, err
 	}
 
-	db.client, err = influxClient.NewHTTPClient(db.Config)
+	// Password may be secret reference, keep reference in config
+	httpConfig := db.Config
+	httpConfig.Password, err = secrets.Resolve(db.Config.Password)
+	if err != nil {
+		return nil, err
+	}
+
+	db.client, err = influxClient.NewHTTPClient(httpConfig)
 	if err == nil {
 		db.enabled = true
 	}
@@ -53,3 +64,27 @@ func (db *InfluxDB) Write(points influxClient.BatchPoints) error {
 	// Bypass mode
 	return nil
 }
+
+// Enabled returns false in bypass mode
+func (db *InfluxDB) Enabled() bool {
+	return db.enabled
+}
+
+// Query runs InfluxQL query, returns series of the first statement
+func (db *InfluxDB) Query(database, command string) ([]models.Row, error) {
+	if !db.enabled {
+		return nil, errors.New("InfluxDB is not enabled")
+	}
+	resp, err := db.client.Query(influxClient.NewQuery(command, database, ""))
+	if err != nil {
+		return nil, err
+	}
+	if resp.Error() != nil {
+		return nil, resp.Error()
+	}
+	if len(resp.Results) == 0 {
+		return nil, nil
+	}
+
+	return resp.Results[0].Series, nil
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"strings"
+
+	"github.com/golang/protobuf/jsonpb"
+	"github.com/golang/protobuf/proto"
+
+	"github.com/lorahome/server/devices"
+	"github.com/lorahome/server/downlink"
+	"github.com/lorahome/server/transport"
+)
+
+// runDecode decrypts and decodes raw packet (hex), e.g. taken from gateway log
+func runDecode(args []string) error {
+	flags := flag.NewFlagSet("decode", flag.ExitOnError)
+	asJson := flags.Bool("json", false, "Print decoded message as JSON")
+	flags.Parse(args)
+	if flags.NArg() == 0 {
+		return errors.New("usage: decode [-json] <packet hex>")
+	}
+
+	// Tolerate common hex dump formats: "0x..", spaces, colons
+	raw := strings.Join(flags.Args(), "")
+	raw = strings.TrimPrefix(strings.ToLower(raw), "0x")
+	raw = strings.NewReplacer(" ", "", ":", "", "-", "").Replace(raw)
+	packet, err := hex.DecodeString(raw)
+	if err != nil {
+		return err
+	}
+
+	deviceId, err := parseDeviceId(packet)
+	if err != nil {
+		return err
+	}
+	// Device keys may be stored in keystore
+	err = unlockKeystore()
+	if err != nil {
+		return err
+	}
+	caps, err := bypassCapabilities(transport.NewMockLoRaTransport())
+	if err != nil {
+		return err
+	}
+	err = devices.LoadFromFile(*flagDevices, caps)
+	if err != nil {
+		return err
+	}
+	device := devices.GetDeviceById(deviceId)
+	if device == nil {
+		return fmt.Errorf("device 0x%x does not exist in %s", deviceId, *flagDevices)
+	}
+	fmt.Printf("Device:    %s (%s), id 0x%x (%d)\n", device.GetName(), device.GetClassName(), deviceId, deviceId)
+
+	decrypted, err := device.GetBaseDevice().Decrypt(packet[8:])
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Decrypted: %x\n", decrypted)
+
+	if id, ok := downlink.ParseAck(decrypted); ok {
+		fmt.Printf("Acknowledge of downlink %d\n", id)
+		return nil
+	}
+	decoder, ok := device.(devices.Decoder)
+	if !ok {
+		return fmt.Errorf("device class %s does not support decoding", device.GetClassName())
+	}
+	msg, err := decoder.Decode(decrypted)
+	if err != nil {
+		return err
+	}
+
+	if *asJson {
+		marshaler := &jsonpb.Marshaler{Indent: "  "}
+		res, err := marshaler.MarshalToString(msg)
+		if err != nil {
+			return err
+		}
+		fmt.Println(res)
+	} else {
+		fmt.Print(proto.MarshalTextString(msg))
+	}
+
+	return nil
+}
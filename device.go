@@ -0,0 +1,222 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/lorahome/server/devices"
+	"github.com/lorahome/server/fileutil"
+	"github.com/lorahome/server/secrets"
+	"github.com/lorahome/server/transport"
+)
+
+// runDevice handles device management commands
+func runDevice(args []string) error {
+	if len(args) == 0 {
+		return errors.New("usage: device add [options] | rotate-key <name or id>")
+	}
+
+	switch args[0] {
+	case "add":
+		return runDeviceAdd(args[1:])
+	case "rotate-key":
+		return runDeviceRotateKey(args[1:])
+	}
+
+	return fmt.Errorf("unknown device command '%s'", args[0])
+}
+
+// runDeviceAdd generates id / AES key for new device, adds it into devices
+// file and prints configuration snippet for device firmware
+func runDeviceAdd(args []string) error {
+	flags := flag.NewFlagSet("device add", flag.ExitOnError)
+	class := flags.String("class", "", "Device class name (e.g. LedStrip) or URL")
+	name := flags.String("name", "", "Device name")
+	rawId := flags.String("id", "", "Device id (random if not set)")
+	join := flags.Bool("join", false, "Generate factory root key for over-the-air join instead of session key")
+	format := flags.String("format", "header", "Firmware config format: header (C) or json")
+	flags.Parse(args)
+
+	if *name == "" {
+		return errors.New("device name is required")
+	}
+	if *format != "header" && *format != "json" {
+		return fmt.Errorf("unknown format '%s'", *format)
+	}
+	url, err := devices.FindDeviceClass(*class)
+	if err != nil {
+		return err
+	}
+
+	// Generate id / key
+	var id uint64
+	if *rawId != "" {
+		id, err = strconv.ParseUint(*rawId, 0, 64)
+		if err != nil {
+			return err
+		}
+	} else {
+		id, err = randomId()
+		if err != nil {
+			return err
+		}
+	}
+	lock, err := lockDevicesFile()
+	if err != nil {
+		return err
+	}
+	defer lock.Unlock()
+	// Secret must not be stored for device which can not be added
+	err = devices.CheckIdInFile(*flagDevices, id)
+	if err != nil {
+		return err
+	}
+	key := make([]byte, 16)
+	if _, err := rand.Read(key); err != nil {
+		return err
+	}
+
+	// Store key in keystore, when configured
+	err = unlockKeystore()
+	if err != nil {
+		return err
+	}
+	keyName := "key"
+	secretName := fmt.Sprintf("device-%d", id)
+	if *join {
+		keyName = "rootKey"
+		secretName += "-root"
+	}
+	keyRef, err := secrets.Protect(secretName, hex.EncodeToString(key))
+	if err != nil {
+		return err
+	}
+
+	err = devices.AddToFile(*flagDevices, url, id, map[string]interface{}{
+		"name":  *name,
+		keyName: keyRef,
+	})
+	if err != nil {
+		return err
+	}
+
+	if *format == "json" {
+		data, _ := json.MarshalIndent(map[string]interface{}{
+			"id":    fmt.Sprintf("0x%016x", id),
+			"name":  *name,
+			"class": url,
+			keyName: hex.EncodeToString(key),
+		}, "", "  ")
+		fmt.Println(string(data))
+		return nil
+	}
+
+	// C header
+	keyBytes := []string{}
+	for _, b := range key {
+		keyBytes = append(keyBytes, fmt.Sprintf("0x%02x", b))
+	}
+	define := "LORAHOME_AES_KEY"
+	if *join {
+		define = "LORAHOME_ROOT_KEY"
+	}
+	fmt.Printf("// LoRaHome device '%s'\n", *name)
+	fmt.Printf("#define LORAHOME_DEVICE_ID 0x%016xULL\n", id)
+	fmt.Printf("static const uint8_t %s[16] = {%s};\n", define, strings.Join(keyBytes, ", "))
+
+	return nil
+}
+
+// runDeviceRotateKey generates new key for device and saves it into devices
+// file as pending one: server delivers it to device after the next uplink
+// and switches to it once device uses it. Server reads devices file on start.
+func runDeviceRotateKey(args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: device rotate-key <name or id>")
+	}
+	lock, err := lockDevicesFile()
+	if err != nil {
+		return err
+	}
+	defer lock.Unlock()
+	err = unlockKeystore()
+	if err != nil {
+		return err
+	}
+	caps, err := bypassCapabilities(transport.NewMockLoRaTransport())
+	if err != nil {
+		return err
+	}
+	err = devices.LoadFromFile(*flagDevices, caps)
+	if err != nil {
+		return err
+	}
+
+	device := devices.GetDeviceByName(args[0])
+	if id, err := strconv.ParseUint(args[0], 0, 64); device == nil && err == nil {
+		device = devices.GetDeviceById(id)
+	}
+	if device == nil {
+		return fmt.Errorf("device '%s' does not exist in %s", args[0], *flagDevices)
+	}
+	devices.SetAuditFile(*flagAudit)
+	err = devices.StartKeyRotation(device)
+	if err != nil {
+		return err
+	}
+	err = devices.SaveToFile(*flagDevices)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Key rotation of '%s' started, new key is sent to device after its next uplink\n", device.GetName())
+
+	return nil
+}
+
+// lockDevicesFile prevents concurrent changes of devices file and keystore:
+// running server holds both in memory and overwrites them on exit
+func lockDevicesFile() (*fileutil.FileLock, error) {
+	lock, err := fileutil.Lock(*flagDevices)
+	if err == fileutil.ErrLocked {
+		return nil, fmt.Errorf("%s is in use by running server, stop it first", *flagDevices)
+	}
+
+	return lock, err
+}
+
+// unlockKeystore sets up keystore from config file, so offline commands
+// are able to resolve / store secret references of devices file
+func unlockKeystore() error {
+	keystore, err := loadKeystore()
+	if err != nil {
+		return err
+	}
+	secrets.SetKeystore(keystore)
+
+	return nil
+}
+
+func loadKeystore() (*secrets.Keystore, error) {
+	cfg, err := ConfigLoadFromFile(*flagConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	return secrets.NewKeystore(cfg.Secrets)
+}
+
+func randomId() (uint64, error) {
+	buf := make([]byte, 8)
+	if _, err := rand.Read(buf); err != nil {
+		return 0, err
+	}
+
+	return binary.LittleEndian.Uint64(buf), nil
+}
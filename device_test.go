@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v2"
+
+	"github.com/lorahome/server/devices/light/led_strip"
+	"github.com/lorahome/server/fileutil"
+	"github.com/lorahome/server/secrets"
+)
+
+func TestDeviceAdd(t *testing.T) {
+	dir, err := ioutil.TempDir("", "device")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	configFile := filepath.Join(dir, "config.yaml")
+	devicesFile := filepath.Join(dir, "devices.yaml")
+	keystoreFile := filepath.Join(dir, "keystore.dat")
+	config := fmt.Sprintf("secrets:\n  filename: %s\n  masterKey: %s\n", keystoreFile, strings.Repeat("ab", 32))
+	require.NoError(t, ioutil.WriteFile(configFile, []byte(config), 0600))
+	oldConfig, oldDevices := *flagConfig, *flagDevices
+	defer func() {
+		*flagConfig, *flagDevices = oldConfig, oldDevices
+		secrets.SetKeystore(&secrets.Keystore{})
+	}()
+	*flagConfig, *flagDevices = configFile, devicesFile
+
+	runs := []struct {
+		name string
+		args []string
+		err  string
+	}{
+		{"added", []string{"-class", "LedStrip", "-name", "strip", "-id", "0x10"}, ""},
+		{"join", []string{"-class", led_strip.Url, "-name", "joining", "-id", "0x11", "-join", "-format", "json"}, ""},
+		{"duplicate id", []string{"-class", "LedStrip", "-name", "other", "-id", "16"}, "already exists"},
+		{"unknown class", []string{"-class", "Toaster", "-name", "toaster", "-id", "0x12"}, "Unknown device class"},
+		{"no name", []string{"-class", "LedStrip", "-id", "0x13"}, "name is required"},
+		{"bad format", []string{"-class", "LedStrip", "-name", "strip2", "-format", "xml"}, "unknown format"},
+	}
+	for _, run := range runs {
+		err := runDeviceAdd(run.args)
+		if run.err == "" {
+			assert.NoError(t, err, run.name)
+		} else if assert.Error(t, err, run.name) {
+			assert.Contains(t, err.Error(), run.err, run.name)
+		}
+	}
+
+	// Generated config refers keys stored in keystore
+	data, err := ioutil.ReadFile(devicesFile)
+	require.NoError(t, err)
+	added := map[string][]map[string]interface{}{}
+	require.NoError(t, yaml.Unmarshal(data, added))
+	assert.Equal(t, map[string][]map[string]interface{}{
+		led_strip.Url: {
+			{"id": 16, "name": "strip", "key": "keystore:device-16"},
+			{"id": 17, "name": "joining", "rootKey": "keystore:device-17-root"},
+		},
+	}, added)
+
+	// Key of existing device is not replaced by rejected duplicate
+	require.NoError(t, unlockKeystore())
+	key, err := secrets.Resolve("keystore:device-16")
+	require.NoError(t, err)
+	require.Len(t, key, 32)
+	assert.Error(t, runDeviceAdd([]string{"-class", "LedStrip", "-name", "again", "-id", "0x10"}))
+	require.NoError(t, unlockKeystore())
+	again, err := secrets.Resolve("keystore:device-16")
+	require.NoError(t, err)
+	assert.Equal(t, key, again)
+
+	// Devices file held by running server must not be changed
+	lock, err := fileutil.Lock(devicesFile)
+	require.NoError(t, err)
+	defer lock.Unlock()
+	err = runDeviceAdd([]string{"-class", "LedStrip", "-name", "late", "-id", "0x14"})
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "in use by running server")
+	}
+	err = runDeviceRotateKey([]string{"strip"})
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "in use by running server")
+	}
+}
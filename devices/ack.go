@@ -0,0 +1,27 @@
+package devices
+
+import (
+	"github.com/lorahome/server/downlink"
+	"github.com/lorahome/server/transport"
+)
+
+// ProcessAck handles acknowledge of confirmed downlink
+func ProcessAck(device Device, _ transport.LoRaTransport, encrypted []byte) (ControlResult, error) {
+	base := device.GetBaseDevice()
+	if base.downlinks == nil {
+		return ControlResult{}, nil
+	}
+
+	decrypted, err := base.Decrypt(encrypted)
+	if err != nil {
+		// Not a valid message at all, let device class report error
+		return ControlResult{}, nil
+	}
+	id, ok := downlink.ParseAck(decrypted)
+	if !ok {
+		return ControlResult{}, nil
+	}
+	base.downlinks.Ack(base.Id, id)
+
+	return ControlResult{Consumed: true}, nil
+}
@@ -0,0 +1,67 @@
+package devices
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// Audit trail of security related events (joins, key rotations)
+var auditFilename string
+var auditLock sync.Mutex
+
+type auditRecord struct {
+	Time     time.Time `json:"time"`
+	DeviceId uint64    `json:"device_id"`
+	Name     string    `json:"name"`
+	Event    string    `json:"event"`
+	Details  string    `json:"details,omitempty"`
+}
+
+// SetAuditFile sets file where audit records will be appended to,
+// empty filename disables audit trail
+func SetAuditFile(filename string) {
+	auditLock.Lock()
+	defer auditLock.Unlock()
+
+	auditFilename = filename
+}
+
+func audit(device *BaseDevice, event, details string) {
+	glog.Infof("Audit: %s (%d) %s %s", device.Name, device.Id, event, details)
+
+	auditLock.Lock()
+	defer auditLock.Unlock()
+	if auditFilename == "" {
+		return
+	}
+
+	data, _ := json.Marshal(&auditRecord{
+		Time:     time.Now(),
+		DeviceId: device.Id,
+		Name:     device.Name,
+		Event:    event,
+		Details:  details,
+	})
+	f, err := os.OpenFile(auditFilename, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		glog.Errorf("Unable to open audit file: %v", err)
+		return
+	}
+	defer f.Close()
+	_, err = f.Write(append(data, '\n'))
+	if err != nil {
+		glog.Errorf("Unable to write audit record: %v", err)
+	}
+}
+
+// keyFingerprint returns short, non secret identifier of key
+func keyFingerprint(key []byte) string {
+	hash := sha256.Sum256(key)
+	return hex.EncodeToString(hash[:4])
+}
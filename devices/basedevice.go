@@ -1,11 +1,46 @@
 package devices
 
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/lorahome/server/downlink"
+	"github.com/lorahome/server/encoding"
+	"github.com/lorahome/server/secrets"
+	"github.com/lorahome/server/state"
+)
+
 // BaseDevice partially implements common methods of Device interface
 type BaseDevice struct {
 	Id        uint64
 	Name      string
 	ClassName string
 	Url       string
+	// AES key (hex) used to encrypt / decrypt messages.
+	// All keys may be secret references, e.g. keystore:name or env:NAME
+	Key string
+	// Factory root key (hex) used only by over-the-air join procedure
+	RootKey string `yaml:",omitempty"`
+	// Pending key (hex) which replaces Key once device confirms it
+	NextKey string `yaml:",omitempty"`
+	// DevNonces (hex) of accepted join requests, replayed ones are rejected
+	JoinNonces []string `yaml:",omitempty"`
+	// Device class, defines when device is able to receive downlinks:
+	// - "A" (battery powered) only right after uplink
+	// - "C" (default) at any time
+	Class string `yaml:",omitempty"`
+	// Downlinks must be acknowledged by device (retransmitted otherwise)
+	ConfirmedDownlinks bool `yaml:",omitempty"`
+
+	downlinks    *downlink.Queue
+	state        *state.Store
+	keyBytes     []byte
+	rootKeyBytes []byte
+	nextKeyBytes []byte
+	keyLock      sync.RWMutex
 }
 
 func (s *BaseDevice) GetName() string {
@@ -23,3 +58,183 @@ func (s *BaseDevice) GetId() uint64 {
 func (s *BaseDevice) GetUrl() string {
 	return s.Url
 }
+
+func (s *BaseDevice) GetBaseDevice() *BaseDevice {
+	return s
+}
+
+// LoadKeys resolves keys (when they are secret references) and converts
+// them into byte arrays. Device classes must call it once configuration is decoded.
+func (s *BaseDevice) LoadKeys() error {
+	keyBytes, err := loadKey(s.Key)
+	if err != nil {
+		return err
+	}
+	rootKeyBytes, err := loadKey(s.RootKey)
+	if err != nil {
+		return err
+	}
+	nextKeyBytes, err := loadKey(s.NextKey)
+	if err != nil {
+		return err
+	}
+
+	s.keyLock.Lock()
+	defer s.keyLock.Unlock()
+	s.keyBytes = keyBytes
+	s.rootKeyBytes = rootKeyBytes
+	s.nextKeyBytes = nextKeyBytes
+
+	return nil
+}
+
+// Decrypt decrypts message received from device, during key rotation
+// message may be encrypted with either current or next key
+func (s *BaseDevice) Decrypt(encrypted []byte) ([]byte, error) {
+	s.keyLock.RLock()
+	defer s.keyLock.RUnlock()
+
+	if len(s.keyBytes) == 0 {
+		return nil, errors.New("device has no key (not joined yet?)")
+	}
+
+	if usesKey(encrypted, s.nextKeyBytes) {
+		return encoding.AESdecryptCBC(s.nextKeyBytes, encrypted)
+	}
+
+	return encoding.AESdecryptCBC(s.keyBytes, encrypted)
+}
+
+// usesKey tells whether message is encrypted with key, by key id of message
+func usesKey(encrypted, key []byte) bool {
+	if len(key) == 0 {
+		return false
+	}
+	id, err := encoding.AESpacketKeyId(encrypted)
+
+	return err == nil && id == encoding.AESkeyId(key)
+}
+
+// EncodePacket encrypts payload and prepends it with device id,
+// so result is ready to be sent to device
+func (s *BaseDevice) EncodePacket(payload []byte) ([]byte, error) {
+	s.keyLock.RLock()
+	defer s.keyLock.RUnlock()
+
+	if len(s.keyBytes) == 0 {
+		return nil, errors.New("device has no key (not joined yet?)")
+	}
+
+	return encodePacket(s.Id, s.keyBytes, payload)
+}
+
+// SendDownlink sends payload to device, either immediately or in receive
+// window after next uplink, depending on device class.
+// Queued message replaces pending message of the same kind.
+func (s *BaseDevice) SendDownlink(kind string, payload []byte) error {
+	if s.downlinks == nil {
+		return errors.New("downlink queue is not available")
+	}
+
+	return s.downlinks.Enqueue(&downlink.Message{
+		DeviceId:    s.Id,
+		Kind:        kind,
+		Payload:     payload,
+		Encode:      s.EncodePacket,
+		AfterUplink: s.Class == "A",
+		Confirmed:   s.ConfirmedDownlinks,
+	})
+}
+
+// DownlinkHistory returns delivery status of recent downlinks
+func (s *BaseDevice) DownlinkHistory() []downlink.Record {
+	if s.downlinks == nil {
+		return nil
+	}
+
+	return s.downlinks.History(s.Id)
+}
+
+// DeliverDownlinks sends pending downlink (if any),
+// called right after uplink from device received
+func (s *BaseDevice) DeliverDownlinks() error {
+	if s.downlinks == nil {
+		return nil
+	}
+
+	return s.downlinks.OnUplink(s.Id)
+}
+
+// Report publishes decoded value into state store (used by rules, alerts, etc)
+func (s *BaseDevice) Report(quantity string, value float64) {
+	if s.state == nil {
+		return
+	}
+
+	s.state.Update(state.Reading{
+		DeviceId: s.Id,
+		Device:   s.Name,
+		Class:    s.ClassName,
+		Quantity: quantity,
+		Value:    value,
+	})
+}
+
+// protectSessionKey stores new device key into keystore (when configured),
+// returns reference to be used as Key
+func (s *BaseDevice) protectSessionKey(key []byte) (string, error) {
+	return secrets.Protect(s.sessionKeyName(), hex.EncodeToString(key))
+}
+
+// rollbackSessionKey reverts keystore entry written by protectSessionKey
+// when new key is not put in use: current key is restored if it is kept
+// under the same reference, entry is removed otherwise
+func (s *BaseDevice) rollbackSessionKey(ref string) error {
+	s.keyLock.RLock()
+	current := s.Key
+	key := s.keyBytes
+	s.keyLock.RUnlock()
+
+	if ref == current {
+		_, err := secrets.Protect(s.sessionKeyName(), hex.EncodeToString(key))
+		return err
+	}
+
+	return secrets.Unprotect(s.sessionKeyName())
+}
+
+func (s *BaseDevice) sessionKeyName() string {
+	return fmt.Sprintf("device-%d", s.Id)
+}
+
+// setSessionKey replaces device key with new one (ref is returned by
+// protectSessionKey), cancels pending key rotation (if any)
+func (s *BaseDevice) setSessionKey(key []byte, ref string) {
+	s.keyLock.Lock()
+	defer s.keyLock.Unlock()
+
+	s.keyBytes = key
+	s.Key = ref
+	s.nextKeyBytes = nil
+	s.NextKey = ""
+}
+
+func loadKey(ref string) ([]byte, error) {
+	key, err := secrets.Resolve(ref)
+	if err != nil {
+		return nil, err
+	}
+
+	return hex.DecodeString(key)
+}
+
+func encodePacket(id uint64, key, payload []byte) ([]byte, error) {
+	encrypted, err := encoding.AESencryptCBC(key, payload)
+	if err != nil {
+		return nil, err
+	}
+	packet := make([]byte, 8, 8+len(encrypted))
+	binary.LittleEndian.PutUint64(packet, id)
+
+	return append(packet, encrypted...), nil
+}
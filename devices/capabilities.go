@@ -2,12 +2,20 @@ package devices
 
 import (
 	"github.com/lorahome/server/db/influxdb"
+	"github.com/lorahome/server/downlink"
 	"github.com/lorahome/server/mqtt"
+	"github.com/lorahome/server/state"
 	"github.com/lorahome/server/transport"
+	"github.com/lorahome/server/webhook"
 )
 
 type Capabilities struct {
 	Udp      transport.LoRaTransport
 	InfluxDb *influxdb.InfluxDB
 	Mqtt     *mqtt.MqttClient
+	Downlink *downlink.Queue
+	State    *state.Store
+	Webhooks *webhook.Dispatcher
+	// Optional: battery level of voltage, published alongside it
+	Battery BatteryLevels
 }
@@ -2,16 +2,54 @@ package devices
 
 import (
 	"context"
+
+	"github.com/golang/protobuf/proto"
 )
 
 type DeviceCreateFunc func(cfg interface{}, caps *Capabilities) (Device, error)
 
+// ControlResult is outcome of server level control message handler
+// (join, key rotation, downlink acknowledge)
+type ControlResult struct {
+	// Packet handled, device class must not process it
+	Consumed bool
+	// Device keys changed, so devices file has to be saved
+	KeysChanged bool
+	// Server already replied in receive window opened by packet
+	Replied bool
+}
+
 type Device interface {
 	GetId() uint64
 	GetName() string
 	GetClassName() string
 	GetUrl() string
+	GetBaseDevice() *BaseDevice
 
 	Start(ctx context.Context) error
 	ProcessMessage(packet []byte) error
 }
+
+// Controllable is implemented by device classes which accept commands
+// from server features (e.g. rules), value format is defined by class
+type Controllable interface {
+	Control(value string) error
+}
+
+// Decoder is implemented by device classes which are able to decode
+// decrypted payload into protobuf message (used by tools, e.g. decode)
+type Decoder interface {
+	Decode(payload []byte) (proto.Message, error)
+}
+
+// BatteryLevels converts battery voltage of device into level (percent),
+// ok is false when battery of device is unknown (see battery.Monitor)
+type BatteryLevels interface {
+	Level(device, class string, voltage float64) (percent float64, ok bool)
+}
+
+// InfluxSeries is implemented by device classes which write readings into
+// InfluxDB, maps quantity into database / measurement / field (used by history API)
+type InfluxSeries interface {
+	InfluxSeries(quantity string) (database, measurement, field string, ok bool)
+}
@@ -0,0 +1,123 @@
+package devices
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+
+	"github.com/golang/glog"
+
+	"github.com/lorahome/server/encoding"
+	"github.com/lorahome/server/transport"
+)
+
+// Over-the-air join procedure, all messages encrypted with factory root key:
+//   - device requests session key: "LHJR" | devNonce (8 bytes)
+//   - server generates random appNonce, derives session key as
+//     HMAC-SHA256(rootKey, devNonce | appNonce)[:16] and replies with
+//     "LHJA" | devNonce | sessionKey (16 bytes)
+//
+// From now on all messages are encrypted with session key.
+// Every devNonce is accepted only once, so recorded join request
+// cannot be replayed to reset device session.
+const (
+	joinRequestMagic = "LHJR"
+	joinAcceptMagic  = "LHJA"
+	joinNonceSize    = 8
+	sessionKeySize   = 16
+	// Number of recent devNonces remembered per device
+	maxJoinNonces = 1024
+)
+
+// ProcessJoin checks whether packet is join request and handles it
+func ProcessJoin(device Device, source transport.LoRaTransport, encrypted []byte) (ControlResult, error) {
+	base := device.GetBaseDevice()
+	base.keyLock.RLock()
+	rootKey := base.rootKeyBytes
+	base.keyLock.RUnlock()
+	if len(rootKey) == 0 {
+		// Join is not enabled for device
+		return ControlResult{}, nil
+	}
+
+	// Any message encrypted with different key (e.g. session key)
+	// decrypts into garbage, so magic does not match
+	decrypted, err := encoding.AESdecryptCBC(rootKey, encrypted)
+	if err != nil || len(decrypted) != len(joinRequestMagic)+joinNonceSize ||
+		!bytes.HasPrefix(decrypted, []byte(joinRequestMagic)) {
+		return ControlResult{}, nil
+	}
+	res := ControlResult{Consumed: true}
+	devNonce := decrypted[len(joinRequestMagic):]
+	if base.joinNonceUsed(devNonce) {
+		glog.Warningf("%s (%d): join request with already used devNonce %x, ignored", base.Name, base.Id, devNonce)
+		return res, nil
+	}
+
+	// Derive new session key
+	appNonce := make([]byte, joinNonceSize)
+	if _, err := rand.Read(appNonce); err != nil {
+		return res, err
+	}
+	sessionKey := deriveSessionKey(rootKey, devNonce, appNonce)
+	ref, err := base.protectSessionKey(sessionKey)
+	if err != nil {
+		return res, err
+	}
+
+	// Reply with join accept
+	accept := make([]byte, 0, len(joinAcceptMagic)+joinNonceSize+sessionKeySize)
+	accept = append(accept, joinAcceptMagic...)
+	accept = append(accept, devNonce...)
+	accept = append(accept, sessionKey...)
+	packet, err := encodePacket(base.Id, rootKey, accept)
+	if err == nil {
+		err = source.Send(packet)
+	}
+	// Switch key only once accept is sent, device keeps using
+	// the old one (and retries join) otherwise
+	if err != nil {
+		if rbErr := base.rollbackSessionKey(ref); rbErr != nil {
+			glog.Errorf("%s (%d): unable to roll back session key: %v", base.Name, base.Id, rbErr)
+		}
+		return res, err
+	}
+	base.setSessionKey(sessionKey, ref)
+	base.addJoinNonce(devNonce)
+	glog.Infof("%s (%d) joined, session key updated", base.Name, base.Id)
+	audit(base, "joined", "key "+keyFingerprint(sessionKey))
+
+	return ControlResult{Consumed: true, KeysChanged: true, Replied: true}, nil
+}
+
+func (s *BaseDevice) joinNonceUsed(nonce []byte) bool {
+	encoded := hex.EncodeToString(nonce)
+	s.keyLock.RLock()
+	defer s.keyLock.RUnlock()
+	for _, used := range s.JoinNonces {
+		if used == encoded {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (s *BaseDevice) addJoinNonce(nonce []byte) {
+	s.keyLock.Lock()
+	defer s.keyLock.Unlock()
+	s.JoinNonces = append(s.JoinNonces, hex.EncodeToString(nonce))
+	if len(s.JoinNonces) > maxJoinNonces {
+		s.JoinNonces = s.JoinNonces[len(s.JoinNonces)-maxJoinNonces:]
+	}
+}
+
+func deriveSessionKey(rootKey, devNonce, appNonce []byte) []byte {
+	mac := hmac.New(sha256.New, rootKey)
+	mac.Write(devNonce)
+	mac.Write(appNonce)
+
+	return mac.Sum(nil)[:sessionKeySize]
+}
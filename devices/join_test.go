@@ -0,0 +1,138 @@
+package devices
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/lorahome/server/encoding"
+	"github.com/lorahome/server/secrets"
+	"github.com/lorahome/server/transport"
+)
+
+func TestJoin(t *testing.T) {
+	rootKey := bytes.Repeat([]byte{0x11}, 16)
+	devNonce := []byte{1, 2, 3, 4, 5, 6, 7, 8}
+	dev := &MockDevice{
+		BaseDevice: BaseDevice{
+			Id:      0x1234,
+			RootKey: "11111111111111111111111111111111",
+		},
+	}
+	require.NoError(t, dev.LoadKeys())
+	source := transport.NewMockLoRaTransport()
+
+	// Key is not changed when join accept is not sent
+	failed, err := encoding.AESencryptCBC(rootKey, append([]byte(joinRequestMagic), 8, 7, 6, 5, 4, 3, 2, 1))
+	require.NoError(t, err)
+	source.Error = errors.New("gateway is down")
+	res, err := ProcessJoin(dev, source, failed)
+	assert.Error(t, err)
+	assert.True(t, res.Consumed)
+	assert.Empty(t, dev.keyBytes)
+	assert.Empty(t, dev.JoinNonces)
+	source.Error = nil
+	source.History = nil
+
+	// Regular (non join) message must not be consumed
+	regular, err := encoding.AESencryptCBC(rootKey, []byte{1, 2, 3})
+	require.NoError(t, err)
+	res, err = ProcessJoin(dev, source, regular)
+	assert.NoError(t, err)
+	assert.False(t, res.Consumed)
+
+	// Join request
+	request, err := encoding.AESencryptCBC(rootKey, append([]byte(joinRequestMagic), devNonce...))
+	require.NoError(t, err)
+	res, err = ProcessJoin(dev, source, request)
+	require.NoError(t, err)
+	assert.Equal(t, ControlResult{Consumed: true, KeysChanged: true, Replied: true}, res)
+
+	// Ensure that join accept carries the same key as stored on server
+	require.Len(t, source.History, 1)
+	accept := source.History[0]
+	assert.Equal(t, uint64(0x1234), binary.LittleEndian.Uint64(accept))
+	decrypted, err := encoding.AESdecryptCBC(rootKey, accept[8:])
+	require.NoError(t, err)
+	assert.Equal(t, []byte(joinAcceptMagic), decrypted[:4])
+	assert.Equal(t, devNonce, decrypted[4:12])
+	assert.Equal(t, decrypted[12:], dev.keyBytes)
+	assert.Len(t, dev.Key, 32)
+
+	// Session key is used from now on
+	encrypted, err := encoding.AESencryptCBC(decrypted[12:], []byte{5, 6})
+	require.NoError(t, err)
+	decrypted, err = dev.Decrypt(encrypted)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte{5, 6}, decrypted)
+	assert.Equal(t, []string{"0102030405060708"}, dev.JoinNonces)
+
+	// Replayed join request is consumed, but neither answered nor changes key
+	key := dev.Key
+	res, err = ProcessJoin(dev, source, request)
+	require.NoError(t, err)
+	assert.Equal(t, ControlResult{Consumed: true}, res)
+	assert.Len(t, source.History, 1)
+	assert.Equal(t, key, dev.Key)
+}
+
+func TestJoinKeystore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "join")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	ks, err := secrets.NewKeystore(map[interface{}]interface{}{
+		"filename":  filepath.Join(dir, "keystore.dat"),
+		"masterKey": "passphrase",
+	})
+	require.NoError(t, err)
+	secrets.SetKeystore(ks)
+	defer secrets.SetKeystore(&secrets.Keystore{})
+
+	rootKey := bytes.Repeat([]byte{0x11}, 16)
+	dev := &MockDevice{
+		BaseDevice: BaseDevice{
+			Id:      0x1234,
+			RootKey: "11111111111111111111111111111111",
+		},
+	}
+	require.NoError(t, dev.LoadKeys())
+	source := transport.NewMockLoRaTransport()
+	join := func(nonce byte) (ControlResult, error) {
+		request, err := encoding.AESencryptCBC(rootKey, append([]byte(joinRequestMagic), nonce, 2, 3, 4, 5, 6, 7, 8))
+		require.NoError(t, err)
+		return ProcessJoin(dev, source, request)
+	}
+
+	// Keystore is not changed when join accept is not sent
+	source.Error = errors.New("gateway is down")
+	_, err = join(1)
+	assert.Error(t, err)
+	_, err = ks.Get("device-4660")
+	assert.Error(t, err)
+
+	// Successful join
+	source.Error = nil
+	_, err = join(2)
+	require.NoError(t, err)
+	assert.Equal(t, "keystore:device-4660", dev.Key)
+	key, err := ks.Get("device-4660")
+	require.NoError(t, err)
+	assert.Equal(t, hex.EncodeToString(dev.keyBytes), key)
+
+	// Failed re-join keeps current key in keystore
+	source.Error = errors.New("gateway is down")
+	_, err = join(3)
+	assert.Error(t, err)
+	stored, err := ks.Get("device-4660")
+	assert.NoError(t, err)
+	assert.Equal(t, key, stored)
+	assert.Equal(t, "keystore:device-4660", dev.Key)
+}
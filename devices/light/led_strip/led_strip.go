@@ -2,8 +2,6 @@ package led_strip
 
 import (
 	"context"
-	"encoding/binary"
-	"encoding/hex"
 	"strconv"
 
 	"github.com/golang/glog"
@@ -12,9 +10,8 @@ import (
 
 	pb "github.com/lorahome/devices/go/proto/light"
 	"github.com/lorahome/server/devices"
-	"github.com/lorahome/server/encoding"
 	"github.com/lorahome/server/mqtt"
-	"github.com/lorahome/server/transport"
+	st "github.com/lorahome/server/state"
 )
 
 const (
@@ -27,12 +24,9 @@ type LedStrip struct {
 	// Public parameters (being saved into YAML)
 	devices.BaseDevice `yaml:",inline" mapstructure:",squash"`
 	Mqtt               *mqttConfig
-	Key                string
 
 	// Private
-	keyBytes   []byte
 	mqttClient *mqtt.MqttClient
-	transport  transport.LoRaTransport
 }
 
 type mqttConfig struct {
@@ -54,21 +48,32 @@ func NewLedStrip(cfg interface{}, caps *devices.Capabilities) (devices.Device, e
 			ClassName: ClassName,
 		},
 		mqttClient: caps.Mqtt,
-		transport:  caps.Udp,
 	}
 	err := mapstructure.Decode(cfg, dev)
 	if err != nil {
 		return nil, err
 	}
+	// All topics may come from topic template
+	if dev.Mqtt == nil {
+		dev.Mqtt = &mqttConfig{}
+	}
+	if dev.Mqtt.Topics == nil {
+		dev.Mqtt.Topics = &mqttTopicsConfig{}
+	}
 
-	// Convert AES key into byte array
-	dev.keyBytes, err = hex.DecodeString(dev.Key)
+	// Convert AES keys into byte arrays
+	err = dev.LoadKeys()
 
 	return dev, err
 }
 
 func (s *LedStrip) Start(ctx context.Context) error {
-	controlCh, err := s.mqttClient.Subscribe(s.Mqtt.Topics.Control, 0)
+	control := s.controlTopic()
+	if control == "" {
+		// Controlled by API / rules only
+		return nil
+	}
+	controlCh, err := s.mqttClient.Subscribe(control, 0)
 	if err != nil {
 		return err
 	}
@@ -77,25 +82,9 @@ func (s *LedStrip) Start(ctx context.Context) error {
 		for {
 			select {
 			case msg := <-controlCh:
-				val, err := strconv.Atoi(msg.Value)
+				err := s.Control(msg.Value)
 				if err != nil {
-					glog.Errorf("parse error for topic %s: %v", s.Mqtt.Topics.Control, err)
-					continue
-				}
-				glog.Infof("%s: set light level to %v", s.Name, val)
-
-				payload := make([]byte, 256)
-				state := &pb.LedStripStatus{
-					Channels: []uint32{uint32(val)},
-				}
-				serializedResp, _ := proto.Marshal(state)
-				encryptedResp, _ := encoding.AESencryptCBC(s.keyBytes, serializedResp)
-				binary.LittleEndian.PutUint64(payload, s.Id)
-				totalLen := len(encryptedResp) + 8
-				copy(payload[8:], encryptedResp)
-				err = s.transport.Send(payload[:totalLen])
-				if err != nil {
-					glog.Errorf("unable to send: %v", err)
+					glog.Errorf("%s: control from topic %s failed: %v", s.Name, control, err)
 				}
 			case <-ctx.Done():
 				return
@@ -105,27 +94,89 @@ func (s *LedStrip) Start(ctx context.Context) error {
 	return nil
 }
 
+// Control sets light level, value is integer level
+func (s *LedStrip) Control(value string) error {
+	level, err := strconv.Atoi(value)
+	if err != nil {
+		return err
+	}
+
+	return s.SetLevel(uint32(level))
+}
+
+// SetLevel sends light level to device
+func (s *LedStrip) SetLevel(level uint32) error {
+	return s.SetChannels([]uint32{level})
+}
+
+// SetChannels sends light levels of all channels to device
+func (s *LedStrip) SetChannels(channels []uint32) error {
+	glog.Infof("%s: set light level to %v", s.Name, channels)
+
+	state := &pb.LedStripStatus{
+		Channels: channels,
+	}
+	serializedResp, _ := proto.Marshal(state)
+	// Only the latest light level matters
+	return s.SendDownlink("light", serializedResp)
+}
+
 func (s *LedStrip) ProcessMessage(encrypted []byte) error {
 	// Decrypt message
 	glog.Infof("%v", encrypted)
-	decrypted, err := encoding.AESdecryptCBC(s.keyBytes, encrypted)
+	decrypted, err := s.Decrypt(encrypted)
 	if err != nil {
 		return err
 	}
 
 	glog.Infof("packet %v, sz %d", decrypted, len(decrypted))
 
-	state := &pb.LedStripStatus{}
-	err = proto.Unmarshal(decrypted, state)
+	msg, err := s.Decode(decrypted)
 	if err != nil {
 		return err
 	}
+	state := msg.(*pb.LedStripStatus)
 
 	glog.Infof("%s status: %v", s.Name, state.Channels)
+	if len(state.Channels) > 0 {
+		s.Report(st.Level, float64(state.Channels[0]))
+		if topic := s.statusTopic(); topic != "" {
+			err = s.mqttClient.Publish(topic, strconv.Itoa(int(state.Channels[0])), s.Mqtt.Qos, s.Mqtt.Retain)
+			if err != nil {
+				glog.Errorf("MQTT Publish failed: %v", err)
+			}
+		}
+	}
 
 	return nil
 }
 
+// statusTopic returns topic light level is published to: explicitly
+// configured one, or rendered from topic template
+func (s *LedStrip) statusTopic() string {
+	if s.Mqtt.Topics.Status != "" {
+		return s.Mqtt.Topics.Status
+	}
+
+	return s.mqttClient.DeviceTopic(s.ClassName, s.Name, st.Level)
+}
+
+// controlTopic returns topic light level commands are received from
+func (s *LedStrip) controlTopic() string {
+	if s.Mqtt.Topics.Control != "" {
+		return s.Mqtt.Topics.Control
+	}
+
+	return s.mqttClient.DeviceCommandTopic(s.ClassName, s.Name, st.Level)
+}
+
+func (s *LedStrip) Decode(payload []byte) (proto.Message, error) {
+	state := &pb.LedStripStatus{}
+	err := proto.Unmarshal(payload, state)
+
+	return state, err
+}
+
 func init() {
-	devices.RegisterDeviceClass(Url, NewLedStrip)
+	devices.RegisterDeviceClass(Url, ClassName, NewLedStrip)
 }
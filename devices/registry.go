@@ -4,6 +4,8 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"sort"
+	"strings"
 
 	"github.com/golang/glog"
 )
@@ -11,11 +13,32 @@ import (
 // Map of url -> device creator func
 var deviceClasses = map[string]DeviceCreateFunc{}
 
+// Map of class name -> url
+var deviceClassNames = map[string]string{}
+
 // deviceId -> device
 var deviceList = map[uint64]Device{}
 
-func RegisterDeviceClass(url string, dev DeviceCreateFunc) {
+func RegisterDeviceClass(url, className string, dev DeviceCreateFunc) {
 	deviceClasses[url] = dev
+	deviceClassNames[className] = url
+}
+
+// FindDeviceClass returns url of device class by its url or class name
+func FindDeviceClass(nameOrUrl string) (string, error) {
+	if _, ok := deviceClasses[nameOrUrl]; ok {
+		return nameOrUrl, nil
+	}
+	if url, ok := deviceClassNames[nameOrUrl]; ok {
+		return url, nil
+	}
+
+	names := []string{}
+	for name := range deviceClassNames {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return "", fmt.Errorf("Unknown device class '%s', available: %s", nameOrUrl, strings.Join(names, ", "))
 }
 
 func RegisterDevice(url string, cfg interface{}, caps *Capabilities) (Device, error) {
@@ -28,6 +51,10 @@ func RegisterDevice(url string, cfg interface{}, caps *Capabilities) (Device, er
 		if err != nil {
 			return nil, err
 		}
+		if caps != nil {
+			device.GetBaseDevice().downlinks = caps.Downlink
+			device.GetBaseDevice().state = caps.State
+		}
 		deviceList[device.GetId()] = device
 		glog.Infof("Added %s device: %s (%d)",
 			device.GetClassName(), device.GetName(), device.GetId())
@@ -44,6 +71,44 @@ func GetDeviceById(id uint64) Device {
 	return nil
 }
 
+// GetDeviceByName returns device by its name, nil if not found
+func GetDeviceByName(name string) Device {
+	for _, device := range deviceList {
+		if device.GetName() == name {
+			return device
+		}
+	}
+	return nil
+}
+
+// ControlDevice sends command to device by name, the same way
+// as device MQTT control topic does
+func ControlDevice(name, value string) error {
+	device := GetDeviceByName(name)
+	if device == nil {
+		return fmt.Errorf("device '%s' does not exist", name)
+	}
+	controllable, ok := device.(Controllable)
+	if !ok {
+		return fmt.Errorf("device '%s' (%s) does not accept commands", name, device.GetClassName())
+	}
+
+	return controllable.Control(value)
+}
+
+// GetAllDevices returns all registered devices, ordered by id
+func GetAllDevices() []Device {
+	res := []Device{}
+	for _, device := range deviceList {
+		res = append(res, device)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].GetId() < res[j].GetId()
+	})
+
+	return res
+}
+
 func StartAllDevices(ctx context.Context) error {
 	for _, d := range deviceList {
 		err := d.Start(ctx)
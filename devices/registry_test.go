@@ -23,7 +23,7 @@ func TestRegistry(t *testing.T) {
 		"id":  123,
 		"url": testUrl,
 	}
-	dev, err := RegisterDevice(cfg)
+	dev, err := RegisterDevice(testUrl, cfg, nil)
 	require.NoError(t, err)
 	assert.Equal(t, uint64(123), dev.GetId())
 	assert.Equal(t, testUrl, dev.GetUrl())
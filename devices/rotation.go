@@ -0,0 +1,115 @@
+package devices
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+
+	"github.com/golang/glog"
+
+	"github.com/lorahome/server/encoding"
+	"github.com/lorahome/server/secrets"
+	"github.com/lorahome/server/transport"
+)
+
+// Key rotation with grace period:
+//   - rotation starts by setting NextKey (devices.yaml, "device rotate-key"
+//     command or StartKeyRotation)
+//   - in reply to every uplink encrypted with current key server queues
+//     key change downlink encrypted with current key: "LHKC" | nextKey (16 bytes)
+//   - device switches to new key and (optionally) confirms it with "LHKA"
+//     encrypted with new key
+//   - server switches to new key on the first uplink encrypted with it,
+//     so current key is not used anymore
+//
+// Until then both keys are valid.
+const (
+	keyChangeMagic    = "LHKC"
+	keyChangeAckMagic = "LHKA"
+	keyChangeKind     = "key_change"
+)
+
+// StartKeyRotation generates new random key for device.
+// Actual switch to new key happens once device confirms it.
+func StartKeyRotation(device Device) error {
+	base := device.GetBaseDevice()
+	base.keyLock.RLock()
+	key := base.keyBytes
+	base.keyLock.RUnlock()
+	// Keys are told apart by key id, so it must differ from current one
+	nextKey := make([]byte, sessionKeySize)
+	for {
+		if _, err := rand.Read(nextKey); err != nil {
+			return err
+		}
+		if len(key) == 0 || encoding.AESkeyId(nextKey) != encoding.AESkeyId(key) {
+			break
+		}
+	}
+	ref, err := secrets.Protect(fmt.Sprintf("device-%d-next", base.Id), hex.EncodeToString(nextKey))
+	if err != nil {
+		return err
+	}
+
+	base.keyLock.Lock()
+	if len(base.keyBytes) == 0 {
+		base.keyLock.Unlock()
+		return errors.New("device has no key, unable to rotate")
+	}
+	base.nextKeyBytes = nextKey
+	base.NextKey = ref
+	base.keyLock.Unlock()
+
+	audit(base, "key_rotation_started", "next key "+keyFingerprint(nextKey))
+
+	return nil
+}
+
+// ProcessKeyRotation drives pending key rotation (if any)
+func ProcessKeyRotation(device Device, _ transport.LoRaTransport, encrypted []byte) (ControlResult, error) {
+	base := device.GetBaseDevice()
+	base.keyLock.RLock()
+	key := base.keyBytes
+	nextKey := base.nextKeyBytes
+	base.keyLock.RUnlock()
+	if len(nextKey) == 0 || len(key) == 0 {
+		// No rotation in progress
+		return ControlResult{}, nil
+	}
+
+	if usesKey(encrypted, nextKey) {
+		// Device already uses new key
+		decrypted, err := encoding.AESdecryptCBC(nextKey, encrypted)
+		if err != nil {
+			// Not a valid message at all, let device class report error
+			return ControlResult{}, nil
+		}
+		ref, err := base.protectSessionKey(nextKey)
+		if err != nil {
+			return ControlResult{}, err
+		}
+		base.setSessionKey(nextKey, ref)
+		audit(base, "key_rotated", "key "+keyFingerprint(nextKey)+", previous "+keyFingerprint(key))
+		// Any message but confirmation goes to device class
+		return ControlResult{
+			Consumed:    bytes.Equal(decrypted, []byte(keyChangeAckMagic)),
+			KeysChanged: true,
+		}, nil
+	}
+
+	// Device still uses current key: let device class process message,
+	// meanwhile (re)queue key change request for receive window of this
+	// uplink, so even battery powered devices have chance to receive it
+	if !usesKey(encrypted, key) {
+		// Not a valid message at all, let device class report error
+		return ControlResult{}, nil
+	}
+	err := base.SendDownlink(keyChangeKind, append([]byte(keyChangeMagic), nextKey...))
+	if err != nil {
+		glog.Errorf("%s: unable to send key change request: %v", base.Name, err)
+	}
+
+	return ControlResult{}, nil
+}
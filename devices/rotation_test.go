@@ -0,0 +1,122 @@
+package devices
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/lorahome/server/downlink"
+	"github.com/lorahome/server/encoding"
+	"github.com/lorahome/server/transport"
+)
+
+func TestKeyRotation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rotation")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	SetAuditFile(filepath.Join(dir, "audit.log"))
+	defer SetAuditFile("")
+
+	key := bytes.Repeat([]byte{0x22}, 16)
+	dev := &MockDevice{
+		BaseDevice: BaseDevice{
+			Id:  0x1234,
+			Key: "22222222222222222222222222222222",
+		},
+	}
+	require.NoError(t, dev.LoadKeys())
+	source := transport.NewMockLoRaTransport()
+	dev.downlinks, err = downlink.NewQueue(nil, source, nil)
+	require.NoError(t, err)
+
+	// No rotation in progress
+	uplink, err := encoding.AESencryptCBC(key, []byte{1, 2, 3})
+	require.NoError(t, err)
+	res, err := ProcessKeyRotation(dev, source, uplink)
+	assert.NoError(t, err)
+	assert.False(t, res.Consumed)
+	assert.Len(t, source.History, 0)
+
+	// Start rotation: uplinks with current key are still processed by device,
+	// server queues key change request encrypted with current key
+	require.NoError(t, StartKeyRotation(dev))
+	nextKey := dev.nextKeyBytes
+	for i := 0; i < 2; i++ {
+		res, err = ProcessKeyRotation(dev, source, uplink)
+		assert.NoError(t, err)
+		assert.False(t, res.Consumed)
+	}
+	require.Len(t, source.History, 2)
+	request, err := encoding.AESdecryptCBC(key, source.History[1][8:])
+	require.NoError(t, err)
+	assert.Equal(t, append([]byte(keyChangeMagic), nextKey...), request)
+	// Old key is still in use
+	decrypted, err := dev.Decrypt(uplink)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte{1, 2, 3}, decrypted)
+
+	// Both keys are accepted
+	newUplink, err := encoding.AESencryptCBC(nextKey, []byte{4, 5, 6})
+	require.NoError(t, err)
+	decrypted, err = dev.Decrypt(newUplink)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte{4, 5, 6}, decrypted)
+
+	// Key is told by key id, payloads with no alignment padding included
+	for _, payload := range [][]byte{bytes.Repeat([]byte{7}, 15), bytes.Repeat([]byte{7}, 16)} {
+		for _, k := range [][]byte{key, nextKey} {
+			encrypted, err := encoding.AESencryptCBC(k, payload)
+			require.NoError(t, err)
+			decrypted, err = dev.Decrypt(encrypted)
+			assert.NoError(t, err)
+			assert.Equal(t, payload, decrypted)
+		}
+	}
+
+	// The first uplink with new key completes rotation,
+	// it is still processed by device
+	res, err = ProcessKeyRotation(dev, source, newUplink)
+	assert.NoError(t, err)
+	assert.Equal(t, ControlResult{KeysChanged: true}, res)
+	assert.Equal(t, nextKey, dev.keyBytes)
+	assert.Empty(t, dev.NextKey)
+	_, err = dev.Decrypt(uplink)
+	assert.NoError(t, err)
+	res, err = ProcessKeyRotation(dev, source, newUplink)
+	assert.NoError(t, err)
+	assert.Equal(t, ControlResult{}, res)
+
+	// Uplink with block aligned payload completes rotation too
+	require.NoError(t, StartKeyRotation(dev))
+	aligned, err := encoding.AESencryptCBC(dev.keyBytes, bytes.Repeat([]byte{8}, 16))
+	require.NoError(t, err)
+	res, err = ProcessKeyRotation(dev, source, aligned)
+	assert.NoError(t, err)
+	assert.Equal(t, ControlResult{}, res)
+	nextKey = dev.nextKeyBytes
+	aligned, err = encoding.AESencryptCBC(nextKey, bytes.Repeat([]byte{8}, 16))
+	require.NoError(t, err)
+	res, err = ProcessKeyRotation(dev, source, aligned)
+	assert.NoError(t, err)
+	assert.Equal(t, ControlResult{KeysChanged: true}, res)
+	assert.Equal(t, nextKey, dev.keyBytes)
+
+	// Explicit confirmation is consumed
+	require.NoError(t, StartKeyRotation(dev))
+	ack, err := encoding.AESencryptCBC(dev.nextKeyBytes, []byte(keyChangeAckMagic))
+	require.NoError(t, err)
+	res, err = ProcessKeyRotation(dev, source, ack)
+	assert.NoError(t, err)
+	assert.Equal(t, ControlResult{Consumed: true, KeysChanged: true}, res)
+
+	// Both events recorded into audit trail
+	data, err := ioutil.ReadFile(filepath.Join(dir, "audit.log"))
+	require.NoError(t, err)
+	assert.Contains(t, string(data), "key_rotation_started")
+	assert.Contains(t, string(data), "key_rotated")
+}
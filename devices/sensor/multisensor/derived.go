@@ -0,0 +1,84 @@
+package multisensor
+
+import "math"
+
+// Magnus formula coefficients (over water, -45..60C)
+const (
+	magnusA = 17.62
+	magnusB = 243.12
+)
+
+// Default lux per raw ambient light count (VEML7700, gain 1, 100ms integration time)
+const defaultLuxFactor = 0.0576
+
+// calibration corrects raw sensor value: value * scale + offset
+type calibration struct {
+	Offset float64
+	// 1 if not set
+	Scale float64
+}
+
+type calibrationConfig struct {
+	Temperature    *calibration
+	Humidity       *calibration
+	BatteryVoltage *calibration
+	Lux            *calibration
+}
+
+func (c *calibration) apply(value float64) float64 {
+	if c == nil {
+		return value
+	}
+	scale := c.Scale
+	if scale == 0 {
+		scale = 1
+	}
+
+	return value*scale + c.Offset
+}
+
+func celsiusToFahrenheit(c float64) float64 {
+	return c*9/5 + 32
+}
+
+func fahrenheitToCelsius(f float64) float64 {
+	return (f - 32) * 5 / 9
+}
+
+// dewPoint returns dew point (C) of air with temperature (C) and relative humidity (%)
+func dewPoint(t, rh float64) float64 {
+	gamma := math.Log(rh/100) + magnusA*t/(magnusB+t)
+
+	return magnusB * gamma / (magnusA - gamma)
+}
+
+// absoluteHumidity returns water vapour density (g/m3) of air with temperature (C)
+// and relative humidity (%)
+func absoluteHumidity(t, rh float64) float64 {
+	// Saturation vapour pressure, hPa
+	es := 6.112 * math.Exp(magnusA*t/(magnusB+t))
+
+	return es * rh * 2.1674 / (273.15 + t)
+}
+
+// heatIndex returns apparent temperature (C) of air with temperature (C) and
+// relative humidity (%), using NOAA (Rothfusz regression) algorithm
+func heatIndex(t, rh float64) float64 {
+	f := celsiusToFahrenheit(t)
+	hi := 0.5 * (f + 61 + (f-68)*1.2 + rh*0.094)
+	if (hi+f)/2 < 80 {
+		return fahrenheitToCelsius(hi)
+	}
+
+	hi = -42.379 + 2.04901523*f + 10.14333127*rh - 0.22475541*f*rh -
+		0.00683783*f*f - 0.05481717*rh*rh + 0.00122874*f*f*rh +
+		0.00085282*f*rh*rh - 0.00000199*f*f*rh*rh
+	switch {
+	case rh < 13 && f >= 80 && f <= 112:
+		hi -= (13 - rh) / 4 * math.Sqrt((17-math.Abs(f-95))/17)
+	case rh > 85 && f >= 80 && f <= 87:
+		hi += (rh - 85) / 10 * (87 - f) / 5
+	}
+
+	return fahrenheitToCelsius(hi)
+}
@@ -0,0 +1,57 @@
+package multisensor
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/lorahome/server/db/influxdb"
+	"github.com/lorahome/server/devices"
+	"github.com/lorahome/server/state"
+)
+
+func TestCalibration(t *testing.T) {
+	var none *calibration
+	assert.Equal(t, 21.5, none.apply(21.5))
+	assert.Equal(t, 20.0, (&calibration{Offset: -1.5}).apply(21.5))
+	assert.Equal(t, 45.0, (&calibration{Offset: 5, Scale: 0.8}).apply(50))
+}
+
+func TestDerived(t *testing.T) {
+	assert.InDelta(t, 9.3, dewPoint(20, 50), 0.1)
+	assert.InDelta(t, 25.0, dewPoint(25, 100), 0.01)
+	assert.InDelta(t, 8.6, absoluteHumidity(20, 50), 0.1)
+	assert.InDelta(t, 23.0, absoluteHumidity(25, 100), 0.1)
+	// Below 80F simple formula, close to air temperature
+	assert.InDelta(t, 19.4, heatIndex(20, 50), 0.1)
+	// NOAA table: 90F, 70% -> 106F
+	assert.InDelta(t, fahrenheitToCelsius(106), heatIndex(fahrenheitToCelsius(90), 70), 0.5)
+	assert.InDelta(t, 212.0, celsiusToFahrenheit(100), 0.001)
+}
+
+func TestDerivedSeries(t *testing.T) {
+	idb, err := influxdb.NewInfluxDB(nil)
+	require.NoError(t, err)
+	dev, err := NewMultiSensor(map[string]interface{}{
+		"id":       1,
+		"name":     "kitchen",
+		"influxDb": map[string]interface{}{"database": "home"},
+	}, &devices.Capabilities{InfluxDb: idb})
+	require.NoError(t, err)
+	series := dev.(devices.InfluxSeries)
+
+	// Derived values are written like native ones
+	for quantity, expected := range map[string][2]string{
+		state.Temperature:      {"temperature", "c"},
+		state.DewPoint:         {"dew_point", "c"},
+		state.HeatIndex:        {"heat_index", "c"},
+		state.AbsoluteHumidity: {"absolute_humidity", "value"},
+		state.Illuminance:      {"illuminance", "value"},
+	} {
+		database, measurement, field, ok := series.InfluxSeries(quantity)
+		assert.True(t, ok, quantity)
+		assert.Equal(t, "home", database, quantity)
+		assert.Equal(t, expected, [2]string{measurement, field}, quantity)
+	}
+}
@@ -0,0 +1,184 @@
+package multisensor
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"time"
+
+	"github.com/lorahome/server/state"
+)
+
+// Digits after decimal point of MQTT payloads, unless configured
+var defaultPrecision = map[string]int{
+	state.Temperature:       1,
+	state.Humidity:          0,
+	state.AmbientLight:      0,
+	state.AmbientLightWhite: 0,
+	state.BatteryVoltage:    2,
+	state.BatteryLevel:      0,
+	state.DewPoint:          1,
+	state.HeatIndex:         1,
+	state.AbsoluteHumidity:  1,
+	state.Illuminance:       0,
+}
+
+// valueFormat defines how value is published to MQTT
+type valueFormat struct {
+	// Unit to convert value into:
+	// - temperatures (incl. dew point / heat index): "C" (default), "F", "K"
+	// - battery voltage: "V" (default), "mV"
+	Unit string
+	// Digits after decimal point
+	Precision *int
+	// Publish only when value changes more than deadband (in Unit)...
+	Deadband float64
+	// ... or this long passed since value was published
+	MaxInterval time.Duration
+}
+
+// mqttFormatsConfig is per topic format, fields match mqttTopicsConfig
+type mqttFormatsConfig struct {
+	Temperature       *valueFormat
+	Humidity          *valueFormat
+	AmbientLight      *valueFormat
+	AmbientLightWhite *valueFormat
+	BatteryVoltage    *valueFormat
+	BatteryLevel      *valueFormat
+	DewPoint          *valueFormat
+	HeatIndex         *valueFormat
+	AbsoluteHumidity  *valueFormat
+	Lux               *valueFormat
+}
+
+// format is resolved (validated, with defaults) valueFormat
+type format struct {
+	unit        string
+	precision   int
+	deadband    float64
+	maxInterval time.Duration
+}
+
+func (f *mqttFormatsConfig) get(quantity string) *valueFormat {
+	switch quantity {
+	case state.Temperature:
+		return f.Temperature
+	case state.Humidity:
+		return f.Humidity
+	case state.AmbientLight:
+		return f.AmbientLight
+	case state.AmbientLightWhite:
+		return f.AmbientLightWhite
+	case state.BatteryVoltage:
+		return f.BatteryVoltage
+	case state.BatteryLevel:
+		return f.BatteryLevel
+	case state.DewPoint:
+		return f.DewPoint
+	case state.HeatIndex:
+		return f.HeatIndex
+	case state.AbsoluteHumidity:
+		return f.AbsoluteHumidity
+	case state.Illuminance:
+		return f.Lux
+	}
+
+	return nil
+}
+
+// resolveFormats validates formats of all quantities and fills in defaults
+func (m *mqttConfig) resolveFormats() (map[string]format, error) {
+	if m.Formats == nil {
+		m.Formats = &mqttFormatsConfig{}
+	}
+
+	formats := map[string]format{}
+	for quantity, precision := range defaultPrecision {
+		f := format{precision: precision}
+		vf := m.Formats.get(quantity)
+		if vf != nil {
+			f.unit = vf.Unit
+			f.deadband = vf.Deadband
+			f.maxInterval = vf.MaxInterval
+			if vf.Precision != nil {
+				f.precision = *vf.Precision
+			}
+		}
+		switch quantity {
+		case state.Temperature, state.DewPoint, state.HeatIndex:
+			if f.unit == "" {
+				f.unit = "C"
+				if m.ImperialUnits {
+					f.unit = "F"
+				}
+			}
+			if f.unit != "C" && f.unit != "F" && f.unit != "K" {
+				return nil, fmt.Errorf("%s: unsupported unit '%s'", quantity, f.unit)
+			}
+		case state.BatteryVoltage:
+			if f.unit == "" {
+				f.unit = "V"
+			}
+			if f.unit != "V" && f.unit != "mV" {
+				return nil, fmt.Errorf("%s: unsupported unit '%s'", quantity, f.unit)
+			}
+			if f.unit == "mV" && (vf == nil || vf.Precision == nil) {
+				f.precision = 0
+			}
+		default:
+			if f.unit != "" {
+				return nil, fmt.Errorf("%s: unit conversion is not supported", quantity)
+			}
+		}
+		if f.precision < 0 {
+			return nil, fmt.Errorf("%s: negative precision", quantity)
+		}
+		if f.deadband < 0 || f.maxInterval < 0 {
+			return nil, fmt.Errorf("%s: negative deadband / max interval", quantity)
+		}
+		formats[quantity] = f
+	}
+
+	return formats, nil
+}
+
+// convert converts value from base unit (C, V) into configured one
+func (f format) convert(value float64) float64 {
+	switch f.unit {
+	case "F":
+		return celsiusToFahrenheit(value)
+	case "K":
+		return value + 273.15
+	case "mV":
+		return value * 1000
+	}
+
+	return value
+}
+
+// round converts value and rounds it to configured precision
+func (f format) round(value float64) float64 {
+	p := math.Pow10(f.precision)
+
+	return math.Round(f.convert(value)*p) / p
+}
+
+// String converts and formats value as MQTT payload
+func (f format) String(value float64) string {
+	return strconv.FormatFloat(f.convert(value), 'f', f.precision, 64)
+}
+
+// stateDocument returns JSON document of all values, e.g.
+// {"temperature": 21.5, "humidity": 40, "time": "2020-01-01T10:00:00Z"}
+func stateDocument(values map[string]float64, formats map[string]format, timestamp time.Time) string {
+	doc := map[string]interface{}{
+		"time": timestamp.UTC().Format(time.RFC3339),
+	}
+	for quantity, value := range values {
+		doc[quantity] = formats[quantity].round(value)
+	}
+	payload, _ := json.Marshal(doc)
+
+	return string(payload)
+}
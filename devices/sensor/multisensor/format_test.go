@@ -0,0 +1,84 @@
+package multisensor
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/lorahome/server/config"
+	"github.com/lorahome/server/state"
+)
+
+func TestResolveFormats(t *testing.T) {
+	cfg := &mqttConfig{ImperialUnits: true}
+	formats, err := cfg.resolveFormats()
+	require.NoError(t, err)
+	assert.Equal(t, "69.8", formats[state.Temperature].String(21))
+	assert.Equal(t, "41", formats[state.Humidity].String(40.6))
+	assert.Equal(t, "2.95", formats[state.BatteryVoltage].String(2.9512))
+
+	cfg = &mqttConfig{ImperialUnits: true}
+	require.NoError(t, config.Decode(map[string]interface{}{
+		"formats": map[string]interface{}{
+			"temperature":    map[string]interface{}{"unit": "C", "precision": 2},
+			"humidity":       map[string]interface{}{"precision": 1},
+			"batteryVoltage": map[string]interface{}{"unit": "mV"},
+			"dewPoint":       map[string]interface{}{"unit": "K", "precision": 0},
+		},
+	}, cfg))
+	formats, err = cfg.resolveFormats()
+	require.NoError(t, err)
+	assert.Equal(t, "21.25", formats[state.Temperature].String(21.25))
+	assert.Equal(t, "40.6", formats[state.Humidity].String(40.6))
+	assert.Equal(t, "2951", formats[state.BatteryVoltage].String(2.951))
+	assert.Equal(t, "283", formats[state.DewPoint].String(10))
+	// Imperial units still apply to other temperatures
+	assert.Equal(t, "86.0", formats[state.HeatIndex].String(30))
+
+	for _, formats := range []*mqttFormatsConfig{
+		{Temperature: &valueFormat{Unit: "mV"}},
+		{BatteryVoltage: &valueFormat{Unit: "F"}},
+		{Humidity: &valueFormat{Unit: "%"}},
+	} {
+		_, err := (&mqttConfig{Formats: formats}).resolveFormats()
+		assert.Error(t, err)
+	}
+}
+
+func TestStateDocument(t *testing.T) {
+	formats, err := (&mqttConfig{}).resolveFormats()
+	require.NoError(t, err)
+	ts := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	doc := stateDocument(map[string]float64{
+		state.Temperature:    21.349,
+		state.Humidity:       40.6,
+		state.BatteryVoltage: 2.951,
+	}, formats, ts)
+	assert.JSONEq(t, `{"temperature": 21.3, "humidity": 41, "battery_voltage": 2.95, "time": "2020-01-02T03:04:05Z"}`, doc)
+}
+
+func TestChangeSuppression(t *testing.T) {
+	cfg := &mqttConfig{}
+	require.NoError(t, config.Decode(map[string]interface{}{
+		"formats": map[string]interface{}{
+			"temperature": map[string]interface{}{"unit": "F", "deadband": 0.5, "maxInterval": "10m"},
+		},
+	}, cfg))
+	formats, err := cfg.resolveFormats()
+	require.NoError(t, err)
+	s := &MultiSensor{formats: formats, published: map[string]publishedValue{}}
+
+	now := time.Now()
+	assert.True(t, s.changed(state.Temperature, 20, now))
+	// 0.2C is 0.36F, within deadband
+	assert.False(t, s.changed(state.Temperature, 20.2, now.Add(time.Minute)))
+	assert.True(t, s.changed(state.Temperature, 20.4, now.Add(2*time.Minute)))
+	assert.False(t, s.changed(state.Temperature, 20.4, now.Add(5*time.Minute)))
+	// Max interval since last publish
+	assert.True(t, s.changed(state.Temperature, 20.4, now.Add(12*time.Minute)))
+	// No suppression configured
+	assert.True(t, s.changed(state.Humidity, 40, now))
+	assert.True(t, s.changed(state.Humidity, 40, now))
+}
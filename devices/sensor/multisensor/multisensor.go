@@ -2,21 +2,21 @@ package multisensor
 
 import (
 	"context"
-	"encoding/hex"
 	"errors"
 	"fmt"
+	"math"
 	"time"
 
 	"github.com/golang/glog"
 	"github.com/golang/protobuf/proto"
 	influxClient "github.com/influxdata/influxdb1-client/v2"
 	pb "github.com/lorahome/devices/go/proto/sensor"
-	"github.com/mitchellh/mapstructure"
 
+	"github.com/lorahome/server/config"
 	"github.com/lorahome/server/db/influxdb"
 	"github.com/lorahome/server/devices"
-	"github.com/lorahome/server/encoding"
 	"github.com/lorahome/server/mqtt"
+	"github.com/lorahome/server/state"
 )
 
 const (
@@ -30,17 +30,31 @@ type MultiSensor struct {
 	devices.BaseDevice `yaml:",inline" mapstructure:",squash"`
 	InfluxDb           *influxDbConfig
 	Mqtt               *mqttConfig
-	Key                string
+	// Per quantity correction of raw readings
+	Calibration *calibrationConfig
+	// Lux per raw ambient light count
+	LuxFactor float64
 
 	// Private
-	keyBytes     []byte
 	influxClient *influxdb.InfluxDB
 	mqttClient   *mqtt.MqttClient
+	battery      devices.BatteryLevels
+	formats      map[string]format
+	aggregator   *influxdb.Aggregator
+	// Last value published per quantity (change based suppression)
+	published map[string]publishedValue
+}
+
+type publishedValue struct {
+	value float64
+	time  time.Time
 }
 
 type influxDbConfig struct {
 	Database     string
 	Measurements *measurementsConfig
+	// Write one aggregated point per window instead of point per uplink
+	Aggregation *influxdb.AggregationConfig
 }
 
 type measurementsConfig struct {
@@ -48,10 +62,20 @@ type measurementsConfig struct {
 	Humidity       string
 	AmbientLight   string
 	BatteryVoltage string
+	// Derived values
+	DewPoint         string
+	HeatIndex        string
+	AbsoluteHumidity string
+	Lux              string
 }
 
 type mqttConfig struct {
-	Topics        *mqttTopicsConfig
+	Topics  *mqttTopicsConfig
+	Formats *mqttFormatsConfig
+	// Topic of JSON document with all values (and timestamp)
+	StateTopic string
+	// Publish JSON document only, no topic per value
+	StateOnly     bool
 	Retain        bool
 	Qos           byte
 	ImperialUnits bool
@@ -63,6 +87,41 @@ type mqttTopicsConfig struct {
 	AmbientLight      string
 	AmbientLightWhite string
 	BatteryVoltage    string
+	BatteryLevel      string
+	DewPoint          string
+	HeatIndex         string
+	AbsoluteHumidity  string
+	Lux               string
+}
+
+func (t *mqttTopicsConfig) get(quantity string) string {
+	if t == nil {
+		return ""
+	}
+	switch quantity {
+	case state.Temperature:
+		return t.Temperature
+	case state.Humidity:
+		return t.Humidity
+	case state.AmbientLight:
+		return t.AmbientLight
+	case state.AmbientLightWhite:
+		return t.AmbientLightWhite
+	case state.BatteryVoltage:
+		return t.BatteryVoltage
+	case state.BatteryLevel:
+		return t.BatteryLevel
+	case state.DewPoint:
+		return t.DewPoint
+	case state.HeatIndex:
+		return t.HeatIndex
+	case state.AbsoluteHumidity:
+		return t.AbsoluteHumidity
+	case state.Illuminance:
+		return t.Lux
+	}
+
+	return ""
 }
 
 func NewMultiSensor(cfg interface{}, caps *devices.Capabilities) (devices.Device, error) {
@@ -72,10 +131,23 @@ func NewMultiSensor(cfg interface{}, caps *devices.Capabilities) (devices.Device
 			Url:       Url,
 			ClassName: ClassName,
 		},
+		LuxFactor:    defaultLuxFactor,
 		influxClient: caps.InfluxDb,
 		mqttClient:   caps.Mqtt,
+		battery:      caps.Battery,
+		published:    map[string]publishedValue{},
 	}
-	err := mapstructure.Decode(cfg, dev)
+	err := config.Decode(cfg, dev)
+	if err != nil {
+		return nil, err
+	}
+
+	if dev.Calibration == nil {
+		dev.Calibration = &calibrationConfig{}
+	}
+
+	// Validate MQTT value formats
+	dev.formats, err = dev.mqttConfig().resolveFormats()
 	if err != nil {
 		return nil, err
 	}
@@ -103,93 +175,182 @@ func NewMultiSensor(cfg interface{}, caps *devices.Capabilities) (devices.Device
 		if msr.Humidity == "" {
 			msr.Humidity = "humidity"
 		}
+		if msr.DewPoint == "" {
+			msr.DewPoint = "dew_point"
+		}
+		if msr.HeatIndex == "" {
+			msr.HeatIndex = "heat_index"
+		}
+		if msr.AbsoluteHumidity == "" {
+			msr.AbsoluteHumidity = "absolute_humidity"
+		}
+		if msr.Lux == "" {
+			msr.Lux = "illuminance"
+		}
+		if idb.Aggregation != nil {
+			dev.aggregator, err = influxdb.NewAggregator(idb.Aggregation, caps.InfluxDb, idb.Database)
+			if err != nil {
+				return nil, err
+			}
+		}
 	}
 
-	// Convert AES key into byte array
-	dev.keyBytes, err = hex.DecodeString(dev.Key)
+	// Convert AES keys into byte arrays
+	err = dev.LoadKeys()
 
 	return dev, err
 }
 
 func (m *MultiSensor) Start(ctx context.Context) error {
+	if m.aggregator != nil {
+		// Do not lose partial window on exit
+		go func() {
+			<-ctx.Done()
+			err := m.aggregator.Flush()
+			if err != nil {
+				glog.Errorf("%s: unable to write aggregated points: %v", m.Name, err)
+			}
+		}()
+	}
+
 	return nil
 }
 
 func (s *MultiSensor) ProcessMessage(encrypted []byte) error {
 	// Decrypt message
-	decrypted, err := encoding.AESdecryptCBC(s.keyBytes, encrypted)
+	decrypted, err := s.Decrypt(encrypted)
 	if err != nil {
 		return err
 	}
 
 	// Unpack multiSensor protobuf
-	ms := &pb.MultiSensorStatus{}
-	err = proto.Unmarshal(decrypted, ms)
+	msg, err := s.Decode(decrypted)
 	if err != nil {
 		return err
 	}
+	ms := msg.(*pb.MultiSensorStatus)
 
 	glog.Infof("Got update from '%s':", s.Name)
 
-	// Prepare InfluxDB points / MQTT topics
+	// Prepare InfluxDB points / MQTT values
+	msr := s.measurements()
 	influxPoints := map[string]influxdb.KV{}
-	mqttTopics := map[string]string{}
+	values := map[string]float64{}
+	report := func(quantity string, value float64) {
+		values[quantity] = value
+		s.Report(quantity, value)
+	}
+	var tempC, humidity float64
 	if ms.Temperature != nil {
-		if s.InfluxDb.Measurements.Temperature != "" {
-			influxPoints[s.InfluxDb.Measurements.Temperature] = influxdb.KV{
-				"c": ms.Temperature.ValueC,
-				"f": ms.Temperature.ValueF,
-			}
-		}
-		if s.Mqtt.Topics.Temperature != "" {
-			if s.Mqtt.ImperialUnits {
-				mqttTopics[s.Mqtt.Topics.Temperature] = fmt.Sprintf("%.1f", ms.Temperature.ValueF)
-			} else {
-				mqttTopics[s.Mqtt.Topics.Temperature] = fmt.Sprintf("%.1f", ms.Temperature.ValueC)
-			}
+		tempC = float64(ms.Temperature.ValueC)
+		tempF := float64(ms.Temperature.ValueF)
+		if s.Calibration.Temperature != nil {
+			tempC = s.Calibration.Temperature.apply(tempC)
+			tempF = celsiusToFahrenheit(tempC)
 		}
-		glog.Infof("\tTemperature %vC, %vF", ms.Temperature.ValueC, ms.Temperature.ValueF)
+		addTemperature(influxPoints, msr.Temperature, tempC, tempF)
+		report(state.Temperature, tempC)
+		glog.Infof("\tTemperature %vC, %vF", tempC, tempF)
 	}
 	if ms.Humidity != nil {
-		if s.InfluxDb.Measurements.Humidity != "" {
-			influxPoints[s.InfluxDb.Measurements.Humidity] = influxdb.KV{
-				"value": ms.Humidity.Value,
+		humidity = math.Max(0, math.Min(100, s.Calibration.Humidity.apply(float64(ms.Humidity.Value))))
+		if msr.Humidity != "" {
+			influxPoints[msr.Humidity] = influxdb.KV{
+				"value": humidity,
 			}
 		}
-		if s.Mqtt.Topics.Humidity != "" {
-			mqttTopics[s.Mqtt.Topics.Humidity] = fmt.Sprintf("%.0f", ms.Humidity.Value)
+		report(state.Humidity, humidity)
+		glog.Infof("\tHumidity %v", humidity)
+	}
+	if ms.Temperature != nil && ms.Humidity != nil && humidity > 0 {
+		dew := dewPoint(tempC, humidity)
+		addTemperature(influxPoints, msr.DewPoint, dew, celsiusToFahrenheit(dew))
+		report(state.DewPoint, dew)
+
+		hi := heatIndex(tempC, humidity)
+		addTemperature(influxPoints, msr.HeatIndex, hi, celsiusToFahrenheit(hi))
+		report(state.HeatIndex, hi)
+
+		ah := absoluteHumidity(tempC, humidity)
+		if msr.AbsoluteHumidity != "" {
+			influxPoints[msr.AbsoluteHumidity] = influxdb.KV{
+				"value": ah,
+			}
 		}
-		glog.Infof("\tHumidity %v", ms.Humidity.Value)
+		report(state.AbsoluteHumidity, ah)
+		glog.Infof("\tDew point %.1fC, heat index %.1fC, absolute humidity %.1fg/m3", dew, hi, ah)
 	}
 	if ms.AmbientLight != nil {
-		if s.InfluxDb.Measurements.AmbientLight != "" {
-			influxPoints[s.InfluxDb.Measurements.AmbientLight] = influxdb.KV{
+		if msr.AmbientLight != "" {
+			influxPoints[msr.AmbientLight] = influxdb.KV{
 				"als":   ms.AmbientLight.Value,
 				"white": ms.AmbientLight.WhiteValue,
 			}
 		}
-		if s.Mqtt.Topics.AmbientLight != "" {
-			mqttTopics[s.Mqtt.Topics.AmbientLight] = fmt.Sprintf("%d", ms.AmbientLight.Value)
-		}
-		if s.Mqtt.Topics.AmbientLightWhite != "" {
-			mqttTopics[s.Mqtt.Topics.AmbientLightWhite] = fmt.Sprintf("%d", ms.AmbientLight.WhiteValue)
-		}
+		report(state.AmbientLight, float64(ms.AmbientLight.Value))
+		report(state.AmbientLightWhite, float64(ms.AmbientLight.WhiteValue))
 		glog.Infof("\tAmbientLight %v (white %v)", ms.AmbientLight.Value, ms.AmbientLight.WhiteValue)
+
+		lux := math.Max(0, s.Calibration.Lux.apply(float64(ms.AmbientLight.Value)*s.LuxFactor))
+		if msr.Lux != "" {
+			influxPoints[msr.Lux] = influxdb.KV{
+				"value": lux,
+			}
+		}
+		report(state.Illuminance, lux)
+		glog.Infof("\tIlluminance %.1f lux", lux)
 	}
 	if ms.Battery != nil {
-		volts := float64(ms.Battery.VoltageMv) / 1000
-		if s.InfluxDb.Measurements.BatteryVoltage != "" {
-			influxPoints[s.InfluxDb.Measurements.BatteryVoltage] = influxdb.KV{
+		volts := s.Calibration.BatteryVoltage.apply(float64(ms.Battery.VoltageMv) / 1000)
+		if msr.BatteryVoltage != "" {
+			influxPoints[msr.BatteryVoltage] = influxdb.KV{
 				"voltage": volts,
 			}
 		}
-		if s.Mqtt.Topics.BatteryVoltage != "" {
-			mqttTopics[s.Mqtt.Topics.BatteryVoltage] = fmt.Sprintf("%0.2f", volts)
-		}
+		report(state.BatteryVoltage, volts)
 		glog.Infof("\tBattery Voltage %v", volts)
+		// Level is published alongside voltage, battery monitor stores it
+		if s.battery != nil {
+			if level, ok := s.battery.Level(s.Name, s.ClassName, volts); ok {
+				values[state.BatteryLevel] = level
+				glog.Infof("\tBattery Level %v%%", level)
+			}
+		}
 	}
 
 	// Emit all InfluxDB points
+	timestamp := time.Now()
+	err = s.writeInfluxPoints(influxPoints, timestamp)
+	if err != nil {
+		return err
+	}
+
+	// Publish all MQTT topics
+	mqttCfg := s.mqttConfig()
+	changed := false
+	for quantity, value := range values {
+		if !s.changed(quantity, value, timestamp) {
+			continue
+		}
+		changed = true
+		topic := s.topic(quantity)
+		if topic == "" || mqttCfg.StateOnly {
+			continue
+		}
+		s.publish(topic, s.formats[quantity].String(value))
+	}
+	if mqttCfg.StateTopic != "" && changed {
+		s.publish(mqttCfg.StateTopic, stateDocument(values, s.formats, timestamp))
+	}
+
+	return nil
+}
+
+// writeInfluxPoints writes points of all measurements, unless device has no InfluxDB config
+func (s *MultiSensor) writeInfluxPoints(influxPoints map[string]influxdb.KV, timestamp time.Time) error {
+	if s.InfluxDb == nil {
+		return nil
+	}
 	batchPoints, err := influxClient.NewBatchPoints(influxClient.BatchPointsConfig{
 		Precision: "s",
 		Database:  s.InfluxDb.Database,
@@ -202,7 +363,15 @@ func (s *MultiSensor) ProcessMessage(encrypted []byte) error {
 		"class_name": s.ClassName,
 		"name":       s.Name,
 	}
-	timestamp := time.Now()
+	if s.aggregator != nil {
+		for measurement, points := range influxPoints {
+			err := s.aggregator.Add(measurement, influxTags, points, timestamp)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
 	for measurement, points := range influxPoints {
 		point, err := influxClient.NewPoint(
 			measurement,
@@ -215,22 +384,112 @@ func (s *MultiSensor) ProcessMessage(encrypted []byte) error {
 		}
 		batchPoints.AddPoint(point)
 	}
-	err = s.influxClient.Write(batchPoints)
+
+	return s.influxClient.Write(batchPoints)
+}
+
+func (s *MultiSensor) publish(topic, payload string) {
+	mqttCfg := s.mqttConfig()
+	err := s.mqttClient.Publish(topic, payload, mqttCfg.Qos, mqttCfg.Retain)
 	if err != nil {
-		return err
+		glog.Errorf("MQTT Publish failed: %v", err)
 	}
+}
 
-	// Publish all MQTT topics
-	for topic, value := range mqttTopics {
-		s.mqttClient.Publish(topic, value, s.Mqtt.Qos, s.Mqtt.Retain)
-		if err != nil {
-			glog.Errorf("MQTT Publish failed: %v", err)
+// changed checks whether value has to be published: it moved out of deadband
+// of the last published value, or max interval passed
+func (s *MultiSensor) changed(quantity string, value float64, now time.Time) bool {
+	f := s.formats[quantity]
+	last, ok := s.published[quantity]
+	if ok && (f.deadband > 0 || f.maxInterval > 0) {
+		moved := math.Abs(f.convert(value)-f.convert(last.value)) > f.deadband
+		expired := f.maxInterval > 0 && now.Sub(last.time) >= f.maxInterval
+		if !moved && !expired {
+			return false
 		}
 	}
+	s.published[quantity] = publishedValue{value, now}
 
-	return nil
+	return true
+}
+
+// topic returns MQTT topic of quantity: explicitly configured one,
+// or rendered from topic template
+func (s *MultiSensor) topic(quantity string) string {
+	if topic := s.mqttConfig().Topics.get(quantity); topic != "" {
+		return topic
+	}
+
+	return s.mqttClient.DeviceTopic(s.ClassName, s.Name, quantity)
+}
+
+// mqttConfig returns MQTT config, defaults if device has none
+func (s *MultiSensor) mqttConfig() *mqttConfig {
+	if s.Mqtt == nil {
+		return &mqttConfig{}
+	}
+
+	return s.Mqtt
+}
+
+// measurements returns InfluxDB measurements, none if InfluxDB is not configured
+func (s *MultiSensor) measurements() *measurementsConfig {
+	if s.InfluxDb == nil {
+		return &measurementsConfig{}
+	}
+
+	return s.InfluxDb.Measurements
+}
+
+// addTemperature adds InfluxDB point (both C and F) of temperature like value,
+// if measurement is set
+func addTemperature(influxPoints map[string]influxdb.KV, measurement string, celsius, fahrenheit float64) {
+	if measurement != "" {
+		influxPoints[measurement] = influxdb.KV{
+			"c": celsius,
+			"f": fahrenheit,
+		}
+	}
+}
+
+// InfluxSeries returns InfluxDB database / measurement / field quantity is written into
+func (s *MultiSensor) InfluxSeries(quantity string) (string, string, string, bool) {
+	if s.InfluxDb == nil {
+		return "", "", "", false
+	}
+	msr := s.InfluxDb.Measurements
+	var measurement, field string
+	switch quantity {
+	case state.Temperature:
+		measurement, field = msr.Temperature, "c"
+	case state.Humidity:
+		measurement, field = msr.Humidity, "value"
+	case state.AmbientLight:
+		measurement, field = msr.AmbientLight, "als"
+	case state.AmbientLightWhite:
+		measurement, field = msr.AmbientLight, "white"
+	case state.BatteryVoltage:
+		measurement, field = msr.BatteryVoltage, "voltage"
+	case state.DewPoint:
+		measurement, field = msr.DewPoint, "c"
+	case state.HeatIndex:
+		measurement, field = msr.HeatIndex, "c"
+	case state.AbsoluteHumidity:
+		measurement, field = msr.AbsoluteHumidity, "value"
+	case state.Illuminance:
+		measurement, field = msr.Lux, "value"
+	}
+
+	return s.InfluxDb.Database, measurement, field, measurement != ""
+}
+
+func (s *MultiSensor) Decode(payload []byte) (proto.Message, error) {
+	ms := &pb.MultiSensorStatus{}
+	err := proto.Unmarshal(payload, ms)
+
+	return ms, err
 }
 
 func init() {
-	devices.RegisterDeviceClass(Url, NewMultiSensor)
+	devices.RegisterDeviceClass(Url, ClassName, NewMultiSensor)
 }
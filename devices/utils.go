@@ -1,11 +1,16 @@
 package devices
 
 import (
+	"fmt"
 	"io/ioutil"
+	"os"
 	"strings"
 
 	"github.com/golang/glog"
+	"github.com/mitchellh/mapstructure"
 	"gopkg.in/yaml.v2"
+
+	"github.com/lorahome/server/fileutil"
 )
 
 // LoadFromFile reads and parses device definitions from YAML
@@ -55,5 +60,65 @@ func SaveToFile(filename string) error {
 		return err
 	}
 
-	return ioutil.WriteFile(filename, data, 0644)
+	return fileutil.WriteAtomic(filename, data, 0644)
+}
+
+// AddToFile appends device definition into devices file, without
+// instantiating (and therefore resolving secrets of) existing devices.
+// Returns error if device with the same id is already defined.
+func AddToFile(filename, url string, id uint64, cfg map[string]interface{}) error {
+	devices, err := readFile(filename)
+	if err != nil {
+		return err
+	}
+	err = checkIdUnique(devices, id)
+	if err != nil {
+		return err
+	}
+
+	cfg["id"] = id
+	devices[url] = append(devices[url], cfg)
+	data, err := yaml.Marshal(devices)
+	if err != nil {
+		return err
+	}
+
+	return fileutil.WriteAtomic(filename, data, 0644)
+}
+
+// CheckIdInFile returns error if device with id is already defined in devices file
+func CheckIdInFile(filename string, id uint64) error {
+	devices, err := readFile(filename)
+	if err != nil {
+		return err
+	}
+
+	return checkIdUnique(devices, id)
+}
+
+// readFile returns raw device definitions of devices file, by url
+func readFile(filename string) (map[string][]interface{}, error) {
+	devices := map[string][]interface{}{}
+	data, err := ioutil.ReadFile(filename)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	err = yaml.Unmarshal(data, devices)
+
+	return devices, err
+}
+
+func checkIdUnique(devices map[string][]interface{}, id uint64) error {
+	for _, list := range devices {
+		for _, device := range list {
+			existing := &BaseDevice{}
+			// Ignore errors of other fields, only id matters
+			mapstructure.Decode(device, existing)
+			if existing.Id == id {
+				return fmt.Errorf("device with id 0x%x already exists", id)
+			}
+		}
+	}
+
+	return nil
 }
@@ -0,0 +1,32 @@
+package downlink
+
+import (
+	"bytes"
+	"encoding/binary"
+)
+
+// Confirmed downlink envelope (before encryption):
+//   - server to device: "LHCD" | message id (2 bytes, LE) | payload
+//   - device acknowledges it with uplink "LHAK" | message id (2 bytes, LE)
+const (
+	confirmedMagic = "LHCD"
+	ackMagic       = "LHAK"
+)
+
+func wrapConfirmed(id uint16, payload []byte) []byte {
+	res := make([]byte, len(confirmedMagic)+2, len(confirmedMagic)+2+len(payload))
+	copy(res, confirmedMagic)
+	binary.LittleEndian.PutUint16(res[len(confirmedMagic):], id)
+
+	return append(res, payload...)
+}
+
+// ParseAck checks whether decrypted uplink is acknowledge of confirmed
+// downlink and returns id of acknowledged message
+func ParseAck(decrypted []byte) (uint16, bool) {
+	if len(decrypted) != len(ackMagic)+2 || !bytes.HasPrefix(decrypted, []byte(ackMagic)) {
+		return 0, false
+	}
+
+	return binary.LittleEndian.Uint16(decrypted[len(ackMagic):]), true
+}
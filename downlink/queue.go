@@ -0,0 +1,455 @@
+package downlink
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+
+	"github.com/lorahome/server/config"
+	"github.com/lorahome/server/mqtt"
+	"github.com/lorahome/server/transport"
+)
+
+// Status of downlink message delivery
+type Status string
+
+const (
+	StatusSent       Status = "sent"
+	StatusDelivered  Status = "delivered"
+	StatusFailed     Status = "failed"
+	StatusExpired    Status = "expired"
+	StatusSuperseded Status = "superseded"
+	// Rejected due to transmitter duty cycle limits
+	StatusRejected Status = "rejected"
+)
+
+// Message is downlink (server to device) message
+type Message struct {
+	DeviceId uint64
+	// Kind of message: queued message superseded by newer one of the same kind
+	// (e.g. only the latest light level matters). Empty kind never superseded.
+	Kind string
+	// Plain payload, encoded right before sending
+	Payload []byte
+	// Encode encrypts payload into packet ready to be sent
+	Encode func(payload []byte) ([]byte, error)
+	// Deliver in receive window following the next device uplink,
+	// instead of sending immediately
+	AfterUplink bool
+	// Message discarded if not delivered until this time
+	Expires time.Time
+	// Confirmed message must be acknowledged by device,
+	// otherwise it is retransmitted with backoff
+	Confirmed bool
+	// OnStatus (optional) is called once delivery status of message is known
+	OnStatus func(msg *Message, status Status)
+
+	// Assigned by queue, used by device to acknowledge confirmed message
+	Id        uint16
+	attempts  int
+	nextRetry time.Time
+	deferred  bool
+}
+
+// Record is delivery status of downlink message
+type Record struct {
+	Id       uint16    `json:"id"`
+	DeviceId uint64    `json:"device_id"`
+	Kind     string    `json:"kind"`
+	Status   Status    `json:"status"`
+	Attempts int       `json:"attempts"`
+	Time     time.Time `json:"time"`
+}
+
+// How many delivery records are kept per device
+const historySize = 16
+
+// Retry interval of message deferred by transport which does not tell
+// when duty cycle budget is available again
+const dutyCycleRetry = time.Minute
+
+// Queue is per device downlink queue
+type Queue struct {
+	// Default time to live of queued messages
+	Ttl time.Duration
+	// Confirmed messages: number of retransmissions and
+	// time to wait for first acknowledge (doubled on every retry)
+	Retries    int
+	AckTimeout time.Duration
+	// MQTT topic to publish delivery status of confirmed messages to,
+	// "{id}" is replaced with device id
+	StatusTopic string
+	// What to do with message exceeding transmitter duty cycle budget:
+	// "queue" (default) - send once budget is available, "reject" - fail
+	OverBudget string
+
+	transport  transport.LoRaTransport
+	mqttClient *mqtt.MqttClient
+	pending    map[uint64][]*Message
+	inflight   map[uint64]map[uint16]*Message
+	history    map[uint64][]*Record
+	deferred   []*Message
+	observers  []func(Record)
+	lastId     uint16
+	lock       sync.Mutex
+}
+
+func NewQueue(cfg interface{}, t transport.LoRaTransport, mqttClient *mqtt.MqttClient) (*Queue, error) {
+	q := &Queue{
+		Ttl:        time.Hour,
+		Retries:    3,
+		AckTimeout: 5 * time.Second,
+		transport:  t,
+		mqttClient: mqttClient,
+		pending:    map[uint64][]*Message{},
+		inflight:   map[uint64]map[uint16]*Message{},
+		history:    map[uint64][]*Record{},
+	}
+	if cfg == nil {
+		// Defaults only
+		return q, nil
+	}
+
+	// Map configuration into structure
+	err := config.Decode(cfg, q)
+
+	return q, err
+}
+
+// Run retransmits unacknowledged confirmed messages and messages
+// deferred by duty cycle limits until context canceled
+func (q *Queue) Run(ctx context.Context) error {
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case now := <-ticker.C:
+			q.retransmit(now)
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// Enqueue sends message immediately or puts it into device queue
+// until next uplink from the device
+func (q *Queue) Enqueue(msg *Message) error {
+	q.lock.Lock()
+	if msg.Expires.IsZero() {
+		msg.Expires = time.Now().Add(q.Ttl)
+	}
+	if msg.Confirmed {
+		q.lastId++
+		msg.Id = q.lastId
+	}
+
+	// De-duplicate: drop superseded messages of the same kind
+	superseded := []*Message{}
+	if msg.Kind != "" {
+		queue := q.pending[msg.DeviceId]
+		for i, queued := range queue {
+			if queued.Kind == msg.Kind {
+				superseded = append(superseded, queued)
+				q.pending[msg.DeviceId] = append(queue[:i], queue[i+1:]...)
+				break
+			}
+		}
+		for id, inflight := range q.inflight[msg.DeviceId] {
+			if inflight.Kind == msg.Kind {
+				superseded = append(superseded, inflight)
+				delete(q.inflight[msg.DeviceId], id)
+			}
+		}
+		deferred := q.deferred[:0]
+		for _, d := range q.deferred {
+			if d.DeviceId == msg.DeviceId && d.Kind == msg.Kind {
+				superseded = append(superseded, d)
+			} else {
+				deferred = append(deferred, d)
+			}
+		}
+		q.deferred = deferred
+	}
+	if msg.AfterUplink {
+		q.pending[msg.DeviceId] = append(q.pending[msg.DeviceId], msg)
+	}
+	q.lock.Unlock()
+
+	for _, s := range superseded {
+		q.report(s, StatusSuperseded)
+	}
+	if msg.AfterUplink {
+		return nil
+	}
+
+	return q.send(msg, time.Now())
+}
+
+// OnUplink delivers first pending message to the device,
+// must be called right after uplink received (device receive window)
+func (q *Queue) OnUplink(deviceId uint64) error {
+	now := time.Now()
+	q.lock.Lock()
+	queue := []*Message{}
+	var msg *Message
+	expired := []*Message{}
+	for _, queued := range q.pending[deviceId] {
+		switch {
+		case now.After(queued.Expires):
+			expired = append(expired, queued)
+		case msg == nil && !now.Before(queued.nextRetry):
+			msg = queued
+		default:
+			// Deferred by duty cycle, or the next one
+			queue = append(queue, queued)
+		}
+	}
+	if len(queue) == 0 {
+		delete(q.pending, deviceId)
+	} else {
+		q.pending[deviceId] = queue
+	}
+	q.lock.Unlock()
+
+	for _, e := range expired {
+		q.report(e, StatusExpired)
+	}
+	if msg == nil {
+		return nil
+	}
+
+	return q.send(msg, now)
+}
+
+// Ack marks confirmed message as delivered
+func (q *Queue) Ack(deviceId uint64, id uint16) {
+	q.lock.Lock()
+	msg, ok := q.inflight[deviceId][id]
+	if ok {
+		delete(q.inflight[deviceId], id)
+	}
+	q.lock.Unlock()
+
+	if !ok {
+		glog.Infof("Unexpected ack %d from %d (already acknowledged?)", id, deviceId)
+		return
+	}
+	q.report(msg, StatusDelivered)
+}
+
+// Pending returns messages waiting for delivery to the device
+func (q *Queue) Pending(deviceId uint64) []*Message {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	res := []*Message{}
+	for _, msg := range q.pending[deviceId] {
+		if time.Now().Before(msg.Expires) {
+			res = append(res, msg)
+		}
+	}
+
+	return res
+}
+
+// Observe registers function called with every status change of every message,
+// unlike MQTT status it includes transmissions of unconfirmed messages
+func (q *Queue) Observe(f func(Record)) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	q.observers = append(q.observers, f)
+}
+
+// History returns delivery status of recent messages sent to the device
+func (q *Queue) History(deviceId uint64) []Record {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	res := []Record{}
+	for _, record := range q.history[deviceId] {
+		res = append(res, *record)
+	}
+
+	return res
+}
+
+func (q *Queue) send(msg *Message, now time.Time) error {
+	payload := msg.Payload
+	if msg.Confirmed {
+		payload = wrapConfirmed(msg.Id, payload)
+	}
+	packet, err := msg.Encode(payload)
+	if err != nil {
+		return err
+	}
+	err = q.transport.Send(packet)
+	if errors.Is(err, transport.ErrDutyCycle) {
+		if q.OverBudget == "reject" {
+			q.report(msg, StatusRejected)
+			return err
+		}
+		q.deferMessage(msg, err, now)
+		return nil
+	}
+	if err != nil {
+		q.report(msg, StatusFailed)
+		return err
+	}
+
+	if msg.Confirmed {
+		// Wait for ack
+		q.lock.Lock()
+		msg.attempts++
+		msg.nextRetry = now.Add(q.AckTimeout << uint(msg.attempts-1))
+		if q.inflight[msg.DeviceId] == nil {
+			q.inflight[msg.DeviceId] = map[uint16]*Message{}
+		}
+		q.inflight[msg.DeviceId][msg.Id] = msg
+		q.lock.Unlock()
+		q.report(msg, StatusSent)
+	} else {
+		q.notify(Record{
+			DeviceId: msg.DeviceId,
+			Kind:     msg.Kind,
+			Status:   StatusSent,
+			Attempts: 1,
+			Time:     now,
+		})
+	}
+
+	return nil
+}
+
+// deferMessage keeps message until transmitter airtime is available again
+func (q *Queue) deferMessage(msg *Message, err error, now time.Time) {
+	retryAt := now.Add(dutyCycleRetry)
+	var dutyCycleErr *transport.DutyCycleError
+	if errors.As(err, &dutyCycleErr) {
+		retryAt = dutyCycleErr.RetryAt
+	}
+
+	q.lock.Lock()
+	logged := msg.deferred
+	msg.deferred = true
+	msg.nextRetry = retryAt
+	if msg.AfterUplink {
+		q.pending[msg.DeviceId] = append([]*Message{msg}, q.pending[msg.DeviceId]...)
+	} else {
+		q.deferred = append(q.deferred, msg)
+	}
+	q.lock.Unlock()
+
+	if !logged {
+		glog.Infof("Downlink '%s' to %d deferred until %v: %v", msg.Kind, msg.DeviceId, retryAt.Format(time.RFC3339), err)
+	}
+}
+
+func (q *Queue) retransmit(now time.Time) {
+	q.lock.Lock()
+	retry := []*Message{}
+	failed := []*Message{}
+	expired := []*Message{}
+	deferred := []*Message{}
+	for _, msg := range q.deferred {
+		switch {
+		case now.After(msg.Expires):
+			expired = append(expired, msg)
+		case now.Before(msg.nextRetry):
+			deferred = append(deferred, msg)
+		default:
+			retry = append(retry, msg)
+		}
+	}
+	q.deferred = deferred
+	for _, messages := range q.inflight {
+		for id, msg := range messages {
+			if now.Before(msg.nextRetry) {
+				continue
+			}
+			delete(messages, id)
+			if msg.attempts > q.Retries || now.After(msg.Expires) {
+				failed = append(failed, msg)
+				continue
+			}
+			if msg.AfterUplink {
+				// Battery device: wait for next uplink
+				q.pending[msg.DeviceId] = append(q.pending[msg.DeviceId], msg)
+				continue
+			}
+			retry = append(retry, msg)
+		}
+	}
+	q.lock.Unlock()
+
+	for _, msg := range failed {
+		q.report(msg, StatusFailed)
+	}
+	for _, msg := range expired {
+		q.report(msg, StatusExpired)
+	}
+	for _, msg := range retry {
+		if msg.attempts > 0 {
+			glog.Infof("Downlink %d to %d not acknowledged, retry %d", msg.Id, msg.DeviceId, msg.attempts)
+		}
+		err := q.send(msg, now)
+		if err != nil {
+			glog.Errorf("Downlink retransmission failed: %v", err)
+		}
+	}
+}
+
+// report delivers message status to owner of message and MQTT
+func (q *Queue) report(msg *Message, status Status) {
+	record := &Record{
+		Id:       msg.Id,
+		DeviceId: msg.DeviceId,
+		Kind:     msg.Kind,
+		Status:   status,
+		Attempts: msg.attempts,
+		Time:     time.Now(),
+	}
+	glog.Infof("Downlink '%s' (%d) to %d: %s", msg.Kind, msg.Id, msg.DeviceId, status)
+
+	// Keep only final status of messages in history
+	if status != StatusSent {
+		q.lock.Lock()
+		history := append(q.history[msg.DeviceId], record)
+		if len(history) > historySize {
+			history = history[1:]
+		}
+		q.history[msg.DeviceId] = history
+		q.lock.Unlock()
+	}
+
+	if msg.OnStatus != nil {
+		msg.OnStatus(msg, status)
+	}
+	q.notify(*record)
+
+	if q.StatusTopic != "" && q.mqttClient != nil {
+		topic := strings.Replace(q.StatusTopic, "{id}", strconv.FormatUint(msg.DeviceId, 10), -1)
+		payload, _ := json.Marshal(record)
+		err := q.mqttClient.Publish(topic, string(payload), 0, false)
+		if err != nil {
+			glog.Errorf("MQTT Publish failed: %v", err)
+		}
+	}
+}
+
+func (q *Queue) notify(record Record) {
+	q.lock.Lock()
+	observers := q.observers
+	q.lock.Unlock()
+
+	for _, f := range observers {
+		f(record)
+	}
+}
@@ -0,0 +1,175 @@
+package downlink
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/lorahome/server/transport"
+)
+
+func encodeAsIs(payload []byte) ([]byte, error) {
+	return payload, nil
+}
+
+func TestQueue(t *testing.T) {
+	source := transport.NewMockLoRaTransport()
+	q, err := NewQueue(map[interface{}]interface{}{"ttl": "1m"}, source, nil)
+	require.NoError(t, err)
+	assert.Equal(t, time.Minute, q.Ttl)
+
+	// Immediate message
+	err = q.Enqueue(&Message{DeviceId: 1, Payload: []byte{1}, Encode: encodeAsIs})
+	assert.NoError(t, err)
+	assert.Equal(t, [][]byte{{1}}, source.History)
+
+	// Queued messages: light level superseded by the latest one
+	for _, msg := range []*Message{
+		{DeviceId: 2, Kind: "light", Payload: []byte{2}},
+		{DeviceId: 2, Kind: "other", Payload: []byte{3}},
+		{DeviceId: 2, Kind: "light", Payload: []byte{4}},
+		{DeviceId: 2, Kind: "expired", Payload: []byte{5}, Expires: time.Now().Add(-time.Second)},
+	} {
+		msg.Encode = encodeAsIs
+		msg.AfterUplink = true
+		require.NoError(t, q.Enqueue(msg))
+	}
+	assert.Len(t, source.History, 1)
+	assert.Len(t, q.Pending(2), 2)
+
+	// One message delivered per uplink
+	assert.NoError(t, q.OnUplink(2))
+	assert.Equal(t, []byte{3}, source.History[1])
+	assert.NoError(t, q.OnUplink(2))
+	assert.Equal(t, []byte{4}, source.History[2])
+	// Expired message is not delivered
+	assert.NoError(t, q.OnUplink(2))
+	assert.Len(t, source.History, 3)
+	assert.Len(t, q.Pending(2), 0)
+
+	// Uplink from device without pending messages
+	assert.NoError(t, q.OnUplink(3))
+	assert.Len(t, source.History, 3)
+}
+
+func TestQueueConfirmed(t *testing.T) {
+	source := transport.NewMockLoRaTransport()
+	q, err := NewQueue(map[interface{}]interface{}{
+		"retries":    2,
+		"ackTimeout": "1s",
+	}, source, nil)
+	require.NoError(t, err)
+
+	statuses := []Status{}
+	onStatus := func(msg *Message, status Status) {
+		statuses = append(statuses, status)
+	}
+
+	// Delivered message: id carried in envelope
+	msg := &Message{DeviceId: 1, Payload: []byte{1}, Encode: encodeAsIs, Confirmed: true, OnStatus: onStatus}
+	require.NoError(t, q.Enqueue(msg))
+	assert.Equal(t, wrapConfirmed(msg.Id, []byte{1}), source.History[0])
+	id, ok := ParseAck(append([]byte(ackMagic), byte(msg.Id), byte(msg.Id>>8)))
+	require.True(t, ok)
+	q.Ack(1, id)
+	assert.Equal(t, []Status{StatusSent, StatusDelivered}, statuses)
+
+	// Not acknowledged message: retransmitted with backoff, then failed
+	statuses = statuses[:0]
+	now := time.Now()
+	require.NoError(t, q.Enqueue(&Message{DeviceId: 1, Payload: []byte{2}, Encode: encodeAsIs, Confirmed: true, OnStatus: onStatus}))
+	q.retransmit(now.Add(500 * time.Millisecond))
+	assert.Len(t, source.History, 2)
+	q.retransmit(now.Add(1100 * time.Millisecond))
+	assert.Len(t, source.History, 3)
+	// Backoff: second retry in 2 seconds
+	q.retransmit(now.Add(2500 * time.Millisecond))
+	assert.Len(t, source.History, 3)
+	q.retransmit(now.Add(3200 * time.Millisecond))
+	assert.Len(t, source.History, 4)
+	q.retransmit(now.Add(8 * time.Second))
+	assert.Len(t, source.History, 4)
+	assert.Equal(t, []Status{StatusSent, StatusSent, StatusSent, StatusFailed}, statuses)
+
+	history := q.History(1)
+	require.Len(t, history, 2)
+	assert.Equal(t, StatusDelivered, history[0].Status)
+	assert.Equal(t, StatusFailed, history[1].Status)
+	assert.Equal(t, 3, history[1].Attempts)
+}
+
+func TestQueueOverBudget(t *testing.T) {
+	source := transport.NewMockLoRaTransport()
+	q, err := NewQueue(nil, source, nil)
+	require.NoError(t, err)
+	statuses := []Status{}
+	onStatus := func(msg *Message, status Status) {
+		statuses = append(statuses, status)
+	}
+
+	// Deferred until airtime available, newer message supersedes deferred one
+	now := time.Now()
+	source.Error = &transport.DutyCycleError{RetryAt: now.Add(10 * time.Second)}
+	assert.NoError(t, q.Enqueue(&Message{DeviceId: 1, Kind: "light", Payload: []byte{1}, Encode: encodeAsIs, OnStatus: onStatus}))
+	assert.NoError(t, q.Enqueue(&Message{DeviceId: 1, Kind: "light", Payload: []byte{2}, Encode: encodeAsIs}))
+	assert.Equal(t, []Status{StatusSuperseded}, statuses)
+	assert.Len(t, q.deferred, 1)
+	source.Error = nil
+	source.History = nil
+	q.retransmit(now.Add(time.Second))
+	assert.Empty(t, source.History)
+	q.retransmit(now.Add(10 * time.Second))
+	assert.Equal(t, [][]byte{{2}}, source.History)
+	q.retransmit(now.Add(11 * time.Second))
+	assert.Len(t, source.History, 1)
+
+	// Battery device: deferred message waits for uplink after retry time
+	source.Error = &transport.DutyCycleError{RetryAt: time.Now().Add(time.Hour)}
+	q.pending[2] = []*Message{{DeviceId: 2, Payload: []byte{3}, Encode: encodeAsIs, AfterUplink: true, Expires: time.Now().Add(2 * time.Hour)}}
+	assert.NoError(t, q.OnUplink(2))
+	source.Error = nil
+	source.History = nil
+	assert.NoError(t, q.OnUplink(2))
+	assert.Empty(t, source.History)
+	assert.Len(t, q.Pending(2), 1)
+
+	// Reject mode: confirmed message is not waiting for ack
+	statuses = statuses[:0]
+	q.OverBudget = "reject"
+	source.Error = &transport.DutyCycleError{RetryAt: now}
+	err = q.Enqueue(&Message{DeviceId: 1, Payload: []byte{4}, Encode: encodeAsIs, Confirmed: true, OnStatus: onStatus})
+	assert.ErrorIs(t, err, transport.ErrDutyCycle)
+	assert.Equal(t, []Status{StatusRejected}, statuses)
+	assert.Empty(t, q.inflight[1])
+
+	// Transport failure
+	statuses = statuses[:0]
+	source.Error = errors.New("network is down")
+	assert.Error(t, q.Enqueue(&Message{DeviceId: 1, Payload: []byte{5}, Encode: encodeAsIs, Confirmed: true, OnStatus: onStatus}))
+	assert.Equal(t, []Status{StatusFailed}, statuses)
+	assert.Empty(t, q.inflight[1])
+}
+
+func TestQueueObserve(t *testing.T) {
+	source := transport.NewMockLoRaTransport()
+	q, err := NewQueue(nil, source, nil)
+	require.NoError(t, err)
+	records := []Record{}
+	q.Observe(func(record Record) {
+		records = append(records, record)
+	})
+
+	require.NoError(t, q.Enqueue(&Message{DeviceId: 1, Kind: "light", Payload: []byte{1}, Encode: encodeAsIs}))
+	require.NoError(t, q.Enqueue(&Message{DeviceId: 1, Kind: "light", Payload: []byte{2}, Encode: encodeAsIs, Confirmed: true}))
+	q.Ack(1, 1)
+
+	statuses := []Status{}
+	for _, record := range records {
+		assert.Equal(t, uint64(1), record.DeviceId)
+		statuses = append(statuses, record.Status)
+	}
+	assert.Equal(t, []Status{StatusSent, StatusSent, StatusDelivered}, statuses)
+}
@@ -4,9 +4,35 @@ import (
 	"crypto/aes"
 	"crypto/cipher"
 	"crypto/rand"
+	"crypto/sha256"
 	"errors"
 )
 
+// AES IV carries metadata in its first bytes, the rest is random:
+// - payload length
+// - id of key message is encrypted with (see AESkeyId)
+const (
+	ivPayloadLen = 0
+	ivKeyId      = 1
+)
+
+// AESkeyId returns id of key: first byte of key hash. It tells which key
+// message is encrypted with (e.g. during key rotation), without revealing key.
+func AESkeyId(key []byte) byte {
+	hash := sha256.Sum256(key)
+
+	return hash[0]
+}
+
+// AESpacketKeyId returns id of key packet is encrypted with
+func AESpacketKeyId(packet []byte) (byte, error) {
+	if len(packet) < aes.BlockSize {
+		return 0, errors.New("Packet too short")
+	}
+
+	return packet[ivKeyId], nil
+}
+
 // AESencryptCBC encrypts packet with AES-CBC using
 // random generated AES initialization vector
 func AESencryptCBC(key, packet []byte) ([]byte, error) {
@@ -25,8 +51,9 @@ func AESencryptCBC(key, packet []byte) ([]byte, error) {
 	if err != nil {
 		return nil, err
 	}
-	// First byte carries actual payload length:
-	buf[0] = byte(packetLen)
+	// IV carries actual payload length and key id
+	buf[ivPayloadLen] = byte(packetLen)
+	buf[ivKeyId] = AESkeyId(key)
 	// Copy packet into aes.blocksize aligned buffer
 	alignedPacket := make([]byte, alignedLength)
 	copy(alignedPacket, packet)
@@ -55,9 +82,9 @@ func AESdecryptCBC(key, packet []byte) ([]byte, error) {
 		return nil, errors.New("Invalid packet length")
 	}
 	// First 16 bytes (AES block size) is IV (AES Initial Value)
-	// Also, first byte carries actual payload length
+	// Also, it carries actual payload length
 	iv := packet[:aes.BlockSize]
-	payloadLen := int(iv[0])
+	payloadLen := int(iv[ivPayloadLen])
 	// Ensure that payload length is correct: less that packet size - IV
 	if payloadLen > packetLen-aes.BlockSize {
 		return nil, errors.New("Invalid packet payload size")
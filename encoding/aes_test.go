@@ -27,6 +27,19 @@ func TestAesCbc(t *testing.T) {
 		assert.NoError(t, err)
 		assert.Equal(t, packet, decrypted)
 	}
+
+	// Packet tells which key it is encrypted with, even with no padding
+	otherKey := []byte{2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2}
+	assert.NotEqual(t, AESkeyId(key), AESkeyId(otherKey))
+	for _, size := range []int{0, 15, 16, 32} {
+		encrypted, err := AESencryptCBC(otherKey, make([]byte, size))
+		require.NoError(t, err)
+		id, err := AESpacketKeyId(encrypted)
+		assert.NoError(t, err)
+		assert.Equal(t, AESkeyId(otherKey), id)
+	}
+	_, err := AESpacketKeyId(make([]byte, aes.BlockSize-1))
+	assert.Error(t, err)
 }
 
 func TestAlignPacketLength(t *testing.T) {
@@ -0,0 +1,112 @@
+// Package events is in-process event bus (packets, readings, commands,
+// device presence, errors), streamed to integrations over SSE / WebSocket.
+package events
+
+import (
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// Event types
+const (
+	TypePacket  = "packet"
+	TypeReading = "reading"
+	TypeCommand = "command"
+	TypeOnline  = "online"
+	TypeOffline = "offline"
+	TypeError   = "error"
+)
+
+// Types lists all event types
+var Types = []string{TypePacket, TypeReading, TypeCommand, TypeOnline, TypeOffline, TypeError}
+
+// Size of subscriber channel: slow subscriber loses events, not blocks publisher
+const subscriberBuffer = 256
+
+// Event is something happened in server, Data depends on type
+type Event struct {
+	Type     string      `json:"type"`
+	Time     time.Time   `json:"time"`
+	DeviceId uint64      `json:"device_id,omitempty"`
+	Device   string      `json:"device,omitempty"`
+	Class    string      `json:"class,omitempty"`
+	Data     interface{} `json:"data,omitempty"`
+}
+
+// Filter selects events by device and type, empty set matches all
+type Filter struct {
+	DeviceIds map[uint64]bool
+	Types     map[string]bool
+}
+
+func (f *Filter) match(e *Event) bool {
+	if len(f.DeviceIds) > 0 && !f.DeviceIds[e.DeviceId] {
+		return false
+	}
+	if len(f.Types) > 0 && !f.Types[e.Type] {
+		return false
+	}
+
+	return true
+}
+
+// Subscription receives events matching filter from C
+type Subscription struct {
+	C <-chan Event
+
+	ch     chan Event
+	filter Filter
+}
+
+// Bus delivers published events to all subscribers
+type Bus struct {
+	subscribers map[*Subscription]bool
+	lock        sync.RWMutex
+}
+
+func NewBus() *Bus {
+	return &Bus{
+		subscribers: map[*Subscription]bool{},
+	}
+}
+
+// Publish delivers event to matching subscribers, never blocks
+func (b *Bus) Publish(e Event) {
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+	for s := range b.subscribers {
+		if !s.filter.match(&e) {
+			continue
+		}
+		select {
+		case s.ch <- e:
+		default:
+			glog.Infof("Event subscriber is too slow, %s event dropped", e.Type)
+		}
+	}
+}
+
+// Subscribe returns subscription to events matching filter
+func (b *Bus) Subscribe(filter Filter) *Subscription {
+	ch := make(chan Event, subscriberBuffer)
+	s := &Subscription{C: ch, ch: ch, filter: filter}
+
+	b.lock.Lock()
+	b.subscribers[s] = true
+	b.lock.Unlock()
+
+	return s
+}
+
+// Unsubscribe stops delivery of events to subscription
+func (b *Bus) Unsubscribe(s *Subscription) {
+	b.lock.Lock()
+	delete(b.subscribers, s)
+	b.lock.Unlock()
+}
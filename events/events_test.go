@@ -0,0 +1,221 @@
+package events
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/lorahome/server/api"
+	"github.com/lorahome/server/devices"
+	"github.com/lorahome/server/downlink"
+	"github.com/lorahome/server/state"
+)
+
+func init() {
+	devices.RegisterDeviceClass(devices.Url, devices.ClassName, devices.NewMockDevice)
+}
+
+func packet(id uint64) []byte {
+	p := make([]byte, 24)
+	binary.LittleEndian.PutUint64(p, id)
+	return p
+}
+
+func receive(t *testing.T, sub *Subscription) Event {
+	t.Helper()
+	select {
+	case event := <-sub.C:
+		return event
+	case <-time.After(5 * time.Second):
+		t.Fatal("no event received")
+	}
+	return Event{}
+}
+
+func TestBusFilter(t *testing.T) {
+	bus := NewBus()
+	all := bus.Subscribe(Filter{})
+	readings := bus.Subscribe(Filter{Types: map[string]bool{TypeReading: true}})
+	device := bus.Subscribe(Filter{DeviceIds: map[uint64]bool{2: true}})
+
+	bus.Publish(Event{Type: TypePacket, DeviceId: 1})
+	bus.Publish(Event{Type: TypeReading, DeviceId: 2})
+
+	event := receive(t, all)
+	assert.Equal(t, TypePacket, event.Type)
+	assert.False(t, event.Time.IsZero())
+	assert.Equal(t, TypeReading, receive(t, all).Type)
+	assert.Equal(t, uint64(2), receive(t, readings).DeviceId)
+	assert.Equal(t, TypeReading, receive(t, device).Type)
+	assert.Len(t, readings.C, 0)
+	assert.Len(t, device.C, 0)
+
+	// Slow subscriber does not block publisher
+	for i := 0; i < subscriberBuffer*2; i++ {
+		bus.Publish(Event{Type: TypePacket})
+	}
+	assert.Len(t, all.C, subscriberBuffer)
+
+	bus.Unsubscribe(readings)
+	bus.Publish(Event{Type: TypeReading})
+	assert.Len(t, readings.C, 0)
+}
+
+func TestServiceEvents(t *testing.T) {
+	store := state.NewStore()
+	_, err := devices.RegisterDevice(devices.Url, map[string]interface{}{"id": 1, "name": "kitchen"}, &devices.Capabilities{State: store})
+	require.NoError(t, err)
+	s, err := NewService(map[string]interface{}{"offlineAfter": "1m"}, store)
+	require.NoError(t, err)
+	assert.Equal(t, time.Minute, s.OfflineAfter)
+	sub := s.Bus().Subscribe(Filter{})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go s.Run(ctx)
+
+	// First packet: device goes online
+	s.Packet(packet(1), nil)
+	event := receive(t, sub)
+	assert.Equal(t, TypePacket, event.Type)
+	assert.Equal(t, "kitchen", event.Device)
+	assert.Equal(t, devices.ClassName, event.Class)
+	assert.Equal(t, &PacketData{Size: 24}, event.Data)
+	assert.Equal(t, TypeOnline, receive(t, sub).Type)
+	s.Packet(packet(1), nil)
+	assert.Equal(t, TypePacket, receive(t, sub).Type)
+
+	// Unknown device
+	s.Packet(packet(7), errors.New("device 0x7 does not exist"))
+	assert.Equal(t, TypePacket, receive(t, sub).Type)
+	event = receive(t, sub)
+	assert.Equal(t, TypeError, event.Type)
+	assert.Equal(t, uint64(7), event.DeviceId)
+	assert.Equal(t, "device 0x7 does not exist", event.Data)
+
+	// Offline, then online again
+	s.checkOffline(time.Now().Add(30 * time.Second))
+	s.checkOffline(time.Now().Add(2 * time.Minute))
+	event = receive(t, sub)
+	assert.Equal(t, TypeOffline, event.Type)
+	assert.Equal(t, "kitchen", event.Device)
+	s.checkOffline(time.Now().Add(3 * time.Minute))
+	s.Packet(packet(1), nil)
+	assert.Equal(t, TypePacket, receive(t, sub).Type)
+	assert.Equal(t, TypeOnline, receive(t, sub).Type)
+
+	// Commands
+	s.Downlink(downlink.Record{DeviceId: 1, Status: downlink.StatusSent, Time: time.Now()})
+	event = receive(t, sub)
+	assert.Equal(t, TypeCommand, event.Type)
+	assert.Equal(t, "kitchen", event.Device)
+
+	// Readings
+	store.Update(state.Reading{DeviceId: 1, Device: "kitchen", Quantity: state.Temperature, Value: 21})
+	event = receive(t, sub)
+	assert.Equal(t, TypeReading, event.Type)
+	assert.Equal(t, uint64(1), event.DeviceId)
+	assert.Equal(t, 21.0, event.Data.(state.Reading).Value)
+	assert.Len(t, sub.C, 0)
+}
+
+func TestHandler(t *testing.T) {
+	store := state.NewStore()
+	_, err := devices.RegisterDevice(devices.Url, map[string]interface{}{"id": 1, "name": "kitchen"}, &devices.Capabilities{State: store})
+	require.NoError(t, err)
+	s, err := NewService(nil, store)
+	require.NoError(t, err)
+	server, err := api.NewServer(map[string]interface{}{
+		"listen":         "127.0.0.1:0",
+		"allowedOrigins": []string{"https://home.example.com"},
+	})
+	require.NoError(t, err)
+	server.Handle("/api/events", s.Handler(server.CheckOrigin))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go server.Run(ctx)
+	<-server.Ready()
+	url := "http://" + server.Addr().String() + "/api/events"
+
+	// Bad filters
+	for _, query := range []string{"?type=bogus", "?device=missing"} {
+		resp, err := http.Get(url + query)
+		require.NoError(t, err)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode, query)
+	}
+
+	// Server-sent events
+	resp, err := http.Get(url + "?device=kitchen&type=error")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+
+	// WebSocket, only from the same or allowed origins
+	wsUrl := "ws://" + server.Addr().String() + "/api/events?device=0x1,7&type=packet"
+	for origin, allowed := range map[string]bool{
+		"http://" + server.Addr().String(): true,
+		"https://home.example.com":         true,
+		"https://evil.example.com":         false,
+	} {
+		conn, resp, err := websocket.DefaultDialer.Dial(wsUrl, http.Header{"Origin": {origin}})
+		if allowed {
+			require.NoError(t, err, origin)
+			conn.Close()
+		} else {
+			require.Error(t, err, origin)
+			assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+		}
+	}
+	// Closed connections unsubscribe
+	require.Eventually(t, func() bool {
+		s.bus.lock.RLock()
+		defer s.bus.lock.RUnlock()
+		return len(s.bus.subscribers) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+	conn, _, err := websocket.DefaultDialer.Dial(wsUrl, nil)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	// Wait until both streams subscribed
+	require.Eventually(t, func() bool {
+		s.bus.lock.RLock()
+		defer s.bus.lock.RUnlock()
+		return len(s.bus.subscribers) == 2
+	}, 5*time.Second, 10*time.Millisecond)
+	s.Packet(packet(1), errors.New("bad packet"))
+
+	lines := make(chan string)
+	go func() {
+		scanner := bufio.NewScanner(resp.Body)
+		for scanner.Scan() {
+			lines <- scanner.Text()
+		}
+	}()
+	for _, prefix := range []string{"event: error", `data: {"type":"error"`} {
+		select {
+		case line := <-lines:
+			assert.True(t, strings.HasPrefix(line, prefix), line)
+		case <-time.After(5 * time.Second):
+			t.Fatal("no event received")
+		}
+	}
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, data, err := conn.ReadMessage()
+	require.NoError(t, err)
+	event := map[string]interface{}{}
+	require.NoError(t, json.Unmarshal(data, &event))
+	assert.Equal(t, TypePacket, event["type"])
+	assert.Equal(t, "kitchen", event["device"])
+	assert.Equal(t, map[string]interface{}{"size": 24.0}, event["data"])
+}
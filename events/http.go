@@ -0,0 +1,165 @@
+package events
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"github.com/lorahome/server/api"
+	"github.com/lorahome/server/devices"
+)
+
+// Stream keepalive, so proxies do not drop idle connection
+const keepaliveInterval = 30 * time.Second
+
+// Handler serves event stream:
+//
+//	GET /api/events?device=kitchen,0x1234&type=reading,error
+//
+// as server-sent events, or as JSON WebSocket messages when requested
+// connection upgrade. Devices are referred by name or id.
+// WebSocket connections are accepted from origins allowed by checkOrigin.
+func (s *Service) Handler(checkOrigin func(r *http.Request) bool) http.Handler {
+	upgrader := &websocket.Upgrader{CheckOrigin: checkOrigin}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		filter, err := parseFilter(r)
+		if err != nil {
+			api.WriteError(w, http.StatusBadRequest, err)
+			return
+		}
+		if websocket.IsWebSocketUpgrade(r) {
+			s.serveWebSocket(w, r, upgrader, filter)
+		} else {
+			s.serveSse(w, r, filter)
+		}
+	})
+}
+
+func (s *Service) serveSse(w http.ResponseWriter, r *http.Request, filter Filter) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	sub := s.bus.Subscribe(filter)
+	defer s.bus.Unsubscribe(sub)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	keepalive := time.NewTicker(keepaliveInterval)
+	defer keepalive.Stop()
+	for {
+		select {
+		case event := <-sub.C:
+			data, _ := json.Marshal(event)
+			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.Type, data)
+		case <-keepalive.C:
+			fmt.Fprint(w, ": keepalive\n\n")
+		case <-r.Context().Done():
+			return
+		}
+		flusher.Flush()
+	}
+}
+
+func (s *Service) serveWebSocket(w http.ResponseWriter, r *http.Request, upgrader *websocket.Upgrader, filter Filter) {
+	// Upgrader replies with error itself
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	sub := s.bus.Subscribe(filter)
+	defer s.bus.Unsubscribe(sub)
+
+	// Stream is one way: read only to process control frames / detect close
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		for {
+			if _, _, err := conn.NextReader(); err != nil {
+				return
+			}
+		}
+	}()
+
+	keepalive := time.NewTicker(keepaliveInterval)
+	defer keepalive.Stop()
+	for {
+		select {
+		case event := <-sub.C:
+			err = conn.WriteJSON(event)
+		case <-keepalive.C:
+			err = conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(keepaliveInterval))
+		case <-closed:
+			return
+		case <-r.Context().Done():
+			return
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// parseFilter makes filter from comma separated device and type query parameters
+func parseFilter(r *http.Request) (Filter, error) {
+	filter := Filter{}
+	if param := r.URL.Query().Get("device"); param != "" {
+		filter.DeviceIds = map[uint64]bool{}
+		for _, ref := range strings.Split(param, ",") {
+			id, err := deviceId(strings.TrimSpace(ref))
+			if err != nil {
+				return filter, err
+			}
+			filter.DeviceIds[id] = true
+		}
+	}
+	if param := r.URL.Query().Get("type"); param != "" {
+		filter.Types = map[string]bool{}
+		for _, typ := range strings.Split(param, ",") {
+			typ = strings.TrimSpace(typ)
+			if !isType(typ) {
+				return filter, fmt.Errorf("unknown event type '%s'", typ)
+			}
+			filter.Types[typ] = true
+		}
+	}
+
+	return filter, nil
+}
+
+// deviceId resolves device name or id (decimal or 0x prefixed hex)
+func deviceId(ref string) (uint64, error) {
+	if device := devices.GetDeviceByName(ref); device != nil {
+		return device.GetId(), nil
+	}
+	id, err := strconv.ParseUint(ref, 0, 64)
+	if err != nil {
+		return 0, fmt.Errorf("unknown device '%s'", ref)
+	}
+
+	return id, nil
+}
+
+func isType(typ string) bool {
+	for _, t := range Types {
+		if t == typ {
+			return true
+		}
+	}
+
+	return false
+}
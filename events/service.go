@@ -0,0 +1,164 @@
+package events
+
+import (
+	"context"
+	"encoding/binary"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+
+	"github.com/lorahome/server/config"
+	"github.com/lorahome/server/devices"
+	"github.com/lorahome/server/downlink"
+	"github.com/lorahome/server/state"
+)
+
+// How often devices are checked for going offline
+const presenceInterval = 10 * time.Second
+
+// PacketData is data of packet event
+type PacketData struct {
+	Size int `json:"size"`
+}
+
+// Service collects events from server parts and publishes them into bus
+type Service struct {
+	// Device is offline once no packets received for this long
+	OfflineAfter time.Duration
+
+	bus      *Bus
+	store    *state.Store
+	readings <-chan state.Reading
+	lastSeen map[uint64]time.Time
+	offline  map[uint64]bool
+	lock     sync.Mutex
+}
+
+func NewService(cfg interface{}, store *state.Store) (*Service, error) {
+	s := &Service{
+		OfflineAfter: time.Hour,
+		bus:          NewBus(),
+		store:        store,
+		readings:     store.Subscribe(),
+		lastSeen:     map[uint64]time.Time{},
+		offline:      map[uint64]bool{},
+	}
+	if cfg == nil {
+		// Defaults only
+		return s, nil
+	}
+
+	// Map configuration into structure
+	err := config.Decode(cfg, s)
+
+	return s, err
+}
+
+// Bus returns event bus
+func (s *Service) Bus() *Bus {
+	return s.bus
+}
+
+// Run publishes readings and device presence changes until context canceled
+func (s *Service) Run(ctx context.Context) error {
+	defer s.store.Unsubscribe(s.readings)
+	ticker := time.NewTicker(presenceInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case reading := <-s.readings:
+			s.bus.Publish(Event{
+				Type:     TypeReading,
+				Time:     reading.Time,
+				DeviceId: reading.DeviceId,
+				Device:   reading.Device,
+				Class:    reading.Class,
+				Data:     reading,
+			})
+		case now := <-ticker.C:
+			s.checkOffline(now)
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// Packet publishes packet received from device and result of its processing,
+// must be called from packet processing loop
+func (s *Service) Packet(packet []byte, err error) {
+	now := time.Now()
+	var id uint64
+	if len(packet) >= 8 {
+		id = binary.LittleEndian.Uint64(packet)
+	}
+	event := Event{DeviceId: id, Time: now}
+	device := devices.GetDeviceById(id)
+	if device != nil {
+		event.Device, event.Class = device.GetName(), device.GetClassName()
+	}
+
+	event.Type, event.Data = TypePacket, &PacketData{Size: len(packet)}
+	s.bus.Publish(event)
+	if err != nil {
+		event.Type, event.Data = TypeError, err.Error()
+		s.bus.Publish(event)
+	}
+	if device == nil || len(packet) < 8 {
+		return
+	}
+
+	s.lock.Lock()
+	_, seen := s.lastSeen[id]
+	online := !seen || s.offline[id]
+	s.lastSeen[id] = now
+	delete(s.offline, id)
+	s.lock.Unlock()
+	if online {
+		event.Type, event.Data = TypeOnline, nil
+		s.bus.Publish(event)
+	}
+}
+
+// Presence returns time of the last packet from device (zero if none)
+// and whether device is online
+func (s *Service) Presence(id uint64) (time.Time, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	lastSeen, seen := s.lastSeen[id]
+
+	return lastSeen, seen && !s.offline[id]
+}
+
+// Downlink publishes status of downlink message (see downlink.Queue.Observe)
+func (s *Service) Downlink(record downlink.Record) {
+	event := Event{
+		Type:     TypeCommand,
+		Time:     record.Time,
+		DeviceId: record.DeviceId,
+		Data:     record,
+	}
+	if device := devices.GetDeviceById(record.DeviceId); device != nil {
+		event.Device, event.Class = device.GetName(), device.GetClassName()
+	}
+	s.bus.Publish(event)
+}
+
+func (s *Service) checkOffline(now time.Time) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for id, lastSeen := range s.lastSeen {
+		if s.offline[id] || now.Sub(lastSeen) < s.OfflineAfter {
+			continue
+		}
+		s.offline[id] = true
+		event := Event{Type: TypeOffline, Time: now, DeviceId: id, Data: map[string]time.Time{"last_seen": lastSeen}}
+		if device := devices.GetDeviceById(id); device != nil {
+			event.Device, event.Class = device.GetName(), device.GetClassName()
+		}
+		glog.Infof("Device 0x%x is offline, last seen %v", id, lastSeen)
+		s.bus.Publish(event)
+	}
+}
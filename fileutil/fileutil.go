@@ -0,0 +1,57 @@
+// Package fileutil contains file helpers shared by packages which
+// persist state (devices file, keystore, schedules, retained messages).
+package fileutil
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"syscall"
+)
+
+// ErrLocked is returned by Lock when file is locked by another process
+var ErrLocked = errors.New("file is locked by another process")
+
+// FileLock is exclusive advisory lock of file, held until Unlock
+// or exit of process (so it never remains stale after crash)
+type FileLock struct {
+	file *os.File
+}
+
+// Lock takes lock of filename (filename.lock is used as lock file),
+// fails with ErrLocked right away when it is held by another process
+func Lock(filename string) (*FileLock, error) {
+	file, err := os.OpenFile(filename+".lock", os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, err
+	}
+	err = syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if err != nil {
+		file.Close()
+		if err == syscall.EWOULDBLOCK {
+			return nil, ErrLocked
+		}
+		return nil, err
+	}
+
+	return &FileLock{file: file}, nil
+}
+
+// Unlock releases lock
+func (l *FileLock) Unlock() error {
+	defer l.file.Close()
+
+	return syscall.Flock(int(l.file.Fd()), syscall.LOCK_UN)
+}
+
+// WriteAtomic writes data into temporary file first, then renames it,
+// so file is never left half written
+func WriteAtomic(filename string, data []byte, perm os.FileMode) error {
+	tmp := filename + ".tmp"
+	err := ioutil.WriteFile(tmp, data, perm)
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, filename)
+}
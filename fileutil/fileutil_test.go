@@ -0,0 +1,50 @@
+package fileutil
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWriteAtomic(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fileutil")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "state.yaml")
+
+	require.NoError(t, WriteAtomic(filename, []byte("old"), 0600))
+	require.NoError(t, WriteAtomic(filename, []byte("new"), 0600))
+	data, err := ioutil.ReadFile(filename)
+	require.NoError(t, err)
+	assert.Equal(t, "new", string(data))
+	info, err := os.Stat(filename)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+	assert.NoFileExists(t, filename+".tmp")
+
+	// Nothing is replaced when write fails
+	assert.Error(t, WriteAtomic(filepath.Join(dir, "missing", "state.yaml"), []byte("x"), 0600))
+}
+
+func TestLock(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fileutil")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "devices.yaml")
+
+	lock, err := Lock(filename)
+	require.NoError(t, err)
+	// Lock is exclusive, even within the same process
+	_, err = Lock(filename)
+	assert.Equal(t, ErrLocked, err)
+
+	// Released lock can be taken again
+	require.NoError(t, lock.Unlock())
+	lock, err = Lock(filename)
+	require.NoError(t, err)
+	assert.NoError(t, lock.Unlock())
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/lorahome/server/mqtt"
+	"github.com/lorahome/server/mqtt/broker"
+)
+
+// Time to wait for any asynchronous result
+const harnessTimeout = 5 * time.Second
+
+// harness runs full server in-process, with embedded MQTT broker,
+// fake InfluxDB HTTP endpoint and fake UDP gateway
+type harness struct {
+	t       *testing.T
+	server  *Server
+	broker  *broker.Broker
+	mqtt    *mqtt.MqttClient
+	influx  *fakeInflux
+	gateway net.PacketConn
+	udpAddr net.Addr
+	cancel  context.CancelFunc
+	done    chan error
+}
+
+// newHarness starts server with devices defined by YAML,
+// configure (optional) may change server configuration
+func newHarness(t *testing.T, devicesYaml string, configure ...func(*Config)) *harness {
+	h := &harness{
+		t:      t,
+		influx: newFakeInflux(),
+		done:   make(chan error, 2),
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	h.cancel = cancel
+
+	// MQTT broker, shared by server and test client
+	var err error
+	h.broker, err = broker.NewBroker(map[string]interface{}{"listen": "127.0.0.1:0"})
+	require.NoError(t, err)
+	go h.broker.Run(ctx)
+	<-h.broker.Ready()
+	brokerUrl := "tcp://" + h.broker.Addr().String()
+
+	// Gateway receives downlinks sent by server
+	h.gateway, err = net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	h.udpAddr = freeUdpAddr(t)
+
+	dir, err := ioutil.TempDir("", "harness")
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		os.RemoveAll(dir)
+	})
+	devicesFile := filepath.Join(dir, "devices.yaml")
+	require.NoError(t, ioutil.WriteFile(devicesFile, []byte(devicesYaml), 0644))
+
+	cfg := &Config{
+		Udp: map[string]interface{}{
+			"listen":  h.udpAddr.String(),
+			"gateway": h.gateway.LocalAddr().String(),
+		},
+		Mqtt: map[string]interface{}{
+			"broker":       brokerUrl,
+			"clientid":     "server",
+			"cleansession": true,
+		},
+		InfluxDb: map[string]interface{}{
+			"addr":            h.influx.server.URL,
+			"defaultDatabase": "test",
+		},
+	}
+	for _, f := range configure {
+		f(cfg)
+	}
+	h.server = NewServer(cfg, devicesFile)
+	go func() {
+		h.done <- h.server.Run(ctx)
+	}()
+
+	// Client to observe / control server via MQTT
+	h.mqtt, err = mqtt.NewMqttClient(map[string]interface{}{
+		"broker":       brokerUrl,
+		"clientid":     "harness",
+		"cleansession": true,
+	})
+	require.NoError(t, err)
+	go h.mqtt.Run(ctx)
+
+	for _, ready := range []<-chan struct{}{h.server.Ready(), h.mqtt.Ready()} {
+		select {
+		case <-ready:
+		case err := <-h.done:
+			t.Fatalf("server failed: %v", err)
+		case <-time.After(harnessTimeout):
+			t.Fatal("server has not started")
+		}
+	}
+
+	return h
+}
+
+// close stops server, returns result of Server.Run
+func (h *harness) close() error {
+	h.cancel()
+	h.gateway.Close()
+	h.influx.server.Close()
+
+	select {
+	case err := <-h.done:
+		return err
+	case <-time.After(harnessTimeout):
+		return context.DeadlineExceeded
+	}
+}
+
+// sendUplink sends packet to server as gateway does
+func (h *harness) sendUplink(packet []byte) {
+	_, err := h.gateway.WriteTo(packet, h.udpAddr)
+	require.NoError(h.t, err)
+}
+
+// receiveDownlink waits for packet sent by server to gateway
+func (h *harness) receiveDownlink() []byte {
+	buf := make([]byte, 1024)
+	h.gateway.SetReadDeadline(time.Now().Add(harnessTimeout))
+	n, _, err := h.gateway.ReadFrom(buf)
+	require.NoError(h.t, err)
+
+	return buf[:n]
+}
+
+// subscribe must be called before action expected to publish into topic
+func (h *harness) subscribe(topic string) <-chan *mqtt.MqttMessage {
+	ch, err := h.mqtt.Subscribe(topic, 0)
+	require.NoError(h.t, err)
+
+	return ch
+}
+
+func (h *harness) receiveMqtt(ch <-chan *mqtt.MqttMessage) string {
+	select {
+	case msg := <-ch:
+		return msg.Value
+	case <-time.After(harnessTimeout):
+		h.t.Fatal("MQTT message not received")
+	}
+	return ""
+}
+
+// waitInflux waits for point of measurement written into database
+func (h *harness) waitInflux(database, measurement string) string {
+	deadline := time.Now().Add(harnessTimeout)
+	for time.Now().Before(deadline) {
+		for _, line := range h.influx.points(database) {
+			if strings.HasPrefix(line, measurement+",") {
+				return line
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	h.t.Fatalf("InfluxDB point %s not written", measurement)
+	return ""
+}
+
+// freeUdpAddr returns address of UDP port not used at the moment
+func freeUdpAddr(t *testing.T) net.Addr {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer conn.Close()
+
+	return conn.LocalAddr()
+}
+
+// fakeInflux accepts InfluxDB 1.x writes, keeps line protocol points
+type fakeInflux struct {
+	server *httptest.Server
+	lines  map[string][]string
+	lock   sync.Mutex
+}
+
+func newFakeInflux() *fakeInflux {
+	f := &fakeInflux{
+		lines: map[string][]string{},
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ping", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Influxdb-Version", "fake")
+		w.WriteHeader(http.StatusNoContent)
+	})
+	mux.HandleFunc("/write", func(w http.ResponseWriter, r *http.Request) {
+		database := r.URL.Query().Get("db")
+		scanner := bufio.NewScanner(r.Body)
+		f.lock.Lock()
+		for scanner.Scan() {
+			f.lines[database] = append(f.lines[database], scanner.Text())
+		}
+		f.lock.Unlock()
+		w.WriteHeader(http.StatusNoContent)
+	})
+	f.server = httptest.NewServer(mux)
+
+	return f
+}
+
+func (f *fakeInflux) points(database string) []string {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	return append([]string{}, f.lines[database]...)
+}
@@ -0,0 +1,147 @@
+// Package history serves reading history of devices, from InfluxDB when
+// device writes quantity there, from state store (short history) otherwise.
+package history
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/lorahome/server/db/influxdb"
+	"github.com/lorahome/server/devices"
+	"github.com/lorahome/server/state"
+)
+
+// Upper limit of points in series
+const maxPoints = 10000
+
+// Data sources
+const (
+	SourceInfluxDb = "influxdb"
+	SourceState    = "state"
+)
+
+// Point is value of quantity aggregated (mean) over resolution interval
+type Point struct {
+	Time  time.Time `json:"time"`
+	Value float64   `json:"value"`
+}
+
+// Series is history of single device quantity
+type Series struct {
+	DeviceId uint64  `json:"device_id"`
+	Device   string  `json:"device"`
+	Quantity string  `json:"quantity"`
+	Source   string  `json:"source"`
+	Points   []Point `json:"points"`
+}
+
+// Service queries history of device readings
+type Service struct {
+	influx *influxdb.InfluxDB
+	store  *state.Store
+}
+
+func NewService(influx *influxdb.InfluxDB, store *state.Store) *Service {
+	return &Service{
+		influx: influx,
+		store:  store,
+	}
+}
+
+// Query returns history of device quantity in [from, to) time range,
+// downsampled to resolution
+func (s *Service) Query(device devices.Device, quantity string, from, to time.Time, resolution time.Duration) (*Series, error) {
+	if !from.Before(to) {
+		return nil, errors.New("empty time range")
+	}
+	if resolution < time.Second {
+		return nil, errors.New("resolution must be at least 1s")
+	}
+	if to.Sub(from)/resolution > maxPoints {
+		return nil, fmt.Errorf("too many points, %d at most", maxPoints)
+	}
+
+	series := &Series{
+		DeviceId: device.GetId(),
+		Device:   device.GetName(),
+		Quantity: quantity,
+	}
+	var err error
+	if source, ok := device.(devices.InfluxSeries); ok && s.influx != nil && s.influx.Enabled() {
+		if database, measurement, field, ok := source.InfluxSeries(quantity); ok {
+			series.Source = SourceInfluxDb
+			series.Points, err = s.queryInflux(device.GetId(), database, measurement, field, from, to, resolution)
+			return series, err
+		}
+	}
+
+	series.Source = SourceState
+	series.Points = s.queryState(device.GetName(), quantity, from, to, resolution)
+
+	return series, nil
+}
+
+func (s *Service) queryInflux(id uint64, database, measurement, field string, from, to time.Time, resolution time.Duration) ([]Point, error) {
+	query := fmt.Sprintf(`SELECT mean(%s) FROM %s WHERE "device_id" = '%d' AND time >= '%s' AND time < '%s' GROUP BY time(%ds) fill(none)`,
+		quoteIdent(field), quoteIdent(measurement), id,
+		from.UTC().Format(time.RFC3339Nano), to.UTC().Format(time.RFC3339Nano), int64(resolution/time.Second))
+	rows, err := s.influx.Query(database, query)
+	if err != nil {
+		return nil, err
+	}
+
+	points := []Point{}
+	for _, row := range rows {
+		for _, values := range row.Values {
+			if len(values) < 2 || values[1] == nil {
+				continue
+			}
+			ts, err := time.Parse(time.RFC3339Nano, fmt.Sprint(values[0]))
+			if err != nil {
+				return nil, fmt.Errorf("unexpected time '%v': %v", values[0], err)
+			}
+			var value float64
+			switch v := values[1].(type) {
+			case json.Number:
+				value, err = v.Float64()
+			case float64:
+				value = v
+			default:
+				err = fmt.Errorf("unexpected value '%v'", v)
+			}
+			if err != nil {
+				return nil, err
+			}
+			points = append(points, Point{Time: ts, Value: value})
+		}
+	}
+
+	return points, nil
+}
+
+func (s *Service) queryState(device, quantity string, from, to time.Time, resolution time.Duration) []Point {
+	points := []Point{}
+	count := 0
+	for _, reading := range s.store.History(device, quantity, from, to) {
+		// Intervals aligned the same way as InfluxDB GROUP BY time() does
+		ts := reading.Time.Truncate(resolution)
+		n := len(points)
+		if n > 0 && points[n-1].Time.Equal(ts) {
+			// Running mean of interval
+			count++
+			points[n-1].Value += (reading.Value - points[n-1].Value) / float64(count)
+			continue
+		}
+		points = append(points, Point{Time: ts, Value: reading.Value})
+		count = 1
+	}
+
+	return points
+}
+
+func quoteIdent(name string) string {
+	return `"` + strings.Replace(strings.Replace(name, `\`, `\\`, -1), `"`, `\"`, -1) + `"`
+}
@@ -0,0 +1,130 @@
+package history
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mitchellh/mapstructure"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/lorahome/server/db/influxdb"
+	"github.com/lorahome/server/devices"
+	"github.com/lorahome/server/state"
+)
+
+const influxDeviceUrl = "testInfluxUrl"
+
+// influxDevice writes temperature into InfluxDB
+type influxDevice struct {
+	devices.MockDevice `mapstructure:",squash"`
+}
+
+func (d *influxDevice) InfluxSeries(quantity string) (string, string, string, bool) {
+	return "home", "temperature", "c", quantity == state.Temperature
+}
+
+func init() {
+	devices.RegisterDeviceClass(devices.Url, devices.ClassName, devices.NewMockDevice)
+	devices.RegisterDeviceClass(influxDeviceUrl, "InfluxDevice", func(cfg interface{}, caps *devices.Capabilities) (devices.Device, error) {
+		dev := &influxDevice{}
+		err := mapstructure.Decode(cfg, dev)
+		return dev, err
+	})
+}
+
+func get(t *testing.T, s *Service, query string) (int, string) {
+	w := httptest.NewRecorder()
+	s.Handler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/history?"+query, nil))
+	body, _ := ioutil.ReadAll(w.Body)
+
+	return w.Code, string(body)
+}
+
+func TestHistoryState(t *testing.T) {
+	store := state.NewStore()
+	_, err := devices.RegisterDevice(devices.Url, map[string]interface{}{"id": 1, "name": "kitchen"}, &devices.Capabilities{State: store})
+	require.NoError(t, err)
+	_, err = devices.RegisterDevice(influxDeviceUrl, map[string]interface{}{"id": 2, "name": "garage"}, &devices.Capabilities{State: store})
+	require.NoError(t, err)
+	influx, err := influxdb.NewInfluxDB(nil)
+	require.NoError(t, err)
+	s := NewService(influx, store)
+	start := time.Date(2020, 1, 1, 10, 0, 0, 0, time.UTC)
+	for i, value := range []float64{20, 22, 30, 31} {
+		store.Update(state.Reading{Device: "kitchen", Quantity: state.Temperature, Value: value, Time: start.Add(time.Duration(i) * 30 * time.Second)})
+		store.Update(state.Reading{Device: "garage", Quantity: state.Temperature, Value: value, Time: start.Add(time.Duration(i) * 30 * time.Second)})
+	}
+
+	code, body := get(t, s, "device=kitchen,0x2&quantity=temperature,humidity&from=2020-01-01T10:00:00Z&to=2020-01-01T11:00:00Z&resolution=1m")
+	require.Equal(t, http.StatusOK, code, body)
+	series := []*Series{}
+	require.NoError(t, json.Unmarshal([]byte(body), &series))
+	require.Len(t, series, 4)
+	assert.Equal(t, uint64(1), series[0].DeviceId)
+	assert.Equal(t, SourceState, series[0].Source)
+	assert.Equal(t, []Point{{start, 21}, {start.Add(time.Minute), 30.5}}, series[0].Points)
+	assert.Empty(t, series[1].Points)
+	// InfluxDB is disabled
+	assert.Equal(t, "garage", series[2].Device)
+	assert.Equal(t, SourceState, series[2].Source)
+
+	code, body = get(t, s, "device=1&quantity=temperature&from=2020-01-01T10:00:00Z&to=2020-01-01T11:00:00Z&resolution=1h&format=csv")
+	require.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "device_id,device,quantity,time,value\n1,kitchen,temperature,2020-01-01T10:00:00Z,25.75\n", body)
+
+	for _, query := range []string{
+		"quantity=temperature",
+		"device=missing&quantity=temperature",
+		"device=kitchen",
+		"device=kitchen&quantity=temperature&from=1h&resolution=100ms",
+		"device=kitchen&quantity=temperature&from=720h&resolution=1s",
+		"device=kitchen&quantity=temperature&from=yesterday",
+	} {
+		code, _ := get(t, s, query)
+		assert.Equal(t, http.StatusBadRequest, code, query)
+	}
+}
+
+func TestHistoryInflux(t *testing.T) {
+	queries := make(chan string, 1)
+	influx := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/ping":
+			w.WriteHeader(http.StatusNoContent)
+		case "/query":
+			w.Header().Set("Content-Type", "application/json")
+			queries <- r.FormValue("db") + ": " + r.FormValue("q")
+			fmt.Fprint(w, `{"results": [{"statement_id": 0, "series": [{"name": "temperature", "columns": ["time", "mean"],
+				"values": [["2020-01-01T10:00:00Z", 21.5], ["2020-01-01T10:05:00Z", 22]]}]}]}`)
+		}
+	}))
+	defer influx.Close()
+	store := state.NewStore()
+	_, err := devices.RegisterDevice(devices.Url, map[string]interface{}{"id": 1, "name": "kitchen"}, &devices.Capabilities{State: store})
+	require.NoError(t, err)
+	_, err = devices.RegisterDevice(influxDeviceUrl, map[string]interface{}{"id": 2, "name": "garage"}, &devices.Capabilities{State: store})
+	require.NoError(t, err)
+	db, err := influxdb.NewInfluxDB(map[string]interface{}{"addr": influx.URL})
+	require.NoError(t, err)
+	s := NewService(db, store)
+
+	code, body := get(t, s, "device=garage&quantity=temperature&from=2020-01-01T10:00:00Z&to=2020-01-01T11:00:00Z&resolution=5m")
+	require.Equal(t, http.StatusOK, code, body)
+	query := <-queries
+	assert.True(t, strings.HasPrefix(query, `home: SELECT mean("c") FROM "temperature" WHERE "device_id" = '2'`), query)
+	assert.Contains(t, query, "GROUP BY time(300s)")
+
+	series := []*Series{}
+	require.NoError(t, json.Unmarshal([]byte(body), &series))
+	require.Len(t, series, 1)
+	assert.Equal(t, SourceInfluxDb, series[0].Source)
+	start := time.Date(2020, 1, 1, 10, 0, 0, 0, time.UTC)
+	assert.Equal(t, []Point{{start, 21.5}, {start.Add(5 * time.Minute), 22}}, series[0].Points)
+}
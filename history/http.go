@@ -0,0 +1,154 @@
+package history
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lorahome/server/api"
+	"github.com/lorahome/server/devices"
+)
+
+// Default time range and number of points, when not set in request
+const (
+	defaultRange  = 24 * time.Hour
+	defaultPoints = 500
+)
+
+// Handler serves history API:
+//
+//	GET /api/history?device=kitchen,2&quantity=temperature,humidity
+//	    &from=2020-01-01T00:00:00Z&to=...&resolution=5m&format=csv
+//
+// Devices are referred by name or id, from may be relative to now (e.g. "6h").
+// JSON response is list of series, CSV has device_id,device,quantity,time,value columns.
+func (s *Service) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		series, err := s.query(r)
+		if err != nil {
+			api.WriteError(w, http.StatusBadRequest, err)
+			return
+		}
+
+		if r.FormValue("format") == "csv" {
+			writeCSV(w, series)
+			return
+		}
+		api.WriteJSON(w, http.StatusOK, series)
+	})
+}
+
+func (s *Service) query(r *http.Request) ([]*Series, error) {
+	now := time.Now()
+	to, err := parseTime(r.FormValue("to"), now, now)
+	if err != nil {
+		return nil, fmt.Errorf("to: %v", err)
+	}
+	from, err := parseTime(r.FormValue("from"), now, to.Add(-defaultRange))
+	if err != nil {
+		return nil, fmt.Errorf("from: %v", err)
+	}
+	resolution := (to.Sub(from) / defaultPoints).Truncate(time.Second)
+	if resolution < time.Second {
+		resolution = time.Second
+	}
+	if value := r.FormValue("resolution"); value != "" {
+		resolution, err = time.ParseDuration(value)
+		if err != nil {
+			return nil, fmt.Errorf("resolution: %v", err)
+		}
+	}
+
+	deviceList, err := findDevices(r.FormValue("device"))
+	if err != nil {
+		return nil, err
+	}
+	quantities := splitList(r.FormValue("quantity"))
+	if len(quantities) == 0 {
+		return nil, errors.New("quantity is required")
+	}
+
+	res := []*Series{}
+	for _, device := range deviceList {
+		for _, quantity := range quantities {
+			series, err := s.Query(device, quantity, from, to, resolution)
+			if err != nil {
+				return nil, fmt.Errorf("%s %s: %v", device.GetName(), quantity, err)
+			}
+			res = append(res, series)
+		}
+	}
+
+	return res, nil
+}
+
+// parseTime parses RFC3339 time or duration before now
+func parseTime(value string, now, def time.Time) (time.Time, error) {
+	if value == "" {
+		return def, nil
+	}
+	if ago, err := time.ParseDuration(strings.TrimPrefix(value, "-")); err == nil {
+		return now.Add(-ago), nil
+	}
+
+	return time.Parse(time.RFC3339, value)
+}
+
+func findDevices(value string) ([]devices.Device, error) {
+	names := splitList(value)
+	if len(names) == 0 {
+		return nil, errors.New("device is required")
+	}
+
+	res := []devices.Device{}
+	for _, name := range names {
+		device := devices.GetDeviceByName(name)
+		if id, err := strconv.ParseUint(name, 0, 64); device == nil && err == nil {
+			device = devices.GetDeviceById(id)
+		}
+		if device == nil {
+			return nil, fmt.Errorf("device '%s' does not exist", name)
+		}
+		res = append(res, device)
+	}
+
+	return res, nil
+}
+
+func splitList(value string) []string {
+	res := []string{}
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			res = append(res, item)
+		}
+	}
+
+	return res
+}
+
+func writeCSV(w http.ResponseWriter, series []*Series) {
+	w.Header().Set("Content-Type", "text/csv")
+	w.WriteHeader(http.StatusOK)
+	out := csv.NewWriter(w)
+	out.Write([]string{"device_id", "device", "quantity", "time", "value"})
+	for _, s := range series {
+		for _, point := range s.Points {
+			out.Write([]string{
+				strconv.FormatUint(s.DeviceId, 10),
+				s.Device,
+				s.Quantity,
+				point.Time.UTC().Format(time.RFC3339),
+				strconv.FormatFloat(point.Value, 'f', -1, 64),
+			})
+		}
+	}
+	out.Flush()
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+	lightpb "github.com/lorahome/devices/go/proto/light"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/lorahome/server/devices/light/led_strip"
+	"github.com/lorahome/server/devices/sensor/multisensor"
+	"github.com/lorahome/server/encoding"
+	"github.com/lorahome/server/simulator"
+)
+
+const integrationKey = "000102030405060708090a0b0c0d0e0f"
+
+func integrationNode(t *testing.T, id uint64, model simulator.Model) *simulator.Node {
+	key, err := hex.DecodeString(integrationKey)
+	require.NoError(t, err)
+
+	return &simulator.Node{Id: id, Key: key, Model: model}
+}
+
+func TestIntegrationUplink(t *testing.T) {
+	h := newHarness(t, fmt.Sprintf(`
+%s:
+- id: 1
+  name: kitchen
+  key: %s
+  influxdb:
+    measurements:
+      temperature: temperature
+  mqtt:
+    topics:
+      temperature: home/kitchen/temperature
+`, multisensor.Url, integrationKey))
+
+	// Uplink in -> MQTT topic + InfluxDB point out
+	ch := h.subscribe("home/kitchen/temperature")
+	packet, err := integrationNode(t, 1, simulator.NewMultiSensor()).Uplink()
+	require.NoError(t, err)
+	h.sendUplink(packet)
+
+	assert.Regexp(t, `^\d+\.\d$`, h.receiveMqtt(ch))
+	point := h.waitInflux("test", "temperature")
+	assert.Contains(t, point, "device_id=1")
+	assert.Contains(t, point, "name=kitchen")
+
+	assert.NoError(t, h.close())
+}
+
+func TestIntegrationDownlink(t *testing.T) {
+	h := newHarness(t, fmt.Sprintf(`
+%s:
+- id: 2
+  name: strip
+  key: %s
+  mqtt:
+    topics:
+      status: home/strip/status
+      control: home/strip/set
+`, led_strip.Url, integrationKey))
+
+	// MQTT command -> downlink bytes
+	require.NoError(t, h.mqtt.Publish("home/strip/set", "42", 0, false))
+	packet := h.receiveDownlink()
+	require.True(t, len(packet) > 8)
+	assert.Equal(t, byte(2), packet[0])
+	key, _ := hex.DecodeString(integrationKey)
+	payload, err := encoding.AESdecryptCBC(key, packet[8:])
+	require.NoError(t, err)
+	status := &lightpb.LedStripStatus{}
+	require.NoError(t, proto.Unmarshal(payload, status))
+	assert.Equal(t, []uint32{42}, status.Channels)
+
+	// Device reports applied level back
+	replies, err := integrationNode(t, 2, simulator.NewLedStrip()).Downlink(packet)
+	require.NoError(t, err)
+	require.Len(t, replies, 1)
+	h.sendUplink(replies[0])
+
+	assert.NoError(t, h.close())
+	// Devices saved on exit
+	saved, err := ioutil.ReadFile(h.server.DevicesFile)
+	require.NoError(t, err)
+	assert.Contains(t, string(saved), "name: strip")
+}
+
+func TestIntegrationRules(t *testing.T) {
+	h := newHarness(t, fmt.Sprintf(`
+%s:
+- id: 1
+  name: hallway
+  key: %s
+  influxdb: {}
+  mqtt:
+    topics: {}
+%s:
+- id: 2
+  name: strip
+  key: %s
+  mqtt:
+    topics:
+      control: home/strip/set
+`, multisensor.Url, integrationKey, led_strip.Url, integrationKey), func(cfg *Config) {
+		cfg.Rules = []interface{}{
+			map[string]interface{}{
+				"name": "dusk",
+				"trigger": map[string]interface{}{
+					"device":   "hallway",
+					"quantity": "ambient_light",
+					"below":    100000,
+				},
+				"actions": []interface{}{
+					map[string]interface{}{"device": "strip", "set": "80"},
+				},
+			},
+		}
+	})
+
+	// Sensor reading -> rule -> LedStrip downlink
+	packet, err := integrationNode(t, 1, simulator.NewMultiSensor()).Uplink()
+	require.NoError(t, err)
+	h.sendUplink(packet)
+
+	packet = h.receiveDownlink()
+	assert.Equal(t, byte(2), packet[0])
+	key, _ := hex.DecodeString(integrationKey)
+	payload, err := encoding.AESdecryptCBC(key, packet[8:])
+	require.NoError(t, err)
+	status := &lightpb.LedStripStatus{}
+	require.NoError(t, proto.Unmarshal(payload, status))
+	assert.Equal(t, []uint32{80}, status.Channels)
+
+	assert.NoError(t, h.close())
+}
+
+func TestIntegrationTopicTemplate(t *testing.T) {
+	h := newHarness(t, fmt.Sprintf(`
+%s:
+- id: 1
+  name: kitchen
+  key: %s
+%s:
+- id: 2
+  name: strip
+  key: %s
+`, multisensor.Url, integrationKey, led_strip.Url, integrationKey), func(cfg *Config) {
+		cfg.Mqtt.(map[string]interface{})["topicTemplate"] = "lorahome/{class}/{name}/{quantity}"
+	})
+
+	// Topics of device without any MQTT config come from template
+	temperature := h.subscribe("lorahome/MultiSensor/kitchen/temperature")
+	packet, err := integrationNode(t, 1, simulator.NewMultiSensor()).Uplink()
+	require.NoError(t, err)
+	h.sendUplink(packet)
+	assert.Regexp(t, `^\d+\.\d$`, h.receiveMqtt(temperature))
+
+	level := h.subscribe("lorahome/LedStrip/strip/level")
+	require.NoError(t, h.mqtt.Publish("lorahome/LedStrip/strip/level/set", "42", 0, false))
+	replies, err := integrationNode(t, 2, simulator.NewLedStrip()).Downlink(h.receiveDownlink())
+	require.NoError(t, err)
+	require.Len(t, replies, 1)
+	h.sendUplink(replies[0])
+	assert.Equal(t, "42", h.receiveMqtt(level))
+
+	assert.NoError(t, h.close())
+}
+
+func TestIntegrationBatteryLevel(t *testing.T) {
+	h := newHarness(t, fmt.Sprintf(`
+%s:
+- id: 1
+  name: kitchen
+  key: %s
+  mqtt:
+    stateTopic: home/kitchen/state
+    stateOnly: true
+`, multisensor.Url, integrationKey), func(cfg *Config) {
+		cfg.Battery = map[string]interface{}{
+			"classes": map[string]interface{}{
+				"MultiSensor": map[string]interface{}{"chemistry": "alkaline", "cells": 2},
+			},
+		}
+	})
+
+	// Battery level is published alongside voltage
+	ch := h.subscribe("home/kitchen/state")
+	packet, err := integrationNode(t, 1, simulator.NewMultiSensor()).Uplink()
+	require.NoError(t, err)
+	h.sendUplink(packet)
+	doc := map[string]interface{}{}
+	require.NoError(t, json.Unmarshal([]byte(h.receiveMqtt(ch)), &doc))
+	assert.Contains(t, doc, "battery_voltage")
+	assert.Contains(t, doc, "battery_level")
+
+	assert.NoError(t, h.close())
+}
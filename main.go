@@ -3,17 +3,12 @@ package main
 import (
 	"context"
 	"flag"
+	"fmt"
 	"os"
 	"os/signal"
-	"sync"
 	"syscall"
-	"time"
 
 	"github.com/golang/glog"
-	"github.com/lorahome/server/db/influxdb"
-	"github.com/lorahome/server/devices"
-	"github.com/lorahome/server/mqtt"
-	"github.com/lorahome/server/transport"
 
 	// Link these devices into server app
 	_ "github.com/lorahome/server/devices/light/led_strip"
@@ -22,94 +17,58 @@ import (
 
 var flagConfig = flag.String("config", "config.yaml", "Config filename")
 var flagDevices = flag.String("devices", "devices.yaml", "Devices filename")
+var flagAudit = flag.String("audit", "audit.log", "Audit trail filename (joins, key rotations), empty to disable")
+var flagCapture = flag.String("capture", "", "Record all raw packets into file, for later replay")
 
 func main() {
 	flag.Set("logtostderr", "true")
 	flag.Parse()
 
-	// Load configuration
-	cfg, err := ConfigLoadFromFile(*flagConfig)
-	if err != nil {
-		glog.Fatalf("Unable to read config file %s: %v", *flagConfig, err)
+	// Optional command, run server by default
+	var err error
+	switch flag.Arg(0) {
+	case "":
+		runServer()
+	case "replay":
+		err = runReplay(flag.Args()[1:])
+	case "decode":
+		err = runDecode(flag.Args()[1:])
+	case "device":
+		err = runDevice(flag.Args()[1:])
+	case "simulate":
+		err = runSimulate(flag.Args()[1:])
+	default:
+		err = fmt.Errorf("unknown command '%s'", flag.Arg(0))
 	}
-
-	// Setup services
-	ctx, cancel := context.WithCancel(context.Background())
-	var wg sync.WaitGroup
-	caps := &devices.Capabilities{}
-
-	// Start UDP transport
-	caps.Udp, err = transport.NewLoRaUdp(cfg.Udp)
 	if err != nil {
-		glog.Fatalf("LoRa UDP transport failed: %v", err)
-	}
-	wg.Add(1)
-	go func(wg *sync.WaitGroup) {
-		err := caps.Udp.Run(ctx)
-		if err != nil {
-			glog.Fatalf("UDP failed: %v", err)
-		}
-		wg.Done()
-	}(&wg)
-
-	// Start InfluxDB
-	caps.InfluxDb, err = influxdb.NewInfluxDB(cfg.InfluxDb)
-	if err != nil {
-		glog.Fatalf("InfluxDB failed: %v", err)
-	}
-
-	// Start MQTT client
-	caps.Mqtt, err = mqtt.NewMqttClient(cfg.Mqtt)
-	wg.Add(1)
-	go func(wg *sync.WaitGroup) {
-		err := caps.Mqtt.Run(ctx)
-		if err != nil {
-			glog.Fatalf("MQTT failed: %v", err)
-		}
-		wg.Done()
-	}(&wg)
-
-	// Load / register devices
-	time.Sleep(100 * time.Millisecond) // Find better solution?
-	err = devices.LoadFromFile(*flagDevices, caps)
-	if err != nil {
-		glog.Fatalf("Unable to load devices: %v", err)
+		glog.Fatalf("%s failed: %v", flag.Arg(0), err)
 	}
+	glog.Flush()
+}
 
-	// Start all devices
-	err = devices.StartAllDevices(ctx)
+func runServer() {
+	// Load configuration
+	cfg, err := ConfigLoadFromFile(*flagConfig)
 	if err != nil {
-		glog.Fatalf("Unable to start devices: %v", err)
+		glog.Fatalf("Unable to read config file %s: %v", *flagConfig, err)
 	}
+	server := NewServer(cfg, *flagDevices)
+	server.AuditFile = *flagAudit
+	server.CaptureFile = *flagCapture
 
 	// Setup SIGTERM / SIGINT
-	signalCh := make(chan os.Signal, 1)
-	signal.Notify(signalCh, syscall.SIGINT, syscall.SIGTERM)
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		signalCh := make(chan os.Signal, 1)
+		signal.Notify(signalCh, syscall.SIGINT, syscall.SIGTERM)
+		sig := <-signalCh
+		glog.Infof("Got SIG %v", sig)
+		cancel()
+	}()
 
-	for {
-		// Wait for packet from any transport
-		var err error
-		select {
-		case packet := <-caps.Udp.Receive():
-			err = processPacket(packet)
-		case sig := <-signalCh:
-			glog.Infof("Got SIG %v", sig)
-			// Cancel context and wait until all jobs done
-			cancel()
-			wg.Wait()
-			// Save devices configuration
-			err := devices.SaveToFile(*flagDevices)
-			if err != nil {
-				glog.Fatalf("Save devices config failed: %v", err)
-			}
-			glog.Info("Gracefully terminated")
-			glog.Flush()
-			return
-		}
-		// Handle all errors in one place
-		if err != nil {
-			glog.Infof("ProcessPacket failed: %v", err)
-		}
+	err = server.Run(ctx)
+	if err != nil {
+		glog.Fatalf("Server failed: %v", err)
 	}
-
+	glog.Info("Gracefully terminated")
 }
@@ -0,0 +1,281 @@
+// Package broker is minimal MQTT 3.1.1 broker, so server can run
+// without external one (and integration tests can run in-process).
+//
+// Limitations: no persistent sessions (every session is clean), messages
+// are delivered to subscribers with QoS 0 (granted QoS of every subscription).
+package broker
+
+import (
+	"context"
+	"crypto/subtle"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/mitchellh/mapstructure"
+
+	"github.com/lorahome/server/secrets"
+)
+
+// How often changed retained messages are saved
+const persistInterval = time.Second
+
+type Broker struct {
+	// TCP listen address, e.g. ":1883" (optional: in-process connections only)
+	Listen string
+	// MQTT over WebSocket listen address, e.g. ":8083" (optional)
+	Websocket string
+	// Browser origins allowed to use WebSocket besides its own one
+	AllowedOrigins []string
+	// Username -> password (may be secret reference),
+	// anonymous access allowed when empty
+	Users map[string]string
+	// File to persist retained messages into (optional)
+	RetainedFile  string
+	MaxPacketSize int
+
+	enabled       bool
+	listener      net.Listener
+	wsListener    net.Listener
+	passwords     map[string]string
+	ready         chan struct{}
+	clients       map[string]*client
+	retained      map[string]*message
+	retainedDirty bool
+	lock          sync.Mutex
+}
+
+type message struct {
+	topic   string
+	payload []byte
+	retain  bool
+}
+
+func NewBroker(cfg interface{}) (*Broker, error) {
+	b := &Broker{
+		MaxPacketSize: 256 * 1024,
+		ready:         make(chan struct{}),
+		clients:       map[string]*client{},
+		retained:      map[string]*message{},
+	}
+	if cfg == nil {
+		// Bypass mode - broker disabled
+		return b, nil
+	}
+
+	// Map configuration into structure
+	err := mapstructure.Decode(cfg, b)
+	if err != nil {
+		return nil, err
+	}
+	// Passwords may be secret references
+	b.passwords = map[string]string{}
+	for user, password := range b.Users {
+		b.passwords[user], err = secrets.Resolve(password)
+		if err != nil {
+			return nil, err
+		}
+	}
+	b.enabled = true
+
+	return b, nil
+}
+
+// Run accepts MQTT connections until context canceled
+func (b *Broker) Run(ctx context.Context) error {
+	if !b.enabled {
+		glog.Info("MQTT broker is not enabled")
+		close(b.ready)
+		<-ctx.Done()
+		return nil
+	}
+
+	err := b.loadRetained()
+	if err != nil {
+		return err
+	}
+	if b.Listen != "" {
+		b.listener, err = net.Listen("tcp", b.Listen)
+		if err != nil {
+			return err
+		}
+		defer b.listener.Close()
+		glog.Infof("MQTT broker started at %s", b.listener.Addr())
+		go b.accept()
+	}
+	if b.Websocket != "" {
+		b.wsListener, err = net.Listen("tcp", b.Websocket)
+		if err != nil {
+			return err
+		}
+		server := &http.Server{Handler: http.HandlerFunc(b.serveWebsocket)}
+		defer server.Close()
+		glog.Infof("MQTT broker websocket started at %s", b.wsListener.Addr())
+		go server.Serve(b.wsListener)
+	}
+	close(b.ready)
+
+	ticker := time.NewTicker(persistInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			b.saveRetained()
+		case <-ctx.Done():
+			// Drop all connections, keep retained messages
+			b.lock.Lock()
+			for _, c := range b.clients {
+				c.conn.Close()
+			}
+			b.lock.Unlock()
+			b.saveRetained()
+			return nil
+		}
+	}
+}
+
+// Ready is closed once broker accepts connections
+func (b *Broker) Ready() <-chan struct{} {
+	return b.ready
+}
+
+// Addr returns TCP address broker listens on, nil until ready
+func (b *Broker) Addr() net.Addr {
+	if b.listener == nil {
+		return nil
+	}
+	return b.listener.Addr()
+}
+
+// WebsocketAddr returns address of websocket listener, nil until ready
+func (b *Broker) WebsocketAddr() net.Addr {
+	if b.wsListener == nil {
+		return nil
+	}
+	return b.wsListener.Addr()
+}
+
+// Connect returns in-process connection to broker, which is trusted
+// (no authentication required). Broker must be ready.
+func (b *Broker) Connect() net.Conn {
+	server, client := net.Pipe()
+	go b.serveConn(server, true)
+
+	return client
+}
+
+func (b *Broker) accept() {
+	for {
+		conn, err := b.listener.Accept()
+		if err != nil {
+			// Terminate goroutine when listener closed
+			if strings.Contains(err.Error(), "use of closed network connection") {
+				return
+			}
+			glog.Infof("MQTT broker accept failed: %v", err)
+			continue
+		}
+		go b.serveConn(conn, false)
+	}
+}
+
+// serveConn handles single client connection until it closed
+func (b *Broker) serveConn(conn net.Conn, trusted bool) {
+	c := newClient(b, conn, trusted)
+	err := c.serve()
+	if err != nil {
+		glog.Infof("MQTT client %s (%s) disconnected: %v", c.id, conn.RemoteAddr(), err)
+	}
+}
+
+// Publish delivers message to all matching subscribers,
+// retained message is kept for future subscribers
+func (b *Broker) Publish(topic string, payload []byte, retain bool) {
+	b.publish(&message{topic, payload, retain})
+}
+
+func (b *Broker) publish(msg *message) {
+	b.lock.Lock()
+	if msg.retain {
+		// Empty payload clears retained message
+		if len(msg.payload) == 0 {
+			delete(b.retained, msg.topic)
+		} else {
+			b.retained[msg.topic] = msg
+		}
+		b.retainedDirty = true
+	}
+	subscribers := []*client{}
+	for _, c := range b.clients {
+		if c.subscribed(msg.topic) {
+			subscribers = append(subscribers, c)
+		}
+	}
+	b.lock.Unlock()
+
+	// Retain flag is set only for messages sent on subscribe
+	for _, c := range subscribers {
+		c.deliver(msg.topic, msg.payload, false)
+	}
+}
+
+// authenticate checks credentials of client
+func (b *Broker) authenticate(user string, password []byte) bool {
+	if len(b.passwords) == 0 {
+		return true
+	}
+	expected, ok := b.passwords[user]
+	if !ok {
+		return false
+	}
+
+	return subtle.ConstantTimeCompare([]byte(expected), password) == 1
+}
+
+// register adds connected client, replacing one with the same id
+func (b *Broker) register(c *client) {
+	b.lock.Lock()
+	existing := b.clients[c.id]
+	b.clients[c.id] = c
+	b.lock.Unlock()
+
+	if existing != nil {
+		glog.Infof("MQTT client %s connected again, closing previous connection", c.id)
+		existing.conn.Close()
+	}
+}
+
+func (b *Broker) unregister(c *client) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if b.clients[c.id] == c {
+		delete(b.clients, c.id)
+	}
+}
+
+// subscribe adds subscription of client, returns matching retained messages
+func (b *Broker) subscribe(c *client, filter string) []*message {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	c.subscriptions[filter] = true
+	res := []*message{}
+	for topic, msg := range b.retained {
+		if matchTopic(filter, topic) {
+			res = append(res, msg)
+		}
+	}
+
+	return res
+}
+
+func (b *Broker) unsubscribe(c *client, filter string) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	delete(c.subscriptions, filter)
+}
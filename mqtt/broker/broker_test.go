@@ -0,0 +1,268 @@
+package broker
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	pmqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMatchTopic(t *testing.T) {
+	runs := []struct {
+		filter string
+		topic  string
+		match  bool
+	}{
+		{"a/b", "a/b", true},
+		{"a/b", "a/c", false},
+		{"a/+", "a/b", true},
+		{"a/+", "a/b/c", false},
+		{"a/+/c", "a/b/c", true},
+		{"a/#", "a", true},
+		{"a/#", "a/b/c", true},
+		{"#", "a/b", true},
+		{"+/+", "/b", true},
+		{"#", "$SYS/uptime", false},
+		{"$SYS/#", "$SYS/uptime", true},
+	}
+	for _, run := range runs {
+		assert.Equal(t, run.match, matchTopic(run.filter, run.topic), "%s %s", run.filter, run.topic)
+	}
+
+	assert.True(t, validFilter("a/+/#"))
+	assert.False(t, validFilter("a/#/b"))
+	assert.False(t, validFilter("a/b+"))
+	assert.False(t, validTopic("a/+"))
+}
+
+func connect(t *testing.T, b *Broker, id string, opts func(*pmqtt.ClientOptions)) pmqtt.Client {
+	options := pmqtt.NewClientOptions()
+	options.AddBroker("tcp://" + b.Addr().String())
+	options.SetClientID(id)
+	options.SetAutoReconnect(false)
+	if opts != nil {
+		opts(options)
+	}
+	client := pmqtt.NewClient(options)
+	token := client.Connect()
+	require.True(t, token.WaitTimeout(5*time.Second))
+	require.NoError(t, token.Error())
+
+	return client
+}
+
+func subscribe(t *testing.T, client pmqtt.Client, filter string) <-chan pmqtt.Message {
+	ch := make(chan pmqtt.Message, 10)
+	token := client.Subscribe(filter, 1, func(_ pmqtt.Client, msg pmqtt.Message) {
+		ch <- msg
+	})
+	require.True(t, token.WaitTimeout(5*time.Second))
+	require.NoError(t, token.Error())
+
+	return ch
+}
+
+func receive(t *testing.T, ch <-chan pmqtt.Message) pmqtt.Message {
+	select {
+	case msg := <-ch:
+		return msg
+	case <-time.After(5 * time.Second):
+		t.Fatal("message not received")
+	}
+	return nil
+}
+
+func TestBroker(t *testing.T) {
+	b, err := NewBroker(map[string]interface{}{"listen": "127.0.0.1:0"})
+	require.NoError(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go b.Run(ctx)
+	<-b.Ready()
+
+	sub := connect(t, b, "sub", nil)
+	pub := connect(t, b, "pub", func(o *pmqtt.ClientOptions) {
+		o.SetWill("devices/pub/online", "false", 0, true)
+	})
+
+	// Wildcard subscription, all QoS levels of publisher
+	ch := subscribe(t, sub, "home/+/temperature")
+	for qos := byte(0); qos <= 2; qos++ {
+		token := pub.Publish("home/kitchen/temperature", qos, false, "21.5")
+		require.True(t, token.WaitTimeout(5*time.Second))
+		require.NoError(t, token.Error())
+		msg := receive(t, ch)
+		assert.Equal(t, "home/kitchen/temperature", msg.Topic())
+		assert.Equal(t, "21.5", string(msg.Payload()))
+		assert.False(t, msg.Retained())
+	}
+
+	// Retained message delivered to new subscriber
+	pub.Publish("home/light", 1, true, "50").Wait()
+	lightCh := subscribe(t, sub, "home/light")
+	msg := receive(t, lightCh)
+	assert.Equal(t, "50", string(msg.Payload()))
+	assert.True(t, msg.Retained())
+
+	// Server side publish
+	b.Publish("home/light", []byte("70"), false)
+	assert.Equal(t, "70", string(receive(t, lightCh).Payload()))
+
+	// Will published when connection lost
+	ch = subscribe(t, sub, "devices/#")
+	b.lock.Lock()
+	b.clients["pub"].conn.Close()
+	b.lock.Unlock()
+	msg = receive(t, ch)
+	assert.Equal(t, "devices/pub/online", msg.Topic())
+	assert.Equal(t, "false", string(msg.Payload()))
+
+	// No messages after unsubscribe
+	require.True(t, sub.Unsubscribe("home/light").WaitTimeout(5*time.Second))
+	b.Publish("home/light", []byte("80"), false)
+	b.Publish("devices/sub", []byte("ok"), false)
+	assert.Equal(t, "devices/sub", receive(t, ch).Topic())
+	assert.Empty(t, lightCh)
+	sub.Disconnect(100)
+}
+
+func startBroker(t *testing.T, cfg map[string]interface{}) (*Broker, context.CancelFunc) {
+	b, err := NewBroker(cfg)
+	require.NoError(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		assert.NoError(t, b.Run(ctx))
+		close(done)
+	}()
+	<-b.Ready()
+
+	return b, func() {
+		cancel()
+		<-done
+	}
+}
+
+func TestBrokerAuth(t *testing.T) {
+	b, stop := startBroker(t, map[string]interface{}{
+		"listen": "127.0.0.1:0",
+		"users":  map[string]interface{}{"ha": "secret"},
+	})
+	defer stop()
+
+	for _, run := range []struct {
+		user     string
+		password string
+		ok       bool
+	}{
+		{"ha", "secret", true},
+		{"ha", "wrong", false},
+		{"", "", false},
+		{"other", "secret", false},
+	} {
+		options := pmqtt.NewClientOptions()
+		options.AddBroker("tcp://" + b.Addr().String())
+		options.SetUsername(run.user)
+		options.SetPassword(run.password)
+		options.SetAutoReconnect(false)
+		client := pmqtt.NewClient(options)
+		token := client.Connect()
+		require.True(t, token.WaitTimeout(5*time.Second))
+		if run.ok {
+			assert.NoError(t, token.Error(), run.user)
+			client.Disconnect(100)
+		} else {
+			assert.Error(t, token.Error(), run.user)
+		}
+	}
+
+	// In-process connection is trusted
+	options := pmqtt.NewClientOptions()
+	options.AddBroker("tcp://embedded")
+	options.SetCustomOpenConnectionFn(func(*url.URL, pmqtt.ClientOptions) (net.Conn, error) {
+		return b.Connect(), nil
+	})
+	client := pmqtt.NewClient(options)
+	token := client.Connect()
+	require.True(t, token.WaitTimeout(5*time.Second))
+	assert.NoError(t, token.Error())
+	client.Disconnect(100)
+}
+
+func TestBrokerWebsocket(t *testing.T) {
+	b, stop := startBroker(t, map[string]interface{}{
+		"websocket":      "127.0.0.1:0",
+		"allowedOrigins": []string{"https://home.example.com"},
+	})
+	defer stop()
+
+	// Web pages of other sites are rejected
+	wsUrl := "ws://" + b.WebsocketAddr().String() + "/mqtt"
+	for origin, allowed := range map[string]bool{
+		"https://evil.example.com":             false,
+		"https://home.example.com":             true,
+		"http://" + b.WebsocketAddr().String(): true,
+	} {
+		conn, _, err := websocket.DefaultDialer.Dial(wsUrl, http.Header{"Origin": {origin}})
+		if allowed {
+			if assert.NoError(t, err, origin) {
+				conn.Close()
+			}
+		} else {
+			assert.Error(t, err, origin)
+		}
+	}
+
+	options := pmqtt.NewClientOptions()
+	options.AddBroker("ws://" + b.WebsocketAddr().String() + "/mqtt")
+	options.SetAutoReconnect(false)
+	client := pmqtt.NewClient(options)
+	token := client.Connect()
+	require.True(t, token.WaitTimeout(5*time.Second))
+	require.NoError(t, token.Error())
+
+	ch := subscribe(t, client, "ws/#")
+	b.Publish("ws/test", []byte("hello"), false)
+	assert.Equal(t, "hello", string(receive(t, ch).Payload()))
+	client.Disconnect(100)
+}
+
+func TestBrokerPersistence(t *testing.T) {
+	dir, err := ioutil.TempDir("", "broker")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	cfg := map[string]interface{}{
+		"listen":       "127.0.0.1:0",
+		"retainedFile": filepath.Join(dir, "retained.json"),
+	}
+
+	// Retained messages saved on exit
+	b, stop := startBroker(t, cfg)
+	b.Publish("home/light", []byte("50"), true)
+	b.Publish("home/cleared", []byte("1"), true)
+	b.Publish("home/cleared", nil, true)
+	b.Publish("home/event", []byte("not retained"), false)
+	stop()
+
+	// ... and restored by next run
+	b, stop = startBroker(t, cfg)
+	defer stop()
+	client := connect(t, b, "sub", nil)
+	ch := subscribe(t, client, "home/#")
+	msg := receive(t, ch)
+	assert.Equal(t, "home/light", msg.Topic())
+	assert.Equal(t, "50", string(msg.Payload()))
+	assert.True(t, msg.Retained())
+	assert.Empty(t, ch)
+	client.Disconnect(100)
+}
@@ -0,0 +1,300 @@
+package broker
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+const (
+	// Time for client to send CONNECT after connection established
+	connectTimeout = 10 * time.Second
+	// Slow subscriber is disconnected, instead of blocking publishers
+	writeTimeout = 10 * time.Second
+)
+
+// client is connection of MQTT client
+type client struct {
+	id     string
+	broker *Broker
+	// In-process connection, no authentication required
+	trusted bool
+	conn    net.Conn
+	reader  *bufio.Reader
+	// Protected by broker lock
+	subscriptions map[string]bool
+	keepAlive     time.Duration
+	will          *message
+	// QoS 2 messages received, waiting for PUBREL
+	qos2      map[uint16]bool
+	writeLock sync.Mutex
+}
+
+func newClient(b *Broker, conn net.Conn, trusted bool) *client {
+	return &client{
+		broker:        b,
+		trusted:       trusted,
+		conn:          conn,
+		reader:        bufio.NewReader(conn),
+		subscriptions: map[string]bool{},
+		qos2:          map[uint16]bool{},
+	}
+}
+
+// serve processes packets of client until connection closed
+func (c *client) serve() error {
+	defer c.conn.Close()
+
+	// First packet must be CONNECT
+	c.conn.SetReadDeadline(time.Now().Add(connectTimeout))
+	p, err := readPacket(c.reader, c.broker.MaxPacketSize)
+	if err != nil {
+		return err
+	}
+	if p.kind != packetConnect {
+		return errors.New("first packet is not CONNECT")
+	}
+	err = c.connect(p)
+	if err != nil {
+		return err
+	}
+	c.broker.register(c)
+	defer c.broker.unregister(c)
+	glog.Infof("MQTT client %s connected from %s", c.id, c.conn.RemoteAddr())
+
+	for {
+		// Client is considered dead after 1.5 keep alive periods of silence
+		deadline := time.Time{}
+		if c.keepAlive > 0 {
+			deadline = time.Now().Add(c.keepAlive * 3 / 2)
+		}
+		c.conn.SetReadDeadline(deadline)
+
+		p, err := readPacket(c.reader, c.broker.MaxPacketSize)
+		if err != nil {
+			c.publishWill()
+			return err
+		}
+		if p.kind == packetDisconnect {
+			// Graceful disconnect: will is discarded
+			return nil
+		}
+		err = c.process(p)
+		if err != nil {
+			c.publishWill()
+			return err
+		}
+	}
+}
+
+func (c *client) connect(p *packet) error {
+	d := &decoder{data: p.body}
+	protocol := d.string()
+	level := d.byte()
+	flags := d.byte()
+	keepAlive := d.uint16()
+	c.id = d.string()
+	if d.err != nil {
+		return d.err
+	}
+	if !(protocol == "MQTT" && level == 4) && !(protocol == "MQIsdp" && level == 3) {
+		c.connack(connackBadProtocolVersion)
+		return fmt.Errorf("unsupported protocol %s level %d", protocol, level)
+	}
+	cleanSession := flags&0x02 != 0
+	if c.id == "" {
+		if !cleanSession {
+			c.connack(connackIdentifierRejected)
+			return errors.New("empty client id requires clean session")
+		}
+		c.id = fmt.Sprintf("auto-%s", c.conn.RemoteAddr())
+	}
+	c.keepAlive = time.Duration(keepAlive) * time.Second
+
+	if flags&0x04 != 0 {
+		c.will = &message{
+			topic:   d.string(),
+			payload: d.bytes(),
+			retain:  flags&0x20 != 0,
+		}
+	}
+	var user string
+	var password []byte
+	if flags&0x80 != 0 {
+		user = d.string()
+	}
+	if flags&0x40 != 0 {
+		password = d.bytes()
+	}
+	if d.err != nil {
+		return d.err
+	}
+	if !c.trusted && !c.broker.authenticate(user, password) {
+		c.connack(connackBadCredentials)
+		return fmt.Errorf("bad credentials of user '%s'", user)
+	}
+
+	return c.connack(connackAccepted)
+}
+
+func (c *client) connack(code byte) error {
+	// No persistent sessions, so session present flag is never set
+	return c.write(packetConnack, 0, []byte{0, code})
+}
+
+func (c *client) process(p *packet) error {
+	switch p.kind {
+	case packetPublish:
+		return c.processPublish(p)
+	case packetPubrel:
+		d := &decoder{data: p.body}
+		id := d.uint16()
+		if d.err != nil {
+			return d.err
+		}
+		delete(c.qos2, id)
+		return c.write(packetPubcomp, 0, appendUint16(nil, id))
+	case packetSubscribe:
+		return c.processSubscribe(p)
+	case packetUnsubscribe:
+		return c.processUnsubscribe(p)
+	case packetPingreq:
+		return c.write(packetPingresp, 0, nil)
+	case packetPuback, packetPubrec, packetPubcomp:
+		// Messages are delivered with QoS 0 only, nothing to acknowledge
+		return nil
+	}
+
+	return fmt.Errorf("unexpected packet type %d", p.kind)
+}
+
+func (c *client) processPublish(p *packet) error {
+	qos := (p.flags >> 1) & 0x03
+	d := &decoder{data: p.body}
+	msg := &message{
+		topic:  d.string(),
+		retain: p.flags&0x01 != 0,
+	}
+	var id uint16
+	if qos > 0 {
+		id = d.uint16()
+	}
+	if d.err != nil {
+		return d.err
+	}
+	if qos > 2 || !validTopic(msg.topic) {
+		return errMalformed
+	}
+	msg.payload = append([]byte{}, d.data...)
+
+	switch qos {
+	case 1:
+		c.broker.publish(msg)
+		return c.write(packetPuback, 0, appendUint16(nil, id))
+	case 2:
+		// Duplicate of message not released yet is not delivered again
+		if !c.qos2[id] {
+			c.qos2[id] = true
+			c.broker.publish(msg)
+		}
+		return c.write(packetPubrec, 0, appendUint16(nil, id))
+	}
+	c.broker.publish(msg)
+
+	return nil
+}
+
+func (c *client) processSubscribe(p *packet) error {
+	d := &decoder{data: p.body}
+	id := d.uint16()
+	codes := []byte{}
+	retained := []*message{}
+	for d.err == nil && !d.empty() {
+		filter := d.string()
+		d.byte() // requested QoS, always granted QoS 0
+		if d.err != nil {
+			break
+		}
+		if !validFilter(filter) {
+			codes = append(codes, 0x80)
+			continue
+		}
+		retained = append(retained, c.broker.subscribe(c, filter)...)
+		codes = append(codes, 0)
+	}
+	if d.err != nil {
+		return d.err
+	}
+
+	err := c.write(packetSuback, 0, append(appendUint16(nil, id), codes...))
+	if err != nil {
+		return err
+	}
+	for _, msg := range retained {
+		c.deliver(msg.topic, msg.payload, true)
+	}
+
+	return nil
+}
+
+func (c *client) processUnsubscribe(p *packet) error {
+	d := &decoder{data: p.body}
+	id := d.uint16()
+	for d.err == nil && !d.empty() {
+		filter := d.string()
+		if d.err == nil {
+			c.broker.unsubscribe(c, filter)
+		}
+	}
+	if d.err != nil {
+		return d.err
+	}
+
+	return c.write(packetUnsuback, 0, appendUint16(nil, id))
+}
+
+// subscribed reports whether any subscription matches topic,
+// must be called with broker lock held
+func (c *client) subscribed(topic string) bool {
+	for filter := range c.subscriptions {
+		if matchTopic(filter, topic) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// deliver sends message to client with QoS 0
+func (c *client) deliver(topic string, payload []byte, retain bool) {
+	flags := byte(0)
+	if retain {
+		flags = 0x01
+	}
+	body := append(appendString(nil, topic), payload...)
+	err := c.write(packetPublish, flags, body)
+	if err != nil {
+		glog.Infof("MQTT delivery to %s failed: %v", c.id, err)
+	}
+}
+
+func (c *client) publishWill() {
+	if c.will != nil {
+		c.broker.publish(c.will)
+		c.will = nil
+	}
+}
+
+func (c *client) write(kind, flags byte, body []byte) error {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+
+	c.conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+	_, err := c.conn.Write(encodePacket(kind, flags, body))
+	return err
+}
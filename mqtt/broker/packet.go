@@ -0,0 +1,152 @@
+package broker
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// MQTT 3.1.1 control packet types
+const (
+	packetConnect     = 1
+	packetConnack     = 2
+	packetPublish     = 3
+	packetPuback      = 4
+	packetPubrec      = 5
+	packetPubrel      = 6
+	packetPubcomp     = 7
+	packetSubscribe   = 8
+	packetSuback      = 9
+	packetUnsubscribe = 10
+	packetUnsuback    = 11
+	packetPingreq     = 12
+	packetPingresp    = 13
+	packetDisconnect  = 14
+)
+
+// CONNACK return codes
+const (
+	connackAccepted           = 0
+	connackBadProtocolVersion = 1
+	connackIdentifierRejected = 2
+	connackBadCredentials     = 4
+)
+
+var errMalformed = errors.New("malformed packet")
+
+type packet struct {
+	kind  byte
+	flags byte
+	body  []byte
+}
+
+// readPacket reads one control packet, rejecting packets larger than maxSize
+func readPacket(r *bufio.Reader, maxSize int) (*packet, error) {
+	header, err := r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+
+	// Remaining length: up to 4 bytes, 7 bits each
+	length := 0
+	for i := 0; ; i++ {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		length |= int(b&0x7f) << (7 * uint(i))
+		if b&0x80 == 0 {
+			break
+		}
+		if i == 3 {
+			return nil, errMalformed
+		}
+	}
+	if length > maxSize {
+		return nil, fmt.Errorf("packet too large (%d bytes)", length)
+	}
+
+	p := &packet{
+		kind:  header >> 4,
+		flags: header & 0x0f,
+		body:  make([]byte, length),
+	}
+	_, err = io.ReadFull(r, p.body)
+
+	return p, err
+}
+
+// encodePacket returns wire representation of control packet
+func encodePacket(kind, flags byte, body []byte) []byte {
+	buf := []byte{kind<<4 | flags}
+	length := len(body)
+	for {
+		b := byte(length & 0x7f)
+		length >>= 7
+		if length > 0 {
+			b |= 0x80
+		}
+		buf = append(buf, b)
+		if length == 0 {
+			break
+		}
+	}
+
+	return append(buf, body...)
+}
+
+func appendUint16(buf []byte, value uint16) []byte {
+	return append(buf, byte(value>>8), byte(value))
+}
+
+func appendString(buf []byte, value string) []byte {
+	buf = appendUint16(buf, uint16(len(value)))
+	return append(buf, value...)
+}
+
+// decoder reads fields of packet body, remembering first error
+type decoder struct {
+	data []byte
+	err  error
+}
+
+func (d *decoder) byte() byte {
+	if len(d.data) < 1 {
+		d.err = errMalformed
+		return 0
+	}
+	b := d.data[0]
+	d.data = d.data[1:]
+	return b
+}
+
+func (d *decoder) uint16() uint16 {
+	if len(d.data) < 2 {
+		d.err = errMalformed
+		return 0
+	}
+	value := binary.BigEndian.Uint16(d.data)
+	d.data = d.data[2:]
+	return value
+}
+
+func (d *decoder) bytes() []byte {
+	length := int(d.uint16())
+	if d.err != nil || len(d.data) < length {
+		d.err = errMalformed
+		return nil
+	}
+	value := d.data[:length]
+	d.data = d.data[length:]
+	return value
+}
+
+func (d *decoder) string() string {
+	return string(d.bytes())
+}
+
+func (d *decoder) empty() bool {
+	return len(d.data) == 0
+}
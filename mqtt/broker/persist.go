@@ -0,0 +1,69 @@
+package broker
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"sort"
+
+	"github.com/golang/glog"
+
+	"github.com/lorahome/server/fileutil"
+)
+
+type retainedRecord struct {
+	Topic   string `json:"topic"`
+	Payload []byte `json:"payload"`
+}
+
+// loadRetained restores retained messages saved by previous run
+func (b *Broker) loadRetained() error {
+	if b.RetainedFile == "" {
+		return nil
+	}
+	data, err := ioutil.ReadFile(b.RetainedFile)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	records := []retainedRecord{}
+	err = json.Unmarshal(data, &records)
+	if err != nil {
+		return err
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	for _, record := range records {
+		b.retained[record.Topic] = &message{record.Topic, record.Payload, true}
+	}
+	glog.Infof("MQTT broker: %d retained message(s) loaded", len(records))
+
+	return nil
+}
+
+// saveRetained writes retained messages into file, if changed
+func (b *Broker) saveRetained() {
+	b.lock.Lock()
+	if b.RetainedFile == "" || !b.retainedDirty {
+		b.lock.Unlock()
+		return
+	}
+	records := []retainedRecord{}
+	for _, msg := range b.retained {
+		records = append(records, retainedRecord{msg.topic, msg.payload})
+	}
+	b.retainedDirty = false
+	b.lock.Unlock()
+
+	sort.Slice(records, func(i, j int) bool {
+		return records[i].Topic < records[j].Topic
+	})
+	data, _ := json.Marshal(records)
+	err := fileutil.WriteAtomic(b.RetainedFile, data, 0644)
+	if err != nil {
+		glog.Errorf("MQTT broker: unable to save retained messages: %v", err)
+	}
+}
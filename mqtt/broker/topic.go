@@ -0,0 +1,51 @@
+package broker
+
+import "strings"
+
+// matchTopic reports whether topic name matches subscription filter,
+// which may contain wildcards: "+" (single level) and "#" (all remaining levels)
+func matchTopic(filter, topic string) bool {
+	// Topics starting with "$" are not matched by wildcards at first level
+	if strings.HasPrefix(topic, "$") && !strings.HasPrefix(filter, "$") {
+		return false
+	}
+
+	filterLevels := strings.Split(filter, "/")
+	topicLevels := strings.Split(topic, "/")
+	for i, level := range filterLevels {
+		if level == "#" {
+			return true
+		}
+		if i >= len(topicLevels) {
+			return false
+		}
+		if level != "+" && level != topicLevels[i] {
+			return false
+		}
+	}
+
+	return len(filterLevels) == len(topicLevels)
+}
+
+// validFilter checks wildcards placement in subscription filter
+func validFilter(filter string) bool {
+	if filter == "" {
+		return false
+	}
+	levels := strings.Split(filter, "/")
+	for i, level := range levels {
+		if level == "#" && i != len(levels)-1 {
+			return false
+		}
+		if level != "#" && level != "+" && strings.ContainsAny(level, "#+") {
+			return false
+		}
+	}
+
+	return true
+}
+
+// validTopic checks that topic name of published message has no wildcards
+func validTopic(topic string) bool {
+	return topic != "" && !strings.ContainsAny(topic, "#+")
+}
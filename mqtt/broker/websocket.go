@@ -0,0 +1,80 @@
+package broker
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/gorilla/websocket"
+
+	"github.com/lorahome/server/api"
+)
+
+// serveWebsocket handles MQTT over WebSocket connection
+func (b *Broker) serveWebsocket(w http.ResponseWriter, r *http.Request) {
+	upgrader := websocket.Upgrader{
+		Subprotocols: []string{"mqtt"},
+		// Web pages of other sites must not connect on behalf of browser
+		CheckOrigin: func(r *http.Request) bool {
+			return api.CheckOrigin(r, b.AllowedOrigins)
+		},
+	}
+	ws, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		glog.Infof("MQTT websocket upgrade failed: %v", err)
+		return
+	}
+	b.serveConn(&wsConn{Conn: ws}, false)
+}
+
+// wsConn is stream of MQTT packets carried by binary websocket messages
+type wsConn struct {
+	*websocket.Conn
+	reader io.Reader
+}
+
+func (c *wsConn) Read(buf []byte) (int, error) {
+	for {
+		if c.reader == nil {
+			kind, reader, err := c.NextReader()
+			if err != nil {
+				return 0, err
+			}
+			if kind != websocket.BinaryMessage {
+				continue
+			}
+			c.reader = reader
+		}
+		n, err := c.reader.Read(buf)
+		if err == io.EOF {
+			// Packets may span messages, continue with next one
+			c.reader = nil
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+		return n, err
+	}
+}
+
+func (c *wsConn) Write(buf []byte) (int, error) {
+	err := c.WriteMessage(websocket.BinaryMessage, buf)
+	if err != nil {
+		return 0, err
+	}
+	return len(buf), nil
+}
+
+func (c *wsConn) SetDeadline(t time.Time) error {
+	err := c.SetReadDeadline(t)
+	if err != nil {
+		return err
+	}
+	return c.SetWriteDeadline(t)
+}
+
+// Ensure that wsConn is usable by MQTT client handler
+var _ net.Conn = &wsConn{}
@@ -2,23 +2,42 @@ package mqtt
 
 import (
 	"context"
+	"fmt"
+	"net"
+	"net/url"
 	"sync"
 
 	pmqtt "github.com/eclipse/paho.mqtt.golang"
 	"github.com/golang/glog"
 	"github.com/mitchellh/mapstructure"
+
+	"github.com/lorahome/server/mqtt/broker"
+	"github.com/lorahome/server/secrets"
 )
 
+// EmbeddedBroker as broker address runs embedded broker,
+// client connects to it in-process
+const EmbeddedBroker = "embedded"
+
 type MqttClient struct {
-	Broker       string
+	Broker string
+	// Configuration of embedded broker (listeners, users, persistence)
+	Embedded     interface{}
 	User         string
 	Password     string
 	CleanSession bool
 	Clientid     string
+	// Template of device topics, used when device has no explicit topic,
+	// e.g. "lorahome/{class}/{name}/{quantity}"
+	TopicTemplate string
+	// Per device class templates, take precedence over TopicTemplate
+	ClassTopicTemplates map[string]string
 
 	client                pmqtt.Client
 	options               *pmqtt.ClientOptions
+	embedded              *broker.Broker
 	enabled               bool
+	connected             chan struct{}
 	subscriptions         map[string][]chan *MqttMessage
 	wildcardSubscriptions []chan *MqttMessage
 	lock                  sync.Mutex
@@ -31,6 +50,7 @@ type MqttMessage struct {
 
 func NewMqttClient(cfg interface{}) (*MqttClient, error) {
 	m := &MqttClient{
+		connected:     make(chan struct{}),
 		subscriptions: make(map[string][]chan *MqttMessage),
 	}
 	if cfg == nil {
@@ -43,13 +63,43 @@ func NewMqttClient(cfg interface{}) (*MqttClient, error) {
 	if err != nil {
 		return nil, err
 	}
+	if m.TopicTemplate != "" {
+		if err := validateTopicTemplate(m.TopicTemplate); err != nil {
+			return nil, fmt.Errorf("topic template: %v", err)
+		}
+	}
+	for class, template := range m.ClassTopicTemplates {
+		if err := validateTopicTemplate(template); err != nil {
+			return nil, fmt.Errorf("topic template of %s: %v", class, err)
+		}
+	}
+	// Password may be secret reference
+	password, err := secrets.Resolve(m.Password)
+	if err != nil {
+		return nil, err
+	}
 
 	m.enabled = true
 	m.options = pmqtt.NewClientOptions()
-	m.options.AddBroker(m.Broker)
+	if m.Broker == EmbeddedBroker {
+		// Embedded broker may have no listeners at all
+		if m.Embedded == nil {
+			m.Embedded = map[string]interface{}{}
+		}
+		m.embedded, err = broker.NewBroker(m.Embedded)
+		if err != nil {
+			return nil, err
+		}
+		m.options.AddBroker("tcp://" + EmbeddedBroker)
+		m.options.SetCustomOpenConnectionFn(func(*url.URL, pmqtt.ClientOptions) (net.Conn, error) {
+			return m.embedded.Connect(), nil
+		})
+	} else {
+		m.options.AddBroker(m.Broker)
+	}
 	m.options.SetClientID(m.Clientid)
 	m.options.SetUsername(m.User)
-	m.options.SetPassword(m.Password)
+	m.options.SetPassword(password)
 	m.options.SetCleanSession(m.CleanSession)
 	m.options.SetDefaultPublishHandler(m.onMessage)
 
@@ -60,15 +110,30 @@ func (m *MqttClient) Run(ctx context.Context) error {
 	if !m.enabled {
 		// Bypass mode - just wait for context close
 		glog.Info("MQTT is not enabled")
+		close(m.connected)
 		<-ctx.Done()
 		return nil
 	}
 
+	if m.embedded != nil {
+		// Broker lives as long as client
+		errCh := make(chan error, 1)
+		go func() {
+			errCh <- m.embedded.Run(ctx)
+		}()
+		select {
+		case <-m.embedded.Ready():
+		case err := <-errCh:
+			return err
+		}
+	}
+
 	m.client = pmqtt.NewClient(m.options)
 	if token := m.client.Connect(); token.Wait() && token.Error() != nil {
 		return token.Error()
 	}
 	glog.Infof("Connected to MQTT broker at %s", m.Broker)
+	close(m.connected)
 
 	// Wait until termianted
 	<-ctx.Done()
@@ -77,7 +142,16 @@ func (m *MqttClient) Run(ctx context.Context) error {
 	return nil
 }
 
+// Ready is closed once client connected to broker (or in bypass mode)
+func (m *MqttClient) Ready() <-chan struct{} {
+	return m.connected
+}
+
 func (m *MqttClient) Subscribe(topic string, qos byte) (<-chan *MqttMessage, error) {
+	if !m.enabled {
+		// Bypass mode - nothing will ever be received
+		return make(chan *MqttMessage), nil
+	}
 	// Subscribe to given topic
 	if token := m.client.Subscribe(topic, qos, nil); token.Wait() && token.Error() != nil {
 		return nil, token.Error()
@@ -115,6 +189,10 @@ func (m *MqttClient) SubscribeMultiple(topics []string, qos byte) (<-chan *MqttM
 }
 
 func (m *MqttClient) Publish(topic string, payload interface{}, qos byte, retained bool) error {
+	if !m.enabled {
+		// Bypass mode - just drop message
+		return nil
+	}
 	if token := m.client.Publish(topic, qos, retained, payload); token.Wait() && token.Error() != nil {
 		return token.Error()
 	}
@@ -0,0 +1,51 @@
+package mqtt
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEmbeddedBroker(t *testing.T) {
+	m, err := NewMqttClient(map[string]interface{}{
+		"broker":   EmbeddedBroker,
+		"clientid": "server",
+		"embedded": map[string]interface{}{
+			"listen": "127.0.0.1:0",
+			"users":  map[string]interface{}{"ha": "secret"},
+		},
+	})
+	require.NoError(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go m.Run(ctx)
+	select {
+	case <-m.Ready():
+	case <-time.After(5 * time.Second):
+		t.Fatal("not connected to embedded broker")
+	}
+
+	// External client authenticated by broker
+	external, err := NewMqttClient(map[string]interface{}{
+		"broker":   "tcp://" + m.embedded.Addr().String(),
+		"clientid": "ha",
+		"user":     "ha",
+		"password": "secret",
+	})
+	require.NoError(t, err)
+	go external.Run(ctx)
+	<-external.Ready()
+
+	ch, err := external.Subscribe("home/light/set", 0)
+	require.NoError(t, err)
+	require.NoError(t, m.Publish("home/light/set", "50", 0, false))
+	select {
+	case msg := <-ch:
+		assert.Equal(t, "50", msg.Value)
+	case <-time.After(5 * time.Second):
+		t.Fatal("message not delivered")
+	}
+}
@@ -0,0 +1,57 @@
+package mqtt
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// CommandTopicSuffix is appended to device topic of value to get topic
+// commands (new values) are received from
+const CommandTopicSuffix = "/set"
+
+// Characters not allowed in single topic level
+var topicLevelReplacer = strings.NewReplacer("/", "_", "+", "_", "#", "_")
+
+// DeviceTopic renders topic of device quantity from template (class template
+// takes precedence over global one), e.g. "lorahome/{class}/{name}/{quantity}".
+// Returns empty string if there is no template.
+func (m *MqttClient) DeviceTopic(class, name, quantity string) string {
+	template, ok := m.ClassTopicTemplates[class]
+	if !ok {
+		template = m.TopicTemplate
+	}
+	if template == "" {
+		return ""
+	}
+
+	return strings.NewReplacer(
+		"{class}", topicLevelReplacer.Replace(class),
+		"{name}", topicLevelReplacer.Replace(name),
+		"{quantity}", topicLevelReplacer.Replace(quantity),
+	).Replace(template)
+}
+
+// DeviceCommandTopic returns topic commands of device quantity are received
+// from, empty string if there is no template
+func (m *MqttClient) DeviceCommandTopic(class, name, quantity string) string {
+	topic := m.DeviceTopic(class, name, quantity)
+	if topic == "" {
+		return ""
+	}
+
+	return topic + CommandTopicSuffix
+}
+
+func validateTopicTemplate(template string) error {
+	if strings.ContainsAny(template, "+#") {
+		return errors.New("wildcards are not allowed")
+	}
+	for _, placeholder := range []string{"{name}", "{quantity}"} {
+		if !strings.Contains(template, placeholder) {
+			return fmt.Errorf("%s placeholder is required", placeholder)
+		}
+	}
+
+	return nil
+}
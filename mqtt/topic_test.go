@@ -0,0 +1,32 @@
+package mqtt
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDeviceTopic(t *testing.T) {
+	m, err := NewMqttClient(nil)
+	require.NoError(t, err)
+	assert.Equal(t, "", m.DeviceTopic("MultiSensor", "kitchen", "temperature"))
+	assert.Equal(t, "", m.DeviceCommandTopic("LedStrip", "strip", "level"))
+
+	m, err = NewMqttClient(map[string]interface{}{
+		"broker":        "tcp://localhost:1883",
+		"topicTemplate": "lorahome/{class}/{name}/{quantity}",
+		"classTopicTemplates": map[string]interface{}{
+			"LedStrip": "lights/{name}/{quantity}",
+		},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "lorahome/MultiSensor/kitchen/temperature", m.DeviceTopic("MultiSensor", "kitchen", "temperature"))
+	assert.Equal(t, "lorahome/MultiSensor/a_b_c_/humidity", m.DeviceTopic("MultiSensor", "a/b+c#", "humidity"))
+	assert.Equal(t, "lights/strip/level/set", m.DeviceCommandTopic("LedStrip", "strip", "level"))
+
+	for _, template := range []string{"lorahome/{name}", "lorahome/{quantity}", "lorahome/+/{name}/{quantity}"} {
+		_, err := NewMqttClient(map[string]interface{}{"topicTemplate": template})
+		assert.Error(t, err, template)
+	}
+}
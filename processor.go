@@ -7,9 +7,20 @@ import (
 	"github.com/golang/glog"
 
 	"github.com/lorahome/server/devices"
+	"github.com/lorahome/server/transport"
 )
 
-func processPacket(packet []byte) error {
+// Server level handlers of control messages (join, key rotation,
+// downlink acknowledges), called before device class handler.
+var controlHandlers = []func(devices.Device, transport.LoRaTransport, []byte) (devices.ControlResult, error){
+	devices.ProcessJoin,
+	devices.ProcessKeyRotation,
+	devices.ProcessAck,
+}
+
+// processPacket dispatches packet to device, devices which keys changed by
+// control messages are saved into devicesFile right away, if set
+func processPacket(source transport.LoRaTransport, packet []byte, devicesFile string) error {
 	// Parse device id
 	deviceId, err := parseDeviceId(packet)
 	if err != nil {
@@ -23,8 +34,36 @@ func processPacket(packet []byte) error {
 	if device == nil {
 		return fmt.Errorf("device 0x%x does not exist", deviceId)
 	}
+	// Control messages are handled by server, regardless of device class
+	for _, handler := range controlHandlers {
+		res, err := handler(device, source, packet[8:])
+		if err != nil {
+			return err
+		}
+		if res.KeysChanged && devicesFile != "" {
+			// Persist changed keys right away
+			err = devices.SaveToFile(devicesFile)
+			if err != nil {
+				return err
+			}
+		}
+		if res.Consumed {
+			if res.Replied {
+				// Receive window already used
+				return nil
+			}
+			// Device has just sent uplink, so it is listening now
+			return device.GetBaseDevice().DeliverDownlinks()
+		}
+	}
 	// Call device handler to process packet
-	return device.ProcessMessage(packet[8:])
+	err = device.ProcessMessage(packet[8:])
+	if err != nil {
+		return err
+	}
+
+	// Device has just sent uplink, so it is listening now
+	return device.GetBaseDevice().DeliverDownlinks()
 }
 
 func parseDeviceId(packet []byte) (uint64, error) {
@@ -1,9 +1,14 @@
 package main
 
 import (
+	"bytes"
+	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/lorahome/server/devices"
+	"github.com/lorahome/server/downlink"
+	"github.com/lorahome/server/encoding"
 	"github.com/lorahome/server/transport"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -33,13 +38,13 @@ func TestParseId(t *testing.T) {
 func TestProcessPacket(t *testing.T) {
 	// End to end test of packet processing with mock device
 	// Add device class
-	devices.RegisterDeviceClass(url, devices.NewMockDevice)
+	devices.RegisterDeviceClass(url, devices.ClassName, devices.NewMockDevice)
 	// Add device
 	cfg := map[interface{}]interface{}{
 		"id":  0x1234,
 		"url": url,
 	}
-	rawDev, err := devices.RegisterDevice(cfg)
+	rawDev, err := devices.RegisterDevice(url, cfg, nil)
 	require.NoError(t, err)
 	dev := rawDev.(*devices.MockDevice)
 
@@ -48,12 +53,43 @@ func TestProcessPacket(t *testing.T) {
 	packet := []byte{0x34, 0x12, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, // id
 		0x00, 0x01, 0x02, 0x03, // some payload
 	}
-	err = processPacket(source, packet)
+	err = processPacket(source, packet, "")
 	// Ensure that mock device received packet
 	assert.NoError(t, err)
 	assert.Equal(t, []byte{0x00, 0x01, 0x02, 0x03}, dev.ProcessMessageHistory[0])
 
 	// Negative: non existing device
-	err = processPacket(source, []byte{0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00})
+	err = processPacket(source, []byte{0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00}, "")
 	assert.Error(t, err)
 }
+
+func TestProcessPacketAck(t *testing.T) {
+	devices.RegisterDeviceClass(url, devices.ClassName, devices.NewMockDevice)
+	source := transport.NewMockLoRaTransport()
+	queue, err := downlink.NewQueue(nil, source, nil)
+	require.NoError(t, err)
+	cfg := map[interface{}]interface{}{
+		"id":    0x4321,
+		"url":   url,
+		"key":   "22222222222222222222222222222222",
+		"class": "A",
+	}
+	rawDev, err := devices.RegisterDevice(url, cfg, &devices.Capabilities{Downlink: queue})
+	require.NoError(t, err)
+	dev := rawDev.(*devices.MockDevice)
+	require.NoError(t, dev.LoadKeys())
+	require.NoError(t, dev.SendDownlink("light", []byte{42}))
+
+	// Acknowledge is consumed by server: devices file is not touched,
+	// but receive window opened by it is used for pending downlink
+	ack, err := encoding.AESencryptCBC(bytes.Repeat([]byte{0x22}, 16), []byte{'L', 'H', 'A', 'K', 1, 0})
+	require.NoError(t, err)
+	packet := append([]byte{0x21, 0x43, 0, 0, 0, 0, 0, 0}, ack...)
+	devicesFile := filepath.Join(t.TempDir(), "devices.yaml")
+	err = processPacket(source, packet, devicesFile)
+	require.NoError(t, err)
+	assert.Empty(t, dev.ProcessMessageHistory)
+	assert.Len(t, source.History, 1)
+	_, err = os.Stat(devicesFile)
+	assert.True(t, os.IsNotExist(err))
+}
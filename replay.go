@@ -0,0 +1,104 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/lorahome/server/capture"
+	"github.com/lorahome/server/db/influxdb"
+	"github.com/lorahome/server/devices"
+	"github.com/lorahome/server/downlink"
+	"github.com/lorahome/server/mqtt"
+	"github.com/lorahome/server/secrets"
+	"github.com/lorahome/server/state"
+	"github.com/lorahome/server/transport"
+	"github.com/lorahome/server/webhook"
+)
+
+// runReplay feeds captured uplinks through processPacket, so decoding
+// issues can be reproduced offline. Downlinks are collected by mock transport.
+func runReplay(args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: replay <capture file>")
+	}
+	records, err := capture.ReadFile(args[0])
+	if err != nil {
+		return err
+	}
+	// Device keys may be stored in keystore. Replayed joins / key
+	// rotations change keys in memory only: keystore file is not written.
+	keystore, err := loadKeystore()
+	if err != nil {
+		return err
+	}
+	keystore.KeepInMemory()
+	secrets.SetKeystore(keystore)
+
+	source := transport.NewMockLoRaTransport()
+	caps, err := bypassCapabilities(source)
+	if err != nil {
+		return err
+	}
+	err = devices.LoadFromFile(*flagDevices, caps)
+	if err != nil {
+		return err
+	}
+
+	for i, record := range records {
+		if record.Direction != capture.Uplink {
+			continue
+		}
+		packet, err := record.Packet()
+		if err != nil {
+			return fmt.Errorf("record %d: %v", i+1, err)
+		}
+
+		sent := len(source.History)
+		// Replay must not change devices file (e.g. by join)
+		err = processPacket(source, packet, "")
+		status := "ok"
+		if err != nil {
+			status = err.Error()
+		}
+		from := record.Transport
+		if addr, ok := record.Metadata["source"]; ok {
+			from += " " + addr
+		}
+		fmt.Printf("#%d %v %s %x: %s\n", i+1, record.Time, from, packet, status)
+		for _, downlink := range source.History[sent:] {
+			fmt.Printf("\tdownlink %x\n", downlink)
+		}
+	}
+
+	return nil
+}
+
+// bypassCapabilities returns capabilities with all external services
+// disabled, for offline tools
+func bypassCapabilities(t transport.LoRaTransport) (*devices.Capabilities, error) {
+	caps := &devices.Capabilities{
+		Udp:   t,
+		State: state.NewStore(),
+	}
+	var err error
+	caps.InfluxDb, err = influxdb.NewInfluxDB(nil)
+	if err != nil {
+		return nil, err
+	}
+	// Devices may require database name, even though nothing is written
+	caps.InfluxDb.DefaultDatabase = "bypass"
+	caps.Mqtt, err = mqtt.NewMqttClient(nil)
+	if err != nil {
+		return nil, err
+	}
+	caps.Downlink, err = downlink.NewQueue(nil, t, caps.Mqtt)
+	if err != nil {
+		return nil, err
+	}
+	caps.Webhooks, err = webhook.NewDispatcher(nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return caps, nil
+}
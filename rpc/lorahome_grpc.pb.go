@@ -0,0 +1,264 @@
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.4.0
+// - protoc             (unknown)
+// source: lorahome.proto
+
+// gRPC API of LoRa Home server: devices, device commands and live readings.
+// Go code is generated (see go:generate in server.go), regenerate it
+// after changing this file.
+
+package rpc
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.62.0 or later.
+const _ = grpc.SupportPackageIsVersion8
+
+const (
+	LoraHome_ListDevices_FullMethodName    = "/lorahome.server.LoraHome/ListDevices"
+	LoraHome_Control_FullMethodName        = "/lorahome.server.LoraHome/Control"
+	LoraHome_SetLedStrip_FullMethodName    = "/lorahome.server.LoraHome/SetLedStrip"
+	LoraHome_StreamReadings_FullMethodName = "/lorahome.server.LoraHome/StreamReadings"
+)
+
+// LoraHomeClient is the client API for LoraHome service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type LoraHomeClient interface {
+	// List devices with their latest readings
+	ListDevices(ctx context.Context, in *ListDevicesRequest, opts ...grpc.CallOption) (*ListDevicesResponse, error)
+	// Send command to device, format of value is defined by device class
+	Control(ctx context.Context, in *ControlRequest, opts ...grpc.CallOption) (*ControlResponse, error)
+	// Set channels of LedStrip device
+	SetLedStrip(ctx context.Context, in *SetLedStripRequest, opts ...grpc.CallOption) (*ControlResponse, error)
+	// Stream decoded readings as they arrive
+	StreamReadings(ctx context.Context, in *StreamReadingsRequest, opts ...grpc.CallOption) (LoraHome_StreamReadingsClient, error)
+}
+
+type loraHomeClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewLoraHomeClient(cc grpc.ClientConnInterface) LoraHomeClient {
+	return &loraHomeClient{cc}
+}
+
+func (c *loraHomeClient) ListDevices(ctx context.Context, in *ListDevicesRequest, opts ...grpc.CallOption) (*ListDevicesResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(ListDevicesResponse)
+	err := c.cc.Invoke(ctx, LoraHome_ListDevices_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *loraHomeClient) Control(ctx context.Context, in *ControlRequest, opts ...grpc.CallOption) (*ControlResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(ControlResponse)
+	err := c.cc.Invoke(ctx, LoraHome_Control_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *loraHomeClient) SetLedStrip(ctx context.Context, in *SetLedStripRequest, opts ...grpc.CallOption) (*ControlResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(ControlResponse)
+	err := c.cc.Invoke(ctx, LoraHome_SetLedStrip_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *loraHomeClient) StreamReadings(ctx context.Context, in *StreamReadingsRequest, opts ...grpc.CallOption) (LoraHome_StreamReadingsClient, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	stream, err := c.cc.NewStream(ctx, &LoraHome_ServiceDesc.Streams[0], LoraHome_StreamReadings_FullMethodName, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &loraHomeStreamReadingsClient{ClientStream: stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type LoraHome_StreamReadingsClient interface {
+	Recv() (*Reading, error)
+	grpc.ClientStream
+}
+
+type loraHomeStreamReadingsClient struct {
+	grpc.ClientStream
+}
+
+func (x *loraHomeStreamReadingsClient) Recv() (*Reading, error) {
+	m := new(Reading)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// LoraHomeServer is the server API for LoraHome service.
+// All implementations must embed UnimplementedLoraHomeServer
+// for forward compatibility
+type LoraHomeServer interface {
+	// List devices with their latest readings
+	ListDevices(context.Context, *ListDevicesRequest) (*ListDevicesResponse, error)
+	// Send command to device, format of value is defined by device class
+	Control(context.Context, *ControlRequest) (*ControlResponse, error)
+	// Set channels of LedStrip device
+	SetLedStrip(context.Context, *SetLedStripRequest) (*ControlResponse, error)
+	// Stream decoded readings as they arrive
+	StreamReadings(*StreamReadingsRequest, LoraHome_StreamReadingsServer) error
+	mustEmbedUnimplementedLoraHomeServer()
+}
+
+// UnimplementedLoraHomeServer must be embedded to have forward compatible implementations.
+type UnimplementedLoraHomeServer struct {
+}
+
+func (UnimplementedLoraHomeServer) ListDevices(context.Context, *ListDevicesRequest) (*ListDevicesResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ListDevices not implemented")
+}
+func (UnimplementedLoraHomeServer) Control(context.Context, *ControlRequest) (*ControlResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Control not implemented")
+}
+func (UnimplementedLoraHomeServer) SetLedStrip(context.Context, *SetLedStripRequest) (*ControlResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method SetLedStrip not implemented")
+}
+func (UnimplementedLoraHomeServer) StreamReadings(*StreamReadingsRequest, LoraHome_StreamReadingsServer) error {
+	return status.Errorf(codes.Unimplemented, "method StreamReadings not implemented")
+}
+func (UnimplementedLoraHomeServer) mustEmbedUnimplementedLoraHomeServer() {}
+
+// UnsafeLoraHomeServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to LoraHomeServer will
+// result in compilation errors.
+type UnsafeLoraHomeServer interface {
+	mustEmbedUnimplementedLoraHomeServer()
+}
+
+func RegisterLoraHomeServer(s grpc.ServiceRegistrar, srv LoraHomeServer) {
+	s.RegisterService(&LoraHome_ServiceDesc, srv)
+}
+
+func _LoraHome_ListDevices_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ListDevicesRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(LoraHomeServer).ListDevices(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: LoraHome_ListDevices_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(LoraHomeServer).ListDevices(ctx, req.(*ListDevicesRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _LoraHome_Control_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ControlRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(LoraHomeServer).Control(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: LoraHome_Control_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(LoraHomeServer).Control(ctx, req.(*ControlRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _LoraHome_SetLedStrip_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(SetLedStripRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(LoraHomeServer).SetLedStrip(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: LoraHome_SetLedStrip_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(LoraHomeServer).SetLedStrip(ctx, req.(*SetLedStripRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _LoraHome_StreamReadings_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(StreamReadingsRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(LoraHomeServer).StreamReadings(m, &loraHomeStreamReadingsServer{ServerStream: stream})
+}
+
+type LoraHome_StreamReadingsServer interface {
+	Send(*Reading) error
+	grpc.ServerStream
+}
+
+type loraHomeStreamReadingsServer struct {
+	grpc.ServerStream
+}
+
+func (x *loraHomeStreamReadingsServer) Send(m *Reading) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+// LoraHome_ServiceDesc is the grpc.ServiceDesc for LoraHome service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var LoraHome_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "lorahome.server.LoraHome",
+	HandlerType: (*LoraHomeServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "ListDevices",
+			Handler:    _LoraHome_ListDevices_Handler,
+		},
+		{
+			MethodName: "Control",
+			Handler:    _LoraHome_Control_Handler,
+		},
+		{
+			MethodName: "SetLedStrip",
+			Handler:    _LoraHome_SetLedStrip_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "StreamReadings",
+			Handler:       _LoraHome_StreamReadings_Handler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "lorahome.proto",
+}
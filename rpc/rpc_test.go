@@ -0,0 +1,156 @@
+package rpc
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/mitchellh/mapstructure"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+
+	lightpb "github.com/lorahome/devices/go/proto/light"
+	"github.com/lorahome/server/devices"
+	"github.com/lorahome/server/state"
+)
+
+const stripUrl = "testStripUrl"
+
+type stripMock struct {
+	devices.MockDevice `mapstructure:",squash"`
+	values             []string
+	channels           []uint32
+}
+
+func (s *stripMock) Control(value string) error {
+	if value == "bad" {
+		return errors.New("bad value")
+	}
+	s.values = append(s.values, value)
+	return nil
+}
+
+func (s *stripMock) SetChannels(channels []uint32) error {
+	s.channels = channels
+	return nil
+}
+
+func init() {
+	devices.RegisterDeviceClass(devices.Url, devices.ClassName, devices.NewMockDevice)
+	devices.RegisterDeviceClass(stripUrl, "LedStrip", func(cfg interface{}, caps *devices.Capabilities) (devices.Device, error) {
+		dev := &stripMock{}
+		dev.ClassName = "LedStrip"
+		err := mapstructure.Decode(cfg, dev)
+		return dev, err
+	})
+}
+
+func TestServer(t *testing.T) {
+	store := state.NewStore()
+	caps := &devices.Capabilities{State: store}
+	_, err := devices.RegisterDevice(devices.Url, map[string]interface{}{"id": 1, "name": "kitchen"}, caps)
+	require.NoError(t, err)
+	_, err = devices.RegisterDevice(stripUrl, map[string]interface{}{"id": 2, "name": "strip"}, caps)
+	require.NoError(t, err)
+	s, err := NewServer(map[string]interface{}{"listen": "127.0.0.1:0"}, store)
+	require.NoError(t, err)
+	assert.True(t, s.enabled)
+
+	// Real gRPC server and client, connected by in-memory listener
+	listener := bufconn.Listen(1 << 20)
+	serverCtx, stop := context.WithCancel(context.Background())
+	defer stop()
+	done := make(chan error)
+	go func() {
+		done <- s.serve(serverCtx, listener)
+	}()
+	<-s.Ready()
+	conn, err := grpc.NewClient("passthrough:///bufconn",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return listener.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	require.NoError(t, err)
+	defer conn.Close()
+	client := NewLoraHomeClient(conn)
+	ctx := context.Background()
+
+	// Devices with their readings
+	now := time.Now()
+	store.Update(state.Reading{Device: "kitchen", Quantity: state.Temperature, Value: 21, Time: now})
+	store.Update(state.Reading{Device: "kitchen", Quantity: state.Humidity, Value: 40, Time: now})
+	res, err := client.ListDevices(ctx, &ListDevicesRequest{})
+	require.NoError(t, err)
+	require.Len(t, res.Devices, 2)
+	assert.Equal(t, "kitchen", res.Devices[0].Name)
+	assert.False(t, res.Devices[0].Controllable)
+	require.Len(t, res.Devices[0].Readings, 2)
+	assert.Equal(t, now.UnixNano(), res.Devices[0].Readings[0].Time.AsTime().UnixNano())
+	assert.True(t, res.Devices[1].Controllable)
+	res, err = client.ListDevices(ctx, &ListDevicesRequest{Class: "LedStrip"})
+	require.NoError(t, err)
+	require.Len(t, res.Devices, 1)
+	assert.Equal(t, "strip", res.Devices[0].Name)
+
+	// Commands
+	strip := devices.GetDeviceByName("strip").(*stripMock)
+	_, err = client.Control(ctx, &ControlRequest{Device: "strip", Value: "42"})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"42"}, strip.values)
+	_, err = client.SetLedStrip(ctx, &SetLedStripRequest{Device: "strip", Status: &lightpb.LedStripStatus{Channels: []uint32{1, 2}}})
+	require.NoError(t, err)
+	assert.Equal(t, []uint32{1, 2}, strip.channels)
+
+	for _, tc := range []struct {
+		err  error
+		code codes.Code
+	}{
+		{errOnly(client.Control(ctx, &ControlRequest{Device: "missing"})), codes.NotFound},
+		{errOnly(client.Control(ctx, &ControlRequest{Device: "kitchen", Value: "1"})), codes.FailedPrecondition},
+		{errOnly(client.Control(ctx, &ControlRequest{Device: "strip", Value: "bad"})), codes.InvalidArgument},
+		{errOnly(client.SetLedStrip(ctx, &SetLedStripRequest{Device: "kitchen"})), codes.FailedPrecondition},
+		{errOnly(client.SetLedStrip(ctx, &SetLedStripRequest{Device: "strip"})), codes.InvalidArgument},
+	} {
+		assert.Equal(t, tc.code, status.Code(tc.err), tc.err)
+	}
+
+	// Readings stream: current value first, then matching new ones
+	stream, err := client.StreamReadings(ctx, &StreamReadingsRequest{
+		Devices:    []string{"kitchen"},
+		Quantities: []string{state.Temperature},
+		Current:    true,
+	})
+	require.NoError(t, err)
+	reading, err := stream.Recv()
+	require.NoError(t, err)
+	assert.Equal(t, 21.0, reading.Value)
+	store.Update(state.Reading{Device: "hallway", Quantity: state.Temperature, Value: 18})
+	store.Update(state.Reading{Device: "kitchen", Quantity: state.Humidity, Value: 41})
+	store.Update(state.Reading{Device: "kitchen", Quantity: state.Temperature, Value: 22})
+	reading, err = stream.Recv()
+	require.NoError(t, err)
+	assert.Equal(t, "kitchen", reading.Device)
+	assert.Equal(t, 22.0, reading.Value)
+
+	// Stream ends with server
+	stop()
+	_, err = stream.Recv()
+	assert.Equal(t, codes.Unavailable, status.Code(err), err)
+	select {
+	case err := <-done:
+		assert.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("server not stopped")
+	}
+}
+
+func errOnly(_ *ControlResponse, err error) error {
+	return err
+}
@@ -0,0 +1,247 @@
+// Package rpc is gRPC API (see lorahome.proto): devices with their latest
+// readings, device commands and stream of decoded readings. Served on its
+// own port, alongside HTTP API.
+package rpc
+
+//go:generate protoc -I . -I $LORAHOME_DEVICES/proto --go_out=paths=source_relative:. --go-grpc_out=paths=source_relative:. lorahome.proto
+
+import (
+	"context"
+	"net"
+	"time"
+
+	"github.com/golang/glog"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	"github.com/lorahome/server/config"
+	"github.com/lorahome/server/devices"
+	"github.com/lorahome/server/state"
+)
+
+// Server serves LoraHome gRPC service
+type Server struct {
+	UnimplementedLoraHomeServer
+	Listen string
+
+	enabled  bool
+	store    *state.Store
+	listener net.Listener
+	done     <-chan struct{}
+	ready    chan struct{}
+}
+
+// channelsSetter is implemented by LedStrip device class
+type channelsSetter interface {
+	SetChannels(channels []uint32) error
+}
+
+func NewServer(cfg interface{}, store *state.Store) (*Server, error) {
+	s := &Server{
+		store: store,
+		ready: make(chan struct{}),
+	}
+	if cfg == nil {
+		// Bypass mode - gRPC API disabled
+		return s, nil
+	}
+
+	// Map configuration into structure
+	err := config.Decode(cfg, s)
+	if err != nil {
+		return nil, err
+	}
+	s.enabled = s.Listen != ""
+
+	return s, nil
+}
+
+// Run serves gRPC requests until context canceled
+func (s *Server) Run(ctx context.Context) error {
+	if !s.enabled {
+		glog.Info("gRPC API is not enabled")
+		close(s.ready)
+		<-ctx.Done()
+		return nil
+	}
+
+	listener, err := net.Listen("tcp", s.Listen)
+	if err != nil {
+		return err
+	}
+
+	return s.serve(ctx, listener)
+}
+
+// serve accepts connections of listener until context canceled
+func (s *Server) serve(ctx context.Context, listener net.Listener) error {
+	s.listener = listener
+	// Readings streams end with server
+	s.done = ctx.Done()
+	server := grpc.NewServer()
+	RegisterLoraHomeServer(server, s)
+	glog.Infof("gRPC server started at %s", s.listener.Addr())
+	close(s.ready)
+	go server.Serve(s.listener)
+
+	// Wait until context canceled, let running requests finish
+	<-ctx.Done()
+	stopped := make(chan struct{})
+	go func() {
+		server.GracefulStop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		server.Stop()
+	}
+
+	return nil
+}
+
+// Ready is closed once server accepts connections
+func (s *Server) Ready() <-chan struct{} {
+	return s.ready
+}
+
+// Addr returns address server listens on, nil until ready
+func (s *Server) Addr() net.Addr {
+	if s.listener == nil {
+		return nil
+	}
+	return s.listener.Addr()
+}
+
+// ListDevices returns all devices (or devices of class) with their latest readings
+func (s *Server) ListDevices(ctx context.Context, req *ListDevicesRequest) (*ListDevicesResponse, error) {
+	res := &ListDevicesResponse{}
+	for _, device := range devices.GetAllDevices() {
+		if req.Class != "" && device.GetClassName() != req.Class {
+			continue
+		}
+		msg := &Device{
+			Id:    device.GetId(),
+			Name:  device.GetName(),
+			Class: device.GetClassName(),
+			Url:   device.GetUrl(),
+		}
+		_, msg.Controllable = device.(devices.Controllable)
+		for _, reading := range s.store.Device(msg.Name) {
+			msg.Readings = append(msg.Readings, readingMessage(reading))
+		}
+		res.Devices = append(res.Devices, msg)
+	}
+
+	return res, nil
+}
+
+// Control sends command to device
+func (s *Server) Control(ctx context.Context, req *ControlRequest) (*ControlResponse, error) {
+	device, err := getDevice(req.Device)
+	if err != nil {
+		return nil, err
+	}
+	controllable, ok := device.(devices.Controllable)
+	if !ok {
+		return nil, status.Errorf(codes.FailedPrecondition, "device '%s' is not controllable", req.Device)
+	}
+	err = controllable.Control(req.Value)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "%v", err)
+	}
+
+	return &ControlResponse{}, nil
+}
+
+// SetLedStrip sends channel levels to LedStrip device
+func (s *Server) SetLedStrip(ctx context.Context, req *SetLedStripRequest) (*ControlResponse, error) {
+	device, err := getDevice(req.Device)
+	if err != nil {
+		return nil, err
+	}
+	strip, ok := device.(channelsSetter)
+	if !ok {
+		return nil, status.Errorf(codes.FailedPrecondition, "device '%s' is not LedStrip", req.Device)
+	}
+	if req.Status == nil || len(req.Status.Channels) == 0 {
+		return nil, status.Errorf(codes.InvalidArgument, "no channels")
+	}
+	err = strip.SetChannels(req.Status.Channels)
+	if err != nil {
+		return nil, status.Errorf(codes.Unavailable, "%v", err)
+	}
+
+	return &ControlResponse{}, nil
+}
+
+// StreamReadings sends decoded readings until client or server gone
+func (s *Server) StreamReadings(req *StreamReadingsRequest, stream LoraHome_StreamReadingsServer) error {
+	names := toSet(req.Devices)
+	quantities := toSet(req.Quantities)
+	match := func(reading state.Reading) bool {
+		return (len(names) == 0 || names[reading.Device]) &&
+			(len(quantities) == 0 || quantities[reading.Quantity])
+	}
+
+	// Subscribe first, so no readings missed between current and new ones
+	readings := s.store.Subscribe()
+	defer s.store.Unsubscribe(readings)
+	if req.Current {
+		for _, reading := range s.store.All() {
+			if !match(reading) {
+				continue
+			}
+			if err := stream.Send(readingMessage(reading)); err != nil {
+				return err
+			}
+		}
+	}
+
+	for {
+		select {
+		case reading := <-readings:
+			if !match(reading) {
+				continue
+			}
+			if err := stream.Send(readingMessage(reading)); err != nil {
+				return err
+			}
+		case <-stream.Context().Done():
+			return nil
+		case <-s.done:
+			return status.Errorf(codes.Unavailable, "server is shutting down")
+		}
+	}
+}
+
+func getDevice(name string) (devices.Device, error) {
+	device := devices.GetDeviceByName(name)
+	if device == nil {
+		return nil, status.Errorf(codes.NotFound, "device '%s' does not exist", name)
+	}
+
+	return device, nil
+}
+
+func readingMessage(reading state.Reading) *Reading {
+	return &Reading{
+		DeviceId: reading.DeviceId,
+		Device:   reading.Device,
+		Class:    reading.Class,
+		Quantity: reading.Quantity,
+		Value:    reading.Value,
+		Time:     timestamppb.New(reading.Time),
+	}
+}
+
+func toSet(values []string) map[string]bool {
+	res := map[string]bool{}
+	for _, value := range values {
+		res[value] = true
+	}
+
+	return res
+}
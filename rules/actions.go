@@ -0,0 +1,129 @@
+package rules
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// Action executed when rule fires. Set, payload and body are templates,
+// e.g. "{{.Device}} is {{.Value}}" (see templateData).
+type Action struct {
+	// Send command to device, e.g. light level to LedStrip
+	Device string
+	Set    string
+	// Publish MQTT message
+	Mqtt *MqttAction
+	// Call HTTP endpoint
+	Webhook *WebhookAction
+
+	set *template.Template
+}
+
+type MqttAction struct {
+	Topic   string
+	Payload string
+	Qos     byte
+	Retain  bool
+
+	payload *template.Template
+}
+
+type WebhookAction struct {
+	Url     string
+	Method  string
+	Headers map[string]string
+	Body    string
+
+	body *template.Template
+}
+
+// templateData is available in action templates
+type templateData struct {
+	Rule     string
+	Device   string
+	Quantity string
+	Value    float64
+	Time     time.Time
+}
+
+func (a *Action) validate() error {
+	var err error
+	switch {
+	case a.Device != "":
+		a.set, err = template.New("set").Parse(a.Set)
+	case a.Mqtt != nil:
+		if a.Mqtt.Topic == "" {
+			return errors.New("mqtt action requires topic")
+		}
+		a.Mqtt.payload, err = template.New("payload").Parse(a.Mqtt.Payload)
+	case a.Webhook != nil:
+		if a.Webhook.Url == "" {
+			return errors.New("webhook action requires url")
+		}
+		if a.Webhook.Method == "" {
+			a.Webhook.Method = http.MethodPost
+		}
+		a.Webhook.body, err = template.New("body").Parse(a.Webhook.Body)
+	default:
+		return errors.New("action requires device, mqtt or webhook")
+	}
+
+	return err
+}
+
+func (e *Engine) execute(a *Action, data *templateData) error {
+	switch {
+	case a.Device != "":
+		value, err := render(a.set, data)
+		if err != nil {
+			return err
+		}
+		return e.control(a.Device, value)
+	case a.Mqtt != nil:
+		payload, err := render(a.Mqtt.payload, data)
+		if err != nil {
+			return err
+		}
+		return e.mqttClient.Publish(a.Mqtt.Topic, payload, a.Mqtt.Qos, a.Mqtt.Retain)
+	case a.Webhook != nil:
+		return e.callWebhook(a.Webhook, data)
+	}
+
+	return nil
+}
+
+func (e *Engine) callWebhook(w *WebhookAction, data *templateData) error {
+	body, err := render(w.body, data)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(w.Method, w.Url, strings.NewReader(body))
+	if err != nil {
+		return err
+	}
+	for name, value := range w.Headers {
+		req.Header.Set(name, value)
+	}
+	resp, err := e.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook %s: %s", w.Url, resp.Status)
+	}
+
+	return nil
+}
+
+func render(t *template.Template, data *templateData) (string, error) {
+	buf := &bytes.Buffer{}
+	err := t.Execute(buf, data)
+
+	return buf.String(), err
+}
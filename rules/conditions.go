@@ -0,0 +1,84 @@
+package rules
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/lorahome/server/state"
+)
+
+// Condition must be met for rule to fire
+type Condition struct {
+	// Time of day window "HH:MM-HH:MM", may span midnight (e.g. "22:00-06:00")
+	Time string
+	// Latest reading of device quantity above / below value
+	Device   string
+	Quantity string
+	Above    *float64
+	Below    *float64
+
+	from, to time.Duration
+}
+
+func (c *Condition) validate() error {
+	if c.Time != "" {
+		var err error
+		window := strings.Split(c.Time, "-")
+		if len(window) == 2 {
+			c.from, err = parseTimeOfDay(window[0])
+			if err == nil {
+				c.to, err = parseTimeOfDay(window[1])
+			}
+		}
+		if len(window) != 2 || err != nil || c.from == c.to {
+			return fmt.Errorf("invalid time window '%s', HH:MM-HH:MM expected", c.Time)
+		}
+		return nil
+	}
+	if c.Device == "" || c.Quantity == "" {
+		return errors.New("condition requires either time or device and quantity")
+	}
+	if c.Above == nil && c.Below == nil {
+		return errors.New("device condition requires above and / or below")
+	}
+
+	return nil
+}
+
+// parseTimeOfDay parses "HH:MM" into duration since midnight
+func parseTimeOfDay(value string) (time.Duration, error) {
+	t, err := time.Parse("15:04", strings.TrimSpace(value))
+	if err != nil {
+		return 0, err
+	}
+
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+func (c *Condition) met(store *state.Store, now time.Time) bool {
+	if c.Time != "" {
+		midnight := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+		timeOfDay := now.Sub(midnight)
+		if c.from <= c.to {
+			return timeOfDay >= c.from && timeOfDay < c.to
+		}
+		// Window spans midnight
+		return timeOfDay >= c.from || timeOfDay < c.to
+	}
+
+	reading, ok := store.Get(c.Device, c.Quantity)
+	if !ok {
+		// Unknown state never meets condition
+		return false
+	}
+	if c.Above != nil && reading.Value <= *c.Above {
+		return false
+	}
+	if c.Below != nil && reading.Value >= *c.Below {
+		return false
+	}
+
+	return true
+}
@@ -0,0 +1,262 @@
+// Package rules is automation engine: rules are triggered by device
+// readings crossing threshold, checked against conditions (time of day,
+// state of other devices) and execute actions (device commands, MQTT, webhooks).
+package rules
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/golang/glog"
+
+	"github.com/lorahome/server/config"
+	"github.com/lorahome/server/devices"
+	"github.com/lorahome/server/mqtt"
+	"github.com/lorahome/server/state"
+)
+
+// How often debounced (pending) rules are checked
+const tickInterval = time.Second
+
+// Fired rules waiting for execution of actions, new ones are dropped when full
+const firingsQueueSize = 64
+
+// Rule reacts on device readings
+type Rule struct {
+	Name       string
+	Trigger    Trigger
+	Conditions []*Condition
+	Actions    []*Action
+
+	// Trigger may fire, cleared once fired until value crosses back (hysteresis)
+	disarmed bool
+	// Trigger threshold crossed since, rule fires once it lasts Trigger.For
+	pending time.Time
+	last    state.Reading
+}
+
+// Trigger fires once reading of device quantity crosses threshold
+type Trigger struct {
+	Device   string
+	Quantity string
+	Above    *float64
+	Below    *float64
+	// Value has to move this far back over threshold to re-arm trigger
+	Hysteresis float64
+	// Threshold must stay crossed this long before rule fires (debounce)
+	For time.Duration
+}
+
+// firing is rule fired, actions are executed with data of the reading fired it
+type firing struct {
+	rule *Rule
+	data *templateData
+}
+
+// Engine evaluates rules on every reading of state store
+type Engine struct {
+	Rules []*Rule
+
+	firings    chan firing
+	store      *state.Store
+	mqttClient *mqtt.MqttClient
+	httpClient *http.Client
+	// Sends command to device by name
+	control func(device, value string) error
+}
+
+func NewEngine(cfg interface{}, store *state.Store, mqttClient *mqtt.MqttClient) (*Engine, error) {
+	e := &Engine{
+		firings:    make(chan firing, firingsQueueSize),
+		store:      store,
+		mqttClient: mqttClient,
+		httpClient: &http.Client{Timeout: 10 * time.Second},
+		control:    devices.ControlDevice,
+	}
+	if cfg == nil {
+		// No rules
+		return e, nil
+	}
+
+	// Map configuration into structure
+	err := config.Decode(cfg, &e.Rules)
+	if err != nil {
+		return nil, err
+	}
+	for i, rule := range e.Rules {
+		if rule.Name == "" {
+			rule.Name = fmt.Sprintf("rule%d", i+1)
+		}
+		err := rule.validate()
+		if err != nil {
+			return nil, fmt.Errorf("rule '%s': %v", rule.Name, err)
+		}
+	}
+
+	return e, nil
+}
+
+// Run evaluates rules until context canceled
+func (e *Engine) Run(ctx context.Context) error {
+	if len(e.Rules) == 0 {
+		glog.Info("No automation rules defined")
+		<-ctx.Done()
+		return nil
+	}
+	glog.Infof("Automation engine started, %d rule(s)", len(e.Rules))
+
+	// Actions may be slow (webhooks), so execute them aside of evaluation
+	executed := make(chan struct{})
+	go func() {
+		defer close(executed)
+		e.executeFirings(ctx)
+	}()
+	defer func() { <-executed }()
+
+	readings := e.store.Subscribe()
+	ticker := time.NewTicker(tickInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case reading := <-readings:
+			e.process(reading, time.Now())
+		case now := <-ticker.C:
+			e.tick(now)
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// process updates trigger state of rules matching reading
+func (e *Engine) process(reading state.Reading, now time.Time) {
+	for _, rule := range e.Rules {
+		t := &rule.Trigger
+		if t.Device != reading.Device || t.Quantity != reading.Quantity {
+			continue
+		}
+		rule.last = reading
+
+		if rule.disarmed {
+			if t.rearmed(reading.Value) {
+				glog.Infof("Rule '%s' re-armed: %s %s is %v", rule.Name, t.Device, t.Quantity, reading.Value)
+				rule.disarmed = false
+			}
+			continue
+		}
+		if !t.crossed(reading.Value) {
+			// Debounce: threshold has to stay crossed
+			rule.pending = time.Time{}
+			continue
+		}
+		if rule.pending.IsZero() {
+			rule.pending = now
+		}
+		e.evaluate(rule, now)
+	}
+}
+
+// tick fires debounced rules
+func (e *Engine) tick(now time.Time) {
+	for _, rule := range e.Rules {
+		if !rule.pending.IsZero() {
+			e.evaluate(rule, now)
+		}
+	}
+}
+
+// evaluate fires pending rule, once debounce period passed and conditions met
+func (e *Engine) evaluate(rule *Rule, now time.Time) {
+	if now.Sub(rule.pending) < rule.Trigger.For {
+		return
+	}
+	for _, condition := range rule.Conditions {
+		if !condition.met(e.store, now) {
+			// Keep pending: rule fires once conditions met
+			return
+		}
+	}
+
+	glog.Infof("Rule '%s' fired: %s %s is %v", rule.Name, rule.last.Device, rule.last.Quantity, rule.last.Value)
+	rule.pending = time.Time{}
+	rule.disarmed = true
+	data := &templateData{
+		Rule:     rule.Name,
+		Device:   rule.last.Device,
+		Quantity: rule.last.Quantity,
+		Value:    rule.last.Value,
+		Time:     rule.last.Time,
+	}
+	select {
+	case e.firings <- firing{rule: rule, data: data}:
+	default:
+		glog.Errorf("Rule '%s': actions queue is full, actions skipped", rule.Name)
+	}
+}
+
+// executeFirings executes actions of fired rules until context canceled
+func (e *Engine) executeFirings(ctx context.Context) {
+	for {
+		select {
+		case f := <-e.firings:
+			e.executeActions(f)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (e *Engine) executeActions(f firing) {
+	for _, action := range f.rule.Actions {
+		err := e.execute(action, f.data)
+		if err != nil {
+			glog.Errorf("Rule '%s': action failed: %v", f.rule.Name, err)
+		}
+	}
+}
+
+func (r *Rule) validate() error {
+	t := &r.Trigger
+	if t.Device == "" || t.Quantity == "" {
+		return errors.New("trigger device and quantity are required")
+	}
+	if (t.Above == nil) == (t.Below == nil) {
+		return errors.New("trigger requires either above or below threshold")
+	}
+	if len(r.Actions) == 0 {
+		return errors.New("no actions")
+	}
+	for _, condition := range r.Conditions {
+		err := condition.validate()
+		if err != nil {
+			return err
+		}
+	}
+	for _, action := range r.Actions {
+		err := action.validate()
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// crossed reports whether value is over threshold
+func (t *Trigger) crossed(value float64) bool {
+	if t.Below != nil {
+		return value < *t.Below
+	}
+	return value > *t.Above
+}
+
+// rearmed reports whether value is back over threshold and hysteresis
+func (t *Trigger) rearmed(value float64) bool {
+	if t.Below != nil {
+		return value >= *t.Below+t.Hysteresis
+	}
+	return value <= *t.Above-t.Hysteresis
+}
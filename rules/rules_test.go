@@ -0,0 +1,216 @@
+package rules
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v2"
+
+	"github.com/lorahome/server/mqtt"
+	"github.com/lorahome/server/state"
+)
+
+type controllableMock struct {
+	engine *Engine
+	values []string
+}
+
+func (c *controllableMock) control(device, value string) error {
+	if device != "strip" {
+		return fmt.Errorf("device '%s' does not exist", device)
+	}
+	c.values = append(c.values, value)
+	return nil
+}
+
+// executed runs actions of fired rules, returns all values sent to device
+func (c *controllableMock) executed() []string {
+	runActions(c.engine)
+	return c.values
+}
+
+// runActions executes actions of fired rules, like Run does
+func runActions(e *Engine) {
+	for len(e.firings) > 0 {
+		e.executeActions(<-e.firings)
+	}
+}
+
+func TestRuleHysteresisDebounce(t *testing.T) {
+	cfg := []interface{}{}
+	require.NoError(t, yaml.Unmarshal([]byte(`
+- name: hallway dusk
+  trigger:
+    device: hallway
+    quantity: ambient_light
+    below: 50
+    hysteresis: 20
+    for: 1m
+  conditions:
+  - device: hallway
+    quantity: temperature
+    above: 10
+  actions:
+  - device: strip
+    set: "{{if lt .Value 10.0}}100{{else}}60{{end}}"
+`), &cfg))
+	store := state.NewStore()
+	mqttClient, err := mqtt.NewMqttClient(nil)
+	require.NoError(t, err)
+	e, err := NewEngine(cfg, store, mqttClient)
+	require.NoError(t, err)
+	strip := &controllableMock{engine: e}
+	e.control = strip.control
+	now := time.Date(2020, 1, 1, 18, 0, 0, 0, time.Local)
+	light := func(value float64, offset time.Duration) {
+		e.process(state.Reading{Device: "hallway", Quantity: state.AmbientLight, Value: value}, now.Add(offset))
+	}
+	store.Update(state.Reading{Device: "hallway", Quantity: state.Temperature, Value: 20})
+
+	// Debounce: short dip below threshold ignored
+	light(40, 0)
+	light(60, 30*time.Second)
+	e.tick(now.Add(2 * time.Minute))
+	assert.Empty(t, strip.executed())
+
+	// Below threshold long enough: fires on tick
+	light(30, 3*time.Minute)
+	e.tick(now.Add(3*time.Minute + 30*time.Second))
+	assert.Empty(t, strip.executed())
+	e.tick(now.Add(4 * time.Minute))
+	assert.Equal(t, []string{"60"}, strip.executed())
+
+	// Hysteresis: no re-fire until value is back above 70
+	light(5, 5*time.Minute)
+	light(60, 6*time.Minute)
+	light(5, 7*time.Minute)
+	e.tick(now.Add(10 * time.Minute))
+	assert.Len(t, strip.executed(), 1)
+	light(80, 11*time.Minute)
+	light(5, 12*time.Minute)
+	e.tick(now.Add(13 * time.Minute))
+	assert.Equal(t, []string{"60", "100"}, strip.executed())
+
+	// Condition not met: rule stays pending until it is
+	light(80, 14*time.Minute)
+	store.Update(state.Reading{Device: "hallway", Quantity: state.Temperature, Value: 5})
+	light(5, 15*time.Minute)
+	e.tick(now.Add(17 * time.Minute))
+	assert.Len(t, strip.executed(), 2)
+	store.Update(state.Reading{Device: "hallway", Quantity: state.Temperature, Value: 15})
+	e.tick(now.Add(18 * time.Minute))
+	assert.Len(t, strip.executed(), 3)
+}
+
+func TestRuleTimeConditionWebhook(t *testing.T) {
+	bodies := make(chan string, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		bodies <- r.Method + " " + r.Header.Get("X-Source") + " " + string(body)
+	}))
+	defer server.Close()
+
+	cfg := []interface{}{}
+	require.NoError(t, yaml.Unmarshal([]byte(`
+- trigger:
+    device: kitchen
+    quantity: temperature
+    above: 30
+  conditions:
+  - time: "22:00-06:00"
+  actions:
+  - webhook:
+      url: `+server.URL+`
+      headers:
+        X-Source: lorahome
+      body: "{{.Rule}}: {{.Device}} {{.Quantity}} {{.Value}}"
+`), &cfg))
+	mqttClient, err := mqtt.NewMqttClient(nil)
+	require.NoError(t, err)
+	e, err := NewEngine(cfg, state.NewStore(), mqttClient)
+	require.NoError(t, err)
+	hot := state.Reading{Device: "kitchen", Quantity: state.Temperature, Value: 35}
+
+	// Outside of time window: pending
+	day := time.Date(2020, 1, 1, 12, 0, 0, 0, time.Local)
+	e.process(hot, day)
+	runActions(e)
+	assert.Empty(t, bodies)
+
+	// Window spans midnight
+	e.tick(time.Date(2020, 1, 1, 23, 0, 0, 0, time.Local))
+	runActions(e)
+	assert.Equal(t, "POST lorahome rule1: kitchen temperature 35", <-bodies)
+}
+
+func TestRuleValidation(t *testing.T) {
+	store := state.NewStore()
+	for _, rules := range []string{
+		`[{trigger: {device: a, quantity: b}, actions: [{device: c}]}]`,
+		`[{trigger: {device: a, quantity: b, above: 1, below: 2}, actions: [{device: c}]}]`,
+		`[{trigger: {device: a, quantity: b, above: 1}}]`,
+		`[{trigger: {device: a, quantity: b, above: 1}, actions: [{}]}]`,
+		`[{trigger: {device: a, quantity: b, above: 1}, actions: [{device: c}], conditions: [{time: "evening"}]}]`,
+		`[{trigger: {device: a, quantity: b, above: 1}, actions: [{device: c}], conditions: [{time: "25:00-06:00"}]}]`,
+		`[{trigger: {device: a, quantity: b, above: 1}, actions: [{device: c}], conditions: [{time: "22:00-06:75"}]}]`,
+		`[{trigger: {device: a, quantity: b, above: 1}, actions: [{device: c}], conditions: [{time: "22:00-06:00-07:00"}]}]`,
+		`[{trigger: {device: a, quantity: b, above: 1}, actions: [{device: c}], conditions: [{time: "22:00-22:00"}]}]`,
+		`[{trigger: {device: a, quantity: b, above: 1}, actions: [{mqtt: {payload: x}}]}]`,
+	} {
+		cfg := []interface{}{}
+		require.NoError(t, yaml.Unmarshal([]byte(rules), &cfg))
+		_, err := NewEngine(cfg, store, nil)
+		assert.Error(t, err, rules)
+	}
+}
+
+func TestRuleActionsAsync(t *testing.T) {
+	release := make(chan struct{})
+	bodies := make(chan string, 2)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		body, _ := ioutil.ReadAll(r.Body)
+		bodies <- string(body)
+	}))
+	defer server.Close()
+	cfg := []interface{}{}
+	require.NoError(t, yaml.Unmarshal([]byte(`
+- trigger:
+    device: kitchen
+    quantity: temperature
+    above: 30
+  actions:
+  - webhook:
+      url: `+server.URL+`
+      body: "{{.Value}}"
+`), &cfg))
+	mqttClient, err := mqtt.NewMqttClient(nil)
+	require.NoError(t, err)
+	e, err := NewEngine(cfg, state.NewStore(), mqttClient)
+	require.NoError(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go e.executeFirings(ctx)
+
+	// Engine goes on evaluating while webhook is slow
+	now := time.Now()
+	e.process(state.Reading{Device: "kitchen", Quantity: state.Temperature, Value: 35}, now)
+	e.process(state.Reading{Device: "kitchen", Quantity: state.Temperature, Value: 20}, now)
+	e.process(state.Reading{Device: "kitchen", Quantity: state.Temperature, Value: 36}, now)
+	close(release)
+	for _, expected := range []string{"35", "36"} {
+		select {
+		case body := <-bodies:
+			assert.Equal(t, expected, body)
+		case <-time.After(5 * time.Second):
+			t.Fatal("webhook not called")
+		}
+	}
+}
@@ -0,0 +1,46 @@
+package scheduler
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/lorahome/server/api"
+)
+
+// Handler serves schedules API:
+//
+//	GET    /api/schedules        - list schedules
+//	POST   /api/schedules        - add / replace schedule
+//	DELETE /api/schedules/{name} - remove schedule
+//
+// Register it on api.Server, which rejects cross-site POST / DELETE requests.
+func (s *Scheduler) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/schedules"), "/")
+		switch {
+		case r.Method == http.MethodGet && name == "":
+			api.WriteJSON(w, http.StatusOK, s.List())
+		case r.Method == http.MethodPost && name == "":
+			schedule := &Schedule{}
+			err := json.NewDecoder(r.Body).Decode(schedule)
+			if err == nil {
+				err = s.Add(schedule)
+			}
+			if err != nil {
+				api.WriteError(w, http.StatusBadRequest, err)
+				return
+			}
+			api.WriteJSON(w, http.StatusCreated, schedule)
+		case r.Method == http.MethodDelete && name != "":
+			err := s.Remove(name)
+			if err != nil {
+				api.WriteError(w, http.StatusBadRequest, err)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	})
+}
@@ -0,0 +1,99 @@
+package scheduler
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/robfig/cron/v3"
+)
+
+const (
+	Sunrise = "sunrise"
+	Sunset  = "sunset"
+)
+
+// Schedule sends command to device at given times
+type Schedule struct {
+	Name string `json:"name"`
+	// Standard cron expression: minute hour day month weekday, e.g. "0 23 * * 1-5"
+	Cron string `yaml:",omitempty" json:"cron,omitempty"`
+	// Or sun event: "sunrise" / "sunset", shifted by offset (e.g. "-30m")
+	Sun    string `yaml:",omitempty" json:"sun,omitempty"`
+	Offset string `yaml:",omitempty" json:"offset,omitempty"`
+	// Weekdays of sun schedule, cron syntax (e.g. "1-5"), every day by default
+	Days string `yaml:",omitempty" json:"days,omitempty"`
+	// Device name and command (e.g. light level)
+	Device string `json:"device"`
+	Set    string `json:"set"`
+
+	// Schedules of config file can not be changed by API
+	ReadOnly bool      `yaml:"-" json:"readonly"`
+	Next     time.Time `yaml:"-" json:"next"`
+
+	cron   cron.Schedule
+	days   cron.Schedule
+	offset time.Duration
+}
+
+func (s *Schedule) validate() error {
+	if s.Name == "" {
+		return errors.New("schedule name is required")
+	}
+	if s.Device == "" {
+		return fmt.Errorf("schedule '%s': device is required", s.Name)
+	}
+
+	var err error
+	switch {
+	case s.Cron != "" && s.Sun == "":
+		s.cron, err = cron.ParseStandard(s.Cron)
+	case s.Sun == Sunrise || s.Sun == Sunset:
+		if s.Offset != "" {
+			s.offset, err = time.ParseDuration(s.Offset)
+			if err != nil {
+				break
+			}
+		}
+		if s.Days != "" {
+			s.days, err = cron.ParseStandard("0 0 * * " + s.Days)
+		}
+	default:
+		err = errors.New("either cron or sun (sunrise / sunset) is required")
+	}
+	if err != nil {
+		return fmt.Errorf("schedule '%s': %v", s.Name, err)
+	}
+
+	return nil
+}
+
+// next returns time of next run after t, zero if none within a year
+func (s *Schedule) next(t time.Time, latitude, longitude float64) time.Time {
+	if s.cron != nil {
+		return s.cron.Next(t)
+	}
+
+	// Sun events: check day by day
+	day := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+	for i := 0; i < 366; i++ {
+		date := day.AddDate(0, 0, i)
+		if s.days != nil && !s.days.Next(date.Add(-time.Second)).Equal(date) {
+			continue
+		}
+		sunrise, sunset, ok := sunTimes(date, latitude, longitude)
+		if !ok {
+			continue
+		}
+		event := sunset
+		if s.Sun == Sunrise {
+			event = sunrise
+		}
+		event = event.Add(s.offset).Truncate(time.Second)
+		if event.After(t) {
+			return event
+		}
+	}
+
+	return time.Time{}
+}
@@ -0,0 +1,241 @@
+// Package scheduler sends device commands at given times: cron expressions
+// or sunrise / sunset of configured location.
+package scheduler
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"gopkg.in/yaml.v2"
+
+	"github.com/lorahome/server/config"
+	"github.com/lorahome/server/devices"
+	"github.com/lorahome/server/fileutil"
+)
+
+// Scheduler runs schedules of config and ones added via API
+type Scheduler struct {
+	// Location, required by sunrise / sunset schedules
+	Latitude  float64
+	Longitude float64
+	// File to persist schedules added via API into
+	File      string
+	Schedules []*Schedule
+
+	schedules map[string]*Schedule
+	// Sends command to device by name
+	control func(device, value string) error
+	changed chan struct{}
+	lock    sync.Mutex
+}
+
+func NewScheduler(cfg interface{}) (*Scheduler, error) {
+	s := &Scheduler{
+		schedules: map[string]*Schedule{},
+		control:   devices.ControlDevice,
+		changed:   make(chan struct{}, 1),
+	}
+	if cfg != nil {
+		// Map configuration into structure
+		err := config.Decode(cfg, s)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for _, schedule := range s.Schedules {
+		schedule.ReadOnly = true
+		err := s.add(schedule, time.Now())
+		if err != nil {
+			return nil, err
+		}
+	}
+	err := s.load()
+
+	return s, err
+}
+
+// Run executes schedules until context canceled
+func (s *Scheduler) Run(ctx context.Context) error {
+	glog.Infof("Scheduler started, %d schedule(s)", len(s.List()))
+	for {
+		// Sleep until the nearest run, or schedules changed
+		wait := time.Hour
+		if next := s.nextRun(); !next.IsZero() {
+			wait = time.Until(next)
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case now := <-timer.C:
+			s.runDue(now)
+		case <-s.changed:
+			timer.Stop()
+		case <-ctx.Done():
+			timer.Stop()
+			return nil
+		}
+	}
+}
+
+// List returns all schedules, ordered by name
+func (s *Scheduler) List() []Schedule {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	res := []Schedule{}
+	for _, schedule := range s.schedules {
+		res = append(res, *schedule)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].Name < res[j].Name
+	})
+
+	return res
+}
+
+// Add adds (or replaces) schedule and persists it
+func (s *Scheduler) Add(schedule *Schedule) error {
+	schedule.ReadOnly = false
+	err := s.add(schedule, time.Now())
+	if err != nil {
+		return err
+	}
+	s.notify()
+
+	return s.save()
+}
+
+// Remove deletes schedule added via API
+func (s *Scheduler) Remove(name string) error {
+	s.lock.Lock()
+	schedule, ok := s.schedules[name]
+	if ok && !schedule.ReadOnly {
+		delete(s.schedules, name)
+	}
+	s.lock.Unlock()
+
+	if !ok {
+		return fmt.Errorf("schedule '%s' does not exist", name)
+	}
+	if schedule.ReadOnly {
+		return fmt.Errorf("schedule '%s' is defined in config", name)
+	}
+	s.notify()
+
+	return s.save()
+}
+
+func (s *Scheduler) add(schedule *Schedule, now time.Time) error {
+	err := schedule.validate()
+	if err != nil {
+		return err
+	}
+	if schedule.Sun != "" && s.Latitude == 0 && s.Longitude == 0 {
+		return fmt.Errorf("schedule '%s': latitude / longitude are required for sun schedules", schedule.Name)
+	}
+	schedule.Next = schedule.next(now, s.Latitude, s.Longitude)
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if existing, ok := s.schedules[schedule.Name]; ok && existing.ReadOnly {
+		return fmt.Errorf("schedule '%s' is defined in config", schedule.Name)
+	}
+	s.schedules[schedule.Name] = schedule
+
+	return nil
+}
+
+// notify wakes up Run loop to recalculate the nearest run
+func (s *Scheduler) notify() {
+	select {
+	case s.changed <- struct{}{}:
+	default:
+	}
+}
+
+func (s *Scheduler) nextRun() time.Time {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	next := time.Time{}
+	for _, schedule := range s.schedules {
+		if !schedule.Next.IsZero() && (next.IsZero() || schedule.Next.Before(next)) {
+			next = schedule.Next
+		}
+	}
+
+	return next
+}
+
+// runDue executes schedules which time has come
+func (s *Scheduler) runDue(now time.Time) {
+	s.lock.Lock()
+	due := []*Schedule{}
+	for _, schedule := range s.schedules {
+		if !schedule.Next.IsZero() && !schedule.Next.After(now) {
+			due = append(due, schedule)
+			schedule.Next = schedule.next(now, s.Latitude, s.Longitude)
+		}
+	}
+	s.lock.Unlock()
+
+	for _, schedule := range due {
+		glog.Infof("Schedule '%s': %s set to %s", schedule.Name, schedule.Device, schedule.Set)
+		err := s.control(schedule.Device, schedule.Set)
+		if err != nil {
+			glog.Errorf("Schedule '%s' failed: %v", schedule.Name, err)
+		}
+	}
+}
+
+// load restores schedules added via API
+func (s *Scheduler) load() error {
+	if s.File == "" {
+		return nil
+	}
+	data, err := ioutil.ReadFile(s.File)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	schedules := []*Schedule{}
+	err = yaml.Unmarshal(data, &schedules)
+	if err != nil {
+		return err
+	}
+	for _, schedule := range schedules {
+		err := s.add(schedule, time.Now())
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// save persists schedules added via API
+func (s *Scheduler) save() error {
+	if s.File == "" {
+		return nil
+	}
+	schedules := []Schedule{}
+	for _, schedule := range s.List() {
+		if !schedule.ReadOnly {
+			schedules = append(schedules, schedule)
+		}
+	}
+	data, err := yaml.Marshal(schedules)
+	if err != nil {
+		return err
+	}
+
+	return fileutil.WriteAtomic(s.File, data, 0644)
+}
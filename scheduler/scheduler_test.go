@@ -0,0 +1,174 @@
+package scheduler
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/lorahome/server/api"
+)
+
+// London
+const (
+	latitude  = 51.5074
+	longitude = -0.1278
+)
+
+func TestSunTimes(t *testing.T) {
+	// Reference values: timeanddate.com
+	sunrise, sunset, ok := sunTimes(time.Date(2020, 6, 21, 0, 0, 0, 0, time.UTC), latitude, longitude)
+	require.True(t, ok)
+	assert.WithinDuration(t, time.Date(2020, 6, 21, 3, 43, 0, 0, time.UTC), sunrise, 2*time.Minute)
+	assert.WithinDuration(t, time.Date(2020, 6, 21, 20, 21, 0, 0, time.UTC), sunset, 2*time.Minute)
+
+	sunrise, sunset, ok = sunTimes(time.Date(2020, 12, 21, 0, 0, 0, 0, time.UTC), latitude, longitude)
+	require.True(t, ok)
+	assert.WithinDuration(t, time.Date(2020, 12, 21, 8, 3, 0, 0, time.UTC), sunrise, 2*time.Minute)
+	assert.WithinDuration(t, time.Date(2020, 12, 21, 15, 53, 0, 0, time.UTC), sunset, 2*time.Minute)
+
+	// Polar day in Tromso
+	_, _, ok = sunTimes(time.Date(2020, 6, 21, 0, 0, 0, 0, time.UTC), 69.65, 18.96)
+	assert.False(t, ok)
+}
+
+func TestScheduleNext(t *testing.T) {
+	// Friday
+	now := time.Date(2020, 6, 19, 23, 30, 0, 0, time.UTC)
+
+	weekdays := &Schedule{Name: "dim", Cron: "0 23 * * 1-5", Device: "strip"}
+	require.NoError(t, weekdays.validate())
+	assert.Equal(t, time.Date(2020, 6, 22, 23, 0, 0, 0, time.UTC), weekdays.next(now, latitude, longitude))
+
+	sunset := &Schedule{Name: "on", Sun: Sunset, Offset: "-30m", Days: "0,6", Device: "strip"}
+	require.NoError(t, sunset.validate())
+	assert.WithinDuration(t, time.Date(2020, 6, 20, 19, 51, 0, 0, time.UTC), sunset.next(now, latitude, longitude), 2*time.Minute)
+
+	for _, invalid := range []*Schedule{
+		{Cron: "0 23 * * *", Device: "strip"},
+		{Name: "x", Cron: "0 23 * * *"},
+		{Name: "x", Cron: "every day", Device: "strip"},
+		{Name: "x", Sun: "noon", Device: "strip"},
+		{Name: "x", Sun: Sunset, Offset: "soon", Device: "strip"},
+		{Name: "x", Device: "strip"},
+	} {
+		assert.Error(t, invalid.validate())
+	}
+}
+
+func TestScheduler(t *testing.T) {
+	dir, err := ioutil.TempDir("", "scheduler")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "schedules.yaml")
+
+	s, err := NewScheduler(map[string]interface{}{
+		"latitude":  latitude,
+		"longitude": longitude,
+		"file":      file,
+		"schedules": []interface{}{
+			map[string]interface{}{"name": "night", "cron": "0 23 * * *", "device": "strip", "set": "20"},
+		},
+	})
+	require.NoError(t, err)
+	commands := []string{}
+	s.control = func(device, value string) error {
+		commands = append(commands, device+"="+value)
+		return nil
+	}
+
+	// Due schedules executed, then rescheduled
+	night := s.schedules["night"]
+	next := night.Next
+	s.runDue(next.Add(-time.Second))
+	assert.Empty(t, commands)
+	s.runDue(next)
+	assert.Equal(t, []string{"strip=20"}, commands)
+	assert.Equal(t, next.AddDate(0, 0, 1), night.Next)
+
+	// Schedules added via API persisted, config ones are read only
+	assert.NoError(t, s.Add(&Schedule{Name: "morning", Sun: Sunrise, Device: "strip", Set: "0"}))
+	assert.Error(t, s.Add(&Schedule{Name: "night", Cron: "0 22 * * *", Device: "strip"}))
+	assert.Error(t, s.Remove("night"))
+	assert.Error(t, s.Remove("unknown"))
+
+	restored, err := NewScheduler(map[string]interface{}{
+		"latitude":  latitude,
+		"longitude": longitude,
+		"file":      file,
+	})
+	require.NoError(t, err)
+	list := restored.List()
+	require.Len(t, list, 1)
+	assert.Equal(t, "morning", list[0].Name)
+	assert.False(t, list[0].ReadOnly)
+	assert.False(t, list[0].Next.IsZero())
+
+	assert.NoError(t, restored.Remove("morning"))
+	assert.Empty(t, restored.List())
+
+	// Sun schedules require location
+	s, err = NewScheduler(nil)
+	require.NoError(t, err)
+	assert.Error(t, s.Add(&Schedule{Name: "x", Sun: Sunset, Device: "strip"}))
+}
+
+func TestSchedulerHandler(t *testing.T) {
+	s, err := NewScheduler(nil)
+	require.NoError(t, err)
+	server, err := api.NewServer(map[string]interface{}{"listen": "127.0.0.1:0"})
+	require.NoError(t, err)
+	server.Handle("/api/schedules", s.Handler())
+	server.Handle("/api/schedules/", s.Handler())
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go server.Run(ctx)
+	<-server.Ready()
+	url := "http://" + server.Addr().String()
+
+	resp, err := http.Post(url+"/api/schedules", "application/json",
+		strings.NewReader(`{"name": "dim", "cron": "0 23 * * 1-5", "device": "strip", "set": "20"}`))
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusCreated, resp.StatusCode)
+
+	resp, err = http.Post(url+"/api/schedules", "application/json", strings.NewReader(`{"name": "bad"}`))
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	// Cross-site requests are rejected
+	resp, err = http.Post(url+"/api/schedules", "text/plain",
+		strings.NewReader(`{"name": "evil", "cron": "* * * * *", "device": "strip", "set": "0"}`))
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusUnsupportedMediaType, resp.StatusCode)
+	req, _ := http.NewRequest(http.MethodDelete, url+"/api/schedules/dim", nil)
+	req.Header.Set("Origin", "https://evil.example.com")
+	resp, err = http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+	assert.Len(t, s.List(), 1)
+
+	resp, err = http.Get(url + "/api/schedules")
+	require.NoError(t, err)
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Contains(t, string(body), `"name":"dim"`)
+	assert.Contains(t, string(body), `"next":`)
+
+	req, _ = http.NewRequest(http.MethodDelete, url+"/api/schedules/dim", nil)
+	resp, err = http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+	assert.Empty(t, s.List())
+}
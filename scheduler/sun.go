@@ -0,0 +1,61 @@
+package scheduler
+
+import (
+	"math"
+	"time"
+)
+
+const (
+	// Julian date of Unix epoch / J2000.0
+	julianUnixEpoch = 2440587.5
+	julian2000      = 2451545.0
+	// Sun altitude at sunrise / sunset: refraction and solar disc radius
+	sunriseAltitude = -0.833
+	// Obliquity of the ecliptic
+	earthTilt = 23.4397
+)
+
+func sin(deg float64) float64 {
+	return math.Sin(deg * math.Pi / 180)
+}
+
+func cos(deg float64) float64 {
+	return math.Cos(deg * math.Pi / 180)
+}
+
+func julianToTime(j float64) time.Time {
+	seconds := (j - julianUnixEpoch) * 86400
+	return time.Unix(0, int64(seconds*float64(time.Second)))
+}
+
+// sunTimes calculates sunrise / sunset for day of date at given location,
+// using sunrise equation (accuracy is about a minute).
+// ok is false when sun does not rise or set at that day (polar day / night).
+func sunTimes(date time.Time, latitude, longitude float64) (sunrise, sunset time.Time, ok bool) {
+	// Days since J2000.0 of local noon of date
+	noon := time.Date(date.Year(), date.Month(), date.Day(), 12, 0, 0, 0, date.Location())
+	julian := float64(noon.Unix())/86400 + julianUnixEpoch
+	n := math.Round(julian - julian2000 + 0.0008 + longitude/360)
+
+	// Mean solar time, solar mean anomaly, equation of center
+	meanSolar := n - longitude/360
+	anomaly := math.Mod(357.5291+0.98560028*meanSolar, 360)
+	center := 1.9148*sin(anomaly) + 0.02*sin(2*anomaly) + 0.0003*sin(3*anomaly)
+	// Ecliptic longitude, solar transit, declination
+	ecliptic := math.Mod(anomaly+center+180+102.9372, 360)
+	transit := julian2000 + meanSolar + 0.0053*sin(anomaly) - 0.0069*sin(2*ecliptic)
+	sinDeclination := sin(ecliptic) * sin(earthTilt)
+	cosDeclination := math.Cos(math.Asin(sinDeclination))
+
+	// Hour angle of sunrise / sunset
+	cosHourAngle := (sin(sunriseAltitude) - sin(latitude)*sinDeclination) / (cos(latitude) * cosDeclination)
+	if cosHourAngle < -1 || cosHourAngle > 1 {
+		return time.Time{}, time.Time{}, false
+	}
+	hourAngle := math.Acos(cosHourAngle) * 180 / math.Pi
+
+	sunrise = julianToTime(transit - hourAngle/360).In(date.Location())
+	sunset = julianToTime(transit + hourAngle/360).In(date.Location())
+
+	return sunrise, sunset, true
+}
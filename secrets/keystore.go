@@ -0,0 +1,233 @@
+package secrets
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+
+	"github.com/golang/glog"
+	"github.com/mitchellh/mapstructure"
+	"golang.org/x/crypto/scrypt"
+
+	"github.com/lorahome/server/fileutil"
+)
+
+// Keystore file header: "LHKS" | version | salt
+const (
+	keystoreMagic    = "LHKS"
+	keystoreVersion  = 1
+	keystoreSaltSize = 16
+	keystoreHeader   = len(keystoreMagic) + 1 + keystoreSaltSize
+)
+
+// scrypt parameters used to derive key from passphrase
+const (
+	scryptN = 1 << 15
+	scryptR = 8
+	scryptP = 1
+)
+
+// Keystore is local file with secrets encrypted by AES-256-GCM
+// using master key. File format: header | nonce | encrypted JSON map name -> value
+type Keystore struct {
+	Filename string
+	// Master key, usually reference like env:LORAHOME_MASTER_KEY.
+	// 64 hex digits are used as AES-256 key, anything else treated
+	// as passphrase (key is derived by scrypt with random salt from file header)
+	MasterKey string
+
+	key      []byte
+	salt     []byte
+	values   map[string]string
+	enabled  bool
+	inMemory bool
+	lock     sync.Mutex
+}
+
+func NewKeystore(cfg interface{}) (*Keystore, error) {
+	ks := &Keystore{}
+	if cfg == nil {
+		// Bypass mode - keystore disabled
+		return ks, nil
+	}
+
+	// Map configuration into structure
+	err := mapstructure.Decode(cfg, ks)
+	if err != nil {
+		return nil, err
+	}
+	if ks.Filename == "" {
+		return nil, errors.New("config parameter secrets.filename is required")
+	}
+
+	// Master key itself must not be stored in config
+	masterKey, err := Resolve(ks.MasterKey)
+	if err != nil {
+		return nil, err
+	}
+	if masterKey == "" {
+		return nil, errors.New("keystore master key is empty")
+	}
+
+	err = ks.load(masterKey)
+	if err != nil {
+		return nil, err
+	}
+	ks.enabled = true
+	glog.Infof("Keystore %s unlocked, %d secret(s)", ks.Filename, len(ks.values))
+
+	return ks, nil
+}
+
+// Get returns secret value by name
+func (ks *Keystore) Get(name string) (string, error) {
+	if !ks.enabled {
+		return "", errors.New("keystore is not enabled")
+	}
+
+	ks.lock.Lock()
+	defer ks.lock.Unlock()
+	value, ok := ks.values[name]
+	if !ok {
+		return "", fmt.Errorf("secret '%s' not found in keystore", name)
+	}
+
+	return value, nil
+}
+
+// Set adds / replaces secret and saves keystore file
+func (ks *Keystore) Set(name, value string) error {
+	if !ks.enabled {
+		return errors.New("keystore is not enabled")
+	}
+
+	ks.lock.Lock()
+	defer ks.lock.Unlock()
+	ks.values[name] = value
+
+	return ks.save()
+}
+
+// KeepInMemory makes keystore keep changes in memory only, file is not
+// written anymore (e.g. by offline tools which process captured traffic)
+func (ks *Keystore) KeepInMemory() {
+	ks.lock.Lock()
+	defer ks.lock.Unlock()
+	ks.inMemory = true
+}
+
+// Delete removes secret (if any) and saves keystore file
+func (ks *Keystore) Delete(name string) error {
+	if !ks.enabled {
+		return errors.New("keystore is not enabled")
+	}
+
+	ks.lock.Lock()
+	defer ks.lock.Unlock()
+	if _, ok := ks.values[name]; !ok {
+		return nil
+	}
+	delete(ks.values, name)
+
+	return ks.save()
+}
+
+func (ks *Keystore) load(masterKey string) error {
+	ks.values = map[string]string{}
+	ks.salt = make([]byte, keystoreSaltSize)
+	data, err := ioutil.ReadFile(ks.Filename)
+	if os.IsNotExist(err) {
+		// No file yet - empty keystore with new salt
+		if _, err := rand.Read(ks.salt); err != nil {
+			return err
+		}
+		return ks.deriveKey(masterKey)
+	}
+	if err != nil {
+		return err
+	}
+
+	if len(data) < keystoreHeader || string(data[:len(keystoreMagic)]) != keystoreMagic {
+		return errors.New("keystore file is corrupted")
+	}
+	if version := data[len(keystoreMagic)]; version != keystoreVersion {
+		return fmt.Errorf("unsupported keystore version %d", version)
+	}
+	copy(ks.salt, data[len(keystoreMagic)+1:keystoreHeader])
+	err = ks.deriveKey(masterKey)
+	if err != nil {
+		return err
+	}
+
+	header, data := data[:keystoreHeader], data[keystoreHeader:]
+	gcm, err := ks.cipher()
+	if err != nil {
+		return err
+	}
+	if len(data) < gcm.NonceSize() {
+		return errors.New("keystore file is corrupted")
+	}
+	// Header is authenticated as well
+	plain, err := gcm.Open(nil, data[:gcm.NonceSize()], data[gcm.NonceSize():], header)
+	if err != nil {
+		return errors.New("unable to decrypt keystore (wrong master key?)")
+	}
+
+	return json.Unmarshal(plain, &ks.values)
+}
+
+func (ks *Keystore) save() error {
+	if ks.inMemory {
+		return nil
+	}
+	plain, err := json.Marshal(ks.values)
+	if err != nil {
+		return err
+	}
+	gcm, err := ks.cipher()
+	if err != nil {
+		return err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	header := make([]byte, 0, keystoreHeader)
+	header = append(header, keystoreMagic...)
+	header = append(header, keystoreVersion)
+	header = append(header, ks.salt...)
+	data := append(append([]byte{}, header...), nonce...)
+	data = gcm.Seal(data, nonce, plain, header)
+
+	// Keystore must never get truncated
+	return fileutil.WriteAtomic(ks.Filename, data, 0600)
+}
+
+// deriveKey sets AES key from master key: either key itself or
+// key derived from passphrase using salt of keystore
+func (ks *Keystore) deriveKey(masterKey string) error {
+	key, err := hex.DecodeString(masterKey)
+	if err == nil && len(key) == 32 {
+		ks.key = key
+		return nil
+	}
+	ks.key, err = scrypt.Key([]byte(masterKey), ks.salt, scryptN, scryptR, scryptP, 32)
+
+	return err
+}
+
+func (ks *Keystore) cipher() (cipher.AEAD, error) {
+	block, err := aes.NewCipher(ks.key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
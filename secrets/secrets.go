@@ -0,0 +1,75 @@
+package secrets
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// Secret references supported by Resolve
+const (
+	envPrefix      = "env:"
+	filePrefix     = "file:"
+	keystorePrefix = "keystore:"
+)
+
+// Keystore used to resolve "keystore:" references
+var defaultKeystore = &Keystore{}
+
+// SetKeystore sets keystore used to resolve / store secrets
+func SetKeystore(ks *Keystore) {
+	defaultKeystore = ks
+}
+
+// Resolve returns actual value of secret reference:
+// - env:NAME - value of environment variable NAME
+// - file:PATH - content of file PATH (leading / trailing spaces trimmed)
+// - keystore:NAME - value from encrypted keystore
+// Anything else is treated as plain value and returned as is.
+func Resolve(ref string) (string, error) {
+	switch {
+	case strings.HasPrefix(ref, envPrefix):
+		name := strings.TrimPrefix(ref, envPrefix)
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			return "", fmt.Errorf("environment variable %s is not set", name)
+		}
+		return value, nil
+	case strings.HasPrefix(ref, filePrefix):
+		data, err := ioutil.ReadFile(strings.TrimPrefix(ref, filePrefix))
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimSpace(string(data)), nil
+	case strings.HasPrefix(ref, keystorePrefix):
+		return defaultKeystore.Get(strings.TrimPrefix(ref, keystorePrefix))
+	}
+
+	return ref, nil
+}
+
+// Protect stores secret value into keystore under given name and
+// returns reference to it. When keystore is not enabled value is
+// returned as is.
+func Protect(name, value string) (string, error) {
+	if !defaultKeystore.enabled {
+		return value, nil
+	}
+	err := defaultKeystore.Set(name, value)
+	if err != nil {
+		return "", err
+	}
+
+	return keystorePrefix + name, nil
+}
+
+// Unprotect removes secret stored by Protect from keystore.
+// Nothing to do when keystore is not enabled.
+func Unprotect(name string) error {
+	if !defaultKeystore.enabled {
+		return nil
+	}
+
+	return defaultKeystore.Delete(name)
+}
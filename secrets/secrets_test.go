@@ -0,0 +1,108 @@
+package secrets
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestResolve(t *testing.T) {
+	dir, err := ioutil.TempDir("", "secrets")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	os.Setenv("LORAHOME_TEST_SECRET", "fromenv")
+	defer os.Unsetenv("LORAHOME_TEST_SECRET")
+	secretFile := filepath.Join(dir, "secret")
+	require.NoError(t, ioutil.WriteFile(secretFile, []byte("fromfile\n"), 0600))
+
+	runs := map[string]string{
+		"plain":                    "plain",
+		"":                         "",
+		"env:LORAHOME_TEST_SECRET": "fromenv",
+		"file:" + secretFile:       "fromfile",
+	}
+	for ref, expected := range runs {
+		res, err := Resolve(ref)
+		assert.NoError(t, err)
+		assert.Equal(t, expected, res)
+	}
+
+	// Negative: missing env / file / disabled keystore
+	for _, ref := range []string{"env:LORAHOME_TEST_NO_SUCH", "file:/no/such/file", "keystore:name"} {
+		_, err := Resolve(ref)
+		assert.Error(t, err, ref)
+	}
+}
+
+func TestKeystore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keystore")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	cfg := map[interface{}]interface{}{
+		"filename":  filepath.Join(dir, "keystore.dat"),
+		"masterKey": "passphrase",
+	}
+	ks, err := NewKeystore(cfg)
+	require.NoError(t, err)
+	SetKeystore(ks)
+	defer SetKeystore(&Keystore{})
+
+	// Store secret, ensure that reference returned instead of value
+	ref, err := Protect("device-1", "0102")
+	require.NoError(t, err)
+	assert.Equal(t, "keystore:device-1", ref)
+	res, err := Resolve(ref)
+	assert.NoError(t, err)
+	assert.Equal(t, "0102", res)
+	ref, err = Protect("device-2", "0304")
+	require.NoError(t, err)
+	require.NoError(t, Unprotect("device-2"))
+	_, err = Resolve(ref)
+	assert.Error(t, err)
+	assert.NoError(t, Unprotect("device-2"))
+
+	// Secrets must not be stored in plain text
+	data, err := ioutil.ReadFile(filepath.Join(dir, "keystore.dat"))
+	require.NoError(t, err)
+	assert.NotContains(t, string(data), "0102")
+	assert.Equal(t, "LHKS", string(data[:4]))
+
+	// Each keystore has own salt, so the same passphrase gives different keys
+	other, err := NewKeystore(map[interface{}]interface{}{
+		"filename":  filepath.Join(dir, "other.dat"),
+		"masterKey": "passphrase",
+	})
+	require.NoError(t, err)
+	assert.NotEqual(t, ks.key, other.key)
+	assert.NotEqual(t, ks.salt, other.salt)
+
+	// Reopen keystore
+	ks, err = NewKeystore(cfg)
+	require.NoError(t, err)
+	res, err = ks.Get("device-1")
+	assert.NoError(t, err)
+	assert.Equal(t, "0102", res)
+
+	// Changes of in-memory keystore are not saved
+	ks.KeepInMemory()
+	require.NoError(t, ks.Set("device-1", "0506"))
+	res, err = ks.Get("device-1")
+	assert.NoError(t, err)
+	assert.Equal(t, "0506", res)
+	ks, err = NewKeystore(cfg)
+	require.NoError(t, err)
+	res, err = ks.Get("device-1")
+	assert.NoError(t, err)
+	assert.Equal(t, "0102", res)
+
+	// Negative: wrong master key
+	cfg["masterKey"] = "wrong"
+	_, err = NewKeystore(cfg)
+	assert.Error(t, err)
+}
@@ -0,0 +1,308 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/golang/glog"
+
+	"github.com/lorahome/server/alerts"
+	"github.com/lorahome/server/api"
+	"github.com/lorahome/server/battery"
+	"github.com/lorahome/server/capture"
+	"github.com/lorahome/server/dashboard"
+	"github.com/lorahome/server/db/influxdb"
+	"github.com/lorahome/server/devices"
+	"github.com/lorahome/server/downlink"
+	"github.com/lorahome/server/events"
+	"github.com/lorahome/server/fileutil"
+	"github.com/lorahome/server/history"
+	"github.com/lorahome/server/mqtt"
+	"github.com/lorahome/server/rpc"
+	"github.com/lorahome/server/rules"
+	"github.com/lorahome/server/scheduler"
+	"github.com/lorahome/server/secrets"
+	"github.com/lorahome/server/state"
+	"github.com/lorahome/server/transport"
+	"github.com/lorahome/server/webhook"
+)
+
+// Server wires transports, services and devices together
+type Server struct {
+	Config      *Config
+	DevicesFile string
+	// Optional: audit trail / raw packets capture filenames
+	AuditFile   string
+	CaptureFile string
+
+	caps    *devices.Capabilities
+	capture *capture.Writer
+	api     *api.Server
+	events  *events.Service
+	ready   chan struct{}
+	errors  chan error
+	wg      sync.WaitGroup
+}
+
+// readier is implemented by services which start asynchronously
+type readier interface {
+	Ready() <-chan struct{}
+}
+
+func NewServer(cfg *Config, devicesFile string) *Server {
+	return &Server{
+		Config:      cfg,
+		DevicesFile: devicesFile,
+		caps: &devices.Capabilities{
+			State: state.NewStore(),
+		},
+		ready:  make(chan struct{}),
+		errors: make(chan error, 8),
+	}
+}
+
+// Ready is closed once all services and devices started
+func (s *Server) Ready() <-chan struct{} {
+	return s.ready
+}
+
+// Capabilities returns services available to devices
+func (s *Server) Capabilities() *devices.Capabilities {
+	return s.caps
+}
+
+// Api returns HTTP API server, valid once ready
+func (s *Server) Api() *api.Server {
+	return s.api
+}
+
+// Run starts all services and devices, then processes packets until
+// context canceled or any of services failed. Devices are saved on exit.
+// Devices file (and keystore) is locked meanwhile, so offline "device"
+// commands do not change it behind the server.
+func (s *Server) Run(ctx context.Context) error {
+	lock, err := fileutil.Lock(s.DevicesFile)
+	if err == fileutil.ErrLocked {
+		return fmt.Errorf("%s is in use by another server", s.DevicesFile)
+	}
+	if err != nil {
+		return err
+	}
+	defer lock.Unlock()
+	// Capture is closed once all services (which may send packets) stopped
+	defer func() {
+		if s.capture != nil {
+			s.capture.Close()
+		}
+	}()
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer func() {
+		// Stop and wait for all services
+		cancel()
+		s.wg.Wait()
+	}()
+
+	err = s.start(ctx)
+	if err != nil {
+		return err
+	}
+	close(s.ready)
+
+	for {
+		// Wait for packet from any transport
+		select {
+		case packet := <-s.caps.Udp.Receive():
+			err := processPacket(s.caps.Udp, packet, s.DevicesFile)
+			s.events.Packet(packet, err)
+			// Handle all errors in one place
+			if err != nil {
+				glog.Infof("ProcessPacket failed: %v", err)
+			}
+		case err := <-s.errors:
+			return err
+		case <-ctx.Done():
+			cancel()
+			s.wg.Wait()
+			return devices.SaveToFile(s.DevicesFile)
+		}
+	}
+}
+
+// start sets up services in order of dependency, then loads devices
+func (s *Server) start(ctx context.Context) error {
+	// Unlock keystore first: other services may refer secrets from it
+	keystore, err := secrets.NewKeystore(s.Config.Secrets)
+	if err != nil {
+		return fmt.Errorf("keystore failed: %v", err)
+	}
+	secrets.SetKeystore(keystore)
+
+	// Start UDP transport
+	udp, err := transport.NewLoRaUdp(s.Config.Udp)
+	if err != nil {
+		return fmt.Errorf("LoRa UDP transport failed: %v", err)
+	}
+	s.caps.Udp = udp
+	// Record all packets, if requested
+	if s.CaptureFile != "" {
+		s.capture, err = capture.NewWriter(s.CaptureFile)
+		if err != nil {
+			return fmt.Errorf("unable to open capture file: %v", err)
+		}
+		s.caps.Udp = capture.Wrap(udp, "udp", s.capture)
+	}
+	s.run(ctx, "UDP", s.caps.Udp.Run)
+
+	// Start InfluxDB
+	s.caps.InfluxDb, err = influxdb.NewInfluxDB(s.Config.InfluxDb)
+	if err != nil {
+		return fmt.Errorf("InfluxDB failed: %v", err)
+	}
+
+	// Report airtime usage, if transport does accounting
+	if reporter, ok := udp.(transport.AirtimeReporter); ok {
+		go reportAirtime(ctx, reporter, s.caps.InfluxDb)
+	}
+
+	// Start MQTT client
+	s.caps.Mqtt, err = mqtt.NewMqttClient(s.Config.Mqtt)
+	if err != nil {
+		return fmt.Errorf("MQTT failed: %v", err)
+	}
+	s.run(ctx, "MQTT", s.caps.Mqtt.Run)
+
+	// Start downlinks queue
+	s.caps.Downlink, err = downlink.NewQueue(s.Config.Downlink, s.caps.Udp, s.caps.Mqtt)
+	if err != nil {
+		return fmt.Errorf("downlink queue failed: %v", err)
+	}
+	s.run(ctx, "Downlink queue", s.caps.Downlink.Run)
+
+	// Live events: packets, readings, commands, device presence, errors
+	s.events, err = events.NewService(s.Config.Events, s.caps.State)
+	if err != nil {
+		return fmt.Errorf("events failed: %v", err)
+	}
+	s.caps.Downlink.Observe(s.events.Downlink)
+	s.run(ctx, "Events", s.events.Run)
+
+	// Outbound webhooks of all events
+	s.caps.Webhooks, err = webhook.NewDispatcher(s.Config.Webhooks)
+	if err != nil {
+		return fmt.Errorf("webhooks failed: %v", err)
+	}
+	if s.caps.Webhooks.Enabled() {
+		s.run(ctx, "Webhook events", func(ctx context.Context) error {
+			return forwardEvents(ctx, s.events.Bus(), s.caps.Webhooks)
+		})
+	}
+	s.run(ctx, "Webhooks", s.caps.Webhooks.Run)
+
+	// Devices subscribe to MQTT topics right away, so wait for connection
+	err = s.wait(ctx, udp.(readier), s.caps.Mqtt)
+	if err != nil {
+		return err
+	}
+
+	// Battery level / life estimation, devices publish level alongside voltage
+	batteries, err := battery.NewMonitor(s.Config.Battery, s.caps.State, s.caps.Mqtt, s.caps.InfluxDb)
+	if err != nil {
+		return fmt.Errorf("battery monitor failed: %v", err)
+	}
+	s.caps.Battery = batteries
+
+	// Load / register devices
+	devices.SetAuditFile(s.AuditFile)
+	err = devices.LoadFromFile(s.DevicesFile, s.caps)
+	if err != nil {
+		return fmt.Errorf("unable to load devices: %v", err)
+	}
+
+	// Start all devices
+	err = devices.StartAllDevices(ctx)
+	if err != nil {
+		return fmt.Errorf("unable to start devices: %v", err)
+	}
+
+	// Automation rules refer devices by name, so start them last
+	engine, err := rules.NewEngine(s.Config.Rules, s.caps.State, s.caps.Mqtt)
+	if err != nil {
+		return fmt.Errorf("rules failed: %v", err)
+	}
+	s.run(ctx, "Rules", engine.Run)
+
+	s.run(ctx, "Battery", batteries.Run)
+
+	// Alerts and notifications
+	alertManager, err := alerts.NewManager(s.Config.Alerts, s.caps.State, s.caps.Mqtt)
+	if err != nil {
+		return fmt.Errorf("alerts failed: %v", err)
+	}
+	names := []string{}
+	for _, device := range devices.GetAllDevices() {
+		names = append(names, device.GetName())
+	}
+	alertManager.Expect(names)
+	s.run(ctx, "Alerts", alertManager.Run)
+
+	// Time based device commands
+	sched, err := scheduler.NewScheduler(s.Config.Scheduler)
+	if err != nil {
+		return fmt.Errorf("scheduler failed: %v", err)
+	}
+	s.run(ctx, "Scheduler", sched.Run)
+
+	// HTTP API of all features
+	s.api, err = api.NewServer(s.Config.Api)
+	if err != nil {
+		return fmt.Errorf("API failed: %v", err)
+	}
+	s.api.Handle("/api/alerts", alertManager.Handler())
+	s.api.Handle("/api/battery", batteries.Handler())
+	s.api.Handle("/api/history", history.NewService(s.caps.InfluxDb, s.caps.State).Handler())
+	ui := dashboard.NewDashboard(s.caps.State, s.events)
+	ui.Register(s.api)
+	s.run(ctx, "Dashboard", ui.Run)
+	s.api.Handle("/api/events", s.events.Handler(s.api.CheckOrigin))
+	s.api.Handle("/api/schedules", sched.Handler())
+	s.api.Handle("/api/schedules/", sched.Handler())
+	s.run(ctx, "API", s.api.Run)
+
+	// gRPC API: devices, commands, readings stream
+	grpcServer, err := rpc.NewServer(s.Config.Grpc, s.caps.State)
+	if err != nil {
+		return fmt.Errorf("gRPC API failed: %v", err)
+	}
+	s.run(ctx, "gRPC", grpcServer.Run)
+
+	return s.wait(ctx, s.api, grpcServer)
+}
+
+// wait waits until services are ready, or any of them failed
+func (s *Server) wait(ctx context.Context, services ...readier) error {
+	for _, service := range services {
+		select {
+		case <-service.Ready():
+		case err := <-s.errors:
+			return err
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	return nil
+}
+
+// run runs service in background, failure of service stops server
+func (s *Server) run(ctx context.Context, name string, service func(context.Context) error) {
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		err := service(ctx)
+		if err != nil {
+			s.errors <- fmt.Errorf("%s failed: %v", name, err)
+		}
+	}()
+}
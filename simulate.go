@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/golang/glog"
+
+	"github.com/lorahome/server/devices"
+	"github.com/lorahome/server/devices/light/led_strip"
+	"github.com/lorahome/server/devices/sensor/multisensor"
+	"github.com/lorahome/server/secrets"
+	"github.com/lorahome/server/simulator"
+	"github.com/lorahome/server/transport"
+)
+
+// Simulation models of device classes
+var simulatorModels = map[string]func() simulator.Model{
+	led_strip.Url:   func() simulator.Model { return simulator.NewLedStrip() },
+	multisensor.Url: func() simulator.Model { return simulator.NewMultiSensor() },
+}
+
+// runSimulate impersonates all devices from devices file, sending uplinks to
+// server UDP listener. Server gateway address should point to -listen.
+func runSimulate(args []string) error {
+	flags := flag.NewFlagSet("simulate", flag.ExitOnError)
+	server := flags.String("server", "127.0.0.1:4444", "UDP address of server")
+	listen := flags.String("listen", "127.0.0.1:4445", "UDP address to receive downlinks on (server's udp.gateway)")
+	interval := flags.Duration("interval", 10*time.Second, "Interval between uplinks of each device")
+	badKey := flags.Float64("bad-key", 0, "Probability of packet encrypted with wrong key")
+	truncate := flags.Float64("truncate", 0, "Probability of truncated packet")
+	replay := flags.Float64("replay", 0, "Probability of replayed packet")
+	flags.Parse(args)
+	if *interval <= 0 {
+		return fmt.Errorf("interval must be positive, got %v", *interval)
+	}
+
+	// Device keys may be stored in keystore
+	err := unlockKeystore()
+	if err != nil {
+		return err
+	}
+
+	caps, err := bypassCapabilities(transport.NewMockLoRaTransport())
+	if err != nil {
+		return err
+	}
+	err = devices.LoadFromFile(*flagDevices, caps)
+	if err != nil {
+		return err
+	}
+
+	sim := simulator.New(*server, *listen, *interval, simulator.Faults{
+		BadKey:   *badKey,
+		Truncate: *truncate,
+		Replay:   *replay,
+	})
+	for _, dev := range devices.GetAllDevices() {
+		model, ok := simulatorModels[dev.GetUrl()]
+		if !ok {
+			glog.Infof("Device class %s can not be simulated, %s skipped", dev.GetClassName(), dev.GetName())
+			continue
+		}
+		node, err := simulatorNode(dev.GetBaseDevice())
+		if err != nil {
+			return fmt.Errorf("device %s: %v", dev.GetName(), err)
+		}
+		node.Model = model()
+		sim.AddNode(node)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		sigCh := make(chan os.Signal, 1)
+		signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
+		<-sigCh
+		cancel()
+	}()
+	err = sim.Run(ctx)
+	stats := sim.Stats()
+	glog.Infof("Simulation stopped: %d uplink(s), %d downlink(s), %d fault(s), %d error(s)",
+		stats.Uplinks, stats.Downlinks, stats.Faults, stats.Errors)
+
+	return err
+}
+
+// simulatorNode makes node with the same id / keys as device
+func simulatorNode(dev *devices.BaseDevice) (*simulator.Node, error) {
+	node := &simulator.Node{
+		Id: dev.Id,
+	}
+	var err error
+	node.Key, err = resolveKey(dev.Key)
+	if err != nil {
+		return nil, err
+	}
+	node.RootKey, err = resolveKey(dev.RootKey)
+
+	return node, err
+}
+
+func resolveKey(ref string) ([]byte, error) {
+	if ref == "" {
+		return nil, nil
+	}
+	value, err := secrets.Resolve(ref)
+	if err != nil {
+		return nil, err
+	}
+
+	return hex.DecodeString(value)
+}
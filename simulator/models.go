@@ -0,0 +1,95 @@
+package simulator
+
+import (
+	"errors"
+	"math/rand"
+
+	"github.com/golang/protobuf/proto"
+	lightpb "github.com/lorahome/devices/go/proto/light"
+	sensorpb "github.com/lorahome/devices/go/proto/sensor"
+)
+
+// MultiSensor simulates slowly changing environment and draining battery
+type MultiSensor struct {
+	temperature float64
+	humidity    float64
+	light       float64
+	voltageMv   float64
+}
+
+func NewMultiSensor() *MultiSensor {
+	return &MultiSensor{
+		temperature: 21,
+		humidity:    45,
+		light:       300,
+		voltageMv:   3000,
+	}
+}
+
+func (m *MultiSensor) Status() proto.Message {
+	m.temperature = walk(m.temperature, 0.2, -10, 40)
+	m.humidity = walk(m.humidity, 1, 10, 95)
+	m.light = walk(m.light, 20, 0, 2000)
+	m.voltageMv = walk(m.voltageMv-0.5, 2, 2000, 3300)
+
+	return &sensorpb.MultiSensorStatus{
+		Temperature: &sensorpb.Temperature{
+			ValueC: float32(m.temperature),
+			ValueF: float32(m.temperature*9/5 + 32),
+		},
+		Humidity: &sensorpb.Humidity{
+			Value: float32(m.humidity),
+		},
+		AmbientLight: &sensorpb.AmbientLight{
+			Value:      uint32(m.light),
+			WhiteValue: uint32(m.light * 0.8),
+		},
+		Battery: &sensorpb.Battery{
+			VoltageMv: uint32(m.voltageMv),
+		},
+	}
+}
+
+func (m *MultiSensor) Command(payload []byte) (proto.Message, error) {
+	return nil, errors.New("multisensor does not accept commands")
+}
+
+// LedStrip applies light level and reports it back
+type LedStrip struct {
+	channels []uint32
+}
+
+func NewLedStrip() *LedStrip {
+	return &LedStrip{
+		channels: []uint32{0},
+	}
+}
+
+func (l *LedStrip) Status() proto.Message {
+	return &lightpb.LedStripStatus{
+		Channels: l.channels,
+	}
+}
+
+func (l *LedStrip) Command(payload []byte) (proto.Message, error) {
+	state := &lightpb.LedStripStatus{}
+	err := proto.Unmarshal(payload, state)
+	if err != nil {
+		return nil, err
+	}
+	l.channels = state.Channels
+
+	return l.Status(), nil
+}
+
+// walk changes value randomly by up to step, keeping it in [min, max]
+func walk(value, step, min, max float64) float64 {
+	value += (rand.Float64()*2 - 1) * step
+	if value < min {
+		return min
+	}
+	if value > max {
+		return max
+	}
+	return value
+}
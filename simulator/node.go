@@ -0,0 +1,162 @@
+package simulator
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"github.com/golang/protobuf/proto"
+
+	"github.com/lorahome/server/encoding"
+)
+
+// Device side of control messages, mirrors server implementation
+// (as device firmware does)
+const (
+	joinRequestMagic  = "LHJR"
+	joinAcceptMagic   = "LHJA"
+	keyChangeMagic    = "LHKC"
+	keyChangeAckMagic = "LHKA"
+	confirmedMagic    = "LHCD"
+	ackMagic          = "LHAK"
+)
+
+// Model is behaviour of simulated device class
+type Model interface {
+	// Status returns next status message reported by device
+	Status() proto.Message
+	// Command applies downlink payload, returns status to report (if any)
+	Command(payload []byte) (proto.Message, error)
+}
+
+// Node is simulated LoRa device
+type Node struct {
+	Id      uint64
+	Key     []byte
+	RootKey []byte
+	Model   Model
+
+	devNonce []byte
+}
+
+// Uplink returns next packet to be sent by node: join request if node
+// has no session key yet, current status otherwise
+func (n *Node) Uplink() ([]byte, error) {
+	return n.uplink(nil)
+}
+
+// uplink encrypts next packet with key, if set (fault injection)
+func (n *Node) uplink(key []byte) ([]byte, error) {
+	if len(n.Key) == 0 {
+		if len(n.RootKey) == 0 {
+			return nil, fmt.Errorf("node 0x%x has neither key nor root key", n.Id)
+		}
+		devNonce := make([]byte, 8)
+		if _, err := rand.Read(devNonce); err != nil {
+			return nil, err
+		}
+		if key != nil {
+			// Faulty request must not affect pending valid one
+			return n.encode(key, append([]byte(joinRequestMagic), devNonce...))
+		}
+		n.devNonce = devNonce
+		return n.encode(n.RootKey, append([]byte(joinRequestMagic), n.devNonce...))
+	}
+
+	payload, err := proto.Marshal(n.Model.Status())
+	if err != nil {
+		return nil, err
+	}
+	if key == nil {
+		key = n.Key
+	}
+
+	return n.encode(key, payload)
+}
+
+// Downlink processes packet received from server,
+// returns uplinks to be sent in reply
+func (n *Node) Downlink(packet []byte) ([][]byte, error) {
+	if len(packet) < 8 || binary.LittleEndian.Uint64(packet) != n.Id {
+		return nil, errors.New("packet is addressed to other node")
+	}
+
+	// Join accept is the only message encrypted with root key
+	if len(n.Key) == 0 {
+		return nil, n.processJoinAccept(packet[8:])
+	}
+
+	payload, err := encoding.AESdecryptCBC(n.Key, packet[8:])
+	if err != nil {
+		return nil, err
+	}
+	replies := [][]byte{}
+
+	switch {
+	case bytes.HasPrefix(payload, []byte(keyChangeMagic)):
+		// Switch to new key right away and confirm it using new key
+		n.Key = payload[len(keyChangeMagic):]
+		ack, err := n.encode(n.Key, []byte(keyChangeAckMagic))
+		if err != nil {
+			return nil, err
+		}
+		return [][]byte{ack}, nil
+	case bytes.HasPrefix(payload, []byte(confirmedMagic)) && len(payload) >= len(confirmedMagic)+2:
+		// Acknowledge confirmed downlink, then process it as usual
+		id := payload[len(confirmedMagic) : len(confirmedMagic)+2]
+		ack, err := n.encode(n.Key, append([]byte(ackMagic), id...))
+		if err != nil {
+			return nil, err
+		}
+		replies = append(replies, ack)
+		payload = payload[len(confirmedMagic)+2:]
+	}
+
+	status, err := n.Model.Command(payload)
+	if err != nil {
+		return nil, err
+	}
+	if status != nil {
+		data, err := proto.Marshal(status)
+		if err != nil {
+			return nil, err
+		}
+		uplink, err := n.encode(n.Key, data)
+		if err != nil {
+			return nil, err
+		}
+		replies = append(replies, uplink)
+	}
+
+	return replies, nil
+}
+
+func (n *Node) processJoinAccept(encrypted []byte) error {
+	payload, err := encoding.AESdecryptCBC(n.RootKey, encrypted)
+	if err != nil {
+		return err
+	}
+	if len(payload) != len(joinAcceptMagic)+8+16 || !bytes.HasPrefix(payload, []byte(joinAcceptMagic)) {
+		return errors.New("not a join accept")
+	}
+	payload = payload[len(joinAcceptMagic):]
+	if !bytes.Equal(payload[:8], n.devNonce) {
+		return errors.New("join accept for other join request")
+	}
+	n.Key = payload[8:]
+
+	return nil
+}
+
+func (n *Node) encode(key, payload []byte) ([]byte, error) {
+	encrypted, err := encoding.AESencryptCBC(key, payload)
+	if err != nil {
+		return nil, err
+	}
+	packet := make([]byte, 8, 8+len(encrypted))
+	binary.LittleEndian.PutUint64(packet, n.Id)
+
+	return append(packet, encrypted...), nil
+}
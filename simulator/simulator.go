@@ -0,0 +1,226 @@
+// Package simulator impersonates LoRa devices, so server can be tested
+// end to end (or demoed) without radios: simulated nodes send encrypted
+// uplinks to UDP listener of server and process downlinks sent to gateway.
+package simulator
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	mathrand "math/rand"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// Faults are probabilities (0..1) of corrupting uplink
+type Faults struct {
+	// Packet encrypted with random key
+	BadKey float64
+	// Packet cut at random position
+	Truncate float64
+	// Previous packet of node sent again instead of new one
+	Replay float64
+}
+
+// Stats counts packets sent / received by simulator
+type Stats struct {
+	Uplinks   int
+	Downlinks int
+	Faults    int
+	Errors    int
+}
+
+// Simulator sends uplinks of all nodes on schedule
+type Simulator struct {
+	// UDP address of server listener
+	Server string
+	// UDP address to receive downlinks on (server's gateway address)
+	Listen string
+	// Interval between uplinks of each node
+	Interval time.Duration
+	Faults   Faults
+
+	nodes  map[uint64]*Node
+	last   map[uint64][]byte
+	stats  Stats
+	server net.Addr
+	socket net.PacketConn
+	lock   sync.Mutex
+}
+
+func New(server, listen string, interval time.Duration, faults Faults) *Simulator {
+	return &Simulator{
+		Server:   server,
+		Listen:   listen,
+		Interval: interval,
+		Faults:   faults,
+		nodes:    map[uint64]*Node{},
+		last:     map[uint64][]byte{},
+	}
+}
+
+// AddNode adds node to simulation, must be called before Run
+func (s *Simulator) AddNode(node *Node) {
+	s.nodes[node.Id] = node
+}
+
+// Stats returns packet counters
+func (s *Simulator) Stats() Stats {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.stats
+}
+
+// Run simulates nodes until context canceled
+func (s *Simulator) Run(ctx context.Context) error {
+	var err error
+	s.server, err = net.ResolveUDPAddr("udp", s.Server)
+	if err != nil {
+		return err
+	}
+	s.socket, err = net.ListenPacket("udp", s.Listen)
+	if err != nil {
+		return err
+	}
+	glog.Infof("Simulating %d node(s), server %s, downlinks at %s", len(s.nodes), s.Server, s.Listen)
+	go s.serve()
+
+	var wg sync.WaitGroup
+	for _, node := range s.nodes {
+		wg.Add(1)
+		go func(node *Node) {
+			defer wg.Done()
+			s.runNode(ctx, node)
+		}(node)
+	}
+
+	<-ctx.Done()
+	s.socket.Close()
+	wg.Wait()
+
+	return nil
+}
+
+// runNode sends uplinks of node with random start offset,
+// so nodes do not transmit at the same time
+func (s *Simulator) runNode(ctx context.Context, node *Node) {
+	delay := time.Duration(mathrand.Int63n(int64(s.Interval)))
+	for {
+		select {
+		case <-time.After(delay):
+			err := s.sendUplink(node)
+			if err != nil {
+				glog.Errorf("Node 0x%x: uplink failed: %v", node.Id, err)
+			}
+			delay = s.Interval
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (s *Simulator) sendUplink(node *Node) error {
+	s.lock.Lock()
+	packet, fault, err := s.nextPacket(node)
+	s.stats.Uplinks++
+	if fault != "" {
+		s.stats.Faults++
+	}
+	if err != nil {
+		s.stats.Errors++
+	}
+	s.lock.Unlock()
+	if err != nil {
+		return err
+	}
+
+	if fault != "" {
+		glog.Infof("Node 0x%x: injected fault '%s'", node.Id, fault)
+	}
+	_, err = s.socket.WriteTo(packet, s.server)
+
+	return err
+}
+
+// nextPacket returns next uplink of node, possibly corrupted by fault
+func (s *Simulator) nextPacket(node *Node) ([]byte, string, error) {
+	if last := s.last[node.Id]; last != nil && mathrand.Float64() < s.Faults.Replay {
+		return last, "replay", nil
+	}
+
+	if mathrand.Float64() < s.Faults.BadKey {
+		key := make([]byte, 16)
+		if _, err := rand.Read(key); err != nil {
+			return nil, "", err
+		}
+		packet, err := node.uplink(key)
+		return packet, "bad key", err
+	}
+
+	packet, err := node.Uplink()
+	if err != nil {
+		return nil, "", err
+	}
+	s.last[node.Id] = packet
+	if mathrand.Float64() < s.Faults.Truncate {
+		return packet[:8+mathrand.Intn(len(packet)-8)], "truncate", nil
+	}
+
+	return packet, "", nil
+}
+
+// serve receives downlinks and sends replies of nodes
+func (s *Simulator) serve() {
+	buf := make([]byte, 1024)
+	for {
+		n, _, err := s.socket.ReadFrom(buf)
+		if err != nil {
+			// Terminate goroutine when socket closed
+			if strings.Contains(err.Error(), "use of closed network connection") {
+				return
+			}
+			glog.Infof("readFrom failed: %v", err)
+			continue
+		}
+
+		replies, err := s.processDownlink(buf[:n])
+		if err != nil {
+			glog.Errorf("Downlink %x: %v", buf[:n], err)
+			continue
+		}
+		for _, reply := range replies {
+			if _, err := s.socket.WriteTo(reply, s.server); err != nil {
+				glog.Errorf("Reply failed: %v", err)
+			}
+		}
+	}
+}
+
+func (s *Simulator) processDownlink(packet []byte) ([][]byte, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.stats.Downlinks++
+	if len(packet) < 8 {
+		s.stats.Errors++
+		return nil, fmt.Errorf("packet too short")
+	}
+	node, ok := s.nodes[binary.LittleEndian.Uint64(packet)]
+	if !ok {
+		s.stats.Errors++
+		return nil, fmt.Errorf("unknown node 0x%x", binary.LittleEndian.Uint64(packet))
+	}
+	replies, err := node.Downlink(packet)
+	if err != nil {
+		s.stats.Errors++
+	}
+	s.stats.Uplinks += len(replies)
+
+	return replies, err
+}
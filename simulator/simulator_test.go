@@ -0,0 +1,145 @@
+package simulator
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	lightpb "github.com/lorahome/devices/go/proto/light"
+	sensorpb "github.com/lorahome/devices/go/proto/sensor"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/lorahome/server/devices"
+	"github.com/lorahome/server/downlink"
+	"github.com/lorahome/server/encoding"
+	"github.com/lorahome/server/transport"
+)
+
+func TestNodeJoin(t *testing.T) {
+	dev := &devices.MockDevice{
+		BaseDevice: devices.BaseDevice{
+			Id:      0x1234,
+			RootKey: "11111111111111111111111111111111",
+		},
+	}
+	require.NoError(t, dev.LoadKeys())
+	source := transport.NewMockLoRaTransport()
+	node := &Node{
+		Id:      0x1234,
+		RootKey: bytes.Repeat([]byte{0x11}, 16),
+		Model:   NewMultiSensor(),
+	}
+
+	// Node without session key joins first
+	packet, err := node.Uplink()
+	require.NoError(t, err)
+	// Request encrypted with wrong key (fault) in between is ignored
+	// and does not break the valid one
+	faulty, err := node.uplink(bytes.Repeat([]byte{0x22}, 16))
+	require.NoError(t, err)
+	res, err := devices.ProcessJoin(dev, source, faulty[8:])
+	require.NoError(t, err)
+	require.False(t, res.Consumed)
+	res, err = devices.ProcessJoin(dev, source, packet[8:])
+	require.NoError(t, err)
+	require.True(t, res.Consumed)
+	require.Len(t, source.History, 1)
+	replies, err := node.Downlink(source.History[0])
+	require.NoError(t, err)
+	assert.Empty(t, replies)
+	assert.Len(t, node.Key, 16)
+
+	// Status is encrypted with session key
+	packet, err = node.Uplink()
+	require.NoError(t, err)
+	payload, err := dev.Decrypt(packet[8:])
+	require.NoError(t, err)
+	status := &sensorpb.MultiSensorStatus{}
+	require.NoError(t, proto.Unmarshal(payload, status))
+	assert.InDelta(t, 21, status.Temperature.ValueC, 1)
+	assert.NotZero(t, status.Battery.VoltageMv)
+
+	// Downlink to other node
+	_, err = node.Downlink([]byte{1, 2, 3, 4, 5, 6, 7, 8, 9})
+	assert.Error(t, err)
+}
+
+func TestNodeDownlink(t *testing.T) {
+	key := bytes.Repeat([]byte{0x22}, 16)
+	node := &Node{
+		Id:    0x42,
+		Key:   key,
+		Model: NewLedStrip(),
+	}
+	downlinkPacket := func(key, payload []byte) []byte {
+		encrypted, err := encoding.AESencryptCBC(key, payload)
+		require.NoError(t, err)
+		return append([]byte{0x42, 0, 0, 0, 0, 0, 0, 0}, encrypted...)
+	}
+	decrypt := func(key, packet []byte) []byte {
+		payload, err := encoding.AESdecryptCBC(key, packet[8:])
+		require.NoError(t, err)
+		return payload
+	}
+
+	// Confirmed light level: acknowledged, then reported back
+	level, err := proto.Marshal(&lightpb.LedStripStatus{Channels: []uint32{50}})
+	require.NoError(t, err)
+	replies, err := node.Downlink(downlinkPacket(key, append([]byte{'L', 'H', 'C', 'D', 7, 0}, level...)))
+	require.NoError(t, err)
+	require.Len(t, replies, 2)
+	id, ok := downlink.ParseAck(decrypt(key, replies[0]))
+	assert.True(t, ok)
+	assert.Equal(t, uint16(7), id)
+	status := &lightpb.LedStripStatus{}
+	require.NoError(t, proto.Unmarshal(decrypt(key, replies[1]), status))
+	assert.Equal(t, []uint32{50}, status.Channels)
+
+	// Key change: confirmed with new key
+	nextKey := bytes.Repeat([]byte{0x33}, 16)
+	replies, err = node.Downlink(downlinkPacket(key, append([]byte("LHKC"), nextKey...)))
+	require.NoError(t, err)
+	require.Len(t, replies, 1)
+	assert.Equal(t, []byte("LHKA"), decrypt(nextKey, replies[0]))
+	assert.Equal(t, nextKey, node.Key)
+}
+
+func TestSimulatorFaults(t *testing.T) {
+	server, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer server.Close()
+
+	sim := New(server.LocalAddr().String(), "127.0.0.1:0", 10*time.Millisecond, Faults{Truncate: 1})
+	node := &Node{
+		Id:    0x42,
+		Key:   bytes.Repeat([]byte{0x22}, 16),
+		Model: NewLedStrip(),
+	}
+	full, err := node.Uplink()
+	require.NoError(t, err)
+	sim.AddNode(node)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- sim.Run(ctx)
+	}()
+
+	// Every packet is truncated, but still carries node id
+	buf := make([]byte, 1024)
+	server.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, _, err := server.ReadFrom(buf)
+	require.NoError(t, err)
+	assert.GreaterOrEqual(t, n, 8)
+	assert.Less(t, n, len(full))
+	assert.Equal(t, byte(0x42), buf[0])
+
+	cancel()
+	assert.NoError(t, <-done)
+	stats := sim.Stats()
+	assert.NotZero(t, stats.Uplinks)
+	assert.Equal(t, stats.Uplinks, stats.Faults)
+}
@@ -0,0 +1,173 @@
+// Package state keeps the latest readings of all devices, so server
+// features (rules, alerts, API) can act on decoded device data.
+package state
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// Well known quantities reported by devices
+const (
+	Temperature       = "temperature"
+	Humidity          = "humidity"
+	AmbientLight      = "ambient_light"
+	AmbientLightWhite = "ambient_light_white"
+	BatteryVoltage    = "battery_voltage"
+	BatteryLevel      = "battery_level"
+	Level             = "level"
+	DewPoint          = "dew_point"
+	HeatIndex         = "heat_index"
+	AbsoluteHumidity  = "absolute_humidity"
+	Illuminance       = "illuminance"
+)
+
+// Size of subscriber channel: slow subscriber loses readings, not blocks devices
+const subscriberBuffer = 64
+
+// Readings kept per device quantity for history queries (when there is no database)
+const historySize = 4096
+
+// Reading is single decoded value reported by device
+type Reading struct {
+	DeviceId uint64    `json:"device_id"`
+	Device   string    `json:"device"`
+	Class    string    `json:"class"`
+	Quantity string    `json:"quantity"`
+	Value    float64   `json:"value"`
+	Time     time.Time `json:"time"`
+}
+
+type key struct {
+	device   string
+	quantity string
+}
+
+// Store keeps the latest reading (and short history) of every device / quantity
+type Store struct {
+	latest      map[key]Reading
+	history     map[key][]Reading
+	subscribers []chan Reading
+	lock        sync.RWMutex
+}
+
+func NewStore() *Store {
+	return &Store{
+		latest:  map[key]Reading{},
+		history: map[key][]Reading{},
+	}
+}
+
+// Update stores reading and notifies subscribers
+func (s *Store) Update(reading Reading) {
+	if reading.Time.IsZero() {
+		reading.Time = time.Now()
+	}
+
+	s.lock.Lock()
+	k := key{reading.Device, reading.Quantity}
+	s.latest[k] = reading
+	history := append(s.history[k], reading)
+	if len(history) > historySize {
+		history = history[len(history)-historySize:]
+	}
+	s.history[k] = history
+	subscribers := s.subscribers
+	s.lock.Unlock()
+
+	for _, ch := range subscribers {
+		select {
+		case ch <- reading:
+		default:
+			glog.Infof("State subscriber is too slow, %s/%s reading dropped", reading.Device, reading.Quantity)
+		}
+	}
+}
+
+// Get returns the latest reading of device quantity
+func (s *Store) Get(device, quantity string) (Reading, bool) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	reading, ok := s.latest[key{device, quantity}]
+	return reading, ok
+}
+
+// Device returns the latest readings of all quantities of device, sorted by quantity
+func (s *Store) Device(device string) []Reading {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	res := []Reading{}
+	for k, reading := range s.latest {
+		if k.device == device {
+			res = append(res, reading)
+		}
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].Quantity < res[j].Quantity
+	})
+
+	return res
+}
+
+// All returns the latest readings of all devices, sorted by device and quantity
+func (s *Store) All() []Reading {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	res := make([]Reading, 0, len(s.latest))
+	for _, reading := range s.latest {
+		res = append(res, reading)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		if res[i].Device != res[j].Device {
+			return res[i].Device < res[j].Device
+		}
+		return res[i].Quantity < res[j].Quantity
+	})
+
+	return res
+}
+
+// History returns readings of device quantity in [from, to) time range,
+// only limited number of the latest readings is kept
+func (s *Store) History(device, quantity string, from, to time.Time) []Reading {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	res := []Reading{}
+	for _, reading := range s.history[key{device, quantity}] {
+		if !reading.Time.Before(from) && reading.Time.Before(to) {
+			res = append(res, reading)
+		}
+	}
+
+	return res
+}
+
+// Subscribe returns channel receiving all new readings
+func (s *Store) Subscribe() <-chan Reading {
+	ch := make(chan Reading, subscriberBuffer)
+	s.lock.Lock()
+	s.subscribers = append(s.subscribers, ch)
+	s.lock.Unlock()
+
+	return ch
+}
+
+// Unsubscribe stops delivery of readings into channel returned by Subscribe
+func (s *Store) Unsubscribe(ch <-chan Reading) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for i, subscriber := range s.subscribers {
+		if subscriber == ch {
+			s.subscribers = append(s.subscribers[:i:i], s.subscribers[i+1:]...)
+			return
+		}
+	}
+}
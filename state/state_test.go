@@ -0,0 +1,76 @@
+package state
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStore(t *testing.T) {
+	s := NewStore()
+	ch := s.Subscribe()
+
+	_, ok := s.Get("kitchen", Temperature)
+	assert.False(t, ok)
+
+	s.Update(Reading{Device: "kitchen", Quantity: Temperature, Value: 21.5})
+	reading, ok := s.Get("kitchen", Temperature)
+	assert.True(t, ok)
+	assert.Equal(t, 21.5, reading.Value)
+	assert.False(t, reading.Time.IsZero())
+	assert.Equal(t, reading, <-ch)
+
+	// Latest value wins
+	now := time.Now()
+	s.Update(Reading{Device: "kitchen", Quantity: Temperature, Value: 22, Time: now})
+	reading, _ = s.Get("kitchen", Temperature)
+	assert.Equal(t, 22.0, reading.Value)
+	assert.Equal(t, now, reading.Time)
+
+	// Slow subscriber does not block updates
+	for i := 0; i < subscriberBuffer*2; i++ {
+		s.Update(Reading{Device: "kitchen", Quantity: Humidity, Value: float64(i)})
+	}
+	assert.Len(t, ch, subscriberBuffer)
+}
+
+func TestStoreHistory(t *testing.T) {
+	s := NewStore()
+	start := time.Now().Add(-time.Hour)
+	for i := 0; i < historySize+10; i++ {
+		s.Update(Reading{Device: "kitchen", Quantity: Temperature, Value: float64(i), Time: start.Add(time.Duration(i) * time.Second)})
+	}
+
+	history := s.History("kitchen", Temperature, start, start.Add(2*time.Hour))
+	assert.Len(t, history, historySize)
+	assert.Equal(t, 10.0, history[0].Value)
+
+	history = s.History("kitchen", Temperature, start.Add(100*time.Second), start.Add(102*time.Second))
+	assert.Len(t, history, 2)
+	assert.Equal(t, 100.0, history[0].Value)
+	assert.Empty(t, s.History("kitchen", Humidity, start, start.Add(time.Hour)))
+}
+
+func TestStoreDeviceUnsubscribe(t *testing.T) {
+	s := NewStore()
+	ch := s.Subscribe()
+	s.Update(Reading{Device: "kitchen", Quantity: Temperature, Value: 21})
+	s.Update(Reading{Device: "kitchen", Quantity: Humidity, Value: 40})
+	s.Update(Reading{Device: "hallway", Quantity: Humidity, Value: 50})
+
+	readings := s.Device("kitchen")
+	assert.Len(t, readings, 2)
+	assert.Equal(t, Humidity, readings[0].Quantity)
+	assert.Equal(t, Temperature, readings[1].Quantity)
+	assert.Len(t, ch, 3)
+	all := s.All()
+	require.Len(t, all, 3)
+	assert.Equal(t, "hallway", all[0].Device)
+	assert.Equal(t, Humidity, all[1].Quantity)
+
+	s.Unsubscribe(ch)
+	s.Update(Reading{Device: "kitchen", Quantity: Temperature, Value: 22})
+	assert.Len(t, ch, 3)
+}
@@ -0,0 +1,69 @@
+package transport
+
+import (
+	"math"
+	"time"
+)
+
+// RadioConfig is LoRa modulation used by gateway to transmit downlinks
+type RadioConfig struct {
+	// Spreading factor 7..12
+	SpreadingFactor int
+	// Bandwidth, Hz
+	Bandwidth int
+	// Coding rate denominator: 5..8 for 4/5..4/8
+	CodingRate int
+	// Preamble length, symbols
+	Preamble int
+	// Transmit frequency, Hz: used to find duty cycle band
+	Frequency int
+	// Downlinks usually sent without payload CRC
+	Crc bool
+	// Overrides duty cycle of band, e.g. 0.01 for 1%
+	DutyCycle float64
+}
+
+// TimeOnAir calculates transmission time of LoRa packet of payloadLen bytes,
+// as described in Semtech AN1200.13 "LoRa Modem Designer's Guide"
+// (explicit header mode)
+func (r *RadioConfig) TimeOnAir(payloadLen int) time.Duration {
+	sf := float64(r.SpreadingFactor)
+	symbol := math.Pow(2, sf) / float64(r.Bandwidth)
+	preamble := (float64(r.Preamble) + 4.25) * symbol
+
+	// Low data rate optimization is mandatory for long symbols
+	de := 0.0
+	if symbol > 0.016 {
+		de = 1
+	}
+	crc := 0.0
+	if r.Crc {
+		crc = 1
+	}
+	payloadSymbols := 8 + math.Max(
+		math.Ceil((8*float64(payloadLen)-4*sf+28+16*crc)/(4*(sf-2*de)))*float64(r.CodingRate),
+		0,
+	)
+
+	seconds := preamble + payloadSymbols*symbol
+	return time.Duration(seconds * float64(time.Second))
+}
+
+// setDefaults fills missing parameters with EU868 downlink defaults
+func (r *RadioConfig) setDefaults() {
+	if r.SpreadingFactor == 0 {
+		r.SpreadingFactor = 7
+	}
+	if r.Bandwidth == 0 {
+		r.Bandwidth = 125000
+	}
+	if r.CodingRate == 0 {
+		r.CodingRate = 5
+	}
+	if r.Preamble == 0 {
+		r.Preamble = 8
+	}
+	if r.Frequency == 0 {
+		r.Frequency = 868100000
+	}
+}
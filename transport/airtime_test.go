@@ -0,0 +1,85 @@
+package transport
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTimeOnAir(t *testing.T) {
+	// Reference values from Semtech LoRa calculator (CR 4/5, preamble 8, CRC on)
+	runs := []struct {
+		sf         int
+		payloadLen int
+		expected   time.Duration
+	}{
+		{7, 20, 56576 * time.Microsecond},
+		{9, 20, 185344 * time.Microsecond},
+		{12, 20, 1318912 * time.Microsecond},
+	}
+	for _, run := range runs {
+		radio := &RadioConfig{SpreadingFactor: run.sf, Crc: true}
+		radio.setDefaults()
+		assert.Equal(t, run.expected, radio.TimeOnAir(run.payloadLen).Round(time.Microsecond), run.sf)
+	}
+}
+
+func TestDutyCycle(t *testing.T) {
+	radio := &RadioConfig{Frequency: 868100000}
+	b, err := findBand(radio)
+	require.NoError(t, err)
+	assert.Equal(t, "g", b.name)
+	assert.Equal(t, 0.01, b.dutyCycle)
+
+	// 1% of hour is 36 seconds
+	dc := newDutyCycle()
+	now := time.Now()
+	assert.NoError(t, dc.reserve("gw", b, 30*time.Second, now))
+	err = dc.reserve("gw", b, 10*time.Second, now)
+	assert.ErrorIs(t, err, ErrDutyCycle)
+	// Fits once the first transmission is out of window
+	assert.Equal(t, now.Add(time.Hour), err.(*DutyCycleError).RetryAt)
+	// Budget is per gateway
+	assert.NoError(t, dc.reserve("gw2", b, 10*time.Second, now))
+	budget := dc.budget("gw", b, now)
+	assert.Equal(t, 30*time.Second, budget.Used)
+	assert.Equal(t, 6*time.Second, budget.Remaining)
+
+	// Released reservation does not use budget
+	later := now.Add(time.Minute)
+	assert.NoError(t, dc.reserve("gw", b, 6*time.Second, later))
+	dc.release("gw", b, 6*time.Second, later)
+	assert.Equal(t, 30*time.Second, dc.budget("gw", b, later).Used)
+
+	// Sliding window: budget restored in an hour
+	assert.NoError(t, dc.reserve("gw", b, 10*time.Second, now.Add(time.Hour)))
+
+	// Negative: unknown band
+	_, err = findBand(&RadioConfig{Frequency: 915000000})
+	assert.Error(t, err)
+}
+
+func TestSendDutyCycle(t *testing.T) {
+	transport, err := NewLoRaUdp(map[string]interface{}{
+		"listen":  "127.0.0.1:0",
+		"gateway": "127.0.0.1:1700",
+		"radio":   map[string]interface{}{"frequency": 868100000},
+	})
+	require.NoError(t, err)
+	udp := transport.(*LoRaUdp)
+	udp.socket, err = net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	// Sent packet uses airtime
+	require.NoError(t, udp.Send(make([]byte, 20)))
+	used := udp.Airtime(time.Now())[0].Used
+	assert.NotZero(t, used)
+
+	// Packet which is not sent does not
+	udp.socket.Close()
+	assert.Error(t, udp.Send(make([]byte, 20)))
+	assert.Equal(t, used, udp.Airtime(time.Now())[0].Used)
+}
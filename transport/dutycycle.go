@@ -0,0 +1,169 @@
+package transport
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// ErrDutyCycle returned by Send when transmission exceeds duty cycle budget
+var ErrDutyCycle = errors.New("duty cycle budget exceeded")
+
+// DutyCycleError is ErrDutyCycle (see errors.Is) which tells when
+// transmission fits into budget again
+type DutyCycleError struct {
+	RetryAt time.Time
+}
+
+func (e *DutyCycleError) Error() string {
+	return ErrDutyCycle.Error()
+}
+
+func (e *DutyCycleError) Is(target error) bool {
+	return target == ErrDutyCycle
+}
+
+// Duty cycle is enforced over sliding window of this length
+const dutyCycleWindow = time.Hour
+
+// band is ETSI EN 300 220 sub-band with its duty cycle limit
+type band struct {
+	name      string
+	minFreq   int
+	maxFreq   int
+	dutyCycle float64
+}
+
+// EU868 sub-bands, as used by LoRaWAN Regional Parameters
+var eu868Bands = []band{
+	{"h1.3", 863000000, 865000000, 0.001},
+	{"h1.4", 865000000, 868000000, 0.01},
+	{"g", 868000000, 868600000, 0.01},
+	{"g1", 868700000, 869200000, 0.001},
+	{"g2", 869400000, 869650000, 0.1},
+	{"g3", 869700000, 870000000, 0.01},
+}
+
+// AirtimeBudget is duty cycle usage of one band of one gateway
+type AirtimeBudget struct {
+	Gateway   string
+	Band      string
+	Used      time.Duration
+	Remaining time.Duration
+}
+
+// AirtimeReporter is implemented by transports which do airtime accounting
+type AirtimeReporter interface {
+	Airtime(now time.Time) []AirtimeBudget
+}
+
+type transmission struct {
+	time    time.Time
+	airtime time.Duration
+}
+
+// dutyCycle tracks transmissions per gateway / band
+type dutyCycle struct {
+	transmissions map[string][]transmission
+	lock          sync.Mutex
+}
+
+func newDutyCycle() *dutyCycle {
+	return &dutyCycle{
+		transmissions: map[string][]transmission{},
+	}
+}
+
+func findBand(radio *RadioConfig) (band, error) {
+	for _, b := range eu868Bands {
+		if radio.Frequency >= b.minFreq && radio.Frequency < b.maxFreq {
+			if radio.DutyCycle != 0 {
+				b.dutyCycle = radio.DutyCycle
+			}
+			return b, nil
+		}
+	}
+	if radio.DutyCycle != 0 {
+		return band{name: "custom", dutyCycle: radio.DutyCycle}, nil
+	}
+
+	return band{}, fmt.Errorf("no duty cycle band for frequency %d", radio.Frequency)
+}
+
+// reserve accounts transmission of given airtime, if it fits into budget
+func (d *dutyCycle) reserve(gateway string, b band, airtime time.Duration, now time.Time) error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	key := gateway + "/" + b.name
+	used := d.expire(key, now)
+	if used+airtime > d.allowed(b) {
+		return &DutyCycleError{RetryAt: d.retryAt(key, used+airtime-d.allowed(b), now)}
+	}
+	d.transmissions[key] = append(d.transmissions[key], transmission{now, airtime})
+
+	return nil
+}
+
+// release cancels reservation of transmission which did not happen
+func (d *dutyCycle) release(gateway string, b band, airtime time.Duration, at time.Time) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	key := gateway + "/" + b.name
+	list := d.transmissions[key]
+	for i := len(list) - 1; i >= 0; i-- {
+		if list[i].time.Equal(at) && list[i].airtime == airtime {
+			d.transmissions[key] = append(list[:i:i], list[i+1:]...)
+			return
+		}
+	}
+}
+
+// budget returns used / remaining airtime in current window
+func (d *dutyCycle) budget(gateway string, b band, now time.Time) AirtimeBudget {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	used := d.expire(gateway+"/"+b.name, now)
+	return AirtimeBudget{
+		Gateway:   gateway,
+		Band:      b.name,
+		Used:      used,
+		Remaining: d.allowed(b) - used,
+	}
+}
+
+// expire drops transmissions out of window, returns airtime used in window
+func (d *dutyCycle) expire(key string, now time.Time) time.Duration {
+	list := d.transmissions[key]
+	for len(list) > 0 && now.Sub(list[0].time) >= dutyCycleWindow {
+		list = list[1:]
+	}
+	d.transmissions[key] = list
+
+	var used time.Duration
+	for _, t := range list {
+		used += t.airtime
+	}
+
+	return used
+}
+
+// retryAt returns time once enough of airtime used in window expires
+func (d *dutyCycle) retryAt(key string, excess time.Duration, now time.Time) time.Time {
+	for _, t := range d.transmissions[key] {
+		excess -= t.airtime
+		if excess <= 0 {
+			return t.time.Add(dutyCycleWindow)
+		}
+	}
+
+	// Transmission never fits into budget
+	return now.Add(dutyCycleWindow)
+}
+
+func (d *dutyCycle) allowed(b band) time.Duration {
+	return time.Duration(float64(dutyCycleWindow) * b.dutyCycle)
+}
@@ -9,3 +9,9 @@ type LoRaTransport interface {
 	Receive() <-chan []byte
 	Send([]byte) error
 }
+
+// UplinkObserver is implemented by transports which know metadata of received
+// packets (e.g. source address), observers must be registered before Run
+type UplinkObserver interface {
+	ObserveUplinks(func(packet []byte, metadata map[string]string))
+}
@@ -24,7 +24,7 @@ func (m *MockLoRaTransport) Receive() <-chan []byte {
 	return m.Ch
 }
 
-func (m *MockLoRaTransport) SendPacket(packet []byte) error {
+func (m *MockLoRaTransport) Send(packet []byte) error {
 	m.History = append(m.History, packet)
 	return m.Error
 }
@@ -5,6 +5,7 @@ import (
 	"errors"
 	"net"
 	"strings"
+	"time"
 
 	"github.com/golang/glog"
 	"github.com/mitchellh/mapstructure"
@@ -13,17 +14,26 @@ import (
 type LoRaUdp struct {
 	Listen        string
 	MaxPacketSize int
-	Gateway       string
+	// Single gateway: downlinks are sent to it and its duty cycle is
+	// accounted, uplinks are accepted from any address
+	Gateway string
+	// Optional: enables airtime accounting / duty cycle enforcement
+	Radio *RadioConfig
 
 	ch                     chan []byte
+	ready                  chan struct{}
 	enabled                bool
 	resolvedGatewayAddress *net.UDPAddr
 	socket                 net.PacketConn
+	band                   band
+	dutyCycle              *dutyCycle
+	observers              []func([]byte, map[string]string)
 }
 
 func NewLoRaUdp(cfg interface{}) (LoRaTransport, error) {
 	udp := &LoRaUdp{
-		ch: make(chan []byte, 1),
+		ch:    make(chan []byte, 1),
+		ready: make(chan struct{}),
 	}
 
 	// If no configuration present - bypass mode
@@ -51,6 +61,17 @@ func NewLoRaUdp(cfg interface{}) (LoRaTransport, error) {
 		glog.Info("UDP gateway address unset, packets will not be delivered to devices back")
 	}
 
+	// Duty cycle band of gateway transmitter
+	if udp.Radio != nil {
+		udp.Radio.setDefaults()
+		udp.band, err = findBand(udp.Radio)
+		if err != nil {
+			return nil, err
+		}
+		udp.dutyCycle = newDutyCycle()
+		glog.Infof("UDP gateway duty cycle %.1f%% (band %s)", udp.band.dutyCycle*100, udp.band.name)
+	}
+
 	return udp, err
 }
 
@@ -58,6 +79,7 @@ func (r *LoRaUdp) Run(ctx context.Context) error {
 	// Simple blocking call for bypass mode
 	if !r.enabled {
 		glog.Info("UDP is not enabled")
+		close(r.ready)
 		<-ctx.Done()
 		return nil
 	}
@@ -69,6 +91,7 @@ func (r *LoRaUdp) Run(ctx context.Context) error {
 		return err
 	}
 	glog.Infof("UDP server started at %s", r.Listen)
+	close(r.ready)
 	// Start receiver
 	go r.serve(ctx)
 
@@ -79,10 +102,15 @@ func (r *LoRaUdp) Run(ctx context.Context) error {
 	return nil
 }
 
+// Ready is closed once UDP socket is listening
+func (r *LoRaUdp) Ready() <-chan struct{} {
+	return r.ready
+}
+
 func (r *LoRaUdp) serve(ctx context.Context) {
 	buf := make([]byte, r.MaxPacketSize)
 	for {
-		n, _, err := r.socket.ReadFrom(buf)
+		n, addr, err := r.socket.ReadFrom(buf)
 		if err != nil {
 			// Terminate goroutine when listener closed
 			if strings.Contains(err.Error(), "use of closed network connection") {
@@ -91,10 +119,28 @@ func (r *LoRaUdp) serve(ctx context.Context) {
 			glog.Infof("readFrom failed: %v", err)
 			continue
 		}
-		r.ch <- buf[:n]
+		// Buffer is reused for next packet, so pass copy
+		packet := make([]byte, n)
+		copy(packet, buf[:n])
+		if len(r.observers) > 0 {
+			metadata := map[string]string{"source": addr.String()}
+			if r.Gateway != "" {
+				metadata["gateway"] = r.Gateway
+			}
+			for _, observer := range r.observers {
+				observer(packet, metadata)
+			}
+		}
+		r.ch <- packet
 	}
 }
 
+// ObserveUplinks registers function called with every received packet
+// and its source address
+func (r *LoRaUdp) ObserveUplinks(f func([]byte, map[string]string)) {
+	r.observers = append(r.observers, f)
+}
+
 func (r *LoRaUdp) Receive() <-chan []byte {
 	return r.ch
 }
@@ -105,10 +151,34 @@ func (r *LoRaUdp) Send(packet []byte) error {
 		return nil
 	}
 
+	// Ensure that transmission fits into duty cycle budget
+	var airtime time.Duration
+	now := time.Now()
+	if r.dutyCycle != nil {
+		airtime = r.Radio.TimeOnAir(len(packet))
+		err := r.dutyCycle.reserve(r.Gateway, r.band, airtime, now)
+		if err != nil {
+			return err
+		}
+	}
+
 	_, err := r.socket.WriteTo(packet, r.resolvedGatewayAddress)
-	if err == nil {
-		glog.Infof("UDP LoRa gateway: %v <-- %d bytes", r.resolvedGatewayAddress, len(packet))
+	if err != nil {
+		// Nothing transmitted, so no airtime used
+		if r.dutyCycle != nil {
+			r.dutyCycle.release(r.Gateway, r.band, airtime, now)
+		}
+		return err
+	}
+	glog.Infof("UDP LoRa gateway: %v <-- %d bytes", r.resolvedGatewayAddress, len(packet))
+
+	return nil
+}
+
+func (r *LoRaUdp) Airtime(now time.Time) []AirtimeBudget {
+	if r.dutyCycle == nil {
+		return nil
 	}
 
-	return err
+	return []AirtimeBudget{r.dutyCycle.budget(r.Gateway, r.band, now)}
 }
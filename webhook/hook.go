@@ -0,0 +1,217 @@
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/lorahome/server/secrets"
+)
+
+// Request headers
+const (
+	EventHeader     = "X-Lorahome-Event"
+	SignatureHeader = "X-Lorahome-Signature"
+)
+
+const jsonContentType = "application/json"
+
+// Hook is one HTTP endpoint events are delivered to
+type Hook struct {
+	Name    string
+	Url     string
+	Method  string
+	Headers map[string]string
+	// Optional: key of HMAC-SHA256 body signature, may be secret reference
+	Secret string
+	// Filters by device name, device class and event type, empty matches all
+	Devices []string
+	Classes []string
+	Events  []string
+	// Optional: Go template of request body, executed with Event,
+	// "json" function encodes value. Event as JSON by default.
+	Template    string
+	ContentType string
+	// Delivery attempts after the first one (default 3), backoff doubles
+	// each retry, up to MaxBackoff (default 1m)
+	Retries    *int
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+	Timeout    time.Duration
+
+	secret   []byte
+	template *template.Template
+	client   *http.Client
+	queue    chan Event
+}
+
+// statusError is unsuccessful HTTP response
+type statusError struct {
+	code int
+	body string
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("HTTP %d: %s", e.code, e.body)
+}
+
+// isPermanent returns true if retry makes no sense: request rejected by endpoint
+func isPermanent(err error) bool {
+	var status *statusError
+	if !errors.As(err, &status) {
+		return false
+	}
+
+	return status.code >= 400 && status.code < 500 &&
+		status.code != http.StatusRequestTimeout && status.code != http.StatusTooManyRequests
+}
+
+var templateFuncs = template.FuncMap{
+	"json": func(value interface{}) (string, error) {
+		data, err := json.Marshal(value)
+		return string(data), err
+	},
+}
+
+func (h *Hook) init() error {
+	if h.Name == "" {
+		return errors.New("webhook name is required")
+	}
+	if h.Url == "" {
+		return fmt.Errorf("webhook %s: url is required", h.Name)
+	}
+	if h.Method == "" {
+		h.Method = http.MethodPost
+	}
+	if h.ContentType == "" {
+		h.ContentType = jsonContentType
+	}
+	if h.Retries == nil {
+		retries := 3
+		h.Retries = &retries
+	}
+	if h.Backoff == 0 {
+		h.Backoff = time.Second
+	}
+	if h.MaxBackoff == 0 {
+		h.MaxBackoff = time.Minute
+	}
+	if h.MaxBackoff < h.Backoff {
+		h.MaxBackoff = h.Backoff
+	}
+	if h.Timeout == 0 {
+		h.Timeout = 10 * time.Second
+	}
+	if h.Secret != "" {
+		secret, err := secrets.Resolve(h.Secret)
+		if err != nil {
+			return fmt.Errorf("webhook %s: %v", h.Name, err)
+		}
+		h.secret = []byte(secret)
+	}
+	if h.Template != "" {
+		var err error
+		h.template, err = template.New(h.Name).Funcs(templateFuncs).Option("missingkey=error").Parse(h.Template)
+		if err != nil {
+			return fmt.Errorf("webhook %s: %v", h.Name, err)
+		}
+	}
+	h.client = &http.Client{Timeout: h.Timeout}
+	h.queue = make(chan Event, queueSize)
+
+	return nil
+}
+
+// nextBackoff returns delay before the next retry
+func (h *Hook) nextBackoff(backoff time.Duration) time.Duration {
+	backoff *= 2
+	if backoff > h.MaxBackoff {
+		return h.MaxBackoff
+	}
+
+	return backoff
+}
+
+func (h *Hook) match(event *Event) bool {
+	return matchAny(h.Devices, event.Device) &&
+		matchAny(h.Classes, event.Class) &&
+		matchAny(h.Events, event.Type)
+}
+
+func matchAny(values []string, value string) bool {
+	if len(values) == 0 {
+		return true
+	}
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+
+	return false
+}
+
+// render makes request body of event
+func (h *Hook) render(event *Event) ([]byte, error) {
+	if h.template == nil {
+		return json.Marshal(event)
+	}
+
+	buf := &bytes.Buffer{}
+	err := h.template.Execute(buf, event)
+	if err != nil {
+		return nil, err
+	}
+	body := buf.Bytes()
+	if strings.HasPrefix(h.ContentType, jsonContentType) && !json.Valid(body) {
+		return body, errors.New("template produced invalid JSON")
+	}
+
+	return body, nil
+}
+
+// sign returns hex encoded HMAC-SHA256 of body
+func (h *Hook) sign(body []byte) string {
+	mac := hmac.New(sha256.New, h.secret)
+	mac.Write(body)
+
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func (h *Hook) post(ctx context.Context, event *Event, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, h.Method, h.Url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", h.ContentType)
+	req.Header.Set(EventHeader, event.Type)
+	if h.secret != nil {
+		req.Header.Set(SignatureHeader, h.sign(body))
+	}
+	for name, value := range h.Headers {
+		req.Header.Set(name, value)
+	}
+
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		text, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 256))
+		return &statusError{code: resp.StatusCode, body: strings.TrimSpace(string(text))}
+	}
+
+	return nil
+}
@@ -0,0 +1,235 @@
+// Package webhook posts device events (readings, presence, commands, errors)
+// to HTTP endpoints: output for integrations next to MQTT and InfluxDB.
+// Events are delivered in order per webhook, with retries; undeliverable
+// ones are appended to dead-letter log.
+package webhook
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+
+	"github.com/lorahome/server/config"
+)
+
+// Events waiting for delivery per webhook
+const queueSize = 256
+
+// Event is delivered to webhooks, Data depends on type
+// (see events package, server forwards all its events)
+type Event struct {
+	Type     string      `json:"type"`
+	Time     time.Time   `json:"time"`
+	DeviceId uint64      `json:"device_id,omitempty"`
+	Device   string      `json:"device,omitempty"`
+	Class    string      `json:"class,omitempty"`
+	Data     interface{} `json:"data,omitempty"`
+}
+
+// DeadLetter is event webhook failed to deliver
+type DeadLetter struct {
+	Time  time.Time `json:"time"`
+	Hook  string    `json:"hook"`
+	Event Event     `json:"event"`
+	Body  string    `json:"body,omitempty"`
+	Error string    `json:"error"`
+}
+
+// Dispatcher delivers events to all matching webhooks
+type Dispatcher struct {
+	Hooks []*Hook
+	// Optional: file undeliverable events are appended to, as JSON lines
+	DeadLetterFile string
+
+	deadLetters chan *DeadLetter
+}
+
+func NewDispatcher(cfg interface{}) (*Dispatcher, error) {
+	d := &Dispatcher{
+		deadLetters: make(chan *DeadLetter, queueSize),
+	}
+	if cfg == nil {
+		// Bypass mode - no webhooks
+		return d, nil
+	}
+
+	// Map configuration into structure
+	err := config.Decode(cfg, d)
+	if err != nil {
+		return nil, err
+	}
+	names := map[string]bool{}
+	for _, hook := range d.Hooks {
+		if names[hook.Name] {
+			return nil, errors.New("duplicate webhook " + hook.Name)
+		}
+		names[hook.Name] = true
+		err = hook.init()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return d, nil
+}
+
+// Enabled returns true if any webhook configured
+func (d *Dispatcher) Enabled() bool {
+	return d != nil && len(d.Hooks) > 0
+}
+
+// Publish queues event for delivery to matching webhooks, never blocks
+func (d *Dispatcher) Publish(event Event) {
+	if !d.Enabled() {
+		return
+	}
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+
+	for _, hook := range d.Hooks {
+		if !hook.match(&event) {
+			continue
+		}
+		select {
+		case hook.queue <- event:
+		default:
+			// Dead letter is written by Run, not to block publisher
+			glog.Errorf("Webhook %s: queue is full, %s event of %s not delivered", hook.Name, event.Type, event.Device)
+			select {
+			case d.deadLetters <- newDeadLetter(hook, event, nil, errors.New("queue is full")):
+			default:
+			}
+		}
+	}
+}
+
+// Run delivers queued events until context canceled
+func (d *Dispatcher) Run(ctx context.Context) error {
+	stop := make(chan struct{})
+	written := make(chan struct{})
+	go func() {
+		defer close(written)
+		d.writeDeadLetters(stop)
+	}()
+
+	wg := sync.WaitGroup{}
+	for _, hook := range d.Hooks {
+		wg.Add(1)
+		go func(hook *Hook) {
+			defer wg.Done()
+			d.worker(ctx, hook)
+		}(hook)
+	}
+	// Dead letters of stopped workers are written as well
+	wg.Wait()
+	close(stop)
+	<-written
+
+	return nil
+}
+
+func (d *Dispatcher) worker(ctx context.Context, hook *Hook) {
+	for {
+		select {
+		case event := <-hook.queue:
+			d.deliver(ctx, hook, event)
+		case <-ctx.Done():
+			// Keep track of everything not delivered
+			for {
+				select {
+				case event := <-hook.queue:
+					d.deadLetter(hook, event, nil, errors.New("server stopped"))
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+// deliver posts event, retrying with exponential backoff
+func (d *Dispatcher) deliver(ctx context.Context, hook *Hook, event Event) {
+	body, err := hook.render(&event)
+	if err != nil {
+		d.deadLetter(hook, event, body, err)
+		return
+	}
+
+	backoff := hook.Backoff
+	for attempt := 0; ; attempt++ {
+		err = hook.post(ctx, &event, body)
+		if err == nil {
+			return
+		}
+		if attempt >= *hook.Retries || isPermanent(err) {
+			break
+		}
+		glog.Infof("Webhook %s: delivery failed, retry in %v: %v", hook.Name, backoff, err)
+		select {
+		case <-time.After(backoff):
+			backoff = hook.nextBackoff(backoff)
+		case <-ctx.Done():
+			d.deadLetter(hook, event, body, err)
+			return
+		}
+	}
+	d.deadLetter(hook, event, body, err)
+}
+
+// deadLetter queues undeliverable event for writing into dead letter file
+func (d *Dispatcher) deadLetter(hook *Hook, event Event, body []byte, err error) {
+	glog.Errorf("Webhook %s: %s event of %s not delivered: %v", hook.Name, event.Type, event.Device, err)
+	d.deadLetters <- newDeadLetter(hook, event, body, err)
+}
+
+func newDeadLetter(hook *Hook, event Event, body []byte, err error) *DeadLetter {
+	return &DeadLetter{
+		Time:  time.Now(),
+		Hook:  hook.Name,
+		Event: event,
+		Body:  string(body),
+		Error: err.Error(),
+	}
+}
+
+// writeDeadLetters appends queued dead letters to file until stopped
+func (d *Dispatcher) writeDeadLetters(stop <-chan struct{}) {
+	for {
+		select {
+		case letter := <-d.deadLetters:
+			d.writeDeadLetter(letter)
+		case <-stop:
+			for {
+				select {
+				case letter := <-d.deadLetters:
+					d.writeDeadLetter(letter)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+func (d *Dispatcher) writeDeadLetter(letter *DeadLetter) {
+	if d.DeadLetterFile == "" {
+		return
+	}
+	data, _ := json.Marshal(letter)
+	f, err := os.OpenFile(d.DeadLetterFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		glog.Errorf("Unable to open webhooks dead letter file: %v", err)
+		return
+	}
+	defer f.Close()
+	_, err = f.Write(append(data, '\n'))
+	if err != nil {
+		glog.Errorf("Unable to write webhooks dead letter file: %v", err)
+	}
+}
@@ -0,0 +1,253 @@
+package webhook
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type request struct {
+	header http.Header
+	body   string
+}
+
+// endpoint records requests, responds with statuses in order (the last one repeated)
+type endpoint struct {
+	*httptest.Server
+	statuses []int
+	requests []request
+	lock     sync.Mutex
+}
+
+func newEndpoint(t *testing.T, statuses ...int) *endpoint {
+	e := &endpoint{statuses: statuses}
+	e.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		e.lock.Lock()
+		defer e.lock.Unlock()
+		e.requests = append(e.requests, request{header: r.Header, body: string(body)})
+		status := e.statuses[0]
+		if len(e.statuses) > 1 {
+			e.statuses = e.statuses[1:]
+		}
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(e.Close)
+
+	return e
+}
+
+func (e *endpoint) received() []request {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	return append([]request{}, e.requests...)
+}
+
+func readDeadLetters(t *testing.T, fn string) []DeadLetter {
+	data, err := ioutil.ReadFile(fn)
+	if err != nil {
+		return nil
+	}
+	res := []DeadLetter{}
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		letter := DeadLetter{}
+		require.NoError(t, json.Unmarshal([]byte(line), &letter))
+		res = append(res, letter)
+	}
+
+	return res
+}
+
+func TestConfig(t *testing.T) {
+	d, err := NewDispatcher(nil)
+	require.NoError(t, err)
+	assert.False(t, d.Enabled())
+	d.Publish(Event{Type: "reading"})
+
+	for _, hooks := range [][]interface{}{
+		{map[string]interface{}{"url": "http://localhost"}},
+		{map[string]interface{}{"name": "a"}},
+		{map[string]interface{}{"name": "a", "url": "http://localhost", "template": "{{"}},
+		{map[string]interface{}{"name": "a", "url": "http://localhost", "secret": "env:LORAHOME_NO_SUCH_VAR"}},
+		{map[string]interface{}{"name": "a", "url": "http://localhost"}, map[string]interface{}{"name": "a", "url": "http://localhost"}},
+	} {
+		_, err := NewDispatcher(map[string]interface{}{"hooks": hooks})
+		assert.Error(t, err, hooks)
+	}
+
+	d, err = NewDispatcher(map[string]interface{}{"hooks": []interface{}{map[string]interface{}{"name": "a", "url": "http://localhost", "backoff": "5s"}}})
+	require.NoError(t, err)
+	assert.True(t, d.Enabled())
+	hook := d.Hooks[0]
+	assert.Equal(t, http.MethodPost, hook.Method)
+	assert.Equal(t, 3, *hook.Retries)
+	assert.Equal(t, 5*time.Second, hook.Backoff)
+	assert.Equal(t, time.Minute, hook.MaxBackoff)
+
+	// Backoff doubles up to limit
+	hook = &Hook{Backoff: time.Second, MaxBackoff: 5 * time.Second}
+	backoff := hook.Backoff
+	for _, expected := range []time.Duration{2 * time.Second, 4 * time.Second, 5 * time.Second, 5 * time.Second} {
+		backoff = hook.nextBackoff(backoff)
+		assert.Equal(t, expected, backoff)
+	}
+}
+
+func TestDelivery(t *testing.T) {
+	all := newEndpoint(t, http.StatusOK)
+	templated := newEndpoint(t, http.StatusNoContent)
+	deadLetters := filepath.Join(t.TempDir(), "dead.log")
+	d, err := NewDispatcher(map[string]interface{}{
+		"deadLetterFile": deadLetters,
+		"hooks": []interface{}{
+			map[string]interface{}{
+				"name":    "all",
+				"url":     all.URL,
+				"secret":  "s3cret",
+				"headers": map[string]interface{}{"Authorization": "Bearer token"},
+			},
+			map[string]interface{}{
+				"name":     "templated",
+				"url":      templated.URL,
+				"devices":  []interface{}{"kitchen"},
+				"classes":  []interface{}{"MultiSensor"},
+				"events":   []interface{}{"reading"},
+				"template": `{"sensor": {{json .Device}}, "{{.Data.Quantity}}": {{.Data.Value}}}`,
+			},
+		},
+	})
+	require.NoError(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		d.Run(ctx)
+		close(done)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	reading := struct {
+		Quantity string
+		Value    float64
+	}{"temperature", 21.5}
+	d.Publish(Event{Type: "reading", Device: "kitchen", Class: "MultiSensor", Data: reading})
+	d.Publish(Event{Type: "reading", Device: "hallway", Class: "MultiSensor", Data: reading})
+	d.Publish(Event{Type: "offline", Device: "kitchen", Class: "MultiSensor"})
+	require.Eventually(t, func() bool {
+		return len(all.received()) == 3 && len(templated.received()) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// Event as JSON, signed
+	req := all.received()[0]
+	event := Event{}
+	require.NoError(t, json.Unmarshal([]byte(req.body), &event))
+	assert.Equal(t, "reading", event.Type)
+	assert.Equal(t, "kitchen", event.Device)
+	assert.False(t, event.Time.IsZero())
+	assert.Equal(t, "application/json", req.header.Get("Content-Type"))
+	assert.Equal(t, "reading", req.header.Get(EventHeader))
+	assert.Equal(t, "Bearer token", req.header.Get("Authorization"))
+	mac := hmac.New(sha256.New, []byte("s3cret"))
+	mac.Write([]byte(req.body))
+	assert.Equal(t, "sha256="+hex.EncodeToString(mac.Sum(nil)), req.header.Get(SignatureHeader))
+	assert.Equal(t, "offline", all.received()[2].header.Get(EventHeader))
+
+	// Filtered and templated
+	req = templated.received()[0]
+	assert.JSONEq(t, `{"sensor": "kitchen", "temperature": 21.5}`, req.body)
+	assert.Empty(t, req.header.Get(SignatureHeader))
+	assert.Empty(t, readDeadLetters(t, deadLetters))
+}
+
+func TestRetries(t *testing.T) {
+	flaky := newEndpoint(t, http.StatusInternalServerError, http.StatusTooManyRequests, http.StatusOK)
+	down := newEndpoint(t, http.StatusServiceUnavailable)
+	rejecting := newEndpoint(t, http.StatusBadRequest)
+	deadLetters := filepath.Join(t.TempDir(), "dead.log")
+	d, err := NewDispatcher(map[string]interface{}{
+		"deadLetterFile": deadLetters,
+		"hooks": []interface{}{
+			map[string]interface{}{"name": "flaky", "url": flaky.URL, "backoff": "1ms"},
+			map[string]interface{}{"name": "down", "url": down.URL, "backoff": "1ms", "retries": 2},
+			map[string]interface{}{"name": "rejecting", "url": rejecting.URL, "backoff": "1ms"},
+			map[string]interface{}{"name": "broken", "url": rejecting.URL, "events": []interface{}{"error"}, "template": "{{.Device}}"},
+		},
+	})
+	require.NoError(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		d.Run(ctx)
+		close(done)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	d.Publish(Event{Type: "reading", Device: "kitchen"})
+	d.Publish(Event{Type: "error", Device: "kitchen", Data: "bad packet"})
+	require.Eventually(t, func() bool {
+		return len(readDeadLetters(t, deadLetters)) == 5
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// Retried until delivered
+	assert.Len(t, flaky.received(), 4)
+	// Retries exhausted
+	assert.Len(t, down.received(), 6)
+	// Permanent failure: no retries
+	assert.Len(t, rejecting.received(), 2)
+
+	letters := map[string][]DeadLetter{}
+	for _, letter := range readDeadLetters(t, deadLetters) {
+		letters[letter.Hook] = append(letters[letter.Hook], letter)
+	}
+	require.Len(t, letters["down"], 2)
+	assert.Equal(t, "kitchen", letters["down"][0].Event.Device)
+	assert.Contains(t, letters["down"][0].Error, "HTTP 503")
+	assert.NotEmpty(t, letters["down"][0].Body)
+	require.Len(t, letters["rejecting"], 2)
+	assert.Contains(t, letters["rejecting"][0].Error, "HTTP 400")
+	require.Len(t, letters["broken"], 1)
+	assert.Equal(t, "template produced invalid JSON", letters["broken"][0].Error)
+}
+
+func TestQueueFull(t *testing.T) {
+	deadLetters := filepath.Join(t.TempDir(), "dead.log")
+	d, err := NewDispatcher(map[string]interface{}{
+		"deadLetterFile": deadLetters,
+		"hooks":          []interface{}{map[string]interface{}{"name": "slow", "url": "http://localhost"}},
+	})
+	require.NoError(t, err)
+
+	// Not running yet, so queue fills up. Publish never writes file itself
+	for i := 0; i <= queueSize; i++ {
+		d.Publish(Event{Type: "reading", Device: "kitchen"})
+	}
+	assert.NoFileExists(t, deadLetters)
+
+	// Stopped dispatcher keeps track of everything not delivered
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	require.NoError(t, d.Run(ctx))
+	letters := readDeadLetters(t, deadLetters)
+	require.Len(t, letters, queueSize+1)
+	assert.Equal(t, "queue is full", letters[0].Error)
+	assert.Equal(t, "server stopped", letters[queueSize].Error)
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"context"
+
+	"github.com/lorahome/server/events"
+	"github.com/lorahome/server/webhook"
+)
+
+// forwardEvents delivers all server events to webhooks until context canceled
+func forwardEvents(ctx context.Context, bus *events.Bus, dispatcher *webhook.Dispatcher) error {
+	sub := bus.Subscribe(events.Filter{})
+	defer bus.Unsubscribe(sub)
+
+	for {
+		select {
+		case e := <-sub.C:
+			dispatcher.Publish(webhook.Event{
+				Type:     e.Type,
+				Time:     e.Time,
+				DeviceId: e.DeviceId,
+				Device:   e.Device,
+				Class:    e.Class,
+				Data:     e.Data,
+			})
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}